@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/segment"
+)
+
+const importUsage = "usage: usersegmentator import [-format csv|ndjson] [-dry-run] [-wait=false] file|-"
+
+// runImport handles `usersegmentator import ...`. It validates the file, queues an import job
+// and waits for the workers of the service to run it, printing the progress and the result.
+func runImport(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or ndjson, taken from the file extension when omitted")
+	dryRun := flags.Bool("dry-run", false, "report what would change without applying it")
+	wait := flags.Bool("wait", true, "wait for the job to finish")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(importUsage)
+	}
+	if cfg.Storage.Driver == config.StorageMemory {
+		return fmt.Errorf("%s storage is not shared with the service, import needs a database", config.StorageMemory)
+	}
+
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = importFormatOf(path)
+	}
+
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func(f *os.File) {
+			_ = f.Close()
+		}(f)
+		in = f
+	}
+
+	out := log.New(os.Stdout, "", 0)
+
+	rows, err := segment.ParseImport(in, *format, segment.ImportMaxRows(cfg.Segment.ImportMaxRows))
+	var invalid *segment.ImportValidationError
+	if errors.As(err, &invalid) {
+		for _, lineErr := range invalid.Errors {
+			out.Printf("line %d: %s\n", lineErr.Line, lineErr.Error)
+		}
+		if more := invalid.Total - len(invalid.Errors); more > 0 {
+			out.Printf("... and %d more\n", more)
+		}
+		return fmt.Errorf("%d invalid lines, nothing imported", invalid.Total)
+	}
+	if err != nil {
+		return err
+	}
+
+	db, err := connectDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+
+	jobsRepo := job.NewJobsRepo(db, cfg)
+	ctx := context.Background()
+
+	j, err := jobsRepo.Create(ctx, job.KindImport, &segment.ImportRequest{DryRun: *dryRun, Rows: rows})
+	if err != nil {
+		return err
+	}
+	out.Printf("Queued import job %s with %d rows\n", j.ID, len(rows))
+	if !*wait {
+		return nil
+	}
+
+	return waitForJob(ctx, jobsRepo, j.ID, out)
+}
+
+// importFormatOf guesses the format of an import file from its extension, CSV being the default.
+func importFormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl":
+		return segment.ImportNDJSON
+	default:
+		return segment.ImportCSV
+	}
+}
+
+// waitForJob polls the job until it finishes and prints its progress along the way.
+func waitForJob(ctx context.Context, jobsRepo job.Repository, id string, out *log.Logger) error {
+	lastDone := -1
+	for {
+		j, err := jobsRepo.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if j.Done != lastDone && j.Total > 0 {
+			out.Printf("%s: %d/%d rows\n", j.Status, j.Done, j.Total)
+			lastDone = j.Done
+		}
+
+		if j.Finished() {
+			if j.Status != job.StatusSucceeded {
+				return fmt.Errorf("job %s %s: %s", j.ID, j.Status, j.Error)
+			}
+
+			result, err := json.MarshalIndent(j.Result, "", "  ")
+			if err != nil {
+				return err
+			}
+			out.Printf("%s\n", result)
+			return nil
+		}
+
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"usersegmentator/pkg/history"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/segment"
+)
+
+// registerJobs connects every job kind to the repository doing the work. All of them can be repeated safely:
+// a fraction change brings the segment to its target whatever part of it is already done,
+// an import reports the rows applied before as already_member or not_member, and a report is simply built again.
+func registerJobs(runner *job.Runner, segmentsRepo segment.Repository, historyRepo history.Repository) {
+	setFraction := func(ctx context.Context, j *job.Job) (interface{}, error) {
+		change := &segment.FractionChange{}
+		err := json.Unmarshal(j.Params, change)
+		if err != nil {
+			return nil, err
+		}
+		return segmentsRepo.SetFraction(ctx, change.SegmentSlug, change.Fraction)
+	}
+	runner.Register(job.KindAutoAssign, setFraction)
+	runner.Register(job.KindSetFraction, setFraction)
+
+	runner.Register(job.KindImport, func(ctx context.Context, j *job.Job) (interface{}, error) {
+		req := &segment.ImportRequest{}
+		err := json.Unmarshal(j.Params, req)
+		if err != nil {
+			return nil, err
+		}
+		return segmentsRepo.ImportMemberships(ctx, req)
+	})
+
+	runner.Register(job.KindReport, func(ctx context.Context, j *job.Job) (interface{}, error) {
+		req := &history.Request{}
+		err := json.Unmarshal(j.Params, req)
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := req.Filter()
+		if err != nil {
+			return nil, err
+		}
+
+		dates, err := historyRepo.ParseAndValidateDates(req)
+		if err != nil {
+			return nil, err
+		}
+
+		output, err := req.Output()
+		if err != nil {
+			return nil, err
+		}
+		return historyRepo.CreateReport(ctx, filter, dates, output)
+	})
+}
@@ -7,16 +7,32 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+	// the report timezones are resolved without the zoneinfo of the host, the alpine image has none
+	_ "time/tzdata"
 	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
 	errs "usersegmentator/pkg/errors"
 	"usersegmentator/pkg/handlers"
+	"usersegmentator/pkg/history"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/memstore"
+	"usersegmentator/pkg/migrate"
+	"usersegmentator/pkg/reportstore"
+	"usersegmentator/pkg/segment"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+)
+
+const (
+	seedUsersFirst = 1000
+	seedUsersLast  = 2000
 )
 
 //	@title			Dynamic User Segmentation Service API
@@ -37,45 +53,151 @@ func main() {
 		return
 	}
 
-	dsn := fmt.Sprintf(
-		"root:%s@tcp(%s:%s)/%s?",
-		cfg.Password,
-		cfg.MySQL.Host,
-		cfg.MySQL.Port,
-		cfg.MySQL.Name,
-	)
-	dsn += "&charset=utf8"
-	dsn += "&multiStatements=true"
-	dsn += "&interpolateParams=true"
-	dsn += "&parseTime=true"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			err = runMigrate(cfg, os.Args[2:])
+			if err != nil {
+				errLog.Printf("Migration failed: %s\n", err)
+				os.Exit(1)
+			}
+		case "import":
+			err = runImport(cfg, os.Args[2:])
+			if err != nil {
+				errLog.Printf("Import failed: %s\n", err)
+				os.Exit(1)
+			}
+		default:
+			errLog.Printf("Unknown command %q, expected migrate or import\n", os.Args[1])
+			os.Exit(2) //nolint:gomnd // usage error exit code
+		}
+		return
+	}
 
-	db, err := errs.DBConnectLoop(dsn, time.Duration(cfg.Timeout*1e9)) //nolint:gomnd // converting nanosecs to secs
+	reports, err := reportstore.New(cfg)
 	if err != nil {
-		errLog.Printf("Couldn't start database driver: %s\n", err)
+		errLog.Printf("Couldn't set up report storage: %s\n", err)
 		return
 	}
 
-	defer func(db *sql.DB) {
-		err = db.Close()
+	var (
+		segmentsRepo segment.Repository
+		historyRepo  history.Repository
+		jobsRepo     job.Repository
+	)
+
+	switch cfg.Storage.Driver {
+	case config.StorageMemory:
+		store := memstore.New()
+		store.AddUsers(seedUserIDs()...)
+
+		segmentsRepo = segment.NewMemorySegmentsRepo(store, cfg)
+		historyRepo = history.NewMemoryHistoryRepo(store, cfg, reports)
+		jobsRepo = job.NewMemoryJobsRepo(store, cfg)
+		infoLog.Printf("Using in-memory storage, data will be lost on shutdown")
+
+	default:
+		var db *sql.DB
+		db, err = connectDB(cfg)
 		if err != nil {
-			errLog.Printf("Error closing database connection: %s\n", err)
+			errLog.Printf("Couldn't start database driver: %s\n", err)
+			return
 		}
-	}(db)
-	db.SetMaxOpenConns(cfg.MaxConnections)
 
-	segmentHandler := handlers.NewSegmentsHandler(db, cfg)
-	reportHandler := handlers.NewHistoryHandler(db, cfg)
+		defer func(db *sql.DB) {
+			err = db.Close()
+			if err != nil {
+				errLog.Printf("Error closing database connection: %s\n", err)
+			}
+		}(db)
+
+		var migrator *migrate.Migrator
+		migrator, err = migrate.NewMigrator(db, dialect.Dialect(cfg.Storage.Driver))
+		if err != nil {
+			errLog.Printf("Error loading migrations: %s\n", err)
+			return
+		}
+
+		err = migrator.Check(context.Background())
+		if err != nil {
+			errLog.Printf("Refusing to start: %s\n", err)
+			return
+		}
+
+		segmentsRepo = segment.NewSegmentsRepo(db, cfg)
+		historyRepo = history.NewHistoryRepo(db, cfg, reports)
+		jobsRepo = job.NewJobsRepo(db, cfg)
+	}
+
+	runner, err := job.NewRunner(jobsRepo, cfg)
+	if err != nil {
+		errLog.Printf("Couldn't start job runner: %s\n", err)
+		return
+	}
+	registerJobs(runner, segmentsRepo, historyRepo)
+
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	ttlStopped := make(chan struct{})
+	go func() {
+		segmentsRepo.RunTTLChecker(workersCtx)
+		close(ttlStopped)
+	}()
+	reconcilerStopped := make(chan struct{})
+	go func() {
+		segmentsRepo.RunReconciler(workersCtx)
+		close(reconcilerStopped)
+	}()
+	rampsStopped := make(chan struct{})
+	go func() {
+		segmentsRepo.RunRampScheduler(workersCtx, jobsRepo)
+		close(rampsStopped)
+	}()
+	windowsStopped := make(chan struct{})
+	go func() {
+		segmentsRepo.RunWindowChecker(workersCtx)
+		close(windowsStopped)
+	}()
+	cleanerStopped := make(chan struct{})
+	go func() {
+		reports.RunCleaner(workersCtx)
+		close(cleanerStopped)
+	}()
+	runnerStopped := make(chan struct{})
+	go func() {
+		runner.Run(workersCtx)
+		close(runnerStopped)
+	}()
+
+	segmentHandler := handlers.NewSegmentsHandler(segmentsRepo, jobsRepo, cfg)
+	reportHandler := handlers.NewHistoryHandler(historyRepo, jobsRepo)
+	jobHandler := handlers.NewJobsHandler(jobsRepo)
+	reportsHandler := handlers.NewReportsHandler(reports)
 
 	r := mux.NewRouter()
+	r.Use(handlers.AuditActor)
 	r.HandleFunc("/api/create_segment", segmentHandler.AddSegment).Methods("POST")
 	r.HandleFunc("/api/delete_segment", segmentHandler.DeleteSegment).Methods("DELETE")
+	r.HandleFunc("/api/update_segment", segmentHandler.UpdateSegment).Methods("PATCH")
+	r.HandleFunc("/api/get_segment", segmentHandler.GetSegment).Methods("GET")
+	r.HandleFunc("/api/list_segments", segmentHandler.ListSegments).Methods("GET")
+	r.HandleFunc("/api/get_segment_members", segmentHandler.GetSegmentMembers).Methods("GET")
+	r.HandleFunc("/api/get_segment_rollout", segmentHandler.GetSegmentRollout).Methods("GET")
+	r.HandleFunc("/api/reconcile_segments", segmentHandler.ReconcileSegments).Methods("POST")
+	r.HandleFunc("/api/update_segment_fraction", segmentHandler.UpdateSegmentFraction).Methods("PATCH")
+	r.HandleFunc("/api/schedule_segment_ramp", segmentHandler.ScheduleSegmentRamp).Methods("POST")
+	r.HandleFunc("/api/get_segment_ramp", segmentHandler.GetSegmentRamp).Methods("GET")
 	r.HandleFunc("/api/update_user_segments", segmentHandler.UpdateUserSegments).Methods("POST")
+	r.HandleFunc("/api/bulk_update_user_segments", segmentHandler.BulkUpdateUserSegments).Methods("POST")
+	r.HandleFunc("/api/import_memberships", segmentHandler.ImportMemberships).Methods("POST")
+	r.HandleFunc("/api/update_membership_expiry", segmentHandler.UpdateMembershipExpiry).Methods("PATCH")
 	r.HandleFunc("/api/get_user_segments", segmentHandler.GetUserSegments).Methods("GET")
 	r.HandleFunc("/api/get_user_history", reportHandler.GetUserHistory).Methods("GET")
+	r.HandleFunc("/api/get_history", reportHandler.GetHistory).Methods("GET")
+	r.HandleFunc("/api/get_job", jobHandler.GetJob).Methods("GET")
+	r.HandleFunc("/api/list_jobs", jobHandler.ListJobs).Methods("GET")
+	r.HandleFunc("/api/cancel_job", jobHandler.CancelJob).Methods("POST")
 
-	r.PathPrefix("/reports/").Handler(
-		http.StripPrefix("/reports/",
-			http.FileServer(http.Dir("./"+cfg.StorageDir))))
+	r.HandleFunc("/reports/{name}", reportsHandler.DownloadReport).Methods("GET", "HEAD")
 
 	srv := &http.Server{
 		Addr:    cfg.HTTP.Host + ":" + cfg.HTTP.Port,
@@ -103,5 +225,74 @@ func main() {
 
 	<-stopped
 
+	// let the TTL sweep finish its batch and the jobs go back to the queue before the deferred db.Close
+	stopWorkers()
+	<-ttlStopped
+	<-reconcilerStopped
+	<-rampsStopped
+	<-windowsStopped
+	<-cleanerStopped
+	<-runnerStopped
+
 	infoLog.Println("Server has been gracefully stopped")
 }
+
+func connectDB(cfg *config.Config) (*sql.DB, error) {
+	if cfg.Storage.Driver == config.StoragePostgres {
+		return connectPostgres(cfg)
+	}
+	return connectMySQL(cfg)
+}
+
+func connectMySQL(cfg *config.Config) (*sql.DB, error) {
+	dsn := fmt.Sprintf(
+		"root:%s@tcp(%s:%s)/%s?",
+		cfg.MySQL.Password,
+		cfg.MySQL.Host,
+		cfg.MySQL.Port,
+		cfg.MySQL.Name,
+	)
+	dsn += "&charset=utf8"
+	dsn += "&multiStatements=true"
+	dsn += "&interpolateParams=true"
+	dsn += "&parseTime=true"
+
+	//nolint:gomnd // converting nanosecs to secs
+	db, err := errs.DBConnectLoop(config.StorageMySQL, dsn, time.Duration(cfg.MySQL.Timeout*1e9))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MySQL.MaxConnections)
+
+	return db, nil
+}
+
+func connectPostgres(cfg *config.Config) (*sql.DB, error) {
+	dsn := (&url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(cfg.Postgres.User, cfg.Postgres.Password),
+		Host:   cfg.Postgres.Host + ":" + cfg.Postgres.Port,
+		Path:   cfg.Postgres.Name,
+	}).String()
+	dsn += "?sslmode=" + cfg.Postgres.SSLMode
+	// timestamps are stored without time zone, keep them in UTC like the MySQL DATETIME columns
+	dsn += "&timezone=UTC"
+
+	//nolint:gomnd // converting nanosecs to secs
+	db, err := errs.DBConnectLoop(config.StoragePostgres, dsn, time.Duration(cfg.Postgres.Timeout*1e9))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.Postgres.MaxConnections)
+
+	return db, nil
+}
+
+// seedUserIDs matches the users fixture of the migrate package, so the in-memory storage behaves like a seeded database.
+func seedUserIDs() []int {
+	ids := make([]int, 0, seedUsersLast-seedUsersFirst+1)
+	for id := seedUsersFirst; id <= seedUsersLast; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
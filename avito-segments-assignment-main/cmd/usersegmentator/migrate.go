@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/migrate"
+)
+
+const migrateUsage = "usage: usersegmentator migrate up | down [steps] | status | seed"
+
+// runMigrate handles `usersegmentator migrate ...`.
+func runMigrate(cfg *config.Config, args []string) error {
+	if cfg.Storage.Driver == config.StorageMemory {
+		return fmt.Errorf("%s storage has no schema to migrate", config.StorageMemory)
+	}
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	db, err := connectDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+
+	migrator, err := migrate.NewMigrator(db, dialect.Dialect(cfg.Storage.Driver))
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		return migrator.Up(ctx)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		return migrator.Down(ctx, steps)
+
+	case "status":
+		version, err := migrator.Version(ctx)
+		if err != nil {
+			return err
+		}
+		migrator.InfoLog.Printf("Schema version %d, latest %d\n", version, migrator.Latest())
+		return nil
+
+	case "seed":
+		return migrator.Seed(ctx)
+
+	default:
+		return errors.New(migrateUsage)
+	}
+}
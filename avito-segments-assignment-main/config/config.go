@@ -1,17 +1,23 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
+	"usersegmentator/pkg/report"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
 type Config struct {
 	UserSegmentator `yaml:"usersegmentator"`
+	Storage         `yaml:"storage"`
 	MySQL           `yaml:"mysql"`
+	Postgres        `yaml:"postgres"`
 	HTTP            `yaml:"http"`
 	Report          `yaml:"report"`
 	Segment         `yaml:"segment"`
+	Job             `yaml:"job"`
 }
 
 type UserSegmentator struct {
@@ -19,28 +25,104 @@ type UserSegmentator struct {
 	Version string `yaml:"version"`
 }
 
+const (
+	StorageMySQL    = "mysql"
+	StoragePostgres = "postgres"
+	StorageMemory   = "memory"
+)
+
+type Storage struct {
+	Driver string `yaml:"driver" env:"STORAGE_DRIVER" env-default:"mysql"`
+}
+
 type MySQL struct {
-	Name           string `env-required:"true"  env:"MYSQL_DATABASE"`
-	Password       string `env-required:"true"  env:"MYSQL_ROOT_PASSWORD"`
+	Name           string `env:"MYSQL_DATABASE"`
+	Password       string `env:"MYSQL_ROOT_PASSWORD"`
 	MaxConnections int    `yaml:"maxConns"`
 	Host           string `yaml:"host"`
 	Port           string `yaml:"port"`
 	Timeout        int    `yaml:"conn_timeout"`
 }
 
+type Postgres struct {
+	Name           string `env:"POSTGRES_DB"`
+	User           string `env:"POSTGRES_USER"`
+	Password       string `env:"POSTGRES_PASSWORD"`
+	MaxConnections int    `yaml:"max_conns"`
+	Host           string `yaml:"host"`
+	Port           string `yaml:"port"`
+	SSLMode        string `yaml:"sslmode"`
+	Timeout        int    `yaml:"conn_timeout"`
+}
+
+// HTTP is the address the server listens on. PublicURL is the address clients reach it at, the download links
+// of the reports are built on it.
 type HTTP struct {
-	Host string `yaml:"host"`
-	Port string `yaml:"port"`
+	Host      string `yaml:"host"`
+	Port      string `yaml:"port"`
+	PublicURL string `yaml:"public_url" env:"HTTP_PUBLIC_URL"`
 }
 
+// Report configures the report files. Retention, CleanupInterval and LinkTTL are in minutes. SigningKey signs
+// the download links, it is required for proxy downloads so the links survive restarts and work on every replica.
+// Backend is local, with the files in StorageDir, or s3. Download is proxy, the files are streamed through
+// the service, or presigned, the links point straight to the s3 bucket.
 type Report struct {
-	FilePrefix string `yaml:"file_prefix"`
-	FileExt    string `yaml:"file_ext"`
-	StorageDir string `env-required:"true"  env:"REPORTS_STORAGE"`
+	FilePrefix      string   `yaml:"file_prefix"`
+	Format          string   `yaml:"format" env:"REPORT_FORMAT" env-default:"csv"`
+	CSVDelimiter    string   `yaml:"csv_delimiter" env:"REPORT_CSV_DELIMITER" env-default:","`
+	Backend         string   `yaml:"backend" env:"REPORT_BACKEND" env-default:"local"`
+	Download        string   `yaml:"download" env:"REPORT_DOWNLOAD" env-default:"proxy"`
+	StorageDir      string   `env:"REPORTS_STORAGE"`
+	S3              ReportS3 `yaml:"s3"`
+	Retention       int      `yaml:"retention" env:"REPORT_RETENTION" env-default:"1440"`
+	CleanupInterval int      `yaml:"cleanup_interval" env:"REPORT_CLEANUP_INTERVAL" env-default:"10"`
+	LinkTTL         int      `yaml:"link_ttl" env:"REPORT_LINK_TTL" env-default:"60"`
+	SigningKey      string   `env:"REPORT_SIGNING_KEY"`
+}
+
+// ReportS3 is the bucket of the s3 report backend. Endpoint is the host:port the service reaches the store at,
+// PublicEndpoint the one presigned links point to when the clients see the store under another address.
+type ReportS3 struct {
+	Endpoint       string `yaml:"endpoint" env:"S3_ENDPOINT"`
+	PublicEndpoint string `yaml:"public_endpoint" env:"S3_PUBLIC_ENDPOINT"`
+	Region         string `yaml:"region" env:"S3_REGION" env-default:"us-east-1"`
+	Bucket         string `yaml:"bucket" env:"S3_BUCKET"`
+	UseSSL         bool   `yaml:"use_ssl" env:"S3_USE_SSL"`
+	AccessKey      string `env:"S3_ACCESS_KEY"`
+	SecretKey      string `env:"S3_SECRET_KEY"`
 }
 
+const (
+	ReportBackendLocal = "local"
+	ReportBackendS3    = "s3"
+
+	ReportDownloadProxy     = "proxy"
+	ReportDownloadPresigned = "presigned"
+)
+
+const (
+	// minSigningKeyLength keeps the HMAC key of the download links from being guessed.
+	minSigningKeyLength = 32
+
+	// maxPresignedLinkTTL is the longest validity of an S3 presigned link, a week in minutes.
+	maxPresignedLinkTTL = 7 * 24 * 60
+)
+
 type Segment struct {
-	TTLCheckInterval int `yaml:"ttl_check_interval"`
+	TTLCheckInterval    int `yaml:"ttl_check_interval" env:"SEGMENT_TTL_CHECK_INTERVAL" env-default:"1"`
+	BatchSize           int `yaml:"batch_size" env:"SEGMENT_BATCH_SIZE"`
+	BulkMaxUsers        int `yaml:"bulk_max_users" env:"SEGMENT_BULK_MAX_USERS" env-default:"10000"`
+	ImportMaxRows       int `yaml:"import_max_rows" env:"SEGMENT_IMPORT_MAX_ROWS" env-default:"100000"`
+	ReconcileInterval   int `yaml:"reconcile_interval" env:"SEGMENT_RECONCILE_INTERVAL" env-default:"5"`
+	RampCheckInterval   int `yaml:"ramp_check_interval" env:"SEGMENT_RAMP_CHECK_INTERVAL" env-default:"1"`
+	WindowCheckInterval int `yaml:"window_check_interval" env:"SEGMENT_WINDOW_CHECK_INTERVAL" env-default:"1"`
+}
+
+// Job configures the runner of asynchronous jobs, PollInterval is in seconds.
+type Job struct {
+	Workers      int `yaml:"workers" env:"JOB_WORKERS" env-default:"2"`
+	PollInterval int `yaml:"poll_interval" env:"JOB_POLL_INTERVAL" env-default:"2"`
 }
 
 func NewConfig() (*Config, error) {
@@ -56,5 +138,93 @@ func NewConfig() (*Config, error) {
 		return nil, err
 	}
 
+	switch cfg.Storage.Driver {
+	case StorageMySQL:
+		if cfg.MySQL.Name == "" || cfg.MySQL.Password == "" {
+			return nil, fmt.Errorf("config error: MYSQL_DATABASE and MYSQL_ROOT_PASSWORD are required for %s storage",
+				StorageMySQL)
+		}
+	case StoragePostgres:
+		if cfg.Postgres.Name == "" || cfg.Postgres.User == "" || cfg.Postgres.Password == "" {
+			return nil, fmt.Errorf("config error: POSTGRES_DB, POSTGRES_USER and POSTGRES_PASSWORD are required for %s storage",
+				StoragePostgres)
+		}
+	case StorageMemory:
+	default:
+		return nil, fmt.Errorf("config error: unknown storage driver %q", cfg.Storage.Driver)
+	}
+
+	err = (&report.Options{Format: cfg.Report.Format, Delimiter: cfg.Report.CSVDelimiter}).Validate()
+	if err != nil {
+		return nil, fmt.Errorf("config error: report: %w", err)
+	}
+
+	err = validatePublicURL(cfg.HTTP.PublicURL)
+	if err != nil {
+		return nil, fmt.Errorf("config error: http.public_url: %w", err)
+	}
+
+	if cfg.Report.Retention < 1 || cfg.Report.CleanupInterval < 1 || cfg.Report.LinkTTL < 1 {
+		return nil, errors.New("config error: report retention, cleanup_interval and link_ttl must be positive")
+	}
+	if cfg.Report.SigningKey != "" && len(cfg.Report.SigningKey) < minSigningKeyLength {
+		return nil, fmt.Errorf("config error: REPORT_SIGNING_KEY must be at least %d characters", minSigningKeyLength)
+	}
+
+	err = validateReportStorage(&cfg.Report)
+	if err != nil {
+		return nil, fmt.Errorf("config error: report: %w", err)
+	}
+
 	return cfg, nil
 }
+
+// validateReportStorage checks that the backend has what it needs and can serve the download mode.
+func validateReportStorage(cfg *Report) error {
+	switch cfg.Backend {
+	case ReportBackendLocal:
+		if cfg.StorageDir == "" {
+			return fmt.Errorf("REPORTS_STORAGE is required for the %s backend", ReportBackendLocal)
+		}
+	case ReportBackendS3:
+		if cfg.S3.Endpoint == "" || cfg.S3.Bucket == "" || cfg.S3.AccessKey == "" || cfg.S3.SecretKey == "" {
+			return fmt.Errorf("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required for the %s backend",
+				ReportBackendS3)
+		}
+	default:
+		return fmt.Errorf("unknown backend %q, expected %s or %s", cfg.Backend, ReportBackendLocal, ReportBackendS3)
+	}
+
+	switch cfg.Download {
+	case ReportDownloadProxy:
+		if cfg.SigningKey == "" {
+			return fmt.Errorf("REPORT_SIGNING_KEY is required for %s downloads", ReportDownloadProxy)
+		}
+	case ReportDownloadPresigned:
+		if cfg.Backend != ReportBackendS3 {
+			return fmt.Errorf("%s downloads need the %s backend", ReportDownloadPresigned, ReportBackendS3)
+		}
+		if cfg.LinkTTL > maxPresignedLinkTTL {
+			return fmt.Errorf("link_ttl of presigned downloads is at most %d minutes", maxPresignedLinkTTL)
+		}
+	default:
+		return fmt.Errorf("unknown download %q, expected %s or %s", cfg.Download, ReportDownloadProxy,
+			ReportDownloadPresigned)
+	}
+	return nil
+}
+
+// validatePublicURL accepts an absolute http or https URL without a query, a path prefix is allowed.
+func validatePublicURL(raw string) error {
+	if raw == "" {
+		return errors.New("the public URL of the service is required, set HTTP_PUBLIC_URL")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%q is not an absolute http or https URL without a query", raw)
+	}
+	return nil
+}
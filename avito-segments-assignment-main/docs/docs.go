@@ -19,24 +19,143 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/api/bulk_update_user_segments": {
+            "post": {
+                "description": "apply update_user_segments to every user of the list. all_or_nothing (default) applies the whole list\nin one transaction or nothing, best_effort applies every user on its own and reports the failed ones.\nA failed all_or_nothing update responds with the status of the error and the per-user result",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "assign and unassign segments of many users",
+                "parameters": [
+                    {
+                        "description": "users to update, at most segment.bulk_max_users",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/segment.RequestBulkUpdate"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/segment.BulkUpdateResult"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "$ref": "#/definitions/segment.BulkUpdateResult"
+                        }
+                    },
+                    "404": {
+                        "description": "user not found",
+                        "schema": {
+                            "$ref": "#/definitions/segment.BulkUpdateResult"
+                        }
+                    },
+                    "413": {
+                        "description": "too many users",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/cancel_job": {
+            "post": {
+                "description": "cancels a queued job right away and asks the runner of a running one to stop it.\nA running job is cancelled within a few seconds, the work it has already committed stays",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Jobs"
+                ],
+                "summary": "cancels a job",
+                "parameters": [
+                    {
+                        "description": "The input struct",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/job.Request"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/job.Job"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "job not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "job already finished",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
         "/api/create_segment": {
             "post": {
-                "description": "creates new segment",
+                "description": "creates new segment, fraction assigns it to a percentage of active users in an auto_assign job.\nHash bucketing picks the same users for the same salt and also applies to users without a stored assignment.\nAn active segment created again only gets the metadata of the request, its fraction is changed by /api/update_segment_fraction",
                 "consumes": [
                     "application/json"
                 ],
+                "produces": [
+                    "application/json"
+                ],
                 "tags": [
                     "Segments"
                 ],
                 "summary": "creates new segment",
                 "parameters": [
                     {
-                        "description": "fraction — optional",
+                        "description": "description, owner, tags, fraction, bucketing, salt, starts_at and ends_at — optional",
                         "name": "request",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/segment.RequestSegmentSlug"
+                            "$ref": "#/definitions/segment.RequestCreateSegment"
                         }
                     }
                 ],
@@ -47,12 +166,24 @@ const docTemplate = `{
                             "type": "string"
                         }
                     },
+                    "202": {
+                        "description": "created, the users are assigned by the job",
+                        "schema": {
+                            "$ref": "#/definitions/job.Job"
+                        }
+                    },
                     "400": {
                         "description": "bad input",
                         "schema": {
                             "type": "string"
                         }
                     },
+                    "409": {
+                        "description": "the segment is active, its fraction is changed by /api/update_segment_fraction",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "500": {
                         "description": "something went wrong",
                         "schema": {
@@ -96,6 +227,12 @@ const docTemplate = `{
                             "type": "string"
                         }
                     },
+                    "404": {
+                        "description": "segment not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "500": {
                         "description": "something went wrong",
                         "schema": {
@@ -105,22 +242,30 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/get_user_history": {
+        "/api/get_history": {
             "get": {
-                "description": "receive report on user segments assignments and unassignments within the given dates",
+                "description": "receive report on the membership changes within the given dates. segment_slug and user_ids narrow\nthe report down, without either it lists every change. The report is read from the database row by row.\nWith async the report is built by a report job, the result of the job is history.ReportResponse.\nWith Accept: text/csv or application/x-ndjson the report is streamed in the response instead of a file",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
-                    "application/json"
+                    "application/json",
+                    "text/csv",
+                    "application/x-ndjson"
                 ],
                 "tags": [
                     "History"
                 ],
-                "summary": "receive report on user segments assignments and unassignments",
+                "summary": "receive report on membership changes of a segment, a set of users or the whole service",
                 "parameters": [
                     {
-                        "description": "The input struct",
+                        "type": "string",
+                        "description": "text/csv or application/x-ndjson stream the report inline",
+                        "name": "Accept",
+                        "in": "header"
+                    },
+                    {
+                        "description": "start_date and end_date, segment_slug, user_ids and async — optional",
                         "name": "request",
                         "in": "body",
                         "required": true,
@@ -136,6 +281,12 @@ const docTemplate = `{
                             "$ref": "#/definitions/history.ReportResponse"
                         }
                     },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/job.Job"
+                        }
+                    },
                     "400": {
                         "description": "bad input",
                         "schema": {
@@ -151,9 +302,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/get_user_segments": {
+        "/api/get_job": {
             "get": {
-                "description": "receive segments assigned to user",
+                "description": "returns the status, progress, error and result of a job. Progress is done out of total,\na total of 0 means the amount of work is not known yet",
                 "consumes": [
                     "application/json"
                 ],
@@ -161,9 +312,9 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Segments"
+                    "Jobs"
                 ],
-                "summary": "receive segments assigned to user",
+                "summary": "returns a job",
                 "parameters": [
                     {
                         "description": "The input struct",
@@ -171,7 +322,7 @@ const docTemplate = `{
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/segment.RequestUserID"
+                            "$ref": "#/definitions/job.Request"
                         }
                     }
                 ],
@@ -179,7 +330,7 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/segment.UserSegments"
+                            "$ref": "#/definitions/job.Job"
                         }
                     },
                     "400": {
@@ -188,6 +339,12 @@ const docTemplate = `{
                             "type": "string"
                         }
                     },
+                    "404": {
+                        "description": "job not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "500": {
                         "description": "something went wrong",
                         "schema": {
@@ -197,32 +354,35 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/update_user_segments": {
-            "post": {
-                "description": "assign and unassign segments from user",
+        "/api/get_segment": {
+            "get": {
+                "description": "receive metadata of a segment, active or deleted, with the number of its active members",
                 "consumes": [
                     "application/json"
                 ],
+                "produces": [
+                    "application/json"
+                ],
                 "tags": [
                     "Segments"
                 ],
-                "summary": "assign and unassign segments from user",
+                "summary": "receive a segment",
                 "parameters": [
                     {
-                        "description": "The input struct",
+                        "description": "fraction is ignored",
                         "name": "request",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/segment.RequestUpdateSegments"
+                            "$ref": "#/definitions/segment.RequestSegmentSlug"
                         }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "assigned and unassigned",
+                        "description": "OK",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/segment.Segment"
                         }
                     },
                     "400": {
@@ -231,6 +391,12 @@ const docTemplate = `{
                             "type": "string"
                         }
                     },
+                    "404": {
+                        "description": "segment not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "500": {
                         "description": "something went wrong",
                         "schema": {
@@ -239,43 +405,1202 @@ const docTemplate = `{
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "history.ReportResponse": {
-            "type": "object",
-            "properties": {
-                "csv_url": {
-                    "type": "string"
-                }
-            }
         },
-        "history.Request": {
-            "type": "object",
-            "properties": {
-                "end_date": {
-                    "type": "string"
-                },
-                "start_date": {
-                    "type": "string"
-                },
-                "user_id": {
-                    "type": "integer"
+        "/api/get_segment_members": {
+            "get": {
+                "description": "receive a page of the users in a segment ordered by user id, either now or at the as_of instant (RFC3339).\ninclude_dates adds date_assigned and expires_at of every membership. Pass next_cursor of a page\nas cursor to receive the following one",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "receive users of a segment",
+                "parameters": [
+                    {
+                        "description": "everything but segment_slug is optional",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/segment.MembersQuery"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/segment.MembersPage"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "segment not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
                 }
             }
         },
-        "segment.RequestSegmentSlug": {
-            "type": "object",
-            "properties": {
-                "fraction": {
-                    "type": "integer"
-                },
-                "segment_slug": {
-                    "type": "string"
+        "/api/get_segment_ramp": {
+            "get": {
+                "description": "receive applied and pending steps of a segment ramp ordered by time",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "receive the ramp of a segment",
+                "parameters": [
+                    {
+                        "description": "fraction is ignored",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/segment.RequestSegmentSlug"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/segment.RampSchedule"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "segment not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
                 }
             }
         },
-        "segment.RequestUpdateSegments": {
+        "/api/get_segment_rollout": {
+            "get": {
+                "description": "compares the share of active users in a segment with its target fraction",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "receive the rollout of a segment",
+                "parameters": [
+                    {
+                        "description": "fraction is ignored",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/segment.RequestSegmentSlug"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/segment.Rollout"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "segment not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/get_user_history": {
+            "get": {
+                "description": "receive report on user segments assignments and unassignments within the given dates.\nWith async the report is built by a report job, the result of the job is history.ReportResponse.\nWith Accept: text/csv or application/x-ndjson the report is streamed in the response instead of a file",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json",
+                    "text/csv",
+                    "application/x-ndjson"
+                ],
+                "tags": [
+                    "History"
+                ],
+                "summary": "receive report on user segments assignments and unassignments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "text/csv or application/x-ndjson stream the report inline",
+                        "name": "Accept",
+                        "in": "header"
+                    },
+                    {
+                        "description": "user_id, start_date and end_date, async — optional",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/history.Request"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/history.ReportResponse"
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/job.Job"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/get_user_segments": {
+            "get": {
+                "description": "receive segments assigned to user. With as_of (RFC3339, not in the future) the segments are\nreconstructed at that moment from the stored memberships, skipping segments that did not exist\nor were outside their window then",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "receive segments assigned to user",
+                "parameters": [
+                    {
+                        "description": "The input struct",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/segment.RequestUserID"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/segment.UserSegments"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/import_memberships": {
+            "post": {
+                "description": "the file is a list of (user_id, segment, action, expires_at) rows: a CSV with a header naming the columns,\nor an NDJSON object per line. action is assign or unassign, expires_at is an optional RFC3339 time.\nEvery line is validated first, an invalid file is rejected with the numbered lines.\nA valid one is applied by an import job in batches of segment.batch_size rows, its result counts\nthe outcome of the rows. A dry run reports the outcomes without changing anything",
+                "consumes": [
+                    "text/csv",
+                    "application/x-ndjson"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "import memberships from a CSV or NDJSON file",
+                "parameters": [
+                    {
+                        "enum": [
+                            "csv",
+                            "ndjson"
+                        ],
+                        "type": "string",
+                        "description": "csv or ndjson, taken from Content-Type when omitted",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "report what would change without applying it",
+                        "name": "dry_run",
+                        "in": "query"
+                    },
+                    {
+                        "description": "rows to import, at most segment.import_max_rows",
+                        "name": "file",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                ],
+                "responses": {
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/job.Job"
+                        }
+                    },
+                    "400": {
+                        "description": "invalid lines",
+                        "schema": {
+                            "$ref": "#/definitions/segment.ImportValidationError"
+                        }
+                    },
+                    "413": {
+                        "description": "too many rows",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/list_jobs": {
+            "get": {
+                "description": "lists the most recent jobs, optionally of one kind or status. The limit defaults to 50, at most 500",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Jobs"
+                ],
+                "summary": "lists jobs",
+                "parameters": [
+                    {
+                        "description": "kind, status and limit — optional",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/job.Filter"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/job.Job"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/list_segments": {
+            "get": {
+                "description": "list segments ordered by creation, filtered by status (active, deleted or all), tag, owner\nand slug prefix. Pass next_cursor of a page as cursor to receive the following one",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "list segments",
+                "parameters": [
+                    {
+                        "description": "every field is optional",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/segment.SegmentFilter"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/segment.SegmentPage"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/reconcile_segments": {
+            "post": {
+                "description": "includes users activated since the rollout of every fraction segment right away, without waiting\nfor the background reconciler, and reports the resulting shares",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "reconciles fraction segments",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/segment.Rollout"
+                            }
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/schedule_segment_ramp": {
+            "post": {
+                "description": "replaces the pending steps of a segment ramp, each step sets the fraction at its time.\nAn empty list of steps cancels the ramp",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "schedules a segment ramp",
+                "parameters": [
+                    {
+                        "description": "applied_at of the steps is ignored",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/segment.RampSchedule"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/segment.RampSchedule"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "segment not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/update_membership_expiry": {
+            "patch": {
+                "description": "sets, extends, shortens or clears the expiry of the active memberships of a segment,\nof one user when user_id is given. Durations are ISO-8601, e.g. PT12H or P1W",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "changes the expiry of memberships",
+                "parameters": [
+                    {
+                        "description": "exactly one of expires_at, expires_in, extend_by, shorten_by and clear",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/segment.ExpiryChange"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/segment.ExpiryResult"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "segment or membership not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/update_segment": {
+            "patch": {
+                "description": "updates description, owner, tags and activation window of a segment, omitted fields are left unchanged.\nclear_window removes the window, starts_at and ends_at of the same request set a new one",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "updates segment metadata",
+                "parameters": [
+                    {
+                        "description": "The input struct",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/segment.SegmentPatch"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/segment.Segment"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "segment not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/update_segment_fraction": {
+            "patch": {
+                "description": "raises or lowers the target fraction of an active segment in a set_fraction job, the result of the job is\nsegment.Rollout. Hash segments change exactly the users whose buckets cross the fraction, random segments\nget random users or lose the most recently assigned ones",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "changes the fraction of a segment",
+                "parameters": [
+                    {
+                        "description": "fraction from 0 to 100",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/segment.FractionChange"
+                        }
+                    }
+                ],
+                "responses": {
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/job.Job"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "segment not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/update_user_segments": {
+            "post": {
+                "description": "assign and unassign segments from user in one transaction and report the outcome for every segment:\nassigned, already_member, unassigned, not_member, unknown_segment or inactive_segment",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "assign and unassign segments from user",
+                "parameters": [
+                    {
+                        "description": "at most one of ttl in days, expires_at and ISO-8601 expires_in",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/segment.RequestUpdateSegments"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/segment.UpdateSegmentsResult"
+                        }
+                    },
+                    "400": {
+                        "description": "bad input",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "user not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/reports/{name}": {
+            "get": {
+                "description": "serves a report file by the signed link returned with the report. A forged link is rejected\nwith 403, an expired one with 410, a report past the retention is gone with 404",
+                "produces": [
+                    "text/csv",
+                    "application/x-ndjson",
+                    "application/json",
+                    "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+                ],
+                "tags": [
+                    "History"
+                ],
+                "summary": "downloads a report file",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "report file name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "unix time the link expires at",
+                        "name": "expires",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "HMAC-SHA256 of the name and expires",
+                        "name": "signature",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "403": {
+                        "description": "invalid link",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "report not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "410": {
+                        "description": "link expired",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "something went wrong",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "history.ReportResponse": {
+            "type": "object",
+            "properties": {
+                "csv_url": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "format": {
+                    "type": "string"
+                },
+                "url": {
+                    "type": "string"
+                }
+            }
+        },
+        "history.Request": {
+            "type": "object",
+            "properties": {
+                "async": {
+                    "type": "boolean"
+                },
+                "delimiter": {
+                    "type": "string"
+                },
+                "end_date": {
+                    "type": "string"
+                },
+                "format": {
+                    "type": "string"
+                },
+                "range": {
+                    "type": "string"
+                },
+                "segment_slug": {
+                    "type": "string"
+                },
+                "start_date": {
+                    "type": "string"
+                },
+                "timezone": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                },
+                "user_ids": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "job.Filter": {
+            "type": "object",
+            "properties": {
+                "kind": {
+                    "type": "string"
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "status": {
+                    "type": "string"
+                }
+            }
+        },
+        "job.Job": {
+            "type": "object",
+            "properties": {
+                "actor": {
+                    "type": "string"
+                },
+                "cancel_requested": {
+                    "type": "boolean"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "done": {
+                    "type": "integer"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "finished_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "kind": {
+                    "type": "string"
+                },
+                "params": {
+                    "type": "object"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "result": {
+                    "type": "object"
+                },
+                "started_at": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "total": {
+                    "type": "integer"
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "job.Request": {
+            "type": "object",
+            "properties": {
+                "job_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "segment.BulkUpdateResult": {
+            "type": "object",
+            "properties": {
+                "applied": {
+                    "type": "integer"
+                },
+                "failed": {
+                    "type": "integer"
+                },
+                "mode": {
+                    "type": "string"
+                },
+                "users": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/segment.BulkUserResult"
+                    }
+                }
+            }
+        },
+        "segment.BulkUserResult": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "results": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/segment.SegmentResult"
+                    }
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "segment.ExpiryChange": {
+            "type": "object",
+            "properties": {
+                "clear": {
+                    "type": "boolean"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "expires_in": {
+                    "type": "string"
+                },
+                "extend_by": {
+                    "type": "string"
+                },
+                "segment_slug": {
+                    "type": "string"
+                },
+                "shorten_by": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "segment.ExpiryResult": {
+            "type": "object",
+            "properties": {
+                "segment_slug": {
+                    "type": "string"
+                },
+                "updated": {
+                    "type": "integer"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "segment.FractionChange": {
+            "type": "object",
+            "properties": {
+                "fraction": {
+                    "type": "integer"
+                },
+                "segment_slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "segment.ImportError": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "line": {
+                    "type": "integer"
+                }
+            }
+        },
+        "segment.ImportValidationError": {
+            "type": "object",
+            "properties": {
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/segment.ImportError"
+                    }
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "segment.Member": {
+            "type": "object",
+            "properties": {
+                "date_assigned": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "segment.MembersPage": {
+            "type": "object",
+            "properties": {
+                "members": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/segment.Member"
+                    }
+                },
+                "next_cursor": {
+                    "type": "string"
+                },
+                "segment_slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "segment.MembersQuery": {
+            "type": "object",
+            "properties": {
+                "as_of": {
+                    "type": "string"
+                },
+                "cursor": {
+                    "type": "string"
+                },
+                "include_dates": {
+                    "type": "boolean"
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "segment_slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "segment.Outcome": {
+            "type": "string",
+            "enum": [
+                "assigned",
+                "already_member",
+                "unassigned",
+                "not_member",
+                "unknown_segment",
+                "inactive_segment"
+            ],
+            "x-enum-varnames": [
+                "OutcomeAssigned",
+                "OutcomeAlreadyMember",
+                "OutcomeUnassigned",
+                "OutcomeNotMember",
+                "OutcomeUnknownSegment",
+                "OutcomeInactiveSegment"
+            ]
+        },
+        "segment.RampSchedule": {
+            "type": "object",
+            "properties": {
+                "segment_slug": {
+                    "type": "string"
+                },
+                "steps": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/segment.RampStep"
+                    }
+                }
+            }
+        },
+        "segment.RampStep": {
+            "type": "object",
+            "properties": {
+                "applied_at": {
+                    "type": "string"
+                },
+                "at": {
+                    "type": "string"
+                },
+                "fraction": {
+                    "type": "integer"
+                },
+                "job_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "segment.RequestBulkUpdate": {
+            "type": "object",
+            "properties": {
+                "mode": {
+                    "type": "string",
+                    "enum": [
+                        "all_or_nothing",
+                        "best_effort"
+                    ]
+                },
+                "users": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/segment.RequestUpdateSegments"
+                    }
+                }
+            }
+        },
+        "segment.RequestCreateSegment": {
+            "type": "object",
+            "properties": {
+                "bucketing": {
+                    "type": "string",
+                    "enum": [
+                        "random",
+                        "hash"
+                    ]
+                },
+                "description": {
+                    "type": "string"
+                },
+                "ends_at": {
+                    "type": "string"
+                },
+                "fraction": {
+                    "type": "integer"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "salt": {
+                    "type": "string"
+                },
+                "segment_slug": {
+                    "type": "string"
+                },
+                "starts_at": {
+                    "type": "string"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "segment.RequestSegmentSlug": {
+            "type": "object",
+            "properties": {
+                "fraction": {
+                    "type": "integer"
+                },
+                "segment_slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "segment.RequestUpdateSegments": {
             "type": "object",
             "properties": {
                 "assign_segments": {
@@ -284,6 +1609,12 @@ const docTemplate = `{
                         "type": "string"
                     }
                 },
+                "expires_at": {
+                    "type": "string"
+                },
+                "expires_in": {
+                    "type": "string"
+                },
                 "ttl": {
                     "type": "integer"
                 },
@@ -301,6 +1632,176 @@ const docTemplate = `{
         "segment.RequestUserID": {
             "type": "object",
             "properties": {
+                "as_of": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "segment.Rollout": {
+            "type": "object",
+            "properties": {
+                "active_users": {
+                    "type": "integer"
+                },
+                "actual_fraction": {
+                    "type": "number"
+                },
+                "bucketing": {
+                    "type": "string"
+                },
+                "members": {
+                    "type": "integer"
+                },
+                "segment_slug": {
+                    "type": "string"
+                },
+                "target_fraction": {
+                    "type": "integer"
+                }
+            }
+        },
+        "segment.Segment": {
+            "type": "object",
+            "properties": {
+                "bucketing": {
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "deleted_at": {
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "ends_at": {
+                    "type": "string"
+                },
+                "fraction": {
+                    "type": "integer"
+                },
+                "is_active": {
+                    "type": "boolean"
+                },
+                "member_count": {
+                    "type": "integer"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "salt": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "starts_at": {
+                    "type": "string"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "segment.SegmentFilter": {
+            "type": "object",
+            "properties": {
+                "cursor": {
+                    "type": "string"
+                },
+                "limit": {
+                    "type": "integer"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "prefix": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "tag": {
+                    "type": "string"
+                }
+            }
+        },
+        "segment.SegmentPage": {
+            "type": "object",
+            "properties": {
+                "next_cursor": {
+                    "type": "string"
+                },
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/segment.Segment"
+                    }
+                }
+            }
+        },
+        "segment.SegmentPatch": {
+            "type": "object",
+            "properties": {
+                "clear_window": {
+                    "type": "boolean"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "ends_at": {
+                    "type": "string"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "segment_slug": {
+                    "type": "string"
+                },
+                "starts_at": {
+                    "type": "string"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "segment.SegmentResult": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string"
+                },
+                "result": {
+                    "$ref": "#/definitions/segment.Outcome"
+                },
+                "segment": {
+                    "type": "string"
+                }
+            }
+        },
+        "segment.UpdateSegmentsResult": {
+            "type": "object",
+            "properties": {
+                "results": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/segment.SegmentResult"
+                    }
+                },
                 "user_id": {
                     "type": "integer"
                 }
@@ -309,6 +1810,12 @@ const docTemplate = `{
         "segment.UserSegments": {
             "type": "object",
             "properties": {
+                "details": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/segment.Segment"
+                    }
+                },
                 "segments": {
                     "type": "array",
                     "items": {
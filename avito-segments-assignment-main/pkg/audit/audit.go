@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"context"
+	"time"
+)
+
+// Sources of membership changes.
+const (
+	SourceManual        = "manual"
+	SourceTTL           = "ttl"
+	SourceAutoFraction  = "auto_fraction"
+	SourceSegmentDelete = "segment_delete"
+	SourceImport        = "import"
+)
+
+// Actions of the audit entries.
+const (
+	ActionAssign       = "assign"
+	ActionUnassign     = "unassign"
+	ActionExpiryChange = "expiry_change"
+)
+
+const (
+	// SystemActor makes the changes the service starts on its own.
+	SystemActor = "system"
+
+	MaxActorLength  = 100
+	MaxReasonLength = 255
+)
+
+// Origin tells who changed a membership, why and through which part of the service.
+type Origin struct {
+	Source string
+	Actor  string
+	Reason string
+}
+
+// Entry is a single record of the append-only membership_audit table. ExpiresAt is the expiry
+// an assignment or expiry change set, nil for memberships without one.
+type Entry struct {
+	ID        int
+	UserID    int
+	SegmentID int
+	Action    string
+	Origin
+	ExpiresAt *time.Time
+	CreatedAt time.Time
+}
+
+type (
+	originKey struct{}
+	timeKey   struct{}
+)
+
+// WithActor records who makes the changes done with ctx and why. The source is kept.
+func WithActor(ctx context.Context, actor, reason string) context.Context {
+	origin := FromContext(ctx)
+	origin.Actor, origin.Reason = actor, reason
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+// WithSource marks the changes done with ctx as coming from source, keeping the actor and the reason.
+func WithSource(ctx context.Context, source string) context.Context {
+	origin := FromContext(ctx)
+	origin.Source = source
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+// FromContext returns the origin of the changes done with ctx. Changes without one are manual
+// changes of the system actor.
+func FromContext(ctx context.Context) Origin {
+	origin, _ := ctx.Value(originKey{}).(Origin)
+	if origin.Source == "" {
+		origin.Source = SourceManual
+	}
+	if origin.Actor == "" {
+		origin.Actor = SystemActor
+	}
+	return origin
+}
+
+// WithTime dates the audit entries of the changes done with ctx at t rather than at the moment they are written,
+// for changes that took effect before the service got to store them.
+func WithTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, timeKey{}, t)
+}
+
+// TimeFromContext returns the moment the changes done with ctx took effect, now when WithTime was not used.
+func TimeFromContext(ctx context.Context, now time.Time) time.Time {
+	t, ok := ctx.Value(timeKey{}).(time.Time)
+	if !ok {
+		return now
+	}
+	return t
+}
@@ -0,0 +1,37 @@
+package bucket
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+)
+
+// Buckets is the number of buckets users are spread over, one per percent of a fraction.
+const Buckets = 100
+
+const saltBytes = 16
+
+// Of returns the bucket of the user in a segment with the given salt, in [0, Buckets).
+// The result depends only on its arguments, so it can be recomputed at any time.
+func Of(salt string, userID int) int {
+	sum := sha256.Sum256([]byte(salt + ":" + strconv.Itoa(userID)))
+	return int(binary.BigEndian.Uint64(sum[:8]) % Buckets)
+}
+
+// Includes reports whether the user falls into a fraction (in percent) of the segment with the given salt.
+// Raising the fraction only adds users and lowering it only removes them.
+func Includes(salt string, userID, fraction int) bool {
+	return Of(salt, userID) < fraction
+}
+
+// NewSalt returns a random salt for a new segment.
+func NewSalt() (string, error) {
+	b := make([]byte, saltBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
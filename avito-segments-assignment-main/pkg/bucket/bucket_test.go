@@ -0,0 +1,122 @@
+package bucket
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		salt   string
+		userID int
+	}{
+		{"fixed salt", "checkout-2023-09", 1000},
+		{"another user", "checkout-2023-09", 1001},
+		{"generated salt", "9f86d081884c7d659a2feaa0c55ad015", 1000},
+		{"empty salt", "", 1000},
+		{"large id", "checkout-2023-09", 1 << 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Of(tt.salt, tt.userID)
+			if b < 0 || b >= Buckets {
+				t.Fatalf("bucket %d is out of [0, %d)", b, Buckets)
+			}
+			for i := 0; i < 10; i++ {
+				if again := Of(tt.salt, tt.userID); again != b {
+					t.Fatalf("bucket %d, then %d for the same salt and user", b, again)
+				}
+			}
+		})
+	}
+}
+
+func TestOfDependsOnSalt(t *testing.T) {
+	same := 0
+	for id := 1; id <= 1000; id++ {
+		if Of("checkout-2023-09", id) == Of("checkout-2023-10", id) {
+			same++
+		}
+	}
+	// about one user in a hundred shares the bucket by chance
+	if same > 50 {
+		t.Errorf("%d of 1000 users are in the same bucket of two salts", same)
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	tests := []struct {
+		name      string
+		fractions []int
+	}{
+		{"ramp up", []int{0, 1, 5, 25, 50, 100}},
+		{"single steps", []int{10, 11, 12, 13}},
+		{"same fraction", []int{30, 30}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for id := 1; id <= 1000; id++ {
+				for i := 1; i < len(tt.fractions); i++ {
+					f, next := tt.fractions[i-1], tt.fractions[i]
+					if Includes("checkout-2023-09", id, f) && !Includes("checkout-2023-09", id, next) {
+						t.Fatalf("user %d is in at %d%% but not at %d%%", id, f, next)
+					}
+				}
+			}
+		})
+	}
+
+	for id := 1; id <= 1000; id++ {
+		if Includes("checkout-2023-09", id, 0) {
+			t.Fatalf("user %d is in at 0%%", id)
+		}
+		if !Includes("checkout-2023-09", id, 100) {
+			t.Fatalf("user %d is not in at 100%%", id)
+		}
+	}
+}
+
+func TestSpread(t *testing.T) {
+	const users = 10000
+
+	counts := make([]int, Buckets)
+	in := 0
+	for id := 1; id <= users; id++ {
+		counts[Of("checkout-2023-09", id)]++
+		if Includes("checkout-2023-09", id, 25) {
+			in++
+		}
+	}
+
+	// 100 users a bucket on average with a deviation of about 10
+	for b, n := range counts {
+		if n < 60 || n > 140 {
+			t.Errorf("bucket %d has %d of %d users", b, n, users)
+		}
+	}
+	if in < 2300 || in > 2700 {
+		t.Errorf("%d of %d users are in at 25%%", in, users)
+	}
+}
+
+func TestNewSalt(t *testing.T) {
+	salts := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		salt, err := NewSalt()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := hex.DecodeString(salt)
+		if err != nil || len(b) != saltBytes {
+			t.Fatalf("salt %q is not %d hex encoded bytes", salt, saltBytes)
+		}
+		if salts[salt] {
+			t.Fatalf("salt %s is generated twice", salt)
+		}
+		salts[salt] = true
+	}
+}
@@ -0,0 +1,74 @@
+package dialect
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect names the SQL flavour a repository talks to. Queries are written with MySQL-style ?
+// placeholders and passed through Rebind before execution.
+type Dialect string
+
+const (
+	MySQL    Dialect = "mysql"
+	Postgres Dialect = "postgres"
+)
+
+// Rebind rewrites ? placeholders into the bind variables of the dialect. Question marks inside
+// quoted literals are left untouched.
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+
+	var (
+		b     strings.Builder
+		n     int
+		quote rune
+	)
+	b.Grow(len(query) + 10) //nolint:gomnd // room for a few multi-digit placeholders
+
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// Random returns the function used to shuffle rows in ORDER BY.
+func (d Dialect) Random() string {
+	if d == Postgres {
+		return "RANDOM()"
+	}
+	return "RAND()"
+}
+
+// Placeholders returns n comma separated ? placeholders for an IN list.
+func Placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strings.Repeat("?, ", n-1) + "?"
+}
+
+// Values returns the VALUES list of a multi-row insert with the given number of rows and columns.
+func Values(rows, columns int) string {
+	if rows <= 0 {
+		return ""
+	}
+	row := "(" + Placeholders(columns) + ")"
+	return strings.Repeat(row+", ", rows-1) + row
+}
@@ -1,6 +1,7 @@
 package errors
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -17,7 +18,14 @@ const (
 	ErrorCommittingTransaction = "error committing transaction"
 )
 
-func DBConnectLoop(dsn string, timeout time.Duration) (*sql.DB, error) {
+// DBConnectLoop waits until the database answers a ping, since migrations run right after connecting
+// and the database container usually starts slower than the service.
+func DBConnectLoop(driver, dsn string, timeout time.Duration) (*sql.DB, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to connect to db %w", dsn, err)
+	}
+
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
@@ -25,14 +33,14 @@ func DBConnectLoop(dsn string, timeout time.Duration) (*sql.DB, error) {
 	for {
 		select {
 		case <-timeoutExceeded:
-			return nil, fmt.Errorf("db connection failed after %s timeout", timeout)
+			_ = db.Close()
+			return nil, fmt.Errorf("db connection failed after %s timeout: %w", timeout, err)
 
 		case <-ticker.C:
-			db, err := sql.Open("mysql", dsn)
+			err = db.Ping()
 			if err == nil {
 				return db, nil
 			}
-			return nil, fmt.Errorf("%s: failed to connect to db %w", dsn, err)
 		}
 	}
 }
@@ -49,6 +57,11 @@ func ValidateAndParseJSON(r *http.Request, parseInto interface{}) error {
 		return err
 	}
 
+	// an empty body leaves every field at its default, e.g. an unfiltered segments list
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
 	err = json.Unmarshal(body, parseInto)
 	if err != nil {
 		return err
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+	"usersegmentator/pkg/audit"
+)
+
+const (
+	ActorHeader       = "X-Actor"
+	AuditReasonHeader = "X-Audit-Reason"
+
+	// anonymousActor makes the requests that don't name an actor.
+	anonymousActor = "anonymous"
+)
+
+// AuditActor puts the actor and the reason of the X-Actor and X-Audit-Reason headers into the request context,
+// so the membership changes of the request and the jobs it creates are audited under them.
+// Values longer than the audit columns are rejected with 400 rather than cut.
+func AuditActor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor := strings.TrimSpace(r.Header.Get(ActorHeader))
+		reason := strings.TrimSpace(r.Header.Get(AuditReasonHeader))
+		if utf8.RuneCountInString(actor) > audit.MaxActorLength ||
+			utf8.RuneCountInString(reason) > audit.MaxReasonLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if actor == "" {
+			actor = anonymousActor
+		}
+		next.ServeHTTP(w, r.WithContext(audit.WithActor(r.Context(), actor, reason)))
+	})
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/segment"
+)
+
+// statusFromError maps the sentinel errors of the repositories to HTTP status codes.
+func statusFromError(err error) int {
+	switch {
+	case stderrors.Is(err, segment.ErrInvalidInput):
+		return http.StatusBadRequest
+	case stderrors.Is(err, segment.ErrSegmentNotFound),
+		stderrors.Is(err, segment.ErrUserNotFound),
+		stderrors.Is(err, segment.ErrMembershipNotFound),
+		stderrors.Is(err, job.ErrJobNotFound):
+		return http.StatusNotFound
+	case stderrors.Is(err, job.ErrJobFinished),
+		stderrors.Is(err, segment.ErrSegmentExists):
+		return http.StatusConflict
+	case stderrors.Is(err, segment.ErrTooManyUsers),
+		stderrors.Is(err, segment.ErrTooManyRows):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeJSON marshals v into the response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(resp)
+	return err
+}
+
+// jsonArrayStream writes a JSON array element by element. The prefix, the status line and the headers
+// are sent with the first element, so a failure before it can still be reported with a status code.
+type jsonArrayStream struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	prefix  string
+	started bool
+}
+
+func newJSONArrayStream(w http.ResponseWriter, prefix string) *jsonArrayStream {
+	return &jsonArrayStream{w: w, enc: json.NewEncoder(w), prefix: prefix}
+}
+
+func (s *jsonArrayStream) Started() bool {
+	return s.started
+}
+
+func (s *jsonArrayStream) start() error {
+	s.started = true
+	s.w.Header().Set("Content-Type", "application/json")
+	s.w.WriteHeader(http.StatusOK)
+	_, err := io.WriteString(s.w, s.prefix+"[")
+	return err
+}
+
+// Write encodes one array element.
+func (s *jsonArrayStream) Write(v interface{}) error {
+	if !s.started {
+		err := s.start()
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := io.WriteString(s.w, ",")
+		if err != nil {
+			return err
+		}
+	}
+	return s.enc.Encode(v)
+}
+
+// Close ends the array and writes the rest of the document.
+func (s *jsonArrayStream) Close(suffix string) error {
+	if !s.started {
+		err := s.start()
+		if err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(s.w, "]"+suffix)
+	return err
+}
+
+// lazyResponse sends the status line and the headers with the first bytes written, so a failure before
+// any output can still be reported with a status code. Without a Content-Length the body is sent chunked.
+type lazyResponse struct {
+	w           http.ResponseWriter
+	contentType string
+	started     bool
+}
+
+func (lr *lazyResponse) Started() bool {
+	return lr.started
+}
+
+func (lr *lazyResponse) Write(p []byte) (int, error) {
+	if !lr.started {
+		lr.started = true
+		lr.w.Header().Set("Content-Type", lr.contentType)
+		lr.w.WriteHeader(http.StatusOK)
+	}
+	return lr.w.Write(p)
+}
+
+// mediaQuality returns the quality the Accept header gives to mediaType. The most specific matching range wins,
+// a type/* range counts only when matchWildcards is set, so */* alone never selects mediaType.
+func mediaQuality(accept, mediaType string, matchWildcards bool) float64 {
+	var (
+		quality     float64
+		specificity = -1
+	)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		rng := strings.ToLower(strings.TrimSpace(params[0]))
+
+		s := -1
+		switch {
+		case rng == mediaType:
+			s = 2 //nolint:gomnd // an exact match is the most specific
+		case matchWildcards && rng == "*/*":
+			s = 0
+		case matchWildcards && strings.HasSuffix(rng, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(rng, "*")):
+			s = 1
+		}
+		if s <= specificity {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(key, "q") {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+		specificity, quality = s, q
+	}
+	return quality
+}
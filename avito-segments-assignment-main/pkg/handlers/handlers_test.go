@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"usersegmentator/config"
+	"usersegmentator/pkg/history"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/memstore"
+	"usersegmentator/pkg/reportstore"
+	"usersegmentator/pkg/segment"
+)
+
+// testUsers are the active users of the in-memory storage the handlers are tested against.
+var testUsers = []int{1000, 1001, 1002, 1003, 1004, 1005, 1006, 1007, 1008, 1009}
+
+// testService is the handlers of the API over a fresh in-memory storage, as the service runs with STORAGE_DRIVER=memory.
+type testService struct {
+	segmentsRepo segment.Repository
+	jobsRepo     job.Repository
+	reports      *reportstore.Store
+	segments     *SegmentsHandler
+	history      *HistoryHandler
+}
+
+func newTestService(t *testing.T) *testService {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Storage.Driver = config.StorageMemory
+	cfg.HTTP.PublicURL = "http://localhost:8000"
+	cfg.Report.FilePrefix = "report_"
+	cfg.Report.Format = "csv"
+	cfg.Report.CSVDelimiter = ","
+	cfg.Report.Backend = config.ReportBackendLocal
+	cfg.Report.Download = config.ReportDownloadProxy
+	cfg.Report.StorageDir = t.TempDir()
+	cfg.Report.Retention = 60
+	cfg.Report.LinkTTL = 30
+	cfg.Report.SigningKey = "0123456789abcdef0123456789abcdef"
+
+	reports, err := reportstore.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports.InfoLog.SetOutput(io.Discard)
+
+	store := memstore.New()
+	store.AddUsers(testUsers...)
+
+	s := &testService{
+		segmentsRepo: segment.NewMemorySegmentsRepo(store, cfg),
+		jobsRepo:     job.NewMemoryJobsRepo(store, cfg),
+		reports:      reports,
+	}
+	s.segments = NewSegmentsHandler(s.segmentsRepo, s.jobsRepo, cfg)
+	s.history = NewHistoryHandler(history.NewMemoryHistoryRepo(store, cfg, reports), s.jobsRepo)
+	s.segments.InfoLog.SetOutput(io.Discard)
+	s.history.InfoLog.SetOutput(io.Discard)
+	return s
+}
+
+// call sends the JSON body to the handler as the actor of the X-Actor header, an empty actor sends no header.
+func call(t *testing.T, h http.HandlerFunc, method, actor string, body interface{}, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(method, "/", bytes.NewReader(b))
+	if actor != "" {
+		r.Header.Set(ActorHeader, actor)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	AuditActor(h).ServeHTTP(w, r)
+	return w
+}
+
+// decode checks the status of the response and unmarshals its body into v.
+func decode(t *testing.T, w *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d, body: %s", w.Code, status, w.Body)
+	}
+	if v == nil {
+		return
+	}
+
+	err := json.Unmarshal(w.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("decoding %s: %s", w.Body, err)
+	}
+}
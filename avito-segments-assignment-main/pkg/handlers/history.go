@@ -1,25 +1,26 @@
 package handlers
 
 import (
-	"database/sql"
-	"encoding/json"
 	"log"
 	"net/http"
 	"os"
-	"usersegmentator/config"
 	"usersegmentator/pkg/errors"
 	"usersegmentator/pkg/history"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/report"
 )
 
 type HistoryHandler struct {
 	HistoryRepo history.Repository
+	JobsRepo    job.Repository
 	InfoLog     *log.Logger
 	ErrLog      *log.Logger
 }
 
-func NewHistoryHandler(db *sql.DB, cfg *config.Config) *HistoryHandler {
+func NewHistoryHandler(repo history.Repository, jobs job.Repository) *HistoryHandler {
 	return &HistoryHandler{
-		HistoryRepo: history.NewHistoryRepo(db, cfg),
+		HistoryRepo: repo,
+		JobsRepo:    jobs,
 		InfoLog:     log.New(os.Stdout, "INFO\tHistory HANDLER\t", log.Ldate|log.Ltime),
 		ErrLog:      log.New(os.Stdout, "ERROR\tHistory HANDLER\t", log.Ldate|log.Ltime),
 	}
@@ -28,12 +29,16 @@ func NewHistoryHandler(db *sql.DB, cfg *config.Config) *HistoryHandler {
 // GetUserHistory godoc
 //
 //	@Summary		receive report on user segments assignments and unassignments
-//	@Description	receive report on user segments assignments and unassignments within the given dates
+//	@Description	receive report on user segments assignments and unassignments within the given dates.
+//	@Description	With async the report is built by a report job, the result of the job is history.ReportResponse.
+//	@Description	With Accept: text/csv or application/x-ndjson the report is streamed in the response instead of a file
 //	@Tags         	History
 //	@Accept			json
-//	@Produce		json
-//	@Param 			request		body 	history.Request true "The input struct"
+//	@Produce		json,text/csv,application/x-ndjson
+//	@Param			Accept		header	string	false	"text/csv or application/x-ndjson stream the report inline"
+//	@Param 			request		body 	history.Request true "user_id, start_date and end_date, async — optional"
 //	@Success		200	{object} history.ReportResponse
+//	@Success		202	{object} job.Job
 //	@Failure		400	{string} string "bad input"
 //	@Failure		500	{string} string "something went wrong"
 //	@Router			/api/get_user_history [get]
@@ -47,38 +52,154 @@ func (rh *HistoryHandler) GetUserHistory(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	dates, err := rh.HistoryRepo.ParseAndValidateDates(receivedRequest.StartDate, receivedRequest.EndDate)
+	if receivedRequest.UserID <= 0 || len(receivedRequest.UserIDs) > 0 || receivedRequest.SegmentSlug != "" {
+		rh.ErrLog.Printf("%s: a single positive user_id is expected", history.ErrInvalidFilter)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rh.report(w, r, receivedRequest)
+}
+
+// GetHistory godoc
+//
+//	@Summary		receive report on membership changes of a segment, a set of users or the whole service
+//	@Description	receive report on the membership changes within the given dates. segment_slug and user_ids narrow
+//	@Description	the report down, without either it lists every change. The report is read from the database row by row.
+//	@Description	With async the report is built by a report job, the result of the job is history.ReportResponse.
+//	@Description	With Accept: text/csv or application/x-ndjson the report is streamed in the response instead of a file
+//	@Tags         	History
+//	@Accept			json
+//	@Produce		json,text/csv,application/x-ndjson
+//	@Param			Accept		header	string	false	"text/csv or application/x-ndjson stream the report inline"
+//	@Param 			request		body 	history.Request true "start_date and end_date, segment_slug, user_ids and async — optional"
+//	@Success		200	{object} history.ReportResponse
+//	@Success		202	{object} job.Job
+//	@Failure		400	{string} string "bad input"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/get_history [get]
+func (rh *HistoryHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	receivedRequest := &history.Request{}
+
+	err := errors.ValidateAndParseJSON(r, receivedRequest)
 	if err != nil {
 		rh.ErrLog.Printf("%s", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	userHistory, err := rh.HistoryRepo.GetUserHistory(r.Context(), receivedRequest.UserID, dates)
+	rh.report(w, r, receivedRequest)
+}
+
+// report builds the report of receivedRequest right away or queues a report job for it.
+func (rh *HistoryHandler) report(w http.ResponseWriter, r *http.Request, receivedRequest *history.Request) {
+	filter, err := receivedRequest.Filter()
 	if err != nil {
 		rh.ErrLog.Printf("%s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	url, err := rh.HistoryRepo.CreateCSV(userHistory)
+	dates, err := rh.HistoryRepo.ParseAndValidateDates(receivedRequest)
 	if err != nil {
 		rh.ErrLog.Printf("%s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	resp, err := json.Marshal(history.ReportResponse{CsvURL: url})
-
+	output, err := receivedRequest.Output()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		rh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	_, err = w.Write(resp)
+	w.Header().Add("Vary", "Accept")
+	if format := streamFormat(r.Header.Get("Accept")); format != "" && !receivedRequest.Async {
+		if output.Format != "" && output.Format != format {
+			rh.ErrLog.Printf("%s: format %s contradicts Accept %s", report.ErrInvalidOptions, output.Format,
+				report.ContentType(format))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		output.Format = format
+
+		rh.stream(w, r, filter, dates, output)
+		return
+	}
+
+	if receivedRequest.Async {
+		// the job reports on the period as of the request, not as of the moment it gets to run
+		receivedRequest.Resolve(dates)
+		j, err := rh.JobsRepo.Create(r.Context(), job.KindReport, receivedRequest)
+		if err != nil {
+			rh.ErrLog.Printf("%s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err = writeJSON(w, http.StatusAccepted, j)
+		if err != nil {
+			rh.ErrLog.Printf("%s", err)
+		}
+		return
+	}
+
+	resp, err := rh.HistoryRepo.CreateReport(r.Context(), filter, dates, output)
 	if err != nil {
 		rh.ErrLog.Printf("%s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	err = writeJSON(w, http.StatusOK, resp)
+	if err != nil {
+		rh.ErrLog.Printf("%s", err)
+	}
+}
+
+// stream writes the report into the response as the rows are read. A failure after the first bytes can't change
+// the status any more, the connection is broken instead, so a cut report never passes for a complete one.
+func (rh *HistoryHandler) stream(
+	w http.ResponseWriter,
+	r *http.Request,
+	filter *history.Filter,
+	dates *history.DatesRange,
+	output *report.Options,
+) {
+	resp := &lazyResponse{w: w, contentType: report.ContentType(output.Format)}
+
+	err := rh.HistoryRepo.WriteReport(r.Context(), resp, filter, dates, output)
+	if err != nil {
+		rh.ErrLog.Printf("%s", err)
+		if !resp.Started() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	if !resp.Started() {
+		// an NDJSON report without rows is empty
+		w.Header().Set("Content-Type", resp.contentType)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// streamFormat picks the format of an inline report from the Accept header. text/csv and application/x-ndjson
+// have to be named explicitly and accepted at least as much as application/json, otherwise the empty format
+// keeps the report file and the JSON response with its URL.
+func streamFormat(accept string) string {
+	if accept == "" {
+		return ""
+	}
+
+	best, bestQuality := "", mediaQuality(accept, "application/json", true)
+	for _, format := range []string{report.CSV, report.NDJSON} {
+		q := mediaQuality(accept, report.ContentType(format), false)
+		if q > 0 && (q > bestQuality || q == bestQuality && best == "") {
+			best, bestQuality = format, q
+		}
+	}
+	return best
 }
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/history"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/segment"
+)
+
+// reportRow is a row of an NDJSON report, the keys are history.ReportColumns.
+type reportRow struct {
+	UserID    int    `json:"user_id"`
+	Segment   string `json:"segment"`
+	Operation string `json:"operation"`
+	Date      string `json:"date"`
+	ExpiresAt string `json:"expires_at"`
+	Source    string `json:"source"`
+	Actor     string `json:"actor"`
+	Reason    string `json:"reason"`
+}
+
+// streamHistory requests the report inline as NDJSON.
+func streamHistory(t *testing.T, h http.HandlerFunc, req *history.Request) []reportRow {
+	t.Helper()
+	w := call(t, h, http.MethodGet, "", req, "Accept", "application/x-ndjson")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("Content-Type = %s", contentType)
+	}
+
+	rows := []reportRow{}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		row := reportRow{}
+		err := json.Unmarshal(scanner.Bytes(), &row)
+		if err != nil {
+			t.Fatalf("decoding %s: %s", scanner.Text(), err)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestUserHistory(t *testing.T) {
+	s := newTestService(t)
+
+	decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+		&segment.RequestCreateSegment{SegmentSlug: "AVITO_VOICE_MESSAGES"}), http.StatusCreated, nil)
+
+	expiresAt := time.Now().UTC().Truncate(time.Second).Add(time.Hour)
+	for _, id := range []int{1000, 1001} {
+		decode(t, call(t, s.segments.UpdateUserSegments, http.MethodPost, "alice", &segment.Template{
+			UserID:         id,
+			AssignSegments: []string{"AVITO_VOICE_MESSAGES"},
+			ExpiresAt:      &expiresAt,
+		}), http.StatusOK, nil)
+	}
+	decode(t, call(t, s.segments.UpdateUserSegments, http.MethodPost, "bob", &segment.Template{
+		UserID:           1000,
+		UnassignSegments: []string{"AVITO_VOICE_MESSAGES"},
+	}), http.StatusOK, nil)
+
+	rows := streamHistory(t, s.history.GetUserHistory, &history.Request{UserID: 1000, Range: "last 1 hour"})
+	if len(rows) != 2 {
+		t.Fatalf("rows = %+v, want the assignment and the unassignment of user 1000", rows)
+	}
+
+	want := []reportRow{
+		{UserID: 1000, Segment: "AVITO_VOICE_MESSAGES", Operation: history.OperationAssigned,
+			ExpiresAt: expiresAt.Format(time.RFC3339), Source: audit.SourceManual, Actor: "alice"},
+		{UserID: 1000, Segment: "AVITO_VOICE_MESSAGES", Operation: history.OperationUnassigned,
+			Source: audit.SourceManual, Actor: "bob"},
+	}
+	for i, row := range rows {
+		if row.Date == "" {
+			t.Errorf("row %d has no date", i)
+		}
+		row.Date = ""
+		if row != want[i] {
+			t.Errorf("row %d = %+v, want %+v", i, row, want[i])
+		}
+	}
+
+	// the dates are shown in the timezone of the request
+	rows = streamHistory(t, s.history.GetUserHistory,
+		&history.Request{UserID: 1000, Range: "last 1 hour", Timezone: "Europe/Moscow"})
+	if len(rows) == 0 || !strings.HasSuffix(rows[0].Date, "+03:00") {
+		t.Errorf("rows = %+v, want the dates in Europe/Moscow", rows)
+	}
+
+	// a period before the changes has no rows
+	rows = streamHistory(t, s.history.GetUserHistory,
+		&history.Request{UserID: 1000, StartDate: "2023-08", EndDate: "2023-08"})
+	if len(rows) != 0 {
+		t.Errorf("rows = %+v, want none in August 2023", rows)
+	}
+}
+
+func TestUserHistoryBadRequest(t *testing.T) {
+	s := newTestService(t)
+
+	tests := []struct {
+		name string
+		req  *history.Request
+	}{
+		{"no user", &history.Request{Range: "last 1 day"}},
+		{"users of get_history", &history.Request{UserID: 1000, UserIDs: []int{1001}, Range: "last 1 day"}},
+		{"start after end", &history.Request{UserID: 1000, StartDate: "2023-09", EndDate: "2023-08"}},
+		{"range and dates", &history.Request{UserID: 1000, Range: "last 1 day", StartDate: "2023-08"}},
+		{"unknown timezone", &history.Request{UserID: 1000, Range: "last 1 day", Timezone: "Mars/Olympus"}},
+		{"unknown format", &history.Request{UserID: 1000, Range: "last 1 day", Format: "pdf"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decode(t, call(t, s.history.GetUserHistory, http.MethodGet, "", tt.req), http.StatusBadRequest, nil)
+		})
+	}
+}
+
+func TestSegmentHistory(t *testing.T) {
+	s := newTestService(t)
+
+	for _, slug := range []string{"AVITO_VOICE_MESSAGES", "AVITO_PERFORMANCE_VAS"} {
+		decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+			&segment.RequestCreateSegment{SegmentSlug: slug}), http.StatusCreated, nil)
+	}
+
+	err := s.segmentsRepo.AutoAssignSegment(context.Background(), 30, "AVITO_VOICE_MESSAGES", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, call(t, s.segments.UpdateUserSegments, http.MethodPost, "alice", &segment.Template{
+		UserID:         1000,
+		AssignSegments: []string{"AVITO_PERFORMANCE_VAS"},
+	}), http.StatusOK, nil)
+	decode(t, call(t, s.segments.DeleteSegment, http.MethodDelete, "carol",
+		&segment.Template{SegmentSlug: "AVITO_VOICE_MESSAGES"}), http.StatusOK, nil)
+
+	rows := streamHistory(t, s.history.GetHistory,
+		&history.Request{SegmentSlug: "AVITO_VOICE_MESSAGES", Range: "last 1 hour"})
+
+	assigned, deleted := map[int]bool{}, map[int]bool{}
+	for _, row := range rows {
+		switch {
+		case row.Segment != "AVITO_VOICE_MESSAGES":
+			t.Errorf("row of another segment %+v", row)
+		case row.Operation == history.OperationAutoAssigned &&
+			row.Source == audit.SourceAutoFraction && row.Actor == audit.SystemActor:
+			assigned[row.UserID] = true
+		case row.Operation == history.OperationSegmentDeleted &&
+			row.Source == audit.SourceSegmentDelete && row.Actor == "carol":
+			deleted[row.UserID] = true
+		default:
+			t.Errorf("unexpected row %+v", row)
+		}
+	}
+	// 30% of 10 users, every membership is closed by the deletion
+	if len(assigned) != 3 || len(rows) != 6 {
+		t.Errorf("%d users auto assigned in %d rows, want 3 users in 6 rows", len(assigned), len(rows))
+	}
+	for id := range assigned {
+		if !deleted[id] {
+			t.Errorf("the membership of user %d is not closed by the deletion", id)
+		}
+	}
+
+	// without a filter the report covers the whole service
+	rows = streamHistory(t, s.history.GetHistory, &history.Request{Range: "last 1 hour"})
+	if len(rows) != 7 {
+		t.Errorf("%d rows of the whole service, want 7", len(rows))
+	}
+}
+
+func TestHistoryReportFile(t *testing.T) {
+	s := newTestService(t)
+
+	decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+		&segment.RequestCreateSegment{SegmentSlug: "AVITO_VOICE_MESSAGES"}), http.StatusCreated, nil)
+	decode(t, call(t, s.segments.UpdateUserSegments, http.MethodPost, "alice", &segment.Template{
+		UserID:         1000,
+		AssignSegments: []string{"AVITO_VOICE_MESSAGES"},
+	}), http.StatusOK, nil)
+
+	resp := &history.ReportResponse{}
+	decode(t, call(t, s.history.GetUserHistory, http.MethodGet, "",
+		&history.Request{UserID: 1000, Range: "last 1 hour"}), http.StatusOK, resp)
+	if resp.Format != "csv" || resp.CsvURL != resp.URL {
+		t.Errorf("response = %+v, want a CSV report", resp)
+	}
+
+	link, err := url.Parse(resp.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := path.Base(link.Path)
+	err = s.reports.Verify(name, link.Query().Get("expires"), link.Query().Get("signature"), time.Now())
+	if err != nil {
+		t.Fatalf("the report link doesn't pass the check of the download: %s", err)
+	}
+
+	obj, err := s.reports.Open(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Body.Close()
+
+	body, err := io.ReadAll(obj.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\r\n")
+	if len(lines) != 2 || lines[0] != strings.Join(history.ReportColumns, ",") ||
+		!strings.HasPrefix(lines[1], "1000,AVITO_VOICE_MESSAGES,assigned,") {
+		t.Errorf("report:\n%s", body)
+	}
+}
+
+func TestAsyncHistoryResolvesRange(t *testing.T) {
+	s := newTestService(t)
+
+	before := time.Now().UTC()
+	queued := &job.Job{}
+	decode(t, call(t, s.history.GetHistory, http.MethodGet, "",
+		&history.Request{Range: "last 2 days", Async: true}), http.StatusAccepted, queued)
+	if queued.Kind != job.KindReport {
+		t.Errorf("kind = %s, want %s", queued.Kind, job.KindReport)
+	}
+
+	req := &history.Request{}
+	err := json.Unmarshal(queued.Params, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Range != "" {
+		t.Errorf("range %q is stored, the job would resolve it when it runs", req.Range)
+	}
+
+	end, err := time.Parse(time.RFC3339Nano, req.EndDate)
+	if err != nil {
+		t.Fatalf("end_date %q: %s", req.EndDate, err)
+	}
+	start, err := time.Parse(time.RFC3339Nano, req.StartDate)
+	if err != nil {
+		t.Fatalf("start_date %q: %s", req.StartDate, err)
+	}
+	if end.Before(before) || end.After(time.Now()) || !start.Equal(end.AddDate(0, 0, -2)) {
+		t.Errorf("period %s – %s, want the 2 days before the request", start, end)
+	}
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	stderrors "errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/segment"
+)
+
+// importFormat takes the format of an import from the format query parameter, or else from the Content-Type.
+func importFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return segment.ImportCSV
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return segment.ImportNDJSON
+	}
+	return ""
+}
+
+// ImportMemberships godoc
+//
+//	@Summary		import memberships from a CSV or NDJSON file
+//	@Description	the file is a list of (user_id, segment, action, expires_at) rows: a CSV with a header naming the columns,
+//	@Description	or an NDJSON object per line. action is assign or unassign, expires_at is an optional RFC3339 time.
+//	@Description	Every line is validated first, an invalid file is rejected with the numbered lines.
+//	@Description	A valid one is applied by an import job in batches of segment.batch_size rows, its result counts
+//	@Description	the outcome of the rows. A dry run reports the outcomes without changing anything
+//	@Tags         	Segments
+//	@Accept			text/csv,application/x-ndjson
+//	@Produce		json
+//	@Param			format	query	string	false	"csv or ndjson, taken from Content-Type when omitted"	Enums(csv, ndjson)
+//	@Param			dry_run	query	bool	false	"report what would change without applying it"
+//	@Param 			file	body 	string	true	"rows to import, at most segment.import_max_rows"
+//	@Success		202	{object} job.Job
+//	@Failure		400	{object} segment.ImportValidationError "invalid lines"
+//	@Failure		413	{string} string "too many rows"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/import_memberships [post]
+func (sh *SegmentsHandler) ImportMemberships(w http.ResponseWriter, r *http.Request) {
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			sh.ErrLog.Printf("%s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := segment.ParseImport(r.Body, importFormat(r), segment.ImportMaxRows(sh.cfg.Segment.ImportMaxRows))
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+
+		var invalid *segment.ImportValidationError
+		if stderrors.As(err, &invalid) {
+			err = writeJSON(w, http.StatusBadRequest, invalid)
+			if err != nil {
+				sh.ErrLog.Printf("%s", err)
+			}
+			return
+		}
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	j, err := sh.JobsRepo.Create(r.Context(), job.KindImport, &segment.ImportRequest{DryRun: dryRun, Rows: rows})
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = writeJSON(w, http.StatusAccepted, j)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/job"
+)
+
+type JobsHandler struct {
+	JobsRepo job.Repository
+	InfoLog  *log.Logger
+	ErrLog   *log.Logger
+}
+
+func NewJobsHandler(repo job.Repository) *JobsHandler {
+	return &JobsHandler{
+		JobsRepo: repo,
+		InfoLog:  log.New(os.Stdout, "INFO\tJOBS HANDLER\t", log.Ldate|log.Ltime),
+		ErrLog:   log.New(os.Stdout, "ERROR\tJOBS HANDLER\t", log.Ldate|log.Ltime),
+	}
+}
+
+// GetJob godoc
+//
+//	@Summary		returns a job
+//	@Description	returns the status, progress, error and result of a job. Progress is done out of total,
+//	@Description	a total of 0 means the amount of work is not known yet
+//	@Tags         	Jobs
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	job.Request true "The input struct"
+//	@Success		200	{object} job.Job
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "job not found"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/get_job [get]
+func (jh *JobsHandler) GetJob(w http.ResponseWriter, r *http.Request) {
+	req := &job.Request{}
+
+	err := errors.ValidateAndParseJSON(r, req)
+	if err != nil {
+		jh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	j, err := jh.JobsRepo.Get(r.Context(), req.JobID)
+	if err != nil {
+		jh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	err = writeJSON(w, http.StatusOK, j)
+	if err != nil {
+		jh.ErrLog.Printf("%s", err)
+	}
+}
+
+// ListJobs godoc
+//
+//	@Summary		lists jobs
+//	@Description	lists the most recent jobs, optionally of one kind or status. The limit defaults to 50, at most 500
+//	@Tags         	Jobs
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	job.Filter false "kind, status and limit — optional"
+//	@Success		200	{array} job.Job
+//	@Failure		400	{string} string "bad input"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/list_jobs [get]
+func (jh *JobsHandler) ListJobs(w http.ResponseWriter, r *http.Request) {
+	filter := &job.Filter{}
+
+	err := errors.ValidateAndParseJSON(r, filter)
+	if err != nil {
+		jh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	jobs, err := jh.JobsRepo.List(r.Context(), filter)
+	if err != nil {
+		jh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	err = writeJSON(w, http.StatusOK, jobs)
+	if err != nil {
+		jh.ErrLog.Printf("%s", err)
+	}
+}
+
+// CancelJob godoc
+//
+//	@Summary		cancels a job
+//	@Description	cancels a queued job right away and asks the runner of a running one to stop it.
+//	@Description	A running job is cancelled within a few seconds, the work it has already committed stays
+//	@Tags         	Jobs
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	job.Request true "The input struct"
+//	@Success		200	{object} job.Job
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "job not found"
+//	@Failure		409	{string} string "job already finished"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/cancel_job [post]
+func (jh *JobsHandler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	req := &job.Request{}
+
+	err := errors.ValidateAndParseJSON(r, req)
+	if err != nil {
+		jh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	j, err := jh.JobsRepo.Cancel(r.Context(), req.JobID)
+	if err != nil {
+		jh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	err = writeJSON(w, http.StatusOK, j)
+	if err != nil {
+		jh.ErrLog.Printf("%s", err)
+	}
+}
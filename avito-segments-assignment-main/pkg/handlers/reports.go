@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	stderrors "errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+	"usersegmentator/pkg/report"
+	"usersegmentator/pkg/reportstore"
+
+	"github.com/gorilla/mux"
+)
+
+type ReportsHandler struct {
+	Reports *reportstore.Store
+	InfoLog *log.Logger
+	ErrLog  *log.Logger
+}
+
+func NewReportsHandler(reports *reportstore.Store) *ReportsHandler {
+	return &ReportsHandler{
+		Reports: reports,
+		InfoLog: log.New(os.Stdout, "INFO\tREPORTS HANDLER\t", log.Ldate|log.Ltime),
+		ErrLog:  log.New(os.Stdout, "ERROR\tREPORTS HANDLER\t", log.Ldate|log.Ltime),
+	}
+}
+
+// DownloadReport godoc
+//
+//	@Summary		downloads a report file
+//	@Description	serves a report file by the signed link returned with the report. A forged link is rejected
+//	@Description	with 403, an expired one with 410, a report past the retention is gone with 404
+//	@Tags         	History
+//	@Produce		text/csv,application/x-ndjson,json,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+//	@Param 			name		path 	string true "report file name"
+//	@Param 			expires		query 	int true "unix time the link expires at"
+//	@Param 			signature	query 	string true "HMAC-SHA256 of the name and expires"
+//	@Success		200	{file} file
+//	@Failure		403	{string} string "invalid link"
+//	@Failure		404	{string} string "report not found"
+//	@Failure		410	{string} string "link expired"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/reports/{name} [get]
+func (rh *ReportsHandler) DownloadReport(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	query := r.URL.Query()
+
+	err := rh.Reports.Verify(name, query.Get("expires"), query.Get("signature"), time.Now())
+	if err != nil {
+		rh.ErrLog.Printf("%s", err)
+		if stderrors.Is(err, reportstore.ErrLinkExpired) {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	obj, err := rh.Reports.Open(r.Context(), name)
+	if err != nil {
+		rh.ErrLog.Printf("%s", err)
+		if stderrors.Is(err, reportstore.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer obj.Body.Close()
+
+	ext := filepath.Ext(name)
+	if contentType := report.ContentType(ext[1:]); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	// the link is the only key to the report, it is not kept by shared caches
+	w.Header().Set("Cache-Control", "private, no-store")
+	// the file is streamed from the storage, from the local directory or the bucket alike
+	http.ServeContent(w, r, name, obj.Modified, obj.Body)
+}
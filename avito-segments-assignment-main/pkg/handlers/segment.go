@@ -1,25 +1,31 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 	"usersegmentator/config"
 	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/job"
 	"usersegmentator/pkg/segment"
 )
 
 type SegmentsHandler struct {
 	SegmentsRepo segment.Repository
+	JobsRepo     job.Repository
+	cfg          *config.Config
 	InfoLog      *log.Logger
 	ErrLog       *log.Logger
 }
 
-func NewSegmentsHandler(db *sql.DB, cfg *config.Config) *SegmentsHandler {
+func NewSegmentsHandler(repo segment.Repository, jobs job.Repository, cfg *config.Config) *SegmentsHandler {
 	return &SegmentsHandler{
-		SegmentsRepo: segment.NewSegmentsRepo(db, cfg),
+		SegmentsRepo: repo,
+		JobsRepo:     jobs,
+		cfg:          cfg,
 		InfoLog:      log.New(os.Stdout, "INFO\tSEGMENTS HANDLER\t", log.Ldate|log.Ltime),
 		ErrLog:       log.New(os.Stdout, "ERROR\tSEGMENTS HANDLER\t", log.Ldate|log.Ltime),
 	}
@@ -28,12 +34,17 @@ func NewSegmentsHandler(db *sql.DB, cfg *config.Config) *SegmentsHandler {
 // AddSegment godoc
 //
 //	@Summary		creates new segment
-//	@Description	creates new segment
+//	@Description	creates new segment, fraction assigns it to a percentage of active users in an auto_assign job.
+//	@Description	Hash bucketing picks the same users for the same salt and also applies to users without a stored assignment.
+//	@Description	An active segment created again only gets the metadata of the request, its fraction is changed by /api/update_segment_fraction
 //	@Tags         	Segments
 //	@Accept			json
-//	@Param 			request		body 	segment.RequestSegmentSlug true "fraction — optional"
+//	@Produce		json
+//	@Param 			request		body 	segment.RequestCreateSegment true "description, owner, tags, fraction, bucketing, salt, starts_at and ends_at — optional"
 //	@Success		201	{string} string "created"
+//	@Success		202	{object} job.Job "created, the users are assigned by the job"
 //	@Failure		400	{string} string "bad input"
+//	@Failure		409	{string} string "the segment is active, its fraction is changed by /api/update_segment_fraction"
 //	@Failure		500	{string} string "something went wrong"
 //	@Router			/api/create_segment [post]
 func (sh *SegmentsHandler) AddSegment(w http.ResponseWriter, r *http.Request) {
@@ -46,22 +57,43 @@ func (sh *SegmentsHandler) AddSegment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = sh.SegmentsRepo.InsertSegment(r.Context(), f.SegmentSlug)
+	outcome, err := sh.SegmentsRepo.InsertSegment(r.Context(), &segment.Segment{
+		Slug:        f.SegmentSlug,
+		Description: f.Description,
+		Owner:       f.Owner,
+		Tags:        f.Tags,
+		Bucketing:   f.Bucketing,
+		Salt:        f.Salt,
+		Fraction:    f.Fraction,
+		StartsAt:    f.StartsAt,
+		EndsAt:      f.EndsAt,
+	})
 	if err != nil {
 		sh.ErrLog.Printf("%s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(statusFromError(err))
 		return
 	}
 
-	if f.Fraction != 0 {
-		err = sh.SegmentsRepo.AutoAssignSegment(r.Context(), f.Fraction, f.SegmentSlug, 0)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	// an active segment is never created again with a fraction, so only a new or a revived one is assigned
+	if f.Fraction == 0 || outcome == segment.InsertUnchanged {
+		w.WriteHeader(http.StatusCreated)
+		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	j, err := sh.JobsRepo.Create(r.Context(), job.KindAutoAssign, &segment.FractionChange{
+		SegmentSlug: f.SegmentSlug,
+		Fraction:    f.Fraction,
+	})
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = writeJSON(w, http.StatusAccepted, j)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
 }
 
 // DeleteSegment godoc
@@ -73,6 +105,7 @@ func (sh *SegmentsHandler) AddSegment(w http.ResponseWriter, r *http.Request) {
 //	@Param 			request		body 	segment.RequestSegmentSlug true "The input struct"
 //	@Success		200	{string} string "deleted"
 //	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "segment not found"
 //	@Failure		500	{string} string "something went wrong"
 //	@Router			/api/delete_segment [delete]
 func (sh *SegmentsHandler) DeleteSegment(w http.ResponseWriter, r *http.Request) {
@@ -88,22 +121,411 @@ func (sh *SegmentsHandler) DeleteSegment(w http.ResponseWriter, r *http.Request)
 	err = sh.SegmentsRepo.DeleteSegment(r.Context(), f.SegmentSlug)
 	if err != nil {
 		sh.ErrLog.Printf("%s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(statusFromError(err))
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// UpdateSegment godoc
+//
+//	@Summary		updates segment metadata
+//	@Description	updates description, owner, tags and activation window of a segment, omitted fields are left unchanged.
+//	@Description	clear_window removes the window, starts_at and ends_at of the same request set a new one
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	segment.SegmentPatch true "The input struct"
+//	@Success		200	{object} segment.Segment
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "segment not found"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/update_segment [patch]
+func (sh *SegmentsHandler) UpdateSegment(w http.ResponseWriter, r *http.Request) {
+	patch := &segment.SegmentPatch{}
+
+	err := errors.ValidateAndParseJSON(r, patch)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	seg, err := sh.SegmentsRepo.UpdateSegment(r.Context(), patch)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	err = writeJSON(w, http.StatusOK, seg)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
+}
+
+// GetSegmentRollout godoc
+//
+//	@Summary		receive the rollout of a segment
+//	@Description	compares the share of active users in a segment with its target fraction
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	segment.RequestSegmentSlug true "fraction is ignored"
+//	@Success		200	{object} segment.Rollout
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "segment not found"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/get_segment_rollout [get]
+func (sh *SegmentsHandler) GetSegmentRollout(w http.ResponseWriter, r *http.Request) {
+	f := &segment.Template{}
+
+	err := errors.ValidateAndParseJSON(r, f)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rollout, err := sh.SegmentsRepo.GetRollout(r.Context(), f.SegmentSlug)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	err = writeJSON(w, http.StatusOK, rollout)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
+}
+
+// ReconcileSegments godoc
+//
+//	@Summary		reconciles fraction segments
+//	@Description	includes users activated since the rollout of every fraction segment right away, without waiting
+//	@Description	for the background reconciler, and reports the resulting shares
+//	@Tags         	Segments
+//	@Produce		json
+//	@Success		200	{array} segment.Rollout
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/reconcile_segments [post]
+func (sh *SegmentsHandler) ReconcileSegments(w http.ResponseWriter, r *http.Request) {
+	rollouts, err := sh.SegmentsRepo.ReconcileSegments(r.Context())
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	err = writeJSON(w, http.StatusOK, rollouts)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
+}
+
+// UpdateSegmentFraction godoc
+//
+//	@Summary		changes the fraction of a segment
+//	@Description	raises or lowers the target fraction of an active segment in a set_fraction job, the result of the job is
+//	@Description	segment.Rollout. Hash segments change exactly the users whose buckets cross the fraction, random segments
+//	@Description	get random users or lose the most recently assigned ones
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	segment.FractionChange true "fraction from 0 to 100"
+//	@Success		202	{object} job.Job
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "segment not found"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/update_segment_fraction [patch]
+func (sh *SegmentsHandler) UpdateSegmentFraction(w http.ResponseWriter, r *http.Request) {
+	change := &segment.FractionChange{}
+
+	err := errors.ValidateAndParseJSON(r, change)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = change.Validate()
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	seg, err := sh.SegmentsRepo.GetSegment(r.Context(), change.SegmentSlug)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+	if !seg.IsActive {
+		sh.ErrLog.Printf("segment %s is deleted", change.SegmentSlug)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	j, err := sh.JobsRepo.Create(r.Context(), job.KindSetFraction, change)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = writeJSON(w, http.StatusAccepted, j)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
+}
+
+// UpdateMembershipExpiry godoc
+//
+//	@Summary		changes the expiry of memberships
+//	@Description	sets, extends, shortens or clears the expiry of the active memberships of a segment,
+//	@Description	of one user when user_id is given. Durations are ISO-8601, e.g. PT12H or P1W
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	segment.ExpiryChange true "exactly one of expires_at, expires_in, extend_by, shorten_by and clear"
+//	@Success		200	{object} segment.ExpiryResult
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "segment or membership not found"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/update_membership_expiry [patch]
+func (sh *SegmentsHandler) UpdateMembershipExpiry(w http.ResponseWriter, r *http.Request) {
+	change := &segment.ExpiryChange{}
+
+	err := errors.ValidateAndParseJSON(r, change)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := sh.SegmentsRepo.UpdateExpiry(r.Context(), change)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	err = writeJSON(w, http.StatusOK, result)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
+}
+
+// ScheduleSegmentRamp godoc
+//
+//	@Summary		schedules a segment ramp
+//	@Description	replaces the pending steps of a segment ramp, each step sets the fraction at its time.
+//	@Description	An empty list of steps cancels the ramp
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	segment.RampSchedule true "applied_at of the steps is ignored"
+//	@Success		200	{object} segment.RampSchedule
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "segment not found"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/schedule_segment_ramp [post]
+func (sh *SegmentsHandler) ScheduleSegmentRamp(w http.ResponseWriter, r *http.Request) {
+	schedule := &segment.RampSchedule{}
+
+	err := errors.ValidateAndParseJSON(r, schedule)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	schedule, err = sh.SegmentsRepo.ScheduleRamp(r.Context(), schedule)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	err = writeJSON(w, http.StatusOK, schedule)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
+}
+
+// GetSegmentRamp godoc
+//
+//	@Summary		receive the ramp of a segment
+//	@Description	receive applied and pending steps of a segment ramp ordered by time
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	segment.RequestSegmentSlug true "fraction is ignored"
+//	@Success		200	{object} segment.RampSchedule
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "segment not found"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/get_segment_ramp [get]
+func (sh *SegmentsHandler) GetSegmentRamp(w http.ResponseWriter, r *http.Request) {
+	f := &segment.Template{}
+
+	err := errors.ValidateAndParseJSON(r, f)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	schedule, err := sh.SegmentsRepo.GetRamp(r.Context(), f.SegmentSlug)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	err = writeJSON(w, http.StatusOK, schedule)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
+}
+
+// GetSegment godoc
+//
+//	@Summary		receive a segment
+//	@Description	receive metadata of a segment, active or deleted, with the number of its active members
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	segment.RequestSegmentSlug true "fraction is ignored"
+//	@Success		200	{object} segment.Segment
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "segment not found"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/get_segment [get]
+func (sh *SegmentsHandler) GetSegment(w http.ResponseWriter, r *http.Request) {
+	f := &segment.Template{}
+
+	err := errors.ValidateAndParseJSON(r, f)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	seg, err := sh.SegmentsRepo.GetSegment(r.Context(), f.SegmentSlug)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	err = writeJSON(w, http.StatusOK, seg)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
+}
+
+// ListSegments godoc
+//
+//	@Summary		list segments
+//	@Description	list segments ordered by creation, filtered by status (active, deleted or all), tag, owner
+//	@Description	and slug prefix. Pass next_cursor of a page as cursor to receive the following one
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	segment.SegmentFilter false "every field is optional"
+//	@Success		200	{object} segment.SegmentPage
+//	@Failure		400	{string} string "bad input"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/list_segments [get]
+func (sh *SegmentsHandler) ListSegments(w http.ResponseWriter, r *http.Request) {
+	filter := &segment.SegmentFilter{}
+
+	err := errors.ValidateAndParseJSON(r, filter)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	page, err := sh.SegmentsRepo.ListSegments(r.Context(), filter)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	err = writeJSON(w, http.StatusOK, page)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
+}
+
+// GetSegmentMembers godoc
+//
+//	@Summary		receive users of a segment
+//	@Description	receive a page of the users in a segment ordered by user id, either now or at the as_of instant (RFC3339).
+//	@Description	include_dates adds date_assigned and expires_at of every membership. Pass next_cursor of a page
+//	@Description	as cursor to receive the following one
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	segment.MembersQuery true "everything but segment_slug is optional"
+//	@Success		200	{object} segment.MembersPage
+//	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "segment not found"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/get_segment_members [get]
+func (sh *SegmentsHandler) GetSegmentMembers(w http.ResponseWriter, r *http.Request) {
+	q := &segment.MembersQuery{}
+
+	err := errors.ValidateAndParseJSON(r, q)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// members are written as they are read, the response starts with the first one
+	stream := newJSONArrayStream(w, `{"segment_slug":`+strconv.Quote(q.SegmentSlug)+`,"members":`)
+
+	nextCursor, err := sh.SegmentsRepo.StreamSegmentMembers(r.Context(), q, func(m *segment.Member) error {
+		return stream.Write(m)
+	})
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		if !stream.Started() {
+			w.WriteHeader(statusFromError(err))
+		}
+		return
+	}
+
+	suffix := "}"
+	if nextCursor != "" {
+		suffix = `,"next_cursor":` + strconv.Quote(nextCursor) + "}"
+	}
+
+	err = stream.Close(suffix)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
+}
+
 // UpdateUserSegments godoc
 //
 //	@Summary		assign and unassign segments from user
-//	@Description	assign and unassign segments from user
+//	@Description	assign and unassign segments from user in one transaction and report the outcome for every segment:
+//	@Description	assigned, already_member, unassigned, not_member, unknown_segment or inactive_segment
 //	@Tags         	Segments
 //	@Accept			json
-//	@Param 			request		body 	segment.RequestUpdateSegments true "The input struct"
-//	@Success		200	{string} string "assigned and unassigned"
+//	@Produce		json
+//	@Param 			request		body 	segment.RequestUpdateSegments true "at most one of ttl in days, expires_at and ISO-8601 expires_in"
+//	@Success		200	{object} segment.UpdateSegmentsResult
 //	@Failure		400	{string} string "bad input"
+//	@Failure		404	{string} string "user not found"
 //	@Failure		500	{string} string "something went wrong"
 //	@Router			/api/update_user_segments [post]
 func (sh *SegmentsHandler) UpdateUserSegments(w http.ResponseWriter, r *http.Request) {
@@ -116,27 +538,83 @@ func (sh *SegmentsHandler) UpdateUserSegments(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = sh.SegmentsRepo.AssignSegments(r.Context(), []int{f.UserID}, f.AssignSegments, f.TTL)
+	expiresAt, err := segment.MembershipExpiry(time.Now(), f.TTL, f.ExpiresAt, f.ExpiresIn)
 	if err != nil {
 		sh.ErrLog.Printf("%s", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err = sh.SegmentsRepo.UnassignSegments(r.Context(), []int{f.UserID}, f.UnassignSegments)
+	result, err := sh.SegmentsRepo.UpdateUserSegments(r.Context(), f.UserID, f.AssignSegments, f.UnassignSegments, expiresAt)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(statusFromError(err))
+		return
+	}
+
+	resp, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(resp)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// BulkUpdateUserSegments godoc
+//
+//	@Summary		assign and unassign segments of many users
+//	@Description	apply update_user_segments to every user of the list. all_or_nothing (default) applies the whole list
+//	@Description	in one transaction or nothing, best_effort applies every user on its own and reports the failed ones.
+//	@Description	A failed all_or_nothing update responds with the status of the error and the per-user result
+//	@Tags         	Segments
+//	@Accept			json
+//	@Produce		json
+//	@Param 			request		body 	segment.RequestBulkUpdate true "users to update, at most segment.bulk_max_users"
+//	@Success		200	{object} segment.BulkUpdateResult
+//	@Failure		400	{object} segment.BulkUpdateResult "bad input"
+//	@Failure		404	{object} segment.BulkUpdateResult "user not found"
+//	@Failure		413	{string} string "too many users"
+//	@Failure		500	{string} string "something went wrong"
+//	@Router			/api/bulk_update_user_segments [post]
+func (sh *SegmentsHandler) BulkUpdateUserSegments(w http.ResponseWriter, r *http.Request) {
+	req := &segment.RequestBulkUpdate{}
+
+	err := errors.ValidateAndParseJSON(r, req)
 	if err != nil {
 		sh.ErrLog.Printf("%s", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	result, err := sh.SegmentsRepo.BulkUpdateUserSegments(r.Context(), req)
+	status := http.StatusOK
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+		status = statusFromError(err)
+		if result == nil {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	err = writeJSON(w, status, result)
+	if err != nil {
+		sh.ErrLog.Printf("%s", err)
+	}
 }
 
 // GetUserSegments godoc
 //
 //	@Summary		receive segments assigned to user
-//	@Description	receive segments assigned to user
+//	@Description	receive segments assigned to user. With as_of (RFC3339, not in the future) the segments are
+//	@Description	reconstructed at that moment from the stored memberships, skipping segments that did not exist
+//	@Description	or were outside their window then
 //	@Tags         	Segments
 //	@Accept			json
 //	@Produce		json
@@ -146,19 +624,19 @@ func (sh *SegmentsHandler) UpdateUserSegments(w http.ResponseWriter, r *http.Req
 //	@Failure		500	{string} string "something went wrong"
 //	@Router			/api/get_user_segments [get]
 func (sh *SegmentsHandler) GetUserSegments(w http.ResponseWriter, r *http.Request) {
-	receivedUserID := &segment.Template{}
+	req := &segment.RequestUserID{}
 
-	err := errors.ValidateAndParseJSON(r, receivedUserID)
+	err := errors.ValidateAndParseJSON(r, req)
 	if err != nil {
 		sh.ErrLog.Printf("%s", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	userSegments, err := sh.SegmentsRepo.GetUserSegments(r.Context(), receivedUserID.UserID)
+	userSegments, err := sh.SegmentsRepo.GetUserSegments(r.Context(), req.UserID, req.AsOf)
 	if err != nil {
 		sh.ErrLog.Printf("%s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(statusFromError(err))
 		return
 	}
 
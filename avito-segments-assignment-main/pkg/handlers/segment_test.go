@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+	"usersegmentator/pkg/bucket"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/segment"
+)
+
+func TestCreateSegmentQueuesAutoAssign(t *testing.T) {
+	s := newTestService(t)
+
+	created := &job.Job{}
+	decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+		&segment.RequestCreateSegment{SegmentSlug: "AVITO_VOICE_MESSAGES", Fraction: 30}), http.StatusAccepted, created)
+	if created.Kind != job.KindAutoAssign || created.Status != job.StatusQueued {
+		t.Errorf("job %s is %s, want a queued %s job", created.ID, created.Kind, job.KindAutoAssign)
+	}
+
+	change := &segment.FractionChange{}
+	err := json.Unmarshal(created.Params, change)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.SegmentSlug != "AVITO_VOICE_MESSAGES" || change.Fraction != 30 {
+		t.Errorf("job params = %s", created.Params)
+	}
+
+	// the users are assigned by the job, not by the request
+	rollout := &segment.Rollout{}
+	decode(t, call(t, s.segments.GetSegmentRollout, http.MethodGet, "",
+		&segment.Template{SegmentSlug: "AVITO_VOICE_MESSAGES"}), http.StatusOK, rollout)
+	if rollout.Members != 0 {
+		t.Errorf("members = %d before the job ran, want 0", rollout.Members)
+	}
+
+	decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+		&segment.RequestCreateSegment{SegmentSlug: "AVITO_DISCOUNT_30"}), http.StatusCreated, nil)
+}
+
+func TestCreateActiveSegmentAgain(t *testing.T) {
+	s := newTestService(t)
+
+	decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+		&segment.RequestCreateSegment{SegmentSlug: "AVITO_VOICE_MESSAGES", Fraction: 30}), http.StatusAccepted, nil)
+
+	// the fraction of an active segment is changed by update_segment_fraction, not by creating it again
+	decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+		&segment.RequestCreateSegment{SegmentSlug: "AVITO_VOICE_MESSAGES", Fraction: 50}), http.StatusConflict, nil)
+	decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice", &segment.RequestCreateSegment{
+		SegmentSlug: "AVITO_VOICE_MESSAGES",
+		Description: "voice messages in chats",
+	}), http.StatusCreated, nil)
+
+	seg := &segment.Segment{}
+	decode(t, call(t, s.segments.GetSegment, http.MethodGet, "",
+		&segment.Template{SegmentSlug: "AVITO_VOICE_MESSAGES"}), http.StatusOK, seg)
+	if seg.Fraction != 30 || seg.Description != "voice messages in chats" {
+		t.Errorf("segment = %+v, want fraction 30 and the new description", seg)
+	}
+
+	// a deleted segment is revived with the fraction of the request
+	decode(t, call(t, s.segments.DeleteSegment, http.MethodDelete, "alice",
+		&segment.Template{SegmentSlug: "AVITO_VOICE_MESSAGES"}), http.StatusOK, nil)
+	revived := &job.Job{}
+	decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+		&segment.RequestCreateSegment{SegmentSlug: "AVITO_VOICE_MESSAGES", Fraction: 50}), http.StatusAccepted, revived)
+	if revived.Kind != job.KindAutoAssign {
+		t.Errorf("kind = %s, want %s", revived.Kind, job.KindAutoAssign)
+	}
+}
+
+func TestAutoAssignSegment(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+		&segment.RequestCreateSegment{SegmentSlug: "AVITO_VOICE_MESSAGES"}), http.StatusCreated, nil)
+
+	for _, fraction := range []int{0, 101} {
+		err := s.segmentsRepo.AutoAssignSegment(ctx, fraction, "AVITO_VOICE_MESSAGES", nil)
+		if err == nil {
+			t.Errorf("fraction %d is accepted", fraction)
+		}
+	}
+
+	err := s.segmentsRepo.AutoAssignSegment(ctx, 30, "AVITO_VOICE_MESSAGES", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rollout := &segment.Rollout{}
+	decode(t, call(t, s.segments.GetSegmentRollout, http.MethodGet, "",
+		&segment.Template{SegmentSlug: "AVITO_VOICE_MESSAGES"}), http.StatusOK, rollout)
+	// 30% of 10 users
+	if rollout.Members != 3 || rollout.ActiveUsers != len(testUsers) {
+		t.Errorf("rollout = %d of %d users, want 3 of %d", rollout.Members, rollout.ActiveUsers, len(testUsers))
+	}
+
+	members := 0
+	for _, id := range testUsers {
+		userSegments := &segment.UserSegments{}
+		decode(t, call(t, s.segments.GetUserSegments, http.MethodGet, "",
+			&segment.RequestUserID{UserID: id}), http.StatusOK, userSegments)
+		for _, slug := range userSegments.Segments {
+			if slug == "AVITO_VOICE_MESSAGES" {
+				members++
+			}
+		}
+	}
+	if members != 3 {
+		t.Errorf("get_user_segments reports %d members, want 3", members)
+	}
+
+	err = s.segmentsRepo.AutoAssignSegment(ctx, 30, "AVITO_UNKNOWN", nil)
+	if statusFromError(err) != http.StatusNotFound {
+		t.Errorf("err = %v for an unknown segment, want segment not found", err)
+	}
+}
+
+func TestUserSegmentsHashBucket(t *testing.T) {
+	s := newTestService(t)
+
+	// the auto_assign job never runs here, so no user has a relation with the segment
+	decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice", &segment.RequestCreateSegment{
+		SegmentSlug: "AVITO_NEW_CHECKOUT",
+		Fraction:    50,
+		Bucketing:   segment.BucketingHash,
+		Salt:        "checkout-2023-09",
+	}), http.StatusAccepted, nil)
+
+	inSegment := func(id int) bool {
+		userSegments := &segment.UserSegments{}
+		decode(t, call(t, s.segments.GetUserSegments, http.MethodGet, "",
+			&segment.RequestUserID{UserID: id}), http.StatusOK, userSegments)
+		for _, slug := range userSegments.Segments {
+			if slug == "AVITO_NEW_CHECKOUT" {
+				return true
+			}
+		}
+		return false
+	}
+
+	members := []int{}
+	for _, id := range testUsers {
+		want := bucket.Includes("checkout-2023-09", id, 50)
+		if got := inSegment(id); got != want {
+			t.Errorf("user %d in the segment = %t, want %t by the bucket", id, got, want)
+		}
+		if want {
+			members = append(members, id)
+		}
+	}
+	if len(members) == 0 {
+		t.Fatal("no test user falls into the bucket")
+	}
+
+	// once the user has a relation the bucket no longer applies, a membership unassigned by hand stays closed
+	decode(t, call(t, s.segments.UpdateUserSegments, http.MethodPost, "alice", &segment.Template{
+		UserID:         members[0],
+		AssignSegments: []string{"AVITO_NEW_CHECKOUT"},
+	}), http.StatusOK, nil)
+	decode(t, call(t, s.segments.UpdateUserSegments, http.MethodPost, "alice", &segment.Template{
+		UserID:           members[0],
+		UnassignSegments: []string{"AVITO_NEW_CHECKOUT"},
+	}), http.StatusOK, nil)
+	if inSegment(members[0]) {
+		t.Errorf("user %d unassigned by hand is still in the segment", members[0])
+	}
+}
+
+func TestUserSegmentsAsOf(t *testing.T) {
+	s := newTestService(t)
+
+	for _, slug := range []string{"AVITO_VOICE_MESSAGES", "AVITO_PERFORMANCE_VAS"} {
+		decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+			&segment.RequestCreateSegment{SegmentSlug: slug}), http.StatusCreated, nil)
+	}
+
+	expiresAt := time.Now().UTC().Truncate(time.Second).Add(2 * time.Second)
+	decode(t, call(t, s.segments.UpdateUserSegments, http.MethodPost, "alice", &segment.Template{
+		UserID:         1000,
+		AssignSegments: []string{"AVITO_VOICE_MESSAGES"},
+		ExpiresAt:      &expiresAt,
+	}), http.StatusOK, nil)
+	decode(t, call(t, s.segments.UpdateUserSegments, http.MethodPost, "alice", &segment.Template{
+		UserID:         1000,
+		AssignSegments: []string{"AVITO_PERFORMANCE_VAS"},
+	}), http.StatusOK, nil)
+
+	segmentsAsOf := func(asOf time.Time) []string {
+		userSegments := &segment.UserSegments{}
+		decode(t, call(t, s.segments.GetUserSegments, http.MethodGet, "",
+			&segment.RequestUserID{UserID: 1000, AsOf: &asOf}), http.StatusOK, userSegments)
+		return userSegments.Segments
+	}
+
+	// as_of can't be in the future, so the expiry has to pass on the wall clock before it is read back,
+	// the sweep itself is covered with an injected time by the segment package
+	time.Sleep(time.Until(expiresAt))
+
+	if got := segmentsAsOf(expiresAt.Add(-time.Second)); len(got) != 2 {
+		t.Errorf("segments before the expiry = %v, want both", got)
+	}
+	got := segmentsAsOf(expiresAt)
+	if len(got) != 1 || got[0] != "AVITO_PERFORMANCE_VAS" {
+		t.Errorf("segments at the expiry = %v, want [AVITO_PERFORMANCE_VAS]", got)
+	}
+
+	future := time.Now().Add(time.Hour)
+	decode(t, call(t, s.segments.GetUserSegments, http.MethodGet, "",
+		&segment.RequestUserID{UserID: 1000, AsOf: &future}), http.StatusBadRequest, nil)
+}
+
+func TestUpdateUserSegmentsExpiryOptions(t *testing.T) {
+	s := newTestService(t)
+	decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+		&segment.RequestCreateSegment{SegmentSlug: "AVITO_VOICE_MESSAGES"}), http.StatusCreated, nil)
+
+	expiresAt := time.Now().Add(time.Hour)
+	tests := []struct {
+		name   string
+		req    *segment.Template
+		status int
+	}{
+		{"ttl and expires_at", &segment.Template{UserID: 1000, AssignSegments: []string{"AVITO_VOICE_MESSAGES"},
+			TTL: 1, ExpiresAt: &expiresAt}, http.StatusBadRequest},
+		{"not an ISO-8601 duration", &segment.Template{UserID: 1000, AssignSegments: []string{"AVITO_VOICE_MESSAGES"},
+			ExpiresIn: "1 day"}, http.StatusBadRequest},
+		{"unknown user", &segment.Template{UserID: 1, AssignSegments: []string{"AVITO_VOICE_MESSAGES"},
+			ExpiresIn: "P1D"}, http.StatusNotFound},
+		{"expires_in", &segment.Template{UserID: 1000, AssignSegments: []string{"AVITO_VOICE_MESSAGES"},
+			ExpiresIn: "P1D"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decode(t, call(t, s.segments.UpdateUserSegments, http.MethodPost, "alice", tt.req), tt.status, nil)
+		})
+	}
+}
+
+func TestBulkUpdateUserSegments(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		invalid *segment.RequestUpdateSegments
+		status  int
+		members []int
+	}{
+		{"all_or_nothing with an unknown user", segment.BulkAllOrNothing,
+			&segment.RequestUpdateSegments{UserID: 1, AssignSegments: []string{"AVITO_VOICE_MESSAGES"}},
+			http.StatusNotFound, nil},
+		{"all_or_nothing with an invalid expiry", segment.BulkAllOrNothing,
+			&segment.RequestUpdateSegments{UserID: 1002, AssignSegments: []string{"AVITO_VOICE_MESSAGES"}, ExpiresIn: "1 day"},
+			http.StatusBadRequest, nil},
+		{"best_effort with an unknown user", segment.BulkBestEffort,
+			&segment.RequestUpdateSegments{UserID: 1, AssignSegments: []string{"AVITO_VOICE_MESSAGES"}},
+			http.StatusOK, []int{1000, 1001}},
+		{"best_effort with an invalid expiry", segment.BulkBestEffort,
+			&segment.RequestUpdateSegments{UserID: 1002, AssignSegments: []string{"AVITO_VOICE_MESSAGES"}, ExpiresIn: "1 day"},
+			http.StatusOK, []int{1000, 1001}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			decode(t, call(t, s.segments.AddSegment, http.MethodPost, "alice",
+				&segment.RequestCreateSegment{SegmentSlug: "AVITO_VOICE_MESSAGES"}), http.StatusCreated, nil)
+
+			// the invalid user sits between two valid ones
+			result := &segment.BulkUpdateResult{}
+			decode(t, call(t, s.segments.BulkUpdateUserSegments, http.MethodPost, "alice", &segment.RequestBulkUpdate{
+				Mode: tt.mode,
+				Users: []*segment.RequestUpdateSegments{
+					{UserID: 1000, AssignSegments: []string{"AVITO_VOICE_MESSAGES"}},
+					tt.invalid,
+					{UserID: 1001, AssignSegments: []string{"AVITO_VOICE_MESSAGES"}},
+				},
+			}), tt.status, result)
+
+			if result.Mode != tt.mode || len(result.Users) != 3 || result.Failed != 1 ||
+				result.Applied != len(tt.members) {
+				t.Fatalf("result = %+v, want 1 failed and %d applied users", result, len(tt.members))
+			}
+			if result.Users[1].UserID != tt.invalid.UserID || result.Users[1].Error == "" {
+				t.Errorf("invalid user = %+v, want its error", result.Users[1])
+			}
+			for _, i := range []int{0, 2} {
+				user := result.Users[i]
+				applied := len(user.Results) == 1 && user.Results[0].Result == segment.OutcomeAssigned
+				if user.Error != "" || applied != (tt.mode == segment.BulkBestEffort) {
+					t.Errorf("user %d = %+v", user.UserID, user)
+				}
+			}
+
+			rollout := &segment.Rollout{}
+			decode(t, call(t, s.segments.GetSegmentRollout, http.MethodGet, "",
+				&segment.Template{SegmentSlug: "AVITO_VOICE_MESSAGES"}), http.StatusOK, rollout)
+			if rollout.Members != len(tt.members) {
+				t.Errorf("%d members, want %v", rollout.Members, tt.members)
+			}
+		})
+	}
+}
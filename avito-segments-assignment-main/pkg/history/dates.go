@@ -0,0 +1,144 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidDates = errors.New("invalid report dates")
+
+const (
+	dateFormatDay = "2006-01-02"
+
+	// maxRelativeAmount bounds the N of "last N days", far beyond any stored history.
+	maxRelativeAmount = 10000
+)
+
+var (
+	monthPattern    = regexp.MustCompile(`^\d{4}-\d{1,2}$`)
+	relativePattern = regexp.MustCompile(`^last\s+(?:(\d+)\s+)?(hour|day|week|month)s?$`)
+)
+
+// parseDates resolves the report period of the request. The period is either a relative range like "last 7 days",
+// ending now, or start_date and end_date, each an RFC3339 timestamp, a plain date or a month. Plain dates and months
+// are taken in the timezone of the request and cover the whole day or month, so an end_date of "2023-08" or
+// "2023-08-31" includes August 31. RFC3339 timestamps are exact, the end is excluded.
+func parseDates(req *Request, now time.Time) (*DatesRange, error) {
+	loc := time.UTC
+	if req.Timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(req.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unknown timezone %q", ErrInvalidDates, req.Timezone)
+		}
+	}
+
+	dates := &DatesRange{Location: loc}
+	if req.Range != "" {
+		if req.StartDate != "" || req.EndDate != "" {
+			return nil, fmt.Errorf("%w: range can't be combined with start_date and end_date", ErrInvalidDates)
+		}
+
+		var err error
+		dates.StartDate, err = relativeStart(strings.ToLower(strings.TrimSpace(req.Range)), now.In(loc))
+		if err != nil {
+			return nil, err
+		}
+		dates.EndDate = now
+		return dates, nil
+	}
+
+	var err error
+	dates.StartDate, err = parseDate(req.StartDate, loc, false)
+	if err != nil {
+		return nil, fmt.Errorf("start_date: %w", err)
+	}
+	dates.EndDate, err = parseDate(req.EndDate, loc, true)
+	if err != nil {
+		return nil, fmt.Errorf("end_date: %w", err)
+	}
+
+	if !dates.StartDate.Before(dates.EndDate) {
+		return nil, fmt.Errorf("%w: start_date must be before end_date", ErrInvalidDates)
+	}
+	return dates, nil
+}
+
+// Resolve replaces the period of the request with the exact bounds of dates. A report job runs some time after
+// it is requested, a relative range resolved then would cover a different period than the one asked for.
+func (r *Request) Resolve(dates *DatesRange) {
+	r.Range = ""
+	r.StartDate = dates.StartDate.UTC().Format(time.RFC3339Nano)
+	r.EndDate = dates.EndDate.UTC().Format(time.RFC3339Nano)
+}
+
+// parseDate parses a bound of the period. The end of a plain date or a month is the start of the next one.
+func parseDate(value string, loc *time.Location, end bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "":
+		return time.Time{}, fmt.Errorf("%w: the date is required", ErrInvalidDates)
+	case monthPattern.MatchString(value):
+		layout := dateFormatShortMonth
+		if len(value) == len(dateFormatFullMonth) {
+			layout = dateFormatFullMonth
+		}
+		t, err := time.ParseInLocation(layout, value, loc)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: %s", ErrInvalidDates, err)
+		}
+		if end {
+			t = t.AddDate(0, 1, 0)
+		}
+		return t, nil
+	case len(value) == len(dateFormatDay):
+		t, err := time.ParseInLocation(dateFormatDay, value, loc)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: %s", ErrInvalidDates, err)
+		}
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf(
+			"%w: %q is not an RFC3339 timestamp, a yyyy-mm-dd date or a yyyy-mm month", ErrInvalidDates, value)
+	}
+	return t, nil
+}
+
+// relativeStart returns the start of a "last N hours|days|weeks|months" range ending at now, N defaults to 1.
+func relativeStart(value string, now time.Time) (time.Time, error) {
+	match := relativePattern.FindStringSubmatch(value)
+	if match == nil {
+		return time.Time{}, fmt.Errorf(
+			`%w: range %q is not like "last 7 days", expected hours, days, weeks or months`, ErrInvalidDates, value)
+	}
+
+	n := 1
+	if match[1] != "" {
+		var err error
+		n, err = strconv.Atoi(match[1])
+		if err != nil || n < 1 || n > maxRelativeAmount {
+			return time.Time{}, fmt.Errorf("%w: range amount must be from 1 to %d", ErrInvalidDates, maxRelativeAmount)
+		}
+	}
+
+	switch match[2] {
+	case "hour":
+		return now.Add(-time.Duration(n) * time.Hour), nil
+	case "day":
+		return now.AddDate(0, 0, -n), nil
+	case "week":
+		return now.AddDate(0, 0, -7*n), nil //nolint:gomnd // days in a week
+	default:
+		return now.AddDate(0, -n, 0), nil
+	}
+}
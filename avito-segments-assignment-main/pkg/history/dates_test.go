@@ -0,0 +1,119 @@
+package history
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseDates(t *testing.T) {
+	now := time.Date(2023, 9, 15, 12, 30, 0, 0, time.UTC)
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name  string
+		req   *Request
+		start time.Time
+		end   time.Time
+	}{
+		{"months of the old API cover the end month", &Request{StartDate: "2023-08", EndDate: "2023-08"},
+			utc(2023, 8, 1, 0), utc(2023, 9, 1, 0)},
+		{"month range", &Request{StartDate: "2023-07", EndDate: "2023-08"},
+			utc(2023, 7, 1, 0), utc(2023, 9, 1, 0)},
+		{"legacy yyyy-m month", &Request{StartDate: "2023-8", EndDate: "2023-9"},
+			utc(2023, 8, 1, 0), utc(2023, 10, 1, 0)},
+		{"month across the new year", &Request{StartDate: "2023-12", EndDate: "2023-12"},
+			utc(2023, 12, 1, 0), utc(2024, 1, 1, 0)},
+		{"plain dates cover the end day", &Request{StartDate: "2023-08-01", EndDate: "2023-08-31"},
+			utc(2023, 8, 1, 0), utc(2023, 9, 1, 0)},
+		{"single day", &Request{StartDate: "2023-08-31", EndDate: "2023-08-31"},
+			utc(2023, 8, 31, 0), utc(2023, 9, 1, 0)},
+		{"RFC3339 end is exact", &Request{StartDate: "2023-08-01T10:00:00Z", EndDate: "2023-08-01T12:00:00Z"},
+			utc(2023, 8, 1, 10), utc(2023, 8, 1, 12)},
+		{"RFC3339 with an offset", &Request{StartDate: "2023-08-01T13:00:00+03:00", EndDate: "2023-08-02"},
+			utc(2023, 8, 1, 10), utc(2023, 8, 3, 0)},
+		{"plain dates in the timezone", &Request{StartDate: "2023-08-01", EndDate: "2023-08-01", Timezone: "Europe/Moscow"},
+			utc(2023, 7, 31, 21), utc(2023, 8, 1, 21)},
+		{"spaces around the dates", &Request{StartDate: " 2023-08 ", EndDate: " 2023-08-31 "},
+			utc(2023, 8, 1, 0), utc(2023, 9, 1, 0)},
+		{"last hour", &Request{Range: "last hour"}, now.Add(-time.Hour), now},
+		{"last 7 days", &Request{Range: "last 7 days"}, now.AddDate(0, 0, -7), now},
+		{"last 2 weeks", &Request{Range: "last 2 weeks"}, now.AddDate(0, 0, -14), now},
+		{"last 3 months", &Request{Range: " Last 3 Months "}, now.AddDate(0, -3, 0), now},
+		{"last day in the timezone", &Request{Range: "last 1 day", Timezone: "Europe/Moscow"},
+			now.In(moscow).AddDate(0, 0, -1), now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dates, err := parseDates(tt.req, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !dates.StartDate.Equal(tt.start) || !dates.EndDate.Equal(tt.end) {
+				t.Errorf("period %s – %s, want %s – %s", dates.StartDate, dates.EndDate, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestParseDatesInvalid(t *testing.T) {
+	now := time.Date(2023, 9, 15, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		req  *Request
+	}{
+		{"empty", &Request{}},
+		{"no start", &Request{EndDate: "2023-08"}},
+		{"no end", &Request{StartDate: "2023-08"}},
+		{"reversed months", &Request{StartDate: "2023-09", EndDate: "2023-08"}},
+		{"reversed dates", &Request{StartDate: "2023-08-02", EndDate: "2023-08-01"}},
+		{"empty RFC3339 period", &Request{StartDate: "2023-08-01T10:00:00Z", EndDate: "2023-08-01T10:00:00Z"}},
+		{"month 13", &Request{StartDate: "2023-13", EndDate: "2023-13"}},
+		{"day 32", &Request{StartDate: "2023-08-32", EndDate: "2023-08-32"}},
+		{"not a date", &Request{StartDate: "yesterday", EndDate: "2023-08"}},
+		{"range and dates", &Request{Range: "last 1 day", StartDate: "2023-08"}},
+		{"unknown range unit", &Request{Range: "last 2 years"}},
+		{"not a range", &Request{Range: "since august"}},
+		{"zero range", &Request{Range: "last 0 days"}},
+		{"range too long", &Request{Range: "last 10001 days"}},
+		{"unknown timezone", &Request{Range: "last 1 day", Timezone: "Mars/Olympus"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDates(tt.req, now)
+			if !errors.Is(err, ErrInvalidDates) {
+				t.Errorf("err = %v, want %v", err, ErrInvalidDates)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	now := time.Date(2023, 9, 15, 12, 30, 0, 0, time.UTC)
+	req := &Request{Range: "last 7 days", Timezone: "Europe/Moscow"}
+
+	dates, err := parseDates(req, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Resolve(dates)
+
+	// the resolved request covers the same period whenever it is parsed again
+	again, err := parseDates(req, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Range != "" || !again.StartDate.Equal(dates.StartDate) || !again.EndDate.Equal(dates.EndDate) {
+		t.Errorf("resolved %+v to %s – %s, want %s – %s",
+			req, again.StartDate, again.EndDate, dates.StartDate, dates.EndDate)
+	}
+}
@@ -1,33 +1,177 @@
 package history
 
 import (
+	"errors"
+	"fmt"
 	"time"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/report"
 )
 
 const (
-	fileIDLength         = 10
 	dateFormatShortMonth = "2006-1"
 	dateFormatFullMonth  = "2006-01"
+
+	// maxFilterUsers bounds the user set of a report, the ids end up in a single IN (...) of the query.
+	maxFilterUsers = 10000
+)
+
+var ErrInvalidFilter = errors.New("invalid report filter")
+
+// Operations of the report rows. Each one is an audited action of a particular source.
+const (
+	OperationAssigned         = "assigned"
+	OperationUnassigned       = "unassigned"
+	OperationExpired          = "expired"
+	OperationAutoAssigned     = "auto_assigned"
+	OperationAutoUnassigned   = "auto_unassigned"
+	OperationSegmentDeleted   = "segment_deleted"
+	OperationImportAssigned   = "import_assigned"
+	OperationImportUnassigned = "import_unassigned"
+
+	// OperationExpiryChanged rows carry the new expiry of the membership, empty when it was cleared.
+	OperationExpiryChanged = "expiry_changed"
 )
 
+// operation names the report operation of an audited action. Assignments and unassignments of the manual
+// source, and of sources not known to the report, keep the plain names.
+func operation(action, source string) string {
+	switch action {
+	case audit.ActionExpiryChange:
+		return OperationExpiryChanged
+	case audit.ActionAssign:
+		switch source {
+		case audit.SourceAutoFraction:
+			return OperationAutoAssigned
+		case audit.SourceImport:
+			return OperationImportAssigned
+		}
+		return OperationAssigned
+	}
+
+	switch source {
+	case audit.SourceTTL:
+		return OperationExpired
+	case audit.SourceAutoFraction:
+		return OperationAutoUnassigned
+	case audit.SourceSegmentDelete:
+		return OperationSegmentDeleted
+	case audit.SourceImport:
+		return OperationImportUnassigned
+	}
+	return OperationUnassigned
+}
+
+// Request asks for a report of the membership changes within the dates or the relative Range. /api/get_user_history
+// reports on UserID, /api/get_history on the changes of SegmentSlug, of UserIDs or of both, and on the whole service
+// without either. Timezone is an IANA name, the dates are shown in it and plain dates and months are taken in it.
+// Format and Delimiter override the report.format and report.csv_delimiter of the config.
 type Request struct {
-	UserID    int    `json:"user_id"`
-	StartDate string `json:"start_date"`
-	EndDate   string `json:"end_date"`
+	UserID      int    `json:"user_id,omitempty"`
+	UserIDs     []int  `json:"user_ids,omitempty"`
+	SegmentSlug string `json:"segment_slug,omitempty"`
+	StartDate   string `json:"start_date,omitempty"`
+	EndDate     string `json:"end_date,omitempty"`
+	Range       string `json:"range,omitempty"`
+	Timezone    string `json:"timezone,omitempty"`
+	Format      string `json:"format,omitempty"`
+	Delimiter   string `json:"delimiter,omitempty"`
+	Async       bool   `json:"async,omitempty"`
+}
+
+// Output validates the format options of the request.
+func (r *Request) Output() (*report.Options, error) {
+	output := &report.Options{Format: r.Format, Delimiter: r.Delimiter}
+	err := output.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
 }
 
+// Filter narrows a report down to a segment, a set of users or both. An empty filter covers the whole service.
+type Filter struct {
+	SegmentSlug string
+	UserIDs     []int
+}
+
+// Filter validates the segment and the users of the request.
+func (r *Request) Filter() (*Filter, error) {
+	filter := &Filter{SegmentSlug: r.SegmentSlug}
+
+	seen := map[int]bool{}
+	for _, id := range append([]int{r.UserID}, r.UserIDs...) {
+		if id == 0 || seen[id] {
+			continue
+		}
+		if id < 0 {
+			return nil, fmt.Errorf("%w: user id %d is not positive", ErrInvalidFilter, id)
+		}
+		seen[id] = true
+		filter.UserIDs = append(filter.UserIDs, id)
+	}
+	if len(filter.UserIDs) > maxFilterUsers {
+		return nil, fmt.Errorf("%w: more than %d users", ErrInvalidFilter, maxFilterUsers)
+	}
+	return filter, nil
+}
+
+// DatesRange is the period of a report, EndDate is excluded. The report dates are shown in Location.
 type DatesRange struct {
 	StartDate time.Time
 	EndDate   time.Time
+	Location  *time.Location
 }
 
+// ReportColumns name the fields of ReportRow in the report files.
+var ReportColumns = []string{"user_id", "segment", "operation", "date", "expires_at", "source", "actor", "reason"}
+
+// ReportRow is a single audited membership change. ExpiresAt is set by assignments and expiry changes.
 type ReportRow struct {
 	UserID    int
 	Segment   string
 	Operation string
 	Date      string
+	ExpiresAt string
+	Source    string
+	Actor     string
+	Reason    string
+}
+
+// Values lists the fields of the row in the order of ReportColumns.
+func (r *ReportRow) Values() []interface{} {
+	return []interface{}{r.UserID, r.Segment, r.Operation, r.Date, r.ExpiresAt, r.Source, r.Actor, r.Reason}
+}
+
+// newReportRow formats the dates of the row as ISO-8601 timestamps in loc.
+func newReportRow(
+	userID int,
+	slug, action string,
+	origin audit.Origin,
+	expiresAt *time.Time,
+	created time.Time,
+	loc *time.Location,
+) ReportRow {
+	row := ReportRow{
+		UserID:    userID,
+		Segment:   slug,
+		Operation: operation(action, origin.Source),
+		Date:      created.In(loc).Format(time.RFC3339),
+		Source:    origin.Source,
+		Actor:     origin.Actor,
+		Reason:    origin.Reason,
+	}
+	if expiresAt != nil {
+		row.ExpiresAt = expiresAt.In(loc).Format(time.RFC3339)
+	}
+	return row
 }
 
+// ReportResponse points to a report file. The signed URL stops working at ExpiresAt, the report has to be requested
+// again after that. CsvURL repeats URL for CSV reports, as it did before the other formats.
 type ReportResponse struct {
-	CsvURL string `json:"csv_url"`
+	URL       string    `json:"url"`
+	Format    string    `json:"format"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CsvURL    string    `json:"csv_url,omitempty"`
 }
@@ -0,0 +1,102 @@
+package history
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"usersegmentator/config"
+	"usersegmentator/pkg/memstore"
+	"usersegmentator/pkg/report"
+	"usersegmentator/pkg/reportstore"
+)
+
+// memoryHistoryRepository reuses date parsing and report files of historyRepository
+// and only replaces the way relations are read.
+type memoryHistoryRepository struct {
+	*historyRepository
+	store *memstore.Store
+}
+
+func NewMemoryHistoryRepo(store *memstore.Store, cfg *config.Config, reports *reportstore.Store) Repository {
+	return &memoryHistoryRepository{
+		historyRepository: &historyRepository{
+			cfg:     cfg,
+			reports: reports,
+			InfoLog: log.New(os.Stdout, "INFO\tMEMORY REPORT REPO\t", log.Ldate|log.Ltime),
+			ErrLog:  log.New(os.Stdout, "ERROR\tMEMORY REPORT REPO\t", log.Ldate|log.Ltime),
+		},
+		store: store,
+	}
+}
+
+// StreamHistory collects the matching rows under the read lock of the store and calls fn after releasing it,
+// so a slow consumer never holds up the changes.
+func (hr *memoryHistoryRepository) StreamHistory(
+	_ context.Context,
+	filter *Filter,
+	dates *DatesRange,
+	fn RowFunc,
+) error {
+	for _, row := range hr.readHistory(filter, dates) {
+		row := row
+		err := fn(&row)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hr *memoryHistoryRepository) readHistory(filter *Filter, dates *DatesRange) []ReportRow {
+	users := map[int]bool{}
+	for _, id := range filter.UserIDs {
+		users[id] = true
+	}
+
+	hr.store.RLock()
+	defer hr.store.RUnlock()
+
+	rows := []ReportRow{}
+	for _, entry := range hr.store.Audit {
+		if len(users) > 0 && !users[entry.UserID] ||
+			entry.CreatedAt.Before(dates.StartDate) || !entry.CreatedAt.Before(dates.EndDate) {
+			continue
+		}
+
+		var slug string
+		if seg := hr.store.SegmentByID(entry.SegmentID); seg != nil {
+			slug = seg.Slug
+		}
+		if filter.SegmentSlug != "" && filter.SegmentSlug != slug {
+			continue
+		}
+
+		rows = append(rows, newReportRow(entry.UserID, slug, entry.Action, entry.Origin, entry.ExpiresAt, entry.CreatedAt,
+			dates.Location))
+	}
+	return rows
+}
+
+func (hr *memoryHistoryRepository) CreateReport(
+	ctx context.Context,
+	filter *Filter,
+	dates *DatesRange,
+	output *report.Options,
+) (*ReportResponse, error) {
+	return hr.writeReport(ctx, output, func(fn RowFunc) error {
+		return hr.StreamHistory(ctx, filter, dates, fn)
+	})
+}
+
+func (hr *memoryHistoryRepository) WriteReport(
+	ctx context.Context,
+	w io.Writer,
+	filter *Filter,
+	dates *DatesRange,
+	output *report.Options,
+) error {
+	return writeRows(w, hr.reportOptions(output), func(fn RowFunc) error {
+		return hr.StreamHistory(ctx, filter, dates, fn)
+	})
+}
@@ -3,176 +3,194 @@ package history
 import (
 	"context"
 	"database/sql"
-	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"os"
-	"regexp"
 	"time"
 	"usersegmentator/config"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/report"
+	"usersegmentator/pkg/reportstore"
 )
 
 type Repository interface {
-	GetUserHistory(ctx context.Context, userID int, dates *DatesRange) ([]ReportRow, error)
-	ParseAndValidateDates(dateStart, dateEnd string) (*DatesRange, error)
-	CreateCSV(history []ReportRow) (string, error)
+	// StreamHistory calls fn for every audited change matching filter within dates in the order the changes were made.
+	// The rows are read one at a time, so a report of any size never sits in memory; an error of fn stops the stream.
+	StreamHistory(ctx context.Context, filter *Filter, dates *DatesRange, fn RowFunc) error
+	ParseAndValidateDates(req *Request) (*DatesRange, error)
+	// CreateReport streams the history matching filter into a new report file in the format of output
+	// and returns a signed link to it.
+	CreateReport(ctx context.Context, filter *Filter, dates *DatesRange, output *report.Options) (*ReportResponse, error)
+	// WriteReport streams the history matching filter to w in the format of output, row by row as it is read.
+	WriteReport(ctx context.Context, w io.Writer, filter *Filter, dates *DatesRange, output *report.Options) error
 }
 
+// RowFunc receives the rows of a streamed report. The row is reused for the next one once RowFunc returns.
+type RowFunc func(row *ReportRow) error
+
 type historyRepository struct {
 	db      *sql.DB
+	dialect dialect.Dialect
 	cfg     *config.Config
+	reports *reportstore.Store
 	InfoLog *log.Logger
 	ErrLog  *log.Logger
 }
 
-func NewHistoryRepo(db *sql.DB, cfg *config.Config) Repository {
+func NewHistoryRepo(db *sql.DB, cfg *config.Config, reports *reportstore.Store) Repository {
 	return &historyRepository{
 		db:      db,
+		dialect: dialect.Dialect(cfg.Storage.Driver),
 		cfg:     cfg,
+		reports: reports,
 		InfoLog: log.New(os.Stdout, "INFO\tREPORT REPO\t", log.Ldate|log.Ltime),
 		ErrLog:  log.New(os.Stdout, "ERROR\tREPORT REPO\t", log.Ldate|log.Ltime),
 	}
 }
 
-func (hr *historyRepository) ParseAndValidateDates(dateStart, dateEnd string) (*DatesRange, error) {
-	dates := &DatesRange{}
-
-	if !regexp.MustCompile(`^\d{4}-\d{1,2}$`).MatchString(dateStart) ||
-		!regexp.MustCompile(`^\d{4}-\d{1,2}$`).MatchString(dateEnd) {
-		return nil, fmt.Errorf("error validating dates range. The format is yyyy-mm or yyyy-m")
-	}
-
-	var err error
-	if len(dateStart) == len(dateFormatFullMonth) {
-		dates.StartDate, err = time.Parse("2006-01", dateStart)
-
-		if err != nil {
-			hr.ErrLog.Printf("Error validating date: %s", err)
-			return nil, err
-		}
-	} else {
-		dates.StartDate, err = time.Parse("2006-1", dateStart)
-
-		if err != nil {
-			hr.ErrLog.Printf("Error validating date: %s", err)
-			return nil, err
-		}
-	}
-
-	if len(dateEnd) == len(dateFormatFullMonth) {
-		dates.EndDate, err = time.Parse("2006-01", dateEnd)
-
-		if err != nil {
-			hr.ErrLog.Printf("Error validating date: %s", err)
-			return nil, err
-		}
-	} else {
-		dates.EndDate, err = time.Parse("2006-1", dateEnd)
-
-		if err != nil {
-			hr.ErrLog.Printf("Error validating date: %s", err)
-			return nil, err
-		}
-	}
-
+func (hr *historyRepository) ParseAndValidateDates(req *Request) (*DatesRange, error) {
+	// now is not truncated, a relative range includes the changes of the current second
+	dates, err := parseDates(req, time.Now().UTC())
 	if err != nil {
-		hr.ErrLog.Printf("Error validating date: %s", err)
+		hr.ErrLog.Printf("Error validating dates: %s", err)
 		return nil, err
 	}
-	dates.EndDate = dates.EndDate.AddDate(0, 1, 0)
 	return dates, nil
 }
 
-func (hr *historyRepository) GetUserHistory(ctx context.Context, userID int, dates *DatesRange) ([]ReportRow, error) {
-	history := []ReportRow{}
-	rows, err := hr.db.QueryContext(
-		ctx,
-		`SELECT f.slug, ufr.date_assigned, ufr.date_unassigned 
-		FROM user_segment_relation ufr 
-		JOIN segments f ON ufr.segment_id = f.id 
-		WHERE ufr.user_id = ? AND (
-		ufr.date_assigned >= ? OR 
-		(ufr.date_unassigned < ? OR ufr.date_unassigned IS NULL))`,
-		userID,
-		dates.StartDate.String(),
-		dates.EndDate.String(),
-	)
+func (hr *historyRepository) StreamHistory(ctx context.Context, filter *Filter, dates *DatesRange, fn RowFunc) error {
+	query := `SELECT a.user_id, f.slug, a.action, a.source, a.actor, a.reason, a.expires_at, a.created_at 
+		FROM membership_audit a 
+		JOIN segments f ON a.segment_id = f.id 
+		WHERE a.created_at >= ? AND a.created_at < ?`
+	args := []interface{}{dates.StartDate, dates.EndDate}
+	if filter.SegmentSlug != "" {
+		query += " AND f.slug = ?"
+		args = append(args, filter.SegmentSlug)
+	}
+	if len(filter.UserIDs) > 0 {
+		query += " AND a.user_id IN (" + dialect.Placeholders(len(filter.UserIDs)) + ")"
+		for _, id := range filter.UserIDs {
+			args = append(args, id)
+		}
+	}
 
+	rows, err := hr.db.QueryContext(ctx, hr.dialect.Rebind(query+" ORDER BY a.created_at, a.id"), args...)
 	if err != nil {
 		hr.ErrLog.Println(err.Error())
-		return nil, err
+		return err
 	}
 
+	row := &ReportRow{}
 	for rows.Next() {
-		var slug sql.NullString
-		var dateAssigned, dateUnassigned sql.NullTime
-		err = rows.Scan(&slug, &dateAssigned, &dateUnassigned)
+		var (
+			userID       int
+			slug, action string
+			origin       audit.Origin
+			expiresAt    sql.NullTime
+			createdAt    time.Time
+		)
+		err = rows.Scan(&userID, &slug, &action, &origin.Source, &origin.Actor, &origin.Reason, &expiresAt, &createdAt)
 		if err != nil {
+			_ = rows.Close()
 			hr.ErrLog.Println(err.Error())
-			return nil, err
+			return err
 		}
 
-		var historyRowUnassign ReportRow
-
-		if dates.StartDate.Before(dateAssigned.Time) && dateAssigned.Time.Before(dates.EndDate) {
-			historyRowAssign := ReportRow{
-				UserID:    userID,
-				Segment:   slug.String,
-				Operation: "assigned",
-				Date:      dateAssigned.Time.String(),
-			}
-			history = append(history, historyRowAssign)
+		var expires *time.Time
+		if expiresAt.Valid {
+			expires = &expiresAt.Time
 		}
+		*row = newReportRow(userID, slug, action, origin, expires, createdAt, dates.Location)
 
-		if dateUnassigned.Valid && dates.EndDate.After(dateUnassigned.Time) &&
-			dates.StartDate.Before(dateUnassigned.Time) {
-			historyRowUnassign = ReportRow{
-				UserID:    userID,
-				Segment:   slug.String,
-				Operation: "unassigned",
-				Date:      dateUnassigned.Time.String(),
-			}
-			history = append(history, historyRowUnassign)
+		err = fn(row)
+		if err != nil {
+			_ = rows.Close()
+			return err
 		}
 	}
-	err = rows.Close()
+
+	// a stream broken half way ends rows.Next without an error of its own
+	err = rows.Err()
+	if closeErr := rows.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		hr.ErrLog.Println(err.Error())
-		return nil, err
 	}
-	return history, nil
+	return err
 }
 
-func (hr *historyRepository) CreateCSV(history []ReportRow) (string, error) {
-	alpa := "abcdefghijklmnopqrstuvwxyz1234567890"
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+func (hr *historyRepository) CreateReport(
+	ctx context.Context,
+	filter *Filter,
+	dates *DatesRange,
+	output *report.Options,
+) (*ReportResponse, error) {
+	return hr.writeReport(ctx, output, func(fn RowFunc) error {
+		return hr.StreamHistory(ctx, filter, dates, fn)
+	})
+}
 
-	randStr := make([]byte, fileIDLength)
-	for i := range randStr {
-		randStr[i] = alpa[r.Intn(len(alpa))]
-	}
+func (hr *historyRepository) WriteReport(
+	ctx context.Context,
+	w io.Writer,
+	filter *Filter,
+	dates *DatesRange,
+	output *report.Options,
+) error {
+	return writeRows(w, hr.reportOptions(output), func(fn RowFunc) error {
+		return hr.StreamHistory(ctx, filter, dates, fn)
+	})
+}
 
-	fileName := hr.cfg.Report.FilePrefix + string(randStr) + hr.cfg.Report.FileExt
-	filePath := hr.cfg.StorageDir + fileName
+// reportOptions fills the options left empty with the ones of the config.
+func (hr *historyRepository) reportOptions(output *report.Options) report.Options {
+	return output.WithDefaults(report.Options{Format: hr.cfg.Report.Format, Delimiter: hr.cfg.Report.CSVDelimiter})
+}
 
-	file, err := os.Create(filePath)
+// writeReport writes the rows of stream into a new report file as they come and returns a signed link to it.
+func (hr *historyRepository) writeReport(
+	ctx context.Context,
+	output *report.Options,
+	stream func(fn RowFunc) error,
+) (*ReportResponse, error) {
+	opts := hr.reportOptions(output)
+
+	name, err := hr.reports.Save(ctx, opts.Format, func(w io.Writer) error {
+		return writeRows(w, opts, stream)
+	})
 	if err != nil {
 		hr.ErrLog.Println(err.Error())
-		return "", err
+		return nil, err
+	}
+
+	url, expires, err := hr.reports.URL(ctx, name)
+	if err != nil {
+		hr.ErrLog.Println(err.Error())
+		return nil, err
 	}
-	defer file.Close()
 
-	fileData := ""
-	for _, row := range history {
-		fileData += fmt.Sprintf("%d;%s;%s;%s\n", row.UserID, row.Segment, row.Operation, row.Date)
+	resp := &ReportResponse{URL: url, Format: opts.Format, ExpiresAt: expires}
+	if opts.Format == report.CSV {
+		resp.CsvURL = resp.URL
 	}
+	return resp, nil
+}
 
-	_, err = file.Write([]byte(fileData))
+// writeRows writes the report of stream to w in the format of opts.
+func writeRows(w io.Writer, opts report.Options, stream func(fn RowFunc) error) error {
+	rw, err := report.NewWriter(w, ReportColumns, opts)
 	if err != nil {
-		hr.ErrLog.Println(err.Error())
-		return "", nil
+		return err
 	}
 
-	fileURL := fmt.Sprintf("%s:%s/reports/%s", hr.cfg.HTTP.Host, hr.cfg.HTTP.Port, fileName)
-	return fileURL, nil
+	err = stream(func(row *ReportRow) error {
+		return rw.Write(row.Values())
+	})
+	if err != nil {
+		return err
+	}
+	return rw.Close()
 }
@@ -0,0 +1,98 @@
+package isoduration
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidDuration = errors.New("invalid ISO-8601 duration")
+
+// Duration is an ISO-8601 duration such as P1Y2M10DT2H30M or P2W. Calendar parts are kept apart from
+// the clock ones, so adding P1M to January 31 behaves like time.AddDate. Only Neg makes a duration negative.
+type Duration struct {
+	Negative bool
+	Years    int
+	Months   int
+	Days     int
+	Clock    time.Duration
+}
+
+// Parse reads a duration with integer components. Signs, as in -P1D, and fractions, as in PT1.5S, are rejected:
+// every duration the API takes counts forward, shorten_by says the direction by its name.
+func Parse(s string) (Duration, error) {
+	d := Duration{}
+	rest := s
+
+	if rest == "" || rest[0] != 'P' {
+		return Duration{}, fmt.Errorf("%w: %q", ErrInvalidDuration, s)
+	}
+	rest = rest[1:]
+
+	var (
+		inTime   bool
+		hasPart  bool
+		timePart bool
+		number   string
+	)
+	for _, c := range rest {
+		switch {
+		case c >= '0' && c <= '9':
+			number += string(c)
+			continue
+		case c == 'T' && !inTime && number == "":
+			inTime = true
+			continue
+		}
+
+		if number == "" {
+			return Duration{}, fmt.Errorf("%w: %q", ErrInvalidDuration, s)
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return Duration{}, fmt.Errorf("%w: %q", ErrInvalidDuration, s)
+		}
+		number = ""
+		hasPart = true
+		timePart = inTime
+
+		switch {
+		case !inTime && c == 'Y':
+			d.Years += n
+		case !inTime && c == 'M':
+			d.Months += n
+		case !inTime && c == 'W':
+			d.Days += n * 7 //nolint:gomnd // days in a week
+		case !inTime && c == 'D':
+			d.Days += n
+		case inTime && c == 'H':
+			d.Clock += time.Duration(n) * time.Hour
+		case inTime && c == 'M':
+			d.Clock += time.Duration(n) * time.Minute
+		case inTime && c == 'S':
+			d.Clock += time.Duration(n) * time.Second
+		default:
+			return Duration{}, fmt.Errorf("%w: %q", ErrInvalidDuration, s)
+		}
+	}
+
+	if number != "" || !hasPart || inTime && !timePart {
+		return Duration{}, fmt.Errorf("%w: %q", ErrInvalidDuration, s)
+	}
+	return d, nil
+}
+
+// AddTo returns t shifted by the duration, calendar parts first.
+func (d Duration) AddTo(t time.Time) time.Time {
+	if d.Negative {
+		return t.AddDate(-d.Years, -d.Months, -d.Days).Add(-d.Clock)
+	}
+	return t.AddDate(d.Years, d.Months, d.Days).Add(d.Clock)
+}
+
+// Neg returns the duration with the opposite sign.
+func (d Duration) Neg() Duration {
+	d.Negative = !d.Negative
+	return d
+}
@@ -0,0 +1,106 @@
+package isoduration
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Duration
+	}{
+		{"P1D", Duration{Days: 1}},
+		{"PT1H30M", Duration{Clock: 90 * time.Minute}},
+		{"P1Y2M", Duration{Years: 1, Months: 2}},
+		{"P2W", Duration{Days: 14}},
+		{"PT45S", Duration{Clock: 45 * time.Second}},
+		{"P1M", Duration{Months: 1}},
+		{"PT1M", Duration{Clock: time.Minute}},
+		{"P1Y2M10DT2H30M15S", Duration{Years: 1, Months: 2, Days: 10, Clock: 2*time.Hour + 30*time.Minute + 15*time.Second}},
+		{"P0D", Duration{}},
+		{"PT36H", Duration{Clock: 36 * time.Hour}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"no parts", "P"},
+		{"no time parts", "PT"},
+		{"time designator without time parts", "P1DT"},
+		{"negative", "-P1D"},
+		{"positive sign", "+P1D"},
+		{"no designator", "1D"},
+		{"lower case", "p1d"},
+		{"hours without T", "P1H"},
+		{"seconds without T", "P30S"},
+		{"days after T", "PT1D"},
+		{"number without unit", "P1"},
+		{"unit without number", "PD"},
+		{"fractional seconds", "PT1.5S"},
+		{"decimal comma", "PT1,5S"},
+		{"second T", "PT1HT30M"},
+		{"space", "P 1D"},
+		{"overflow", "P99999999999999999999D"},
+		{"plain text", "1 day"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := Parse(tt.in)
+			if !errors.Is(err, ErrInvalidDuration) {
+				t.Errorf("Parse(%q) = %+v, %v, want %v", tt.in, d, err, ErrInvalidDuration)
+			}
+		})
+	}
+}
+
+func TestAddTo(t *testing.T) {
+	start := time.Date(2023, 1, 31, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		in   string
+		neg  bool
+		want time.Time
+	}{
+		{"P1D", false, time.Date(2023, 2, 1, 10, 0, 0, 0, time.UTC)},
+		{"PT1H30M", false, time.Date(2023, 1, 31, 11, 30, 0, 0, time.UTC)},
+		// calendar parts follow time.AddDate, January 31 plus a month normalizes to March 3
+		{"P1M", false, time.Date(2023, 3, 3, 10, 0, 0, 0, time.UTC)},
+		{"P1Y2M", false, time.Date(2024, 3, 31, 10, 0, 0, 0, time.UTC)},
+		{"P1DT12H", true, time.Date(2023, 1, 29, 22, 0, 0, 0, time.UTC)},
+		{"P1W", true, time.Date(2023, 1, 24, 10, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			d, err := Parse(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.neg {
+				d = d.Neg()
+			}
+			if got := d.AddTo(start); !got.Equal(tt.want) {
+				t.Errorf("%s added to %s = %s, want %s", tt.in, start, got, tt.want)
+			}
+		})
+	}
+}
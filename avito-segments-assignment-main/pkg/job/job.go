@@ -0,0 +1,127 @@
+package job
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobFinished = errors.New("job already finished")
+)
+
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Kinds of the jobs the service runs. Every kind has a Func registered with the Runner.
+const (
+	KindAutoAssign  = "auto_assign"
+	KindSetFraction = "set_fraction"
+	KindReport      = "report"
+	KindImport      = "import"
+)
+
+const (
+	idBytes          = 16
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// Job is a unit of background work. Actor and Reason are those of the request that created it,
+// the membership changes the job makes are audited under them.
+type Job struct {
+	ID              string          `json:"id"`
+	Kind            string          `json:"kind"`
+	Status          string          `json:"status"`
+	Params          json.RawMessage `json:"params" swaggertype:"object"`
+	Result          json.RawMessage `json:"result,omitempty" swaggertype:"object"`
+	Error           string          `json:"error,omitempty"`
+	Done            int             `json:"done"`
+	Total           int             `json:"total"`
+	CancelRequested bool            `json:"cancel_requested,omitempty"`
+	Actor           string          `json:"actor,omitempty"`
+	Reason          string          `json:"reason,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+	StartedAt       *time.Time      `json:"started_at,omitempty"`
+	FinishedAt      *time.Time      `json:"finished_at,omitempty"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+}
+
+// Finished reports whether the job reached a final status.
+func (j *Job) Finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed || j.Status == StatusCancelled
+}
+
+type Request struct {
+	JobID string `json:"job_id"`
+}
+
+type Filter struct {
+	Kind   string `json:"kind,omitempty"`
+	Status string `json:"status,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+func (f *Filter) limit() int {
+	switch {
+	case f.Limit <= 0:
+		return defaultListLimit
+	case f.Limit > maxListLimit:
+		return maxListLimit
+	}
+	return f.Limit
+}
+
+// Func runs a job of one kind and returns its result, stored as JSON. A job is started again from the beginning
+// when its runner stops, so a Func has to be safe to repeat; Done and Total of j hold the last reported progress.
+type Func func(ctx context.Context, j *Job) (interface{}, error)
+
+func newID() (string, error) {
+	b := make([]byte, idBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type progressKey struct{}
+
+// progress holds the latest progress of a running job until the next heartbeat stores it.
+type progress struct {
+	sync.Mutex
+	done, total int
+}
+
+func (p *progress) get() (done, total int) {
+	p.Lock()
+	defer p.Unlock()
+	return p.done, p.total
+}
+
+func withProgress(ctx context.Context, p *progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// Progress records how much of a job is done. Total of 0 means the amount of work is not known yet.
+// Outside of a job it does nothing, so repositories can report progress unconditionally.
+func Progress(ctx context.Context, done, total int) {
+	p, ok := ctx.Value(progressKey{}).(*progress)
+	if !ok {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.done, p.total = done, total
+}
@@ -0,0 +1,222 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/memstore"
+)
+
+type memoryJobsRepository struct {
+	store   *memstore.Store
+	cfg     *config.Config
+	InfoLog *log.Logger
+	ErrLog  *log.Logger
+}
+
+func NewMemoryJobsRepo(store *memstore.Store, cfg *config.Config) Repository {
+	return &memoryJobsRepository{
+		store:   store,
+		cfg:     cfg,
+		InfoLog: log.New(os.Stdout, "INFO\tMEMORY JOBS REPO\t", log.Ldate|log.Ltime),
+		ErrLog:  log.New(os.Stdout, "ERROR\tMEMORY JOBS REPO\t", log.Ldate|log.Ltime),
+	}
+}
+
+func (jr *memoryJobsRepository) Create(ctx context.Context, kind string, params interface{}) (*Job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	jr.store.Lock()
+	defer jr.store.Unlock()
+
+	origin := audit.FromContext(ctx)
+	created := memstore.Now()
+	stored := &memstore.Job{
+		ID:        id,
+		Kind:      kind,
+		Status:    StatusQueued,
+		Params:    encoded,
+		Actor:     origin.Actor,
+		Reason:    origin.Reason,
+		CreatedAt: created,
+		UpdatedAt: created,
+	}
+	jr.store.Jobs = append(jr.store.Jobs, stored)
+
+	jr.InfoLog.Printf("Create — %s %s\n", kind, id)
+	return toJob(stored), nil
+}
+
+func (jr *memoryJobsRepository) Get(_ context.Context, id string) (*Job, error) {
+	jr.store.RLock()
+	defer jr.store.RUnlock()
+
+	stored := jr.store.JobByID(id)
+	if stored == nil {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	return toJob(stored), nil
+}
+
+func (jr *memoryJobsRepository) List(_ context.Context, filter *Filter) ([]*Job, error) {
+	jr.store.RLock()
+	defer jr.store.RUnlock()
+
+	// newest first, the store keeps jobs in creation order
+	jobs := []*Job{}
+	for i := len(jr.store.Jobs) - 1; i >= 0; i-- {
+		stored := jr.store.Jobs[i]
+		if filter.Kind != "" && stored.Kind != filter.Kind || filter.Status != "" && stored.Status != filter.Status {
+			continue
+		}
+		jobs = append(jobs, toJob(stored))
+	}
+
+	if len(jobs) > filter.limit() {
+		jobs = jobs[:filter.limit()]
+	}
+	return jobs, nil
+}
+
+func (jr *memoryJobsRepository) Cancel(_ context.Context, id string) (*Job, error) {
+	jr.store.Lock()
+	defer jr.store.Unlock()
+
+	stored := jr.store.JobByID(id)
+	if stored == nil {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	if toJob(stored).Finished() {
+		return nil, fmt.Errorf("%w: %s is %s", ErrJobFinished, id, stored.Status)
+	}
+
+	cancelled := memstore.Now()
+	stored.CancelRequested = true
+	stored.UpdatedAt = cancelled
+	if stored.Status == StatusQueued {
+		stored.Status = StatusCancelled
+		stored.FinishedAt = &cancelled
+	}
+
+	jr.InfoLog.Printf("Cancel — %s\n", id)
+	return toJob(stored), nil
+}
+
+func (jr *memoryJobsRepository) Claim(_ context.Context, holder string, staleBefore time.Time) (*Job, error) {
+	jr.store.Lock()
+	defer jr.store.Unlock()
+
+	for _, stored := range jr.store.Jobs {
+		stale := stored.Status == StatusRunning && stored.HeartbeatAt != nil && stored.HeartbeatAt.Before(staleBefore)
+		if stored.Status != StatusQueued && !stale {
+			continue
+		}
+
+		claimed := memstore.Now()
+		stored.Status = StatusRunning
+		stored.Holder = holder
+		stored.HeartbeatAt = &claimed
+		stored.UpdatedAt = claimed
+		if stored.StartedAt == nil {
+			stored.StartedAt = &claimed
+		}
+		return toJob(stored), nil
+	}
+	return nil, nil
+}
+
+func (jr *memoryJobsRepository) Heartbeat(_ context.Context, id, holder string, done, total int) (bool, error) {
+	jr.store.Lock()
+	defer jr.store.Unlock()
+
+	stored := jr.store.JobByID(id)
+	if stored == nil || stored.Holder != holder || stored.Status != StatusRunning {
+		return false, errJobLost
+	}
+
+	beat := memstore.Now()
+	stored.Done, stored.Total = done, total
+	stored.HeartbeatAt = &beat
+	stored.UpdatedAt = beat
+	return stored.CancelRequested, nil
+}
+
+func (jr *memoryJobsRepository) Finish(
+	_ context.Context,
+	id, holder string,
+	status string,
+	result json.RawMessage,
+	message string,
+) error {
+	jr.store.Lock()
+	defer jr.store.Unlock()
+
+	stored := jr.store.JobByID(id)
+	if stored == nil || stored.Holder != holder || stored.Status != StatusRunning {
+		return nil
+	}
+
+	finished := memstore.Now()
+	stored.Status = status
+	stored.Result = result
+	stored.Error = message
+	stored.FinishedAt = &finished
+	stored.UpdatedAt = finished
+	return nil
+}
+
+func (jr *memoryJobsRepository) Release(_ context.Context, id, holder string) error {
+	jr.store.Lock()
+	defer jr.store.Unlock()
+
+	stored := jr.store.JobByID(id)
+	if stored == nil || stored.Holder != holder || stored.Status != StatusRunning {
+		return nil
+	}
+
+	stored.Status = StatusQueued
+	stored.Holder = ""
+	stored.HeartbeatAt = nil
+	stored.UpdatedAt = memstore.Now()
+	return nil
+}
+
+func toJob(stored *memstore.Job) *Job {
+	j := &Job{
+		ID:              stored.ID,
+		Kind:            stored.Kind,
+		Status:          stored.Status,
+		Params:          stored.Params,
+		Result:          stored.Result,
+		Error:           stored.Error,
+		Done:            stored.Done,
+		Total:           stored.Total,
+		CancelRequested: stored.CancelRequested,
+		Actor:           stored.Actor,
+		Reason:          stored.Reason,
+		CreatedAt:       stored.CreatedAt,
+		UpdatedAt:       stored.UpdatedAt,
+	}
+	if stored.StartedAt != nil {
+		startedAt := *stored.StartedAt
+		j.StartedAt = &startedAt
+	}
+	if stored.FinishedAt != nil {
+		finishedAt := *stored.FinishedAt
+		j.FinishedAt = &finishedAt
+	}
+	return j
+}
@@ -0,0 +1,359 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/dialect"
+	errs "usersegmentator/pkg/errors"
+)
+
+// errJobLost means another runner took the job over, usually because this one missed its heartbeats.
+var errJobLost = errors.New("job was taken over by another runner")
+
+type Repository interface {
+	Create(ctx context.Context, kind string, params interface{}) (*Job, error)
+	Get(ctx context.Context, id string) (*Job, error)
+	List(ctx context.Context, filter *Filter) ([]*Job, error)
+	Cancel(ctx context.Context, id string) (*Job, error)
+	// Claim hands a queued job, or a running one whose heartbeat is older than staleBefore, to holder.
+	// It returns nil when there is nothing to run.
+	Claim(ctx context.Context, holder string, staleBefore time.Time) (*Job, error)
+	// Heartbeat stores the progress of a running job and reports whether it has been asked to cancel.
+	Heartbeat(ctx context.Context, id, holder string, done, total int) (bool, error)
+	Finish(ctx context.Context, id, holder string, status string, result json.RawMessage, message string) error
+	// Release puts a running job back into the queue, so it is resumed by the next runner.
+	Release(ctx context.Context, id, holder string) error
+}
+
+const jobColumns = "id, kind, status, params, result, error_message, done, total, cancel_requested, actor, reason, " +
+	"created_at, started_at, finished_at, updated_at"
+
+type jobsRepository struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+	cfg     *config.Config
+	InfoLog *log.Logger
+	ErrLog  *log.Logger
+}
+
+func NewJobsRepo(db *sql.DB, cfg *config.Config) Repository {
+	return &jobsRepository{
+		db:      db,
+		dialect: dialect.Dialect(cfg.Storage.Driver),
+		cfg:     cfg,
+		InfoLog: log.New(os.Stdout, "INFO\tJOBS REPO\t", log.Ldate|log.Ltime),
+		ErrLog:  log.New(os.Stdout, "ERROR\tJOBS REPO\t", log.Ldate|log.Ltime),
+	}
+}
+
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func (jr *jobsRepository) Create(ctx context.Context, kind string, params interface{}) (*Job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	origin := audit.FromContext(ctx)
+	created := now()
+	_, err = jr.db.ExecContext(
+		ctx,
+		jr.dialect.Rebind("INSERT INTO jobs (id, kind, status, params, actor, reason, created_at, updated_at) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?)"),
+		id,
+		kind,
+		StatusQueued,
+		string(encoded),
+		origin.Actor,
+		origin.Reason,
+		created,
+		created,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	jr.InfoLog.Printf("Create — %s %s\n", kind, id)
+	return &Job{
+		ID:        id,
+		Kind:      kind,
+		Status:    StatusQueued,
+		Params:    encoded,
+		Actor:     origin.Actor,
+		Reason:    origin.Reason,
+		CreatedAt: created,
+		UpdatedAt: created,
+	}, nil
+}
+
+func (jr *jobsRepository) Get(ctx context.Context, id string) (*Job, error) {
+	jobs, err := jr.readJobs(ctx, jr.db, "WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	return jobs[0], nil
+}
+
+func (jr *jobsRepository) List(ctx context.Context, filter *Filter) ([]*Job, error) {
+	where := "WHERE 1 = 1"
+	args := []interface{}{}
+	if filter.Kind != "" {
+		where += " AND kind = ?"
+		args = append(args, filter.Kind)
+	}
+	if filter.Status != "" {
+		where += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+
+	return jr.readJobs(ctx, jr.db, where+" ORDER BY created_at DESC, id LIMIT ?", append(args, filter.limit())...)
+}
+
+// Cancel finishes a queued job right away and asks the runner of a running one to stop it.
+func (jr *jobsRepository) Cancel(ctx context.Context, id string) (*Job, error) {
+	tx, err := jr.db.BeginTx(ctx, nil)
+	if err != nil {
+		jr.ErrLog.Printf("%s: %s", errs.ErrorBeginTransaction, err)
+		return nil, err
+	}
+
+	err = jr.cancel(ctx, tx, id)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		jr.ErrLog.Printf("%s: %s", errs.ErrorCommittingTransaction, err)
+		return nil, err
+	}
+
+	jr.InfoLog.Printf("Cancel — %s\n", id)
+	return jr.Get(ctx, id)
+}
+
+func (jr *jobsRepository) cancel(ctx context.Context, tx *sql.Tx, id string) error {
+	jobs, err := jr.readJobs(ctx, tx, "WHERE id = ? FOR UPDATE", id)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	if jobs[0].Finished() {
+		return fmt.Errorf("%w: %s is %s", ErrJobFinished, id, jobs[0].Status)
+	}
+
+	cancelled := now()
+	if jobs[0].Status == StatusQueued {
+		_, err = tx.ExecContext(
+			ctx,
+			jr.dialect.Rebind("UPDATE jobs SET status = ?, cancel_requested = TRUE, finished_at = ?, updated_at = ? "+
+				"WHERE id = ?"),
+			StatusCancelled,
+			cancelled,
+			cancelled,
+			id,
+		)
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		jr.dialect.Rebind("UPDATE jobs SET cancel_requested = TRUE, updated_at = ? WHERE id = ?"),
+		cancelled,
+		id,
+	)
+	return err
+}
+
+func (jr *jobsRepository) Claim(ctx context.Context, holder string, staleBefore time.Time) (*Job, error) {
+	var id string
+	err := jr.db.QueryRowContext(
+		ctx,
+		jr.dialect.Rebind("SELECT id FROM jobs WHERE status = ? OR (status = ? AND heartbeat_at < ?) "+
+			"ORDER BY created_at LIMIT 1"),
+		StatusQueued,
+		StatusRunning,
+		staleBefore,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the conditions are checked again, so only one of the runners racing for the job gets it
+	claimed := now()
+	res, err := jr.db.ExecContext(
+		ctx,
+		jr.dialect.Rebind("UPDATE jobs SET status = ?, holder = ?, heartbeat_at = ?, updated_at = ?, "+
+			"started_at = COALESCE(started_at, ?) "+
+			"WHERE id = ? AND (status = ? OR (status = ? AND heartbeat_at < ?))"),
+		StatusRunning,
+		holder,
+		claimed,
+		claimed,
+		claimed,
+		id,
+		StatusQueued,
+		StatusRunning,
+		staleBefore,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	return jr.Get(ctx, id)
+}
+
+func (jr *jobsRepository) Heartbeat(ctx context.Context, id, holder string, done, total int) (bool, error) {
+	beat := now()
+	_, err := jr.db.ExecContext(
+		ctx,
+		jr.dialect.Rebind("UPDATE jobs SET done = ?, total = ?, heartbeat_at = ?, updated_at = ? "+
+			"WHERE id = ? AND holder = ? AND status = ?"),
+		done,
+		total,
+		beat,
+		beat,
+		id,
+		holder,
+		StatusRunning,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		currentHolder, status string
+		cancelRequested       bool
+	)
+	err = jr.db.QueryRowContext(
+		ctx,
+		jr.dialect.Rebind("SELECT holder, status, cancel_requested FROM jobs WHERE id = ?"),
+		id,
+	).Scan(&currentHolder, &status, &cancelRequested)
+	if err != nil {
+		return false, err
+	}
+	if currentHolder != holder || status != StatusRunning {
+		return false, errJobLost
+	}
+	return cancelRequested, nil
+}
+
+func (jr *jobsRepository) Finish(
+	ctx context.Context,
+	id, holder string,
+	status string,
+	result json.RawMessage,
+	message string,
+) error {
+	var encoded sql.NullString
+	if result != nil {
+		encoded = sql.NullString{String: string(result), Valid: true}
+	}
+
+	finished := now()
+	_, err := jr.db.ExecContext(
+		ctx,
+		jr.dialect.Rebind("UPDATE jobs SET status = ?, result = ?, error_message = ?, finished_at = ?, updated_at = ? "+
+			"WHERE id = ? AND holder = ? AND status = ?"),
+		status,
+		encoded,
+		message,
+		finished,
+		finished,
+		id,
+		holder,
+		StatusRunning,
+	)
+	return err
+}
+
+func (jr *jobsRepository) Release(ctx context.Context, id, holder string) error {
+	_, err := jr.db.ExecContext(
+		ctx,
+		jr.dialect.Rebind("UPDATE jobs SET status = ?, holder = '', heartbeat_at = NULL, updated_at = ? "+
+			"WHERE id = ? AND holder = ? AND status = ?"),
+		StatusQueued,
+		now(),
+		id,
+		holder,
+		StatusRunning,
+	)
+	return err
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (jr *jobsRepository) readJobs(ctx context.Context, q querier, where string, args ...interface{}) ([]*Job, error) {
+	rows, err := q.QueryContext(ctx, jr.dialect.Rebind("SELECT "+jobColumns+" FROM jobs "+where), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []*Job{}
+	for rows.Next() {
+		var (
+			j                     = &Job{}
+			params                string
+			result, message       sql.NullString
+			startedAt, finishedAt sql.NullTime
+		)
+		err = rows.Scan(&j.ID, &j.Kind, &j.Status, &params, &result, &message, &j.Done, &j.Total,
+			&j.CancelRequested, &j.Actor, &j.Reason, &j.CreatedAt, &startedAt, &finishedAt, &j.UpdatedAt)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+
+		j.Params = json.RawMessage(params)
+		if result.Valid {
+			j.Result = json.RawMessage(result.String)
+		}
+		j.Error = message.String
+		if startedAt.Valid {
+			j.StartedAt = &startedAt.Time
+		}
+		if finishedAt.Valid {
+			j.FinishedAt = &finishedAt.Time
+		}
+		jobs = append(jobs, j)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
@@ -0,0 +1,212 @@
+package job
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/audit"
+)
+
+const (
+	defaultWorkers      = 2
+	defaultPollInterval = 2 * time.Second
+
+	// heartbeatInterval is how often a running job stores its progress and checks for a cancel request.
+	heartbeatInterval = 5 * time.Second
+	// staleAfter is how long a running job may go without a heartbeat before another runner resumes it.
+	staleAfter = 30 * time.Second
+
+	holderSuffixBytes = 4
+)
+
+// Runner executes queued jobs with a fixed number of workers. Jobs of a runner that stops gracefully go back
+// to the queue, jobs of a runner that crashed are resumed by any runner once their heartbeat is stale.
+type Runner struct {
+	repo    Repository
+	funcs   map[string]Func
+	holder  string
+	workers int
+	poll    time.Duration
+	InfoLog *log.Logger
+	ErrLog  *log.Logger
+}
+
+func NewRunner(repo Repository, cfg *config.Config) (*Runner, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	suffix := make([]byte, holderSuffixBytes)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	workers := cfg.Job.Workers
+	if workers < 1 {
+		workers = defaultWorkers
+	}
+
+	poll := time.Duration(cfg.Job.PollInterval) * time.Second
+	if poll <= 0 {
+		poll = defaultPollInterval
+	}
+
+	return &Runner{
+		repo:    repo,
+		funcs:   map[string]Func{},
+		holder:  fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix)),
+		workers: workers,
+		poll:    poll,
+		InfoLog: log.New(os.Stdout, "INFO\tJOB RUNNER\t", log.Ldate|log.Ltime),
+		ErrLog:  log.New(os.Stdout, "ERROR\tJOB RUNNER\t", log.Ldate|log.Ltime),
+	}, nil
+}
+
+// Register sets the function running the jobs of kind. It must be called before Run.
+func (r *Runner) Register(kind string, fn Func) {
+	r.funcs[kind] = fn
+}
+
+// Run claims and executes jobs until ctx is done, then waits for the running jobs to be released.
+func (r *Runner) Run(ctx context.Context) {
+	r.InfoLog.Printf("Job runner is running as %s with %d workers", r.holder, r.workers)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < r.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+	wg.Wait()
+
+	r.InfoLog.Printf("Job runner has been stopped")
+}
+
+func (r *Runner) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		j, err := r.repo.Claim(ctx, r.holder, time.Now().UTC().Add(-staleAfter))
+		if err != nil && ctx.Err() == nil {
+			r.ErrLog.Printf("error claiming a job: %s", err)
+		}
+
+		if j == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(r.poll):
+			}
+			continue
+		}
+
+		r.execute(ctx, j)
+	}
+}
+
+// execute runs j and stores the outcome. The job context is not derived from ctx: shutting down releases the job
+// for another runner, while a cancel request finishes it as cancelled.
+func (r *Runner) execute(ctx context.Context, j *Job) {
+	r.InfoLog.Printf("Running %s job %s\n", j.Kind, j.ID)
+
+	fn, ok := r.funcs[j.Kind]
+	if !ok {
+		r.finish(j, StatusFailed, nil, fmt.Sprintf("unknown job kind %q", j.Kind))
+		return
+	}
+
+	p := &progress{done: j.Done, total: j.Total}
+	jobCtx, cancel := context.WithCancel(audit.WithActor(withProgress(context.Background(), p), j.Actor, j.Reason))
+	defer cancel()
+
+	// the flags are written by the heartbeat goroutine only and read once it has exited
+	var (
+		cancelled bool
+		lost      bool
+		beatDone  = make(chan struct{})
+		beatsStop = make(chan struct{})
+	)
+	go func() {
+		defer close(beatDone)
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-beatsStop:
+				return
+			case <-ctx.Done():
+				cancel()
+				return
+			case <-ticker.C:
+			}
+
+			done, total := p.get()
+			cancelRequested, err := r.repo.Heartbeat(context.Background(), j.ID, r.holder, done, total)
+			switch {
+			case errors.Is(err, errJobLost):
+				lost = true
+				cancel()
+				return
+			case err != nil:
+				r.ErrLog.Printf("error storing heartbeat of job %s: %s", j.ID, err)
+			case cancelRequested:
+				cancelled = true
+				cancel()
+				return
+			}
+		}
+	}()
+
+	result, err := fn(jobCtx, j)
+	close(beatsStop)
+	<-beatDone
+
+	done, total := p.get()
+	j.Done, j.Total = done, total
+	if _, beatErr := r.repo.Heartbeat(context.Background(), j.ID, r.holder, done, total); errors.Is(beatErr, errJobLost) {
+		lost = true
+	}
+
+	// a job that completed before it noticed the cancel request or the shutdown is reported as it is
+	switch {
+	case lost:
+		r.InfoLog.Printf("Job %s was taken over by another runner\n", j.ID)
+	case err == nil:
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			r.finish(j, StatusFailed, nil, err.Error())
+			return
+		}
+		r.finish(j, StatusSucceeded, encoded, "")
+	case cancelled:
+		r.finish(j, StatusCancelled, nil, "cancelled on request")
+	case ctx.Err() != nil:
+		err = r.repo.Release(context.Background(), j.ID, r.holder)
+		if err != nil {
+			r.ErrLog.Printf("error releasing job %s: %s", j.ID, err)
+			return
+		}
+		r.InfoLog.Printf("Job %s has been put back into the queue\n", j.ID)
+	default:
+		r.finish(j, StatusFailed, nil, err.Error())
+	}
+}
+
+func (r *Runner) finish(j *Job, status string, result json.RawMessage, message string) {
+	err := r.repo.Finish(context.Background(), j.ID, r.holder, status, result, message)
+	if err != nil {
+		r.ErrLog.Printf("error finishing job %s: %s", j.ID, err)
+		return
+	}
+	r.InfoLog.Printf("Job %s has %s\n", j.ID, status)
+}
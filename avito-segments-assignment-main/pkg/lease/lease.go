@@ -0,0 +1,118 @@
+package lease
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+	"usersegmentator/pkg/dialect"
+)
+
+const holderSuffixBytes = 4
+
+// Lease elects a single replica for a background job through a row of the worker_leases table.
+// The holder keeps the lease by renewing it before it expires, a crashed holder loses it once expires_at passes.
+// Expiry times come from the clocks of the replicas, so they are expected to be roughly in sync.
+type Lease struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+	name    string
+	holder  string
+	ttl     time.Duration
+}
+
+// New returns a lease on name held for ttl after every successful Acquire. The holder is named after the host
+// and the process, with a random suffix so restarted processes do not inherit the lease of their predecessor.
+func New(db *sql.DB, d dialect.Dialect, name string, ttl time.Duration) (*Lease, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	suffix := make([]byte, holderSuffixBytes)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Lease{
+		db:      db,
+		dialect: d,
+		name:    name,
+		holder:  fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix)),
+		ttl:     ttl,
+	}, nil
+}
+
+// Holder identifies this replica in the worker_leases table.
+func (l *Lease) Holder() string {
+	return l.holder
+}
+
+// Acquire takes the lease when it is free or expired, or renews it when this replica already holds it.
+// It reports whether this replica is the holder afterwards.
+func (l *Lease) Acquire(ctx context.Context) (bool, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	_, err := l.db.ExecContext(
+		ctx,
+		l.dialect.Rebind("UPDATE worker_leases SET holder = ?, expires_at = ? "+
+			"WHERE name = ? AND (holder = ? OR expires_at <= ?)"),
+		l.holder,
+		now.Add(l.ttl),
+		l.name,
+		l.holder,
+		now,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	holder, err := l.currentHolder(ctx)
+	if err != sql.ErrNoRows {
+		return holder == l.holder, err
+	}
+
+	// the first replica to run the job creates the row, a concurrent insert fails on the primary key
+	_, err = l.db.ExecContext(
+		ctx,
+		l.dialect.Rebind("INSERT INTO worker_leases (name, holder, expires_at) VALUES (?, ?, ?)"),
+		l.name,
+		l.holder,
+		now.Add(l.ttl),
+	)
+	if err == nil {
+		return true, nil
+	}
+
+	holder, selectErr := l.currentHolder(ctx)
+	if selectErr != nil {
+		return false, err
+	}
+	return holder == l.holder, nil
+}
+
+// Release lets another replica take the lease right away instead of waiting for it to expire.
+func (l *Lease) Release(ctx context.Context) error {
+	_, err := l.db.ExecContext(
+		ctx,
+		l.dialect.Rebind("UPDATE worker_leases SET expires_at = ? WHERE name = ? AND holder = ?"),
+		time.Now().UTC().Truncate(time.Second),
+		l.name,
+		l.holder,
+	)
+	return err
+}
+
+func (l *Lease) currentHolder(ctx context.Context) (string, error) {
+	var holder string
+	err := l.db.QueryRowContext(
+		ctx,
+		l.dialect.Rebind("SELECT holder FROM worker_leases WHERE name = ?"),
+		l.name,
+	).Scan(&holder)
+	return holder, err
+}
@@ -0,0 +1,242 @@
+package memstore
+
+import (
+	"sync"
+	"time"
+	"usersegmentator/pkg/audit"
+)
+
+type User struct {
+	ID       int
+	IsActive bool
+}
+
+type Segment struct {
+	ID          int
+	Slug        string
+	Description string
+	Owner       string
+	Tags        []string
+	Bucketing   string
+	Salt        string
+	Fraction    int
+	StartsAt    *time.Time
+	EndsAt      *time.Time
+	IsActive    bool
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   *time.Time
+}
+
+type Relation struct {
+	ID             int
+	UserID         int
+	SegmentID      int
+	IsActive       bool
+	DateAssigned   time.Time
+	DateUnassigned *time.Time
+	UnassignReason string
+}
+
+type Ramp struct {
+	ID        int
+	SegmentID int
+	Fraction  int
+	RunAt     time.Time
+	AppliedAt *time.Time
+	JobID     string
+}
+
+type Job struct {
+	ID              string
+	Kind            string
+	Status          string
+	Params          []byte
+	Result          []byte
+	Error           string
+	Done            int
+	Total           int
+	CancelRequested bool
+	Actor           string
+	Reason          string
+	Holder          string
+	HeartbeatAt     *time.Time
+	CreatedAt       time.Time
+	StartedAt       *time.Time
+	FinishedAt      *time.Time
+	UpdatedAt       time.Time
+}
+
+// Store mirrors the users, segments, user_segment_relation, segment_ramps, membership_audit and jobs tables. Callers must hold the embedded lock while reading or changing the data.
+// Relations are only changed through NewRelation, Deactivate and ChangeExpiry, which append to Audit.
+type Store struct {
+	sync.RWMutex
+	Users     map[int]*User
+	Segments  []*Segment
+	Relations []*Relation
+	Ramps     []*Ramp
+	Audit     []*audit.Entry
+	Jobs      []*Job
+
+	// active indexes the active relations by user and segment, so membership checks do not scan Relations
+	active map[[2]int]*Relation
+
+	lastSegmentID  int
+	lastRelationID int
+	lastRampID     int
+	lastAuditID    int
+}
+
+func New() *Store {
+	return &Store{
+		Users:     map[int]*User{},
+		Segments:  []*Segment{},
+		Relations: []*Relation{},
+		Ramps:     []*Ramp{},
+		Audit:     []*audit.Entry{},
+		Jobs:      []*Job{},
+		active:    map[[2]int]*Relation{},
+	}
+}
+
+// AddUsers creates active users with the given ids, the same way `usersegmentator migrate seed` loads the users
+// fixtures of pkg/migrate/fixtures.
+func (s *Store) AddUsers(ids ...int) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, id := range ids {
+		s.Users[id] = &User{ID: id, IsActive: true}
+	}
+}
+
+func (s *Store) SegmentBySlug(slug string) *Segment {
+	for _, seg := range s.Segments {
+		if seg.Slug == slug {
+			return seg
+		}
+	}
+	return nil
+}
+
+func (s *Store) SegmentByID(id int) *Segment {
+	for _, seg := range s.Segments {
+		if seg.ID == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+func (s *Store) NewSegment(slug string) *Segment {
+	s.lastSegmentID++
+	now := Now()
+	seg := &Segment{
+		ID:        s.lastSegmentID,
+		Slug:      slug,
+		Tags:      []string{},
+		IsActive:  true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.Segments = append(s.Segments, seg)
+	return seg
+}
+
+func (s *Store) NewRelation(
+	userID, segmentID int,
+	assigned time.Time,
+	expiresAt *time.Time,
+	origin audit.Origin,
+) *Relation {
+	s.lastRelationID++
+	rel := &Relation{
+		ID:             s.lastRelationID,
+		UserID:         userID,
+		SegmentID:      segmentID,
+		IsActive:       true,
+		DateAssigned:   assigned,
+		DateUnassigned: expiresAt,
+	}
+	s.Relations = append(s.Relations, rel)
+	s.active[[2]int{userID, segmentID}] = rel
+	s.record(rel, audit.ActionAssign, expiresAt, origin, assigned)
+	return rel
+}
+
+func (s *Store) NewRamp(segmentID, fraction int, runAt time.Time) *Ramp {
+	s.lastRampID++
+	ramp := &Ramp{
+		ID:        s.lastRampID,
+		SegmentID: segmentID,
+		Fraction:  fraction,
+		RunAt:     runAt,
+	}
+	s.Ramps = append(s.Ramps, ramp)
+	return ramp
+}
+
+// ChangeExpiry moves the expiry of rel and audits the change.
+func (s *Store) ChangeExpiry(rel *Relation, expiresAt *time.Time, changed time.Time, origin audit.Origin) {
+	rel.DateUnassigned = expiresAt
+	s.record(rel, audit.ActionExpiryChange, expiresAt, origin, changed)
+}
+
+func (s *Store) JobByID(id string) *Job {
+	for _, j := range s.Jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+func (s *Store) ActiveRelation(userID, segmentID int) *Relation {
+	return s.active[[2]int{userID, segmentID}]
+}
+
+// HasRelation reports whether the user has ever been assigned the segment, including inactive relations.
+func (s *Store) HasRelation(userID, segmentID int) bool {
+	for _, rel := range s.Relations {
+		if rel.UserID == userID && rel.SegmentID == segmentID {
+			return true
+		}
+	}
+	return false
+}
+
+// Deactivate marks rel inactive. A nil unassigned keeps the previously stored DateUnassigned.
+func (s *Store) Deactivate(rel *Relation, unassigned *time.Time, origin audit.Origin) {
+	rel.IsActive = false
+	if unassigned != nil {
+		rel.DateUnassigned = unassigned
+	}
+	delete(s.active, [2]int{rel.UserID, rel.SegmentID})
+	s.record(rel, audit.ActionUnassign, nil, origin, Now())
+}
+
+// DeactivateAt marks rel inactive as of at, a moment in the past, and dates its audit entry at the same moment.
+func (s *Store) DeactivateAt(rel *Relation, at time.Time, origin audit.Origin) {
+	rel.IsActive = false
+	rel.DateUnassigned = &at
+	delete(s.active, [2]int{rel.UserID, rel.SegmentID})
+	s.record(rel, audit.ActionUnassign, nil, origin, at)
+}
+
+func (s *Store) record(rel *Relation, action string, expiresAt *time.Time, origin audit.Origin, created time.Time) {
+	s.lastAuditID++
+	s.Audit = append(s.Audit, &audit.Entry{
+		ID:        s.lastAuditID,
+		UserID:    rel.UserID,
+		SegmentID: rel.SegmentID,
+		Action:    action,
+		Origin:    origin,
+		ExpiresAt: expiresAt,
+		CreatedAt: created,
+	})
+}
+
+// Now returns the current time the way a DATETIME column stores it: in UTC with second precision.
+func Now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
@@ -0,0 +1,9 @@
+SET SESSION cte_max_recursion_depth = 2000;
+
+INSERT IGNORE INTO `users` (`id`)
+WITH RECURSIVE seq (n) AS (
+    SELECT 1000
+    UNION ALL
+    SELECT n + 1 FROM seq WHERE n < 2000
+)
+SELECT n FROM seq;
@@ -0,0 +1,3 @@
+INSERT INTO users (id) SELECT generate_series(1000, 2000) ON CONFLICT (id) DO NOTHING;
+
+SELECT setval(pg_get_serial_sequence('users', 'id'), (SELECT MAX(id) FROM users));
@@ -0,0 +1,269 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"usersegmentator/pkg/dialect"
+	errs "usersegmentator/pkg/errors"
+)
+
+//go:embed migrations fixtures
+var files embed.FS
+
+var ErrSchemaBehind = errors.New("database schema is behind, run the migrate subcommand")
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Migrator struct {
+	db         *sql.DB
+	dialect    dialect.Dialect
+	migrations []Migration
+	InfoLog    *log.Logger
+	ErrLog     *log.Logger
+}
+
+func NewMigrator(db *sql.DB, d dialect.Dialect) (*Migrator, error) {
+	migrations, err := loadMigrations(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         db,
+		dialect:    d,
+		migrations: migrations,
+		InfoLog:    log.New(os.Stdout, "INFO\tMIGRATE\t", log.Ldate|log.Ltime),
+		ErrLog:     log.New(os.Stdout, "ERROR\tMIGRATE\t", log.Ldate|log.Ltime),
+	}, nil
+}
+
+// loadMigrations reads NNNN_name.up.sql and NNNN_name.down.sql pairs of the dialect, ordered by version.
+func loadMigrations(d dialect.Dialect) ([]Migration, error) {
+	dir := path.Join("migrations", string(d))
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", d, err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		versionStr, rest, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("malformed migration file name %s", name)
+		}
+
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("malformed migration version in %s: %w", name, err)
+		}
+
+		body, err := fs.ReadFile(files, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version}
+			byVersion[version] = m
+		}
+
+		switch {
+		case strings.HasSuffix(rest, ".up.sql"):
+			m.Name = strings.TrimSuffix(rest, ".up.sql")
+			m.Up = string(body)
+		case strings.HasSuffix(rest, ".down.sql"):
+			m.Down = string(body)
+		default:
+			return nil, fmt.Errorf("migration %s is neither up nor down", name)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d must have both up and down steps", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func (m *Migrator) ensureVersionTable(ctx context.Context) error {
+	_, err := m.db.ExecContext(
+		ctx,
+		"CREATE TABLE IF NOT EXISTS schema_migrations ("+
+			"version INT NOT NULL PRIMARY KEY, "+
+			"applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+	)
+	return err
+}
+
+// Latest returns the version of the newest embedded migration.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the version of the most recently applied migration, 0 for an empty database.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	err := m.ensureVersionTable(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = m.db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(version.Int64), nil
+}
+
+// Check fails with ErrSchemaBehind unless every embedded migration has been applied.
+func (m *Migrator) Check(ctx context.Context) error {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if version < m.Latest() {
+		return fmt.Errorf("%w: version %d, expected %d", ErrSchemaBehind, version, m.Latest())
+	}
+	return nil
+}
+
+// Up applies every pending migration, each in its own transaction.
+func (m *Migrator) Up(ctx context.Context) error {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range m.migrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		err = m.apply(ctx, migration.Up,
+			m.dialect.Rebind("INSERT INTO schema_migrations (version) VALUES (?)"), migration.Version)
+		if err != nil {
+			return fmt.Errorf("migration %d_%s up: %w", migration.Version, migration.Name, err)
+		}
+		m.InfoLog.Printf("Applied %d_%s\n", migration.Version, migration.Name)
+	}
+
+	return nil
+}
+
+// Down reverts the given number of most recently applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version > version {
+			continue
+		}
+
+		err = m.apply(ctx, migration.Down,
+			m.dialect.Rebind("DELETE FROM schema_migrations WHERE version = ?"), migration.Version)
+		if err != nil {
+			return fmt.Errorf("migration %d_%s down: %w", migration.Version, migration.Name, err)
+		}
+		m.InfoLog.Printf("Reverted %d_%s\n", migration.Version, migration.Name)
+		steps--
+	}
+
+	return nil
+}
+
+// apply runs a migration script and records the version change in the same transaction.
+// MySQL commits DDL implicitly, so there a failed script may leave the schema partially changed.
+func (m *Migrator) apply(ctx context.Context, script, versionQuery string, version int) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		m.ErrLog.Printf("%s: %s", errs.ErrorBeginTransaction, err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, versionQuery, version)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		m.ErrLog.Printf("%s: %s", errs.ErrorCommittingTransaction, err)
+		return err
+	}
+
+	return nil
+}
+
+// Seed loads the optional fixtures, such as the synthetic users 1000–2000. It is never run automatically,
+// so production databases only get fixtures on explicit request.
+func (m *Migrator) Seed(ctx context.Context) error {
+	err := m.Check(ctx)
+	if err != nil {
+		return err
+	}
+
+	dir := path.Join("fixtures", string(m.dialect))
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return fmt.Errorf("no fixtures for %s: %w", m.dialect, err)
+	}
+
+	for _, entry := range entries {
+		body, err := fs.ReadFile(files, path.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		_, err = m.db.ExecContext(ctx, string(body))
+		if err != nil {
+			return fmt.Errorf("fixture %s: %w", entry.Name(), err)
+		}
+		m.InfoLog.Printf("Loaded fixture %s\n", entry.Name())
+	}
+
+	return nil
+}
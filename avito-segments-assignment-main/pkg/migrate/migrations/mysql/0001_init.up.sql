@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS `users` (
+    `id` INT(4) ZEROFILL NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `is_active` BOOL DEFAULT TRUE NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `segments` (
+    `id` INT(3) NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `slug` VARCHAR(50) NOT NULL UNIQUE,
+    `is_active` BOOL DEFAULT TRUE NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `user_segment_relation` (
+    `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `user_id` INT(4) ZEROFILL NOT NULL,
+    `segment_id` INT(3) NOT NULL,
+    `is_active` BOOL DEFAULT TRUE NOT NULL,
+    `date_assigned` DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    `date_unassigned` DATETIME,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (segment_id) REFERENCES segments(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS `segment_tags`;
+
+ALTER TABLE `segments`
+    DROP COLUMN `description`,
+    DROP COLUMN `owner`,
+    DROP COLUMN `created_at`,
+    DROP COLUMN `updated_at`,
+    DROP COLUMN `deleted_at`;
@@ -0,0 +1,16 @@
+ALTER TABLE `segments`
+    ADD COLUMN `description` VARCHAR(1000) DEFAULT '' NOT NULL,
+    ADD COLUMN `owner` VARCHAR(100) DEFAULT '' NOT NULL,
+    ADD COLUMN `created_at` DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    ADD COLUMN `updated_at` DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    ADD COLUMN `deleted_at` DATETIME;
+
+UPDATE `segments` SET `deleted_at` = CURRENT_TIMESTAMP WHERE `is_active` = FALSE;
+
+CREATE TABLE IF NOT EXISTS `segment_tags` (
+    `segment_id` INT(3) NOT NULL,
+    `tag` VARCHAR(50) NOT NULL,
+    PRIMARY KEY (`segment_id`, `tag`),
+    INDEX `segment_tags_tag` (`tag`),
+    FOREIGN KEY (segment_id) REFERENCES segments(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
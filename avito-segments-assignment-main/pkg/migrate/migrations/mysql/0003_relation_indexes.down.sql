@@ -0,0 +1 @@
+DROP INDEX `user_segment_relation_segment_user` ON `user_segment_relation`;
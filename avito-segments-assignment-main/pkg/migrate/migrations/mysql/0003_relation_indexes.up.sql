@@ -0,0 +1 @@
+CREATE INDEX `user_segment_relation_segment_user` ON `user_segment_relation` (`segment_id`, `user_id`);
@@ -0,0 +1,4 @@
+ALTER TABLE `segments`
+    ADD COLUMN `bucketing` VARCHAR(10) DEFAULT 'random' NOT NULL,
+    ADD COLUMN `salt` VARCHAR(64) DEFAULT '' NOT NULL,
+    ADD COLUMN `fraction` INT DEFAULT 0 NOT NULL;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS `segment_ramps` (
+    `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `segment_id` INT(3) NOT NULL,
+    `fraction` INT NOT NULL,
+    `run_at` DATETIME NOT NULL,
+    `applied_at` DATETIME,
+    INDEX `segment_ramps_due` (`applied_at`, `run_at`),
+    FOREIGN KEY (segment_id) REFERENCES segments(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
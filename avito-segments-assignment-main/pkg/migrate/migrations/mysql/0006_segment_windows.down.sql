@@ -0,0 +1,6 @@
+ALTER TABLE `user_segment_relation`
+    DROP COLUMN `unassign_reason`;
+
+ALTER TABLE `segments`
+    DROP COLUMN `starts_at`,
+    DROP COLUMN `ends_at`;
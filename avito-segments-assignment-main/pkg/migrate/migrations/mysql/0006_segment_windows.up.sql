@@ -0,0 +1,6 @@
+ALTER TABLE `segments`
+    ADD COLUMN `starts_at` DATETIME,
+    ADD COLUMN `ends_at` DATETIME;
+
+ALTER TABLE `user_segment_relation`
+    ADD COLUMN `unassign_reason` VARCHAR(20) DEFAULT '' NOT NULL;
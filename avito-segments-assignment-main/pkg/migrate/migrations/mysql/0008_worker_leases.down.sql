@@ -0,0 +1,3 @@
+DROP INDEX `user_segment_relation_expiry` ON `user_segment_relation`;
+
+DROP TABLE IF EXISTS `worker_leases`;
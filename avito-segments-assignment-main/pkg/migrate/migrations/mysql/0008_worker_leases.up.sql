@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS `worker_leases` (
+    `name` VARCHAR(50) NOT NULL PRIMARY KEY,
+    `holder` VARCHAR(100) NOT NULL,
+    `expires_at` DATETIME NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE INDEX `user_segment_relation_expiry` ON `user_segment_relation` (`is_active`, `date_unassigned`);
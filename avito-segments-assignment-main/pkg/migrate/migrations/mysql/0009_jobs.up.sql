@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS `jobs` (
+    `id` VARCHAR(32) NOT NULL PRIMARY KEY,
+    `kind` VARCHAR(30) NOT NULL,
+    `status` VARCHAR(20) NOT NULL,
+    `params` TEXT NOT NULL,
+    `result` TEXT,
+    `error_message` TEXT,
+    `done` INT DEFAULT 0 NOT NULL,
+    `total` INT DEFAULT 0 NOT NULL,
+    `cancel_requested` BOOL DEFAULT FALSE NOT NULL,
+    `holder` VARCHAR(100) DEFAULT '' NOT NULL,
+    `heartbeat_at` DATETIME,
+    `created_at` DATETIME NOT NULL,
+    `started_at` DATETIME,
+    `finished_at` DATETIME,
+    `updated_at` DATETIME NOT NULL,
+    INDEX `jobs_status` (`status`, `created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
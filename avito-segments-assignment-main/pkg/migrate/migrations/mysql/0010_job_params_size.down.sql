@@ -0,0 +1 @@
+ALTER TABLE `jobs` MODIFY `params` TEXT NOT NULL;
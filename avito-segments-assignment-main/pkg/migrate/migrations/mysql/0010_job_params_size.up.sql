@@ -0,0 +1,2 @@
+-- import jobs carry their rows in params, TEXT stops at 64 KB
+ALTER TABLE `jobs` MODIFY `params` MEDIUMTEXT NOT NULL;
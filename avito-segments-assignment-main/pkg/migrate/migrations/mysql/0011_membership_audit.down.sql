@@ -0,0 +1,5 @@
+ALTER TABLE `jobs`
+    DROP COLUMN `actor`,
+    DROP COLUMN `reason`;
+
+DROP TABLE IF EXISTS `membership_audit`;
@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS `membership_audit` (
+    `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `user_id` INT(4) ZEROFILL NOT NULL,
+    `segment_id` INT(3) NOT NULL,
+    `action` VARCHAR(20) NOT NULL,
+    `source` VARCHAR(20) NOT NULL,
+    `actor` VARCHAR(100) NOT NULL,
+    `reason` VARCHAR(255) DEFAULT '' NOT NULL,
+    `expires_at` DATETIME,
+    `created_at` DATETIME NOT NULL,
+    INDEX `membership_audit_user` (`user_id`, `created_at`),
+    INDEX `membership_audit_segment` (`segment_id`, `created_at`),
+    INDEX `membership_audit_created` (`created_at`),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (segment_id) REFERENCES segments(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+ALTER TABLE `jobs`
+    ADD COLUMN `actor` VARCHAR(100) DEFAULT '' NOT NULL,
+    ADD COLUMN `reason` VARCHAR(255) DEFAULT '' NOT NULL;
+
+-- the changes made before the audit existed are rebuilt from the relations,
+-- an unassignment at the moment its segment was deleted is taken for the deletion
+INSERT INTO `membership_audit` (`user_id`, `segment_id`, `action`, `source`, `actor`, `reason`, `expires_at`, `created_at`)
+SELECT `user_id`, `segment_id`, 'assign', 'manual', 'system', 'backfilled', NULL, `date_assigned`
+FROM `user_segment_relation`;
+
+INSERT INTO `membership_audit` (`user_id`, `segment_id`, `action`, `source`, `actor`, `reason`, `expires_at`, `created_at`)
+SELECT r.`user_id`, r.`segment_id`, 'unassign',
+    CASE
+        WHEN r.`unassign_reason` = 'expired' THEN 'ttl'
+        WHEN s.`deleted_at` = r.`date_unassigned` THEN 'segment_delete'
+        ELSE 'manual'
+    END,
+    'system', 'backfilled', NULL, r.`date_unassigned`
+FROM `user_segment_relation` r
+JOIN `segments` s ON r.`segment_id` = s.`id`
+WHERE r.`is_active` = FALSE AND r.`date_unassigned` IS NOT NULL;
+
+INSERT INTO `membership_audit` (`user_id`, `segment_id`, `action`, `source`, `actor`, `reason`, `expires_at`, `created_at`)
+SELECT `user_id`, `segment_id`, 'expiry_change', 'manual', 'system', 'backfilled', `new_expires_at`, `changed_at`
+FROM `membership_expiry_changes`;
@@ -0,0 +1 @@
+ALTER TABLE `segment_ramps` DROP COLUMN `job_id`;
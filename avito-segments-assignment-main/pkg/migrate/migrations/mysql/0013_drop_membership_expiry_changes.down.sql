@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS `membership_expiry_changes` (
+    `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `user_id` INT(4) ZEROFILL NOT NULL,
+    `segment_id` INT(3) NOT NULL,
+    `old_expires_at` DATETIME,
+    `new_expires_at` DATETIME,
+    `changed_at` DATETIME NOT NULL,
+    INDEX `membership_expiry_changes_user` (`user_id`, `changed_at`),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (segment_id) REFERENCES segments(id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,2 @@
+-- expiry changes are recorded in membership_audit, which 0011 backfilled from this table
+DROP TABLE IF EXISTS `membership_expiry_changes`;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS user_segment_relation;
+DROP TABLE IF EXISTS segments;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS users (
+    id        SERIAL PRIMARY KEY,
+    is_active BOOLEAN DEFAULT TRUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS segments (
+    id        SERIAL PRIMARY KEY,
+    slug      VARCHAR(50) NOT NULL UNIQUE,
+    is_active BOOLEAN DEFAULT TRUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_segment_relation (
+    id              SERIAL PRIMARY KEY,
+    user_id         INT NOT NULL REFERENCES users (id),
+    segment_id      INT NOT NULL REFERENCES segments (id),
+    is_active       BOOLEAN DEFAULT TRUE NOT NULL,
+    date_assigned   TIMESTAMP DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'UTC') NOT NULL,
+    date_unassigned TIMESTAMP
+);
@@ -0,0 +1,16 @@
+ALTER TABLE segments
+    ADD COLUMN description VARCHAR(1000) DEFAULT '' NOT NULL,
+    ADD COLUMN owner       VARCHAR(100) DEFAULT '' NOT NULL,
+    ADD COLUMN created_at  TIMESTAMP DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'UTC') NOT NULL,
+    ADD COLUMN updated_at  TIMESTAMP DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'UTC') NOT NULL,
+    ADD COLUMN deleted_at  TIMESTAMP;
+
+UPDATE segments SET deleted_at = CURRENT_TIMESTAMP AT TIME ZONE 'UTC' WHERE is_active = FALSE;
+
+CREATE TABLE IF NOT EXISTS segment_tags (
+    segment_id INT NOT NULL REFERENCES segments (id),
+    tag        VARCHAR(50) NOT NULL,
+    PRIMARY KEY (segment_id, tag)
+);
+
+CREATE INDEX IF NOT EXISTS segment_tags_tag ON segment_tags (tag);
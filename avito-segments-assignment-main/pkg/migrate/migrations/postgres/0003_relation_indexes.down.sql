@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS user_segment_relation_user;
+
+DROP INDEX IF EXISTS user_segment_relation_segment_user;
@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS user_segment_relation_segment_user ON user_segment_relation (segment_id, user_id);
+
+CREATE INDEX IF NOT EXISTS user_segment_relation_user ON user_segment_relation (user_id);
@@ -0,0 +1,4 @@
+ALTER TABLE segments
+    DROP COLUMN bucketing,
+    DROP COLUMN salt,
+    DROP COLUMN fraction;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS segment_ramps (
+    id         SERIAL PRIMARY KEY,
+    segment_id INT NOT NULL REFERENCES segments (id),
+    fraction   INT NOT NULL,
+    run_at     TIMESTAMP NOT NULL,
+    applied_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS segment_ramps_due ON segment_ramps (applied_at, run_at);
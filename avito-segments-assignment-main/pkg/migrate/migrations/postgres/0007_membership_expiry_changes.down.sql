@@ -0,0 +1 @@
+DROP TABLE IF EXISTS membership_expiry_changes;
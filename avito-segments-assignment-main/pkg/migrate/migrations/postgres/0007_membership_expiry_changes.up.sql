@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS membership_expiry_changes (
+    id             SERIAL PRIMARY KEY,
+    user_id        INT NOT NULL REFERENCES users (id),
+    segment_id     INT NOT NULL REFERENCES segments (id),
+    old_expires_at TIMESTAMP,
+    new_expires_at TIMESTAMP,
+    changed_at     TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS membership_expiry_changes_user ON membership_expiry_changes (user_id, changed_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS user_segment_relation_expiry;
+
+DROP TABLE IF EXISTS worker_leases;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS worker_leases (
+    name       VARCHAR(50) PRIMARY KEY,
+    holder     VARCHAR(100) NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS user_segment_relation_expiry ON user_segment_relation (is_active, date_unassigned);
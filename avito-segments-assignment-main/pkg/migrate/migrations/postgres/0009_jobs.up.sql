@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS jobs (
+    id               VARCHAR(32) PRIMARY KEY,
+    kind             VARCHAR(30) NOT NULL,
+    status           VARCHAR(20) NOT NULL,
+    params           TEXT NOT NULL,
+    result           TEXT,
+    error_message    TEXT,
+    done             INT DEFAULT 0 NOT NULL,
+    total            INT DEFAULT 0 NOT NULL,
+    cancel_requested BOOLEAN DEFAULT FALSE NOT NULL,
+    holder           VARCHAR(100) DEFAULT '' NOT NULL,
+    heartbeat_at     TIMESTAMP,
+    created_at       TIMESTAMP NOT NULL,
+    started_at       TIMESTAMP,
+    finished_at      TIMESTAMP,
+    updated_at       TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS jobs_status ON jobs (status, created_at);
@@ -0,0 +1 @@
+ALTER TABLE jobs ALTER COLUMN params TYPE TEXT;
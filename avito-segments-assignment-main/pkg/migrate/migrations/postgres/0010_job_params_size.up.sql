@@ -0,0 +1,2 @@
+-- TEXT has no length limit in PostgreSQL, the column already fits the rows of an import job
+ALTER TABLE jobs ALTER COLUMN params TYPE TEXT;
@@ -0,0 +1,5 @@
+ALTER TABLE jobs
+    DROP COLUMN IF EXISTS actor,
+    DROP COLUMN IF EXISTS reason;
+
+DROP TABLE IF EXISTS membership_audit;
@@ -0,0 +1,41 @@
+CREATE TABLE IF NOT EXISTS membership_audit (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    INT NOT NULL REFERENCES users (id),
+    segment_id INT NOT NULL REFERENCES segments (id),
+    action     VARCHAR(20) NOT NULL,
+    source     VARCHAR(20) NOT NULL,
+    actor      VARCHAR(100) NOT NULL,
+    reason     VARCHAR(255) DEFAULT '' NOT NULL,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS membership_audit_user ON membership_audit (user_id, created_at);
+CREATE INDEX IF NOT EXISTS membership_audit_segment ON membership_audit (segment_id, created_at);
+CREATE INDEX IF NOT EXISTS membership_audit_created ON membership_audit (created_at);
+
+ALTER TABLE jobs
+    ADD COLUMN IF NOT EXISTS actor VARCHAR(100) DEFAULT '' NOT NULL,
+    ADD COLUMN IF NOT EXISTS reason VARCHAR(255) DEFAULT '' NOT NULL;
+
+-- the changes made before the audit existed are rebuilt from the relations,
+-- an unassignment at the moment its segment was deleted is taken for the deletion
+INSERT INTO membership_audit (user_id, segment_id, action, source, actor, reason, expires_at, created_at)
+SELECT user_id, segment_id, 'assign', 'manual', 'system', 'backfilled', NULL, date_assigned
+FROM user_segment_relation;
+
+INSERT INTO membership_audit (user_id, segment_id, action, source, actor, reason, expires_at, created_at)
+SELECT r.user_id, r.segment_id, 'unassign',
+    CASE
+        WHEN r.unassign_reason = 'expired' THEN 'ttl'
+        WHEN s.deleted_at = r.date_unassigned THEN 'segment_delete'
+        ELSE 'manual'
+    END,
+    'system', 'backfilled', NULL, r.date_unassigned
+FROM user_segment_relation r
+JOIN segments s ON r.segment_id = s.id
+WHERE r.is_active = FALSE AND r.date_unassigned IS NOT NULL;
+
+INSERT INTO membership_audit (user_id, segment_id, action, source, actor, reason, expires_at, created_at)
+SELECT user_id, segment_id, 'expiry_change', 'manual', 'system', 'backfilled', new_expires_at, changed_at
+FROM membership_expiry_changes;
@@ -0,0 +1,2 @@
+-- the set_fraction job a ramp step was handed to, NULL for the steps skipped in favour of a later one
+ALTER TABLE segment_ramps ADD COLUMN IF NOT EXISTS job_id VARCHAR(32);
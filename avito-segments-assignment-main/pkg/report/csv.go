@@ -0,0 +1,40 @@
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// csvWriter writes RFC 4180 CSV: CRLF line breaks, fields quoted when they need to be, and a header row.
+type csvWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func newCSVWriter(w io.Writer, columns []string, delimiter string) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w), record: make([]string, len(columns))}
+	cw.w.UseCRLF = true
+	if delimiter != "" {
+		cw.w.Comma, _ = utf8.DecodeRuneInString(delimiter)
+	}
+
+	err := cw.w.Write(columns)
+	if err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) Write(values []interface{}) error {
+	for i, v := range values {
+		cw.record[i] = fmt.Sprint(v)
+	}
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
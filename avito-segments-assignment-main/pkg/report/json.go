@@ -0,0 +1,73 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// jsonWriter writes every row as an object with the keys in the order of the columns: one object per line for NDJSON,
+// or the elements of a single array for JSON.
+type jsonWriter struct {
+	w     io.Writer
+	keys  [][]byte
+	array bool
+	rows  int
+	buf   bytes.Buffer
+}
+
+func newJSONWriter(w io.Writer, columns []string, array bool) (*jsonWriter, error) {
+	jw := &jsonWriter{w: w, array: array}
+	for _, column := range columns {
+		key, err := json.Marshal(column)
+		if err != nil {
+			return nil, err
+		}
+		jw.keys = append(jw.keys, key)
+	}
+
+	if array {
+		_, err := io.WriteString(w, "[")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return jw, nil
+}
+
+func (jw *jsonWriter) Write(values []interface{}) error {
+	jw.buf.Reset()
+	if jw.array && jw.rows > 0 {
+		jw.buf.WriteByte(',')
+	}
+
+	jw.buf.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			jw.buf.WriteByte(',')
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		jw.buf.Write(jw.keys[i])
+		jw.buf.WriteByte(':')
+		jw.buf.Write(value)
+	}
+	jw.buf.WriteByte('}')
+	if !jw.array {
+		jw.buf.WriteByte('\n')
+	}
+
+	jw.rows++
+	_, err := jw.w.Write(jw.buf.Bytes())
+	return err
+}
+
+func (jw *jsonWriter) Close() error {
+	if !jw.array {
+		return nil
+	}
+	_, err := io.WriteString(jw.w, "]\n")
+	return err
+}
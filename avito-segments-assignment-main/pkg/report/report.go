@@ -0,0 +1,100 @@
+package report
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Formats of the report files.
+const (
+	CSV    = "csv"
+	NDJSON = "ndjson"
+	JSON   = "json"
+	XLSX   = "xlsx"
+)
+
+var ErrInvalidOptions = errors.New("invalid report options")
+
+var contentTypes = map[string]string{
+	CSV:    "text/csv",
+	NDJSON: "application/x-ndjson",
+	JSON:   "application/json",
+	XLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// Options choose the format of a report. Delimiter is a single character separating the CSV fields.
+type Options struct {
+	Format    string `json:"format,omitempty"`
+	Delimiter string `json:"delimiter,omitempty"`
+}
+
+// Validate checks the options that are set, empty ones are filled with defaults later.
+func (o *Options) Validate() error {
+	if _, ok := contentTypes[o.Format]; o.Format != "" && !ok {
+		return fmt.Errorf("%w: unknown format %q, expected %s, %s, %s or %s", ErrInvalidOptions, o.Format,
+			CSV, NDJSON, JSON, XLSX)
+	}
+	if o.Delimiter == "" {
+		return nil
+	}
+
+	r, size := utf8.DecodeRuneInString(o.Delimiter)
+	if size != len(o.Delimiter) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return fmt.Errorf("%w: delimiter %q must be a single character other than a quote or a line break",
+			ErrInvalidOptions, o.Delimiter)
+	}
+	return nil
+}
+
+// WithDefaults returns the options with the empty ones taken from defaults.
+func (o Options) WithDefaults(defaults Options) Options {
+	if o.Format == "" {
+		o.Format = defaults.Format
+	}
+	if o.Delimiter == "" {
+		o.Delimiter = defaults.Delimiter
+	}
+	return o
+}
+
+// Ext is the file extension of the format, with the leading dot.
+func Ext(format string) string {
+	return "." + format
+}
+
+// ContentType is the MIME type of the format.
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// Writer writes the rows of a report one at a time, nothing but the current row is kept in memory.
+type Writer interface {
+	// Write adds a row, the values follow the columns the writer was created with.
+	// Values are ints or strings, an empty string is an empty cell.
+	Write(values []interface{}) error
+	// Close completes the document and flushes it. The underlying writer is left open.
+	Close() error
+}
+
+// NewWriter starts a report with the given columns in the format of opts. The header is written right away.
+func NewWriter(w io.Writer, columns []string, opts Options) (Writer, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.Format {
+	case CSV:
+		return newCSVWriter(w, columns, opts.Delimiter)
+	case NDJSON:
+		return newJSONWriter(w, columns, false)
+	case JSON:
+		return newJSONWriter(w, columns, true)
+	case XLSX:
+		return newXLSXWriter(w, columns)
+	default:
+		return nil, fmt.Errorf("%w: format is required", ErrInvalidOptions)
+	}
+}
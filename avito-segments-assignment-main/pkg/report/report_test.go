@@ -0,0 +1,249 @@
+package report
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"testing"
+)
+
+var testColumns = []string{"user_id", "segment", "reason"}
+
+// writeReport writes the rows in the format of opts and returns the document.
+func writeReport(t *testing.T, opts Options, rows ...[]interface{}) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, testColumns, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		err = w.Write(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCSV(t *testing.T) {
+	tests := []struct {
+		name      string
+		delimiter string
+		row       []interface{}
+		want      string
+	}{
+		{"plain fields", "", []interface{}{1000, "AVITO_VOICE_MESSAGES", ""},
+			"user_id,segment,reason\r\n1000,AVITO_VOICE_MESSAGES,\r\n"},
+		{"delimiter in a field", "", []interface{}{1000, "AVITO_VOICE_MESSAGES", "rollout, step 2"},
+			"user_id,segment,reason\r\n1000,AVITO_VOICE_MESSAGES,\"rollout, step 2\"\r\n"},
+		{"quote in a field", "", []interface{}{1000, "AVITO_VOICE_MESSAGES", `the "checkout" test`},
+			"user_id,segment,reason\r\n1000,AVITO_VOICE_MESSAGES,\"the \"\"checkout\"\" test\"\r\n"},
+		{"line break in a field", "", []interface{}{1000, "AVITO_VOICE_MESSAGES", "first line\nsecond line"},
+			"user_id,segment,reason\r\n1000,AVITO_VOICE_MESSAGES,\"first line\r\nsecond line\"\r\n"},
+		{"semicolon delimiter", ";", []interface{}{1000, "AVITO_VOICE_MESSAGES", "a;b, c"},
+			"user_id;segment;reason\r\n1000;AVITO_VOICE_MESSAGES;\"a;b, c\"\r\n"},
+		{"tab delimiter", "\t", []interface{}{1000, "AVITO_VOICE_MESSAGES", "a, b"},
+			"user_id\tsegment\treason\r\n1000\tAVITO_VOICE_MESSAGES\ta, b\r\n"},
+		{"multibyte delimiter", "¦", []interface{}{1000, "AVITO_VOICE_MESSAGES", "a¦b"},
+			"user_id¦segment¦reason\r\n1000¦AVITO_VOICE_MESSAGES¦\"a¦b\"\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := writeReport(t, Options{Format: CSV, Delimiter: tt.delimiter}, tt.row)
+			if string(got) != tt.want {
+				t.Errorf("report = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderOnly(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{CSV, "user_id,segment,reason\r\n"},
+		{NDJSON, ""},
+		{JSON, "[]\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			got := writeReport(t, Options{Format: tt.format})
+			if string(got) != tt.want {
+				t.Errorf("empty report = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	rows := [][]interface{}{{1000, "AVITO_VOICE_MESSAGES", ""}, {1001, "AVITO_DISCOUNT_30", `"quoted"`}}
+
+	ndjson := writeReport(t, Options{Format: NDJSON}, rows...)
+	want := `{"user_id":1000,"segment":"AVITO_VOICE_MESSAGES","reason":""}` + "\n" +
+		`{"user_id":1001,"segment":"AVITO_DISCOUNT_30","reason":"\"quoted\""}` + "\n"
+	if string(ndjson) != want {
+		t.Errorf("ndjson = %q, want %q", ndjson, want)
+	}
+
+	array := writeReport(t, Options{Format: JSON}, rows...)
+	want = `[{"user_id":1000,"segment":"AVITO_VOICE_MESSAGES","reason":""},` +
+		`{"user_id":1001,"segment":"AVITO_DISCOUNT_30","reason":"\"quoted\""}]` + "\n"
+	if string(array) != want {
+		t.Errorf("json = %q, want %q", array, want)
+	}
+}
+
+// xlsxSheet is the part of a worksheet the tests read back.
+type xlsxSheet struct {
+	Rows []struct {
+		R     string `xml:"r,attr"`
+		Cells []struct {
+			R      string `xml:"r,attr"`
+			T      string `xml:"t,attr"`
+			Value  string `xml:"v"`
+			Inline string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func TestXLSX(t *testing.T) {
+	doc := writeReport(t, Options{Format: XLSX},
+		[]interface{}{1000, "AVITO_VOICE_MESSAGES", ""},
+		[]interface{}{1001, "AVITO_DISCOUNT_30", "<b> & \"quoted\"\n"},
+	)
+
+	archive, err := zip.NewReader(bytes.NewReader(doc), int64(len(doc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := map[string]*zip.File{}
+	for _, f := range archive.File {
+		parts[f.Name] = f
+	}
+	for _, part := range xlsxParts {
+		if parts[part.name] == nil {
+			t.Errorf("the workbook has no %s", part.name)
+		}
+	}
+	if parts["xl/worksheets/sheet1.xml"] == nil {
+		t.Fatal("the workbook has no sheet")
+	}
+
+	rc, err := parts["xl/worksheets/sheet1.xml"].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sheet := &xlsxSheet{}
+	err = xml.Unmarshal(b, sheet)
+	if err != nil {
+		t.Fatalf("decoding the sheet: %s\n%s", err, b)
+	}
+	if len(sheet.Rows) != 3 {
+		t.Fatalf("%d rows, want the header and 2 rows", len(sheet.Rows))
+	}
+
+	header := sheet.Rows[0]
+	for i, column := range testColumns {
+		if cell := header.Cells[i]; cell.T != "inlineStr" || cell.Inline != column {
+			t.Errorf("header cell %d = %+v, want %s", i, cell, column)
+		}
+	}
+
+	// an empty string is an empty cell, so the first row has no C1
+	first := sheet.Rows[1]
+	if first.R != "2" || len(first.Cells) != 2 ||
+		first.Cells[0].R != "A2" || first.Cells[0].T != "" || first.Cells[0].Value != "1000" ||
+		first.Cells[1].R != "B2" || first.Cells[1].Inline != "AVITO_VOICE_MESSAGES" {
+		t.Errorf("row 2 = %+v", first)
+	}
+
+	second := sheet.Rows[2]
+	if len(second.Cells) != 3 || second.Cells[2].R != "C3" || second.Cells[2].Inline != "<b> & \"quoted\"\n" {
+		t.Errorf("row 3 = %+v", second)
+	}
+}
+
+func TestXLSXUnsupportedValue(t *testing.T) {
+	w, err := NewWriter(io.Discard, testColumns, Options{Format: XLSX})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write([]interface{}{1000, "AVITO_VOICE_MESSAGES", 1.5})
+	if err == nil {
+		t.Error("a float is written")
+	}
+}
+
+func TestColumnName(t *testing.T) {
+	tests := []struct {
+		i    int
+		want string
+	}{
+		{0, "A"},
+		{1, "B"},
+		{25, "Z"},
+		{26, "AA"},
+		{27, "AB"},
+		{51, "AZ"},
+		{52, "BA"},
+		{701, "ZZ"},
+		{702, "AAA"},
+	}
+
+	for _, tt := range tests {
+		if got := columnName(tt.i); got != tt.want {
+			t.Errorf("columnName(%d) = %s, want %s", tt.i, got, tt.want)
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  Options
+		valid bool
+	}{
+		{"defaults", Options{}, true},
+		{"csv with a semicolon", Options{Format: CSV, Delimiter: ";"}, true},
+		{"xlsx", Options{Format: XLSX}, true},
+		{"unknown format", Options{Format: "pdf"}, false},
+		{"two characters", Options{Delimiter: ";;"}, false},
+		{"quote", Options{Delimiter: `"`}, false},
+		{"line break", Options{Delimiter: "\n"}, false},
+		{"invalid UTF-8", Options{Delimiter: "\xff"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("err = %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("err = %v, want %v", err, ErrInvalidOptions)
+			}
+		})
+	}
+
+	_, err := NewWriter(io.Discard, testColumns, Options{})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("err = %v without a format, want %v", err, ErrInvalidOptions)
+	}
+}
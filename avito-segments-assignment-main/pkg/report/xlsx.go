@@ -0,0 +1,167 @@
+package report
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxXLSXRows is the row limit of an Excel sheet, the header included.
+const maxXLSXRows = 1048576
+
+// The parts of the workbook besides the sheet never change. Strings are stored inline in the cells,
+// so there is no shared strings table to build before the sheet is written.
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ` +
+		`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ` +
+		`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ` +
+		`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" ` +
+		`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" ` +
+		`Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="report" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header +
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" ` +
+		`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" ` +
+		`Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" ` +
+		`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" ` +
+		`Target="styles.xml"/>` +
+		`</Relationships>`},
+	{"xl/styles.xml", xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<fonts count="1"><font/></fonts>` +
+		`<fills count="1"><fill/></fills>` +
+		`<borders count="1"><border/></borders>` +
+		`<cellStyleXfs count="1"><xf/></cellStyleXfs>` +
+		`<cellXfs count="1"><xf/></cellXfs>` +
+		`</styleSheet>`},
+}
+
+const (
+	xlsxSheetStart = xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<sheetData>`
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+// xlsxWriter writes a workbook with a single sheet. The sheet is the last part of the archive
+// and its rows are compressed as they come.
+type xlsxWriter struct {
+	zip     *zip.Writer
+	sheet   *bufio.Writer
+	columns []string
+	rows    int
+}
+
+func newXLSXWriter(w io.Writer, columns []string) (*xlsxWriter, error) {
+	xw := &xlsxWriter{zip: zip.NewWriter(w)}
+	for _, part := range xlsxParts {
+		f, err := xw.zip.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(f, part.content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := xw.zip.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	xw.sheet = bufio.NewWriter(f)
+	_, err = xw.sheet.WriteString(xlsxSheetStart)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range columns {
+		xw.columns = append(xw.columns, columnName(i))
+	}
+
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	err = xw.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return xw, nil
+}
+
+func (xw *xlsxWriter) Write(values []interface{}) error {
+	if xw.rows == maxXLSXRows {
+		return fmt.Errorf("the report has more than %d rows, the limit of an xlsx sheet", maxXLSXRows-1)
+	}
+	xw.rows++
+
+	row := strconv.Itoa(xw.rows)
+	_, err := xw.sheet.WriteString(`<row r="` + row + `">`)
+	if err != nil {
+		return err
+	}
+
+	for i, v := range values {
+		ref := xw.columns[i] + row
+		switch v := v.(type) {
+		case int:
+			_, err = xw.sheet.WriteString(`<c r="` + ref + `"><v>` + strconv.Itoa(v) + `</v></c>`)
+		case string:
+			if v == "" {
+				continue
+			}
+			_, err = xw.sheet.WriteString(`<c r="` + ref + `" t="inlineStr"><is><t xml:space="preserve">`)
+			if err == nil {
+				err = xml.EscapeText(xw.sheet, []byte(v))
+			}
+			if err == nil {
+				_, err = xw.sheet.WriteString(`</t></is></c>`)
+			}
+		default:
+			err = fmt.Errorf("unsupported xlsx value %T", v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = xw.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (xw *xlsxWriter) Close() error {
+	_, err := xw.sheet.WriteString(xlsxSheetEnd)
+	if err != nil {
+		return err
+	}
+	err = xw.sheet.Flush()
+	if err != nil {
+		return err
+	}
+	return xw.zip.Close()
+}
+
+// columnName returns the letters of the i-th column counting from 0: A, B, ..., Z, AA, AB and so on.
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 { //nolint:gomnd // letters in the alphabet
+		name = string(rune('A'+(i-1)%26)) + name //nolint:gomnd // letters in the alphabet
+	}
+	return name
+}
@@ -0,0 +1,100 @@
+package reportstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// localStorage keeps the report files in a directory. Replicas only see each other's reports
+// when the directory is shared between them.
+type localStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) Storage {
+	return &localStorage{dir: dir}
+}
+
+func (ls *localStorage) Put(_ context.Context, name, _ string, write func(w io.Writer) error) error {
+	path := filepath.Join(ls.dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(file)
+	err = write(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func (ls *localStorage) Get(_ context.Context, name string) (*Object, error) {
+	file, err := os.Open(filepath.Join(ls.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &Object{Body: file, Modified: info.ModTime()}, nil
+}
+
+func (ls *localStorage) List(_ context.Context, prefix string, fn func(name string, modified time.Time) error) error {
+	entries, err := os.ReadDir(ls.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = fn(entry.Name(), info.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ls *localStorage) Remove(_ context.Context, name string) error {
+	err := os.Remove(filepath.Join(ls.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (ls *localStorage) PresignGet(context.Context, string, time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
@@ -0,0 +1,139 @@
+package reportstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+	"usersegmentator/config"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize is the smallest part S3 accepts. An upload of unknown size buffers a whole part in memory,
+// so the report is sent in parts of 5 MiB and can grow to 10000 of them.
+const s3PartSize = 5 << 20
+
+// s3Timeout bounds the bucket check at startup.
+const s3Timeout = 10 * time.Second
+
+// s3NoSuchKey is the error code of a missing object.
+const s3NoSuchKey = "NoSuchKey"
+
+// s3Storage keeps the report files in a bucket of an S3-compatible object store, shared by all the replicas.
+// Links are presigned with the public endpoint when it differs from the one the service reaches the store at.
+type s3Storage struct {
+	client    *minio.Client
+	presigner *minio.Client
+	bucket    string
+}
+
+// NewS3Storage connects to the bucket of report.s3 and creates it when it doesn't exist yet.
+func NewS3Storage(cfg *config.ReportS3) (Storage, error) {
+	opts := &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		// with the region set the client never asks the store for it, presigning stays offline
+		Region: cfg.Region,
+	}
+	client, err := minio.New(cfg.Endpoint, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &s3Storage{client: client, presigner: client, bucket: cfg.Bucket}
+	if cfg.PublicEndpoint != "" && cfg.PublicEndpoint != cfg.Endpoint {
+		s.presigner, err = minio.New(cfg.PublicEndpoint, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("checking bucket %s: %w", cfg.Bucket, err)
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region})
+		if err != nil {
+			return nil, fmt.Errorf("creating bucket %s: %w", cfg.Bucket, err)
+		}
+	}
+	return s, nil
+}
+
+// Put uploads the file as it is written. A failed write aborts the upload, so no object is created.
+func (s *s3Storage) Put(ctx context.Context, name, contentType string, write func(w io.Writer) error) error {
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		_ = pw.CloseWithError(err)
+		written <- err
+	}()
+
+	_, err := s.client.PutObject(ctx, s.bucket, name, pr, -1,
+		minio.PutObjectOptions{ContentType: contentType, PartSize: s3PartSize})
+	// a failed upload stops reading, the writer is unblocked with the upload error
+	_ = pr.CloseWithError(err)
+
+	if writeErr := <-written; writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+func (s *s3Storage) Get(ctx context.Context, name string) (*Object, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := obj.Stat()
+	if err != nil {
+		_ = obj.Close()
+		if minio.ToErrorResponse(err).Code == s3NoSuchKey {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+		}
+		return nil, err
+	}
+	return &Object{Body: obj, Modified: info.LastModified}, nil
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string, fn func(name string, modified time.Time) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	// stops the listing when fn fails half way
+	defer cancel()
+
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		err := fn(obj.Key, obj.LastModified)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Storage) Remove(ctx context.Context, name string) error {
+	return s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+}
+
+// PresignGet signs a GET of the object that saves it under its own name.
+func (s *s3Storage) PresignGet(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	params := url.Values{}
+	params.Set("response-content-disposition", `attachment; filename="`+name+`"`)
+
+	u, err := s.presigner.PresignedGetObject(ctx, s.bucket, name, ttl, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
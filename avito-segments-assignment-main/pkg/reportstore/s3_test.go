@@ -0,0 +1,193 @@
+package reportstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"usersegmentator/config"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// newTestS3Storage connects to the MinIO of REPORTSTORE_S3_ENDPOINT with REPORTSTORE_S3_ACCESS_KEY
+// and REPORTSTORE_S3_SECRET_KEY and creates a throwaway bucket, which is emptied and removed after the test.
+func newTestS3Storage(t *testing.T) *s3Storage {
+	t.Helper()
+	endpoint := os.Getenv("REPORTSTORE_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("REPORTSTORE_S3_ENDPOINT is not set")
+	}
+
+	cfg := &config.ReportS3{
+		Endpoint:  endpoint,
+		Region:    "us-east-1",
+		Bucket:    fmt.Sprintf("reportstore-test-%d", time.Now().UnixNano()),
+		AccessKey: os.Getenv("REPORTSTORE_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("REPORTSTORE_S3_SECRET_KEY"),
+	}
+	storage, err := NewS3Storage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := storage.(*s3Storage)
+	t.Cleanup(func() {
+		ctx := context.Background()
+		for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Recursive: true}) {
+			if obj.Err == nil {
+				_ = s.client.RemoveObject(ctx, s.bucket, obj.Key, minio.RemoveObjectOptions{})
+			}
+		}
+		err := s.client.RemoveBucket(ctx, s.bucket)
+		if err != nil {
+			t.Errorf("removing bucket %s: %s", s.bucket, err)
+		}
+	})
+	return s
+}
+
+func putString(t *testing.T, s Storage, name, body string) {
+	t.Helper()
+	err := s.Put(context.Background(), name, "text/csv", func(w io.Writer) error {
+		_, err := io.WriteString(w, body)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readBody(t *testing.T, body io.ReadCloser) string {
+	t.Helper()
+	defer body.Close()
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestS3StoragePutGet(t *testing.T) {
+	s := newTestS3Storage(t)
+	ctx := context.Background()
+
+	before := time.Now().Add(-time.Minute)
+	putString(t, s, "report_a.csv", "user_id,segment\n1000,AVITO_VOICE_MESSAGES\n")
+
+	obj, err := s.Get(ctx, "report_a.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, obj.Body); body != "user_id,segment\n1000,AVITO_VOICE_MESSAGES\n" {
+		t.Errorf("body = %q", body)
+	}
+	if obj.Modified.Before(before) {
+		t.Errorf("modified = %s, the object was put after %s", obj.Modified, before)
+	}
+
+	_, err = s.Get(ctx, "report_missing.csv")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestS3StoragePutFailureLeavesNothing(t *testing.T) {
+	s := newTestS3Storage(t)
+	failed := errors.New("database went away")
+
+	err := s.Put(context.Background(), "report_broken.csv", "text/csv", func(w io.Writer) error {
+		_, _ = io.WriteString(w, "half a report")
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("err = %v, want %v", err, failed)
+	}
+
+	_, err = s.Get(context.Background(), "report_broken.csv")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestS3StorageListRemove(t *testing.T) {
+	s := newTestS3Storage(t)
+	ctx := context.Background()
+
+	putString(t, s, "report_a.csv", "a")
+	putString(t, s, "report_b.csv", "b")
+	putString(t, s, "notes.txt", "not a report")
+
+	list := func() []string {
+		var names []string
+		err := s.List(ctx, "report_", func(name string, modified time.Time) error {
+			if modified.IsZero() {
+				t.Errorf("%s has no modification time", name)
+			}
+			names = append(names, name)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+
+	if names := strings.Join(list(), ","); names != "report_a.csv,report_b.csv" {
+		t.Errorf("listed %s, want report_a.csv,report_b.csv", names)
+	}
+
+	stop := errors.New("stop")
+	err := s.List(ctx, "report_", func(string, time.Time) error { return stop })
+	if !errors.Is(err, stop) {
+		t.Errorf("err = %v, want the error of fn", err)
+	}
+
+	err = s.Remove(ctx, "report_a.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Get(ctx, "report_a.csv")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("err = %v, want %v", err, ErrNotFound)
+	}
+	if names := strings.Join(list(), ","); names != "report_b.csv" {
+		t.Errorf("listed %s after the removal, want report_b.csv", names)
+	}
+
+	// the cleaners of several replicas may remove the same file
+	err = s.Remove(ctx, "report_a.csv")
+	if err != nil {
+		t.Errorf("removing a missing object: %s", err)
+	}
+}
+
+func TestS3StoragePresignGet(t *testing.T) {
+	s := newTestS3Storage(t)
+	putString(t, s, "report_a.csv", "user_id,segment\n")
+
+	link, err := s.PresignGet(context.Background(), "report_a.csv", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != `attachment; filename="report_a.csv"` {
+		t.Errorf("Content-Disposition = %s", disposition)
+	}
+	if body := readBody(t, resp.Body); body != "user_id,segment\n" {
+		t.Errorf("body = %q", body)
+	}
+}
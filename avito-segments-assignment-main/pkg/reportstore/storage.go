@@ -0,0 +1,30 @@
+package reportstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrPresignUnsupported = errors.New("the storage can't presign download links")
+
+// Storage holds the report files by name. The names come from Store, a Storage doesn't check them.
+type Storage interface {
+	// Put stores the file written by write under name. Nothing is left behind when write fails.
+	Put(ctx context.Context, name, contentType string, write func(w io.Writer) error) error
+	// Get opens a file for reading, ErrNotFound when there is no such file.
+	Get(ctx context.Context, name string) (*Object, error)
+	// List calls fn with every file whose name starts with prefix.
+	List(ctx context.Context, prefix string, fn func(name string, modified time.Time) error) error
+	// Remove deletes a file, a missing file is not an error.
+	Remove(ctx context.Context, name string) error
+	// PresignGet returns a link to download the file straight from the storage for ttl.
+	PresignGet(ctx context.Context, name string, ttl time.Duration) (string, error)
+}
+
+// Object is an open report file.
+type Object struct {
+	Body     io.ReadSeekCloser
+	Modified time.Time
+}
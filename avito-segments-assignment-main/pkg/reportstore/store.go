@@ -0,0 +1,236 @@
+package reportstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/report"
+)
+
+// idBytes is the entropy of a report id, 128 bits can't be guessed or enumerated.
+const idBytes = 16
+
+var (
+	ErrInvalidLink = errors.New("invalid report link")
+	ErrLinkExpired = errors.New("report link has expired")
+	ErrNotFound    = errors.New("report not found")
+)
+
+// Store names the report files, keeps them in a Storage for report.retention minutes and hands out links to them,
+// valid for report.link_ttl minutes. Links to the service are signed with HMAC-SHA256, with presigned downloads
+// they are presigned by the storage instead.
+type Store struct {
+	storage   Storage
+	prefix    string
+	names     *regexp.Regexp
+	presign   bool
+	retention time.Duration
+	cleanup   time.Duration
+	linkTTL   time.Duration
+	baseURL   string
+	key       []byte
+	InfoLog   *log.Logger
+	ErrLog    *log.Logger
+}
+
+// New sets up the storage of report.backend.
+func New(cfg *config.Config) (*Store, error) {
+	var (
+		storage Storage
+		err     error
+	)
+	switch cfg.Report.Backend {
+	case config.ReportBackendS3:
+		storage, err = NewS3Storage(&cfg.Report.S3)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		storage = NewLocalStorage(cfg.Report.StorageDir)
+	}
+	return NewStore(storage, cfg)
+}
+
+func NewStore(storage Storage, cfg *config.Config) (*Store, error) {
+	s := &Store{
+		storage:   storage,
+		prefix:    cfg.Report.FilePrefix,
+		names:     regexp.MustCompile(`^` + regexp.QuoteMeta(cfg.Report.FilePrefix) + `[0-9a-f]{32}\.[a-z]+$`),
+		presign:   cfg.Report.Download == config.ReportDownloadPresigned,
+		retention: time.Duration(cfg.Report.Retention) * time.Minute,
+		cleanup:   time.Duration(cfg.Report.CleanupInterval) * time.Minute,
+		linkTTL:   time.Duration(cfg.Report.LinkTTL) * time.Minute,
+		baseURL:   cfg.HTTP.PublicURL,
+		key:       []byte(cfg.Report.SigningKey),
+		InfoLog:   log.New(os.Stdout, "INFO\tREPORT STORE\t", log.Ldate|log.Ltime),
+		ErrLog:    log.New(os.Stdout, "ERROR\tREPORT STORE\t", log.Ldate|log.Ltime),
+	}
+
+	if len(s.key) == 0 {
+		if !s.presign {
+			return nil, errors.New("REPORT_SIGNING_KEY is required to sign the download links")
+		}
+		// presigned downloads never hand out links to the service, but they are still checked there,
+		// and an empty key would let anyone sign them
+		s.key = make([]byte, sha256.Size)
+		_, err := rand.Read(s.key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// newID returns a random report id of 32 hex digits.
+func newID() (string, error) {
+	b := make([]byte, idBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Save writes a new report file in format and returns its name. Nothing is stored when write fails.
+func (s *Store) Save(ctx context.Context, format string, write func(w io.Writer) error) (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	name := s.prefix + id + report.Ext(format)
+
+	err = s.storage.Put(ctx, name, report.ContentType(format), write)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// URL returns the download link of the report and the moment it expires. A link never outlives the file.
+func (s *Store) URL(ctx context.Context, name string) (string, time.Time, error) {
+	ttl := s.linkTTL
+	if s.retention < ttl {
+		ttl = s.retention
+	}
+	expires := time.Now().UTC().Add(ttl).Truncate(time.Second)
+
+	if s.presign {
+		link, err := s.storage.PresignGet(ctx, name, ttl)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return link, expires, nil
+	}
+
+	link, err := url.JoinPath(s.baseURL, "reports", name)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", s.sign(name, expires.Unix()))
+	return link + "?" + query.Encode(), expires, nil
+}
+
+// Verify checks the expires and signature query parameters of a download link to the report.
+func (s *Store) Verify(name, expires, signature string, now time.Time) error {
+	if !s.names.MatchString(name) {
+		return fmt.Errorf("%w: unexpected report name %q", ErrInvalidLink, name)
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: expires is not a unix timestamp", ErrInvalidLink)
+	}
+
+	// the signature is checked first, an expired but forged link is reported as forged
+	if !hmac.Equal([]byte(signature), []byte(s.sign(name, unix))) {
+		return fmt.Errorf("%w: signature mismatch for %s", ErrInvalidLink, name)
+	}
+	if !now.Before(time.Unix(unix, 0)) {
+		return fmt.Errorf("%w: %s expired at %s", ErrLinkExpired, name, time.Unix(unix, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (s *Store) sign(name string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(name + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Open opens a report file for reading. Files past the retention are not served even before the cleaner removes them.
+func (s *Store) Open(ctx context.Context, name string) (*Object, error) {
+	if !s.names.MatchString(name) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+
+	obj, err := s.storage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if s.expired(obj.Modified, time.Now()) {
+		_ = obj.Body.Close()
+		return nil, fmt.Errorf("%w: %s is past the retention", ErrNotFound, name)
+	}
+	return obj, nil
+}
+
+func (s *Store) expired(modified, now time.Time) bool {
+	return !now.Before(modified.Add(s.retention))
+}
+
+// RunCleaner removes the reports past the retention every report.cleanup_interval minutes until ctx is done.
+// Every replica runs its own cleaner: with a shared bucket they may race to remove the same file, which is harmless.
+// Only the files named like reports are touched.
+func (s *Store) RunCleaner(ctx context.Context) {
+	s.InfoLog.Printf("Report cleaner is running every %s, reports are kept for %s", s.cleanup, s.retention)
+	ticker := time.NewTicker(s.cleanup)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.InfoLog.Printf("Report cleaner has been stopped")
+			return
+		case <-ticker.C:
+		}
+
+		removed, err := s.removeExpired(ctx, time.Now())
+		if err != nil {
+			s.ErrLog.Printf("error removing expired reports after %d files: %s", removed, err)
+			continue
+		}
+		if removed > 0 {
+			s.InfoLog.Printf("Report cleaner removed %d expired reports", removed)
+		}
+	}
+}
+
+func (s *Store) removeExpired(ctx context.Context, now time.Time) (int, error) {
+	removed := 0
+	err := s.storage.List(ctx, s.prefix, func(name string, modified time.Time) error {
+		if !s.names.MatchString(name) || !s.expired(modified, now) {
+			return nil
+		}
+		err := s.storage.Remove(ctx, name)
+		if err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,264 @@
+package reportstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"usersegmentator/config"
+)
+
+const testSigningKey = "0123456789abcdef0123456789abcdef"
+
+func testConfig(dir string) *config.Config {
+	cfg := &config.Config{}
+	cfg.HTTP.PublicURL = "http://localhost:8000/segmentator"
+	cfg.Report.FilePrefix = "report_"
+	cfg.Report.Backend = config.ReportBackendLocal
+	cfg.Report.Download = config.ReportDownloadProxy
+	cfg.Report.StorageDir = dir
+	cfg.Report.Retention = 60
+	cfg.Report.CleanupInterval = 10
+	cfg.Report.LinkTTL = 30
+	cfg.Report.SigningKey = testSigningKey
+	return cfg
+}
+
+func newLocalStore(t *testing.T, cfg *config.Config) *Store {
+	t.Helper()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.InfoLog.SetOutput(io.Discard)
+	s.ErrLog.SetOutput(io.Discard)
+	return s
+}
+
+func saveReport(t *testing.T, s *Store, body string) string {
+	t.Helper()
+	name, err := s.Save(context.Background(), "csv", func(w io.Writer) error {
+		_, err := io.WriteString(w, body)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// linkParams splits a download link into the report name and its query.
+func linkParams(t *testing.T, link string) (string, url.Values) {
+	t.Helper()
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Path[strings.LastIndex(u.Path, "/")+1:], u.Query()
+}
+
+func TestNewStoreRequiresSigningKeyForProxy(t *testing.T) {
+	cfg := testConfig(t.TempDir())
+	cfg.Report.SigningKey = ""
+
+	_, err := New(cfg)
+	if err == nil {
+		t.Fatal("expected an error without REPORT_SIGNING_KEY")
+	}
+}
+
+func TestStoreURL(t *testing.T) {
+	s := newLocalStore(t, testConfig(t.TempDir()))
+	name := saveReport(t, s, "user_id,segment\n1000,AVITO_VOICE_MESSAGES\n")
+
+	before := time.Now().UTC().Truncate(time.Second)
+	link, expires, err := s.URL(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(link, "http://localhost:8000/segmentator/reports/"+name+"?") {
+		t.Errorf("link %s doesn't point to the report under the public URL", link)
+	}
+	if want := before.Add(30 * time.Minute); expires.Before(want) || expires.After(want.Add(time.Second)) {
+		t.Errorf("expires = %s, want link_ttl after %s", expires, before)
+	}
+
+	linkName, query := linkParams(t, link)
+	if linkName != name {
+		t.Errorf("link name = %s, want %s", linkName, name)
+	}
+	if query.Get("expires") != strconv.FormatInt(expires.Unix(), 10) {
+		t.Errorf("expires parameter = %s, want %d", query.Get("expires"), expires.Unix())
+	}
+	if query.Get("signature") == "" {
+		t.Error("link is not signed")
+	}
+}
+
+func TestStoreURLNeverOutlivesTheFile(t *testing.T) {
+	cfg := testConfig(t.TempDir())
+	cfg.Report.Retention = 5
+	s := newLocalStore(t, cfg)
+	name := saveReport(t, s, "")
+
+	before := time.Now().UTC().Truncate(time.Second)
+	_, expires, err := s.URL(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires.After(before.Add(5*time.Minute + time.Second)) {
+		t.Errorf("expires = %s, the file is kept for 5 minutes after %s", expires, before)
+	}
+}
+
+func TestStoreURLPresignedNeedsS3(t *testing.T) {
+	cfg := testConfig(t.TempDir())
+	cfg.Report.Download = config.ReportDownloadPresigned
+	s := newLocalStore(t, cfg)
+
+	_, _, err := s.URL(context.Background(), saveReport(t, s, ""))
+	if !errors.Is(err, ErrPresignUnsupported) {
+		t.Errorf("err = %v, want %v", err, ErrPresignUnsupported)
+	}
+}
+
+func TestStoreVerify(t *testing.T) {
+	s := newLocalStore(t, testConfig(t.TempDir()))
+	name := saveReport(t, s, "")
+
+	link, expires, err := s.URL(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, query := linkParams(t, link)
+	signature := query.Get("signature")
+	unix := query.Get("expires")
+
+	other := newLocalStore(t, testConfig(t.TempDir()))
+	otherName := saveReport(t, other, "")
+
+	forger := testConfig(t.TempDir())
+	forger.Report.SigningKey = strings.Repeat("f", len(testSigningKey))
+	forged, _, err := newLocalStore(t, forger).URL(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, forgedQuery := linkParams(t, forged)
+
+	tests := []struct {
+		name      string
+		report    string
+		expires   string
+		signature string
+		now       time.Time
+		want      error
+	}{
+		{"valid", name, unix, signature, time.Now(), nil},
+		{"last second", name, unix, signature, expires.Add(-time.Second), nil},
+		{"expired", name, unix, signature, expires, ErrLinkExpired},
+		{"another report", otherName, unix, signature, time.Now(), ErrInvalidLink},
+		{"extended expiry", name, strconv.FormatInt(expires.Add(time.Hour).Unix(), 10), signature, time.Now(), ErrInvalidLink},
+		{"expired and forged", name, unix, strings.Repeat("0", len(signature)), expires.Add(time.Hour), ErrInvalidLink},
+		{"signed with another key", name, forgedQuery.Get("expires"), forgedQuery.Get("signature"), time.Now(), ErrInvalidLink},
+		{"no signature", name, unix, "", time.Now(), ErrInvalidLink},
+		{"expires is not a number", name, "tomorrow", signature, time.Now(), ErrInvalidLink},
+		{"path traversal", "../" + name, unix, signature, time.Now(), ErrInvalidLink},
+		{"not a report", "config.yml", unix, signature, time.Now(), ErrInvalidLink},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.Verify(tt.report, tt.expires, tt.signature, tt.now)
+			if tt.want == nil && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreRemoveExpired(t *testing.T) {
+	dir := t.TempDir()
+	s := newLocalStore(t, testConfig(dir))
+	ctx := context.Background()
+
+	stale := saveReport(t, s, "stale")
+	fresh := saveReport(t, s, "fresh")
+
+	// a file that only shares the prefix is not a report, the cleaner leaves it alone however old it is
+	notes := filepath.Join(dir, "report_notes.txt")
+	err := os.WriteFile(notes, []byte("keep me"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, path := range []string{filepath.Join(dir, stale), notes} {
+		err = os.Chtimes(path, old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = s.Open(ctx, stale)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("opening a report past the retention: err = %v, want %v", err, ErrNotFound)
+	}
+
+	removed, err := s.removeExpired(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed = %d, want 1", removed)
+	}
+
+	for path, want := range map[string]bool{filepath.Join(dir, stale): false, filepath.Join(dir, fresh): true, notes: true} {
+		_, err = os.Stat(path)
+		if exists := err == nil; exists != want {
+			t.Errorf("%s exists = %t, want %t", filepath.Base(path), exists, want)
+		}
+	}
+
+	obj, err := s.Open(ctx, fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Body.Close()
+
+	body, err := io.ReadAll(obj.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "fresh" {
+		t.Errorf("body = %q, want %q", body, "fresh")
+	}
+}
+
+func TestLocalStoragePutFailureLeavesNothing(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewLocalStorage(dir)
+	failed := errors.New("database went away")
+
+	err := storage.Put(context.Background(), "report_broken.csv", "text/csv", func(w io.Writer) error {
+		_, _ = io.WriteString(w, "half a report")
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("err = %v, want %v", err, failed)
+	}
+
+	_, err = storage.Get(context.Background(), "report_broken.csv")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("err = %v, want %v", err, ErrNotFound)
+	}
+}
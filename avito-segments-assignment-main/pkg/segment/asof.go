@@ -0,0 +1,105 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"usersegmentator/pkg/memstore"
+)
+
+// validateAsOf rejects moments in the future, the segments of a user are only known up to now.
+func validateAsOf(asOf, now time.Time) error {
+	if asOf.After(now) {
+		return fmt.Errorf("%w: as_of %s is in the future", ErrInvalidInput, asOf.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// existedAt reports whether the segment was created and not yet deleted at the moment. Segments closed
+// by the end of their window carry the end as deletion time as well.
+func existedAt(createdAt time.Time, deletedAt *time.Time, asOf time.Time) bool {
+	return !createdAt.After(asOf) && (deletedAt == nil || deletedAt.After(asOf))
+}
+
+// relationAt reports whether the relation covered the moment. date_unassigned of a closed relation is when it
+// was closed, that of an open one the expiry, so both end the membership the same way.
+func relationAt(rel *memstore.Relation, asOf time.Time) bool {
+	return !rel.DateAssigned.After(asOf) && (rel.DateUnassigned == nil || rel.DateUnassigned.After(asOf))
+}
+
+// userSegmentsAsOf reconstructs the segments of the user at asOf from the stored relations, keeping only segments
+// that existed and were within their window then. Hash segments the user had no relation with by then are
+// evaluated by the bucket with their current fraction, as the fractions of the past are not stored.
+func (sr *segmentsRepository) userSegmentsAsOf(ctx context.Context, userID int, asOf time.Time) ([]*Segment, error) {
+	const lifetime = "created_at <= ? AND (deleted_at IS NULL OR deleted_at > ?) AND " + windowCondition
+
+	segments, err := sr.readSegments(
+		ctx,
+		sr.db,
+		"WHERE id IN ("+
+			"SELECT segment_id FROM user_segment_relation "+
+			"WHERE user_id = ? AND date_assigned <= ? AND (date_unassigned IS NULL OR date_unassigned > ?)"+
+			") AND "+lifetime+" ORDER BY id",
+		userID,
+		asOf,
+		asOf,
+		asOf,
+		asOf,
+		asOf,
+		asOf,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	lazy, err := sr.readSegments(
+		ctx,
+		sr.db,
+		"WHERE bucketing = ? AND fraction > 0 AND "+lifetime+" "+
+			"AND id NOT IN (SELECT segment_id FROM user_segment_relation WHERE user_id = ? AND date_assigned <= ?) "+
+			"AND EXISTS (SELECT 1 FROM users WHERE id = ? AND is_active = TRUE)",
+		BucketingHash,
+		asOf,
+		asOf,
+		asOf,
+		asOf,
+		userID,
+		asOf,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeLazy(userID, segments, lazy), nil
+}
+
+// userSegmentsAsOf is the in-memory counterpart of the SQL one. The caller must hold the store lock.
+func (sr *memorySegmentsRepository) userSegmentsAsOf(userID int, asOf time.Time) []*Segment {
+	usr, userActive := sr.store.Users[userID]
+	userActive = userActive && usr.IsActive
+
+	member := map[int]bool{}
+	related := map[int]bool{}
+	for _, rel := range sr.store.Relations {
+		if rel.UserID != userID || rel.DateAssigned.After(asOf) {
+			continue
+		}
+		related[rel.SegmentID] = true
+		if relationAt(rel, asOf) {
+			member[rel.SegmentID] = true
+		}
+	}
+
+	segments := []*Segment{}
+	for _, stored := range sr.store.Segments {
+		seg := toSegment(stored)
+		if !existedAt(stored.CreatedAt, stored.DeletedAt, asOf) || !seg.inWindow(asOf) {
+			continue
+		}
+		if member[seg.ID] || userActive && !related[seg.ID] && seg.includes(userID) {
+			segments = append(segments, seg)
+		}
+	}
+	return segments
+}
@@ -0,0 +1,140 @@
+package segment
+
+import (
+	"context"
+	"database/sql"
+	"time"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/dialect"
+)
+
+// auditEntry is a membership change to append to membership_audit. ExpiresAt is the expiry an assignment
+// or an expiry change sets.
+type auditEntry struct {
+	UserID    int
+	SegmentID int
+	ExpiresAt *time.Time
+}
+
+func planEntries(userID int, segmentIDs []int, expiresAt *time.Time) []auditEntry {
+	entries := make([]auditEntry, 0, len(segmentIDs))
+	for _, segmentID := range segmentIDs {
+		entries = append(entries, auditEntry{UserID: userID, SegmentID: segmentID, ExpiresAt: expiresAt})
+	}
+	return entries
+}
+
+// writeAudit appends the entries of one action to membership_audit within the transaction that made the changes,
+// so a change is never stored without its entry. The source, actor and reason are taken from ctx.
+func (sr *segmentsRepository) writeAudit(ctx context.Context, tx *sql.Tx, action string, entries []auditEntry) error {
+	origin := audit.FromContext(ctx)
+	created := audit.TimeFromContext(ctx, time.Now()).UTC().Truncate(time.Second)
+
+	for len(entries) > 0 {
+		batch := entries
+		if len(batch) > sr.batchSize() {
+			batch = entries[:sr.batchSize()]
+		}
+		entries = entries[len(batch):]
+
+		args := make([]interface{}, 0, len(batch)*8) //nolint:gomnd // eight inserted columns
+		for _, e := range batch {
+			args = append(args, e.UserID, e.SegmentID, action, origin.Source, origin.Actor, origin.Reason,
+				nullTime(e.ExpiresAt), created)
+		}
+
+		_, err := tx.ExecContext(
+			ctx,
+			sr.dialect.Rebind("INSERT INTO membership_audit "+
+				"(user_id, segment_id, action, source, actor, reason, expires_at, created_at) VALUES "+
+				dialect.Values(len(batch), 8)), //nolint:gomnd // eight inserted columns
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeRelations deactivates all active relations matching where one batch at a time within tx
+// and audits every one of them as an unassignment. set continues the SET clause and starts with a comma.
+func (sr *segmentsRepository) closeRelations(
+	ctx context.Context,
+	tx *sql.Tx,
+	where string,
+	whereArgs []interface{},
+	set string,
+	setArgs []interface{},
+) (int, error) {
+	closed := 0
+	for {
+		n, err := sr.closeRelationsBatch(ctx, tx, where, whereArgs, set, setArgs)
+		closed += n
+		if err != nil || n < sr.batchSize() {
+			return closed, err
+		}
+	}
+}
+
+// closeRelationsBatch closes at most segment.batch_size of the relations closeRelations would. The relations are
+// locked first, so the audit lists exactly the rows the update changes.
+func (sr *segmentsRepository) closeRelationsBatch(
+	ctx context.Context,
+	tx *sql.Tx,
+	where string,
+	whereArgs []interface{},
+	set string,
+	setArgs []interface{},
+) (int, error) {
+	args := append(append([]interface{}{}, whereArgs...), sr.batchSize())
+	rows, err := tx.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT id, user_id, segment_id FROM user_segment_relation "+
+			"WHERE is_active = TRUE AND "+where+" ORDER BY id LIMIT ? FOR UPDATE"),
+		args...,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := []int{}
+	entries := []auditEntry{}
+	for rows.Next() {
+		var (
+			id    int
+			entry auditEntry
+		)
+		err = rows.Scan(&id, &entry.UserID, &entry.SegmentID)
+		if err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		entries = append(entries, entry)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		sr.dialect.Rebind("UPDATE user_segment_relation SET is_active = FALSE"+set+
+			" WHERE id IN ("+dialect.Placeholders(len(ids))+")"),
+		appendInts(append([]interface{}{}, setArgs...), ids)...,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	err = sr.writeAudit(ctx, tx, audit.ActionUnassign, entries)
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
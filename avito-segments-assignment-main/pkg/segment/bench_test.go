@@ -0,0 +1,91 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/memstore"
+)
+
+// benchUsers is the number of users every iteration assigns a throwaway segment to and unassigns it from.
+const benchUsers = 1000
+
+// benchBatchSizes are compared on a database. Batch size 1 issues a statement per user.
+var benchBatchSizes = []int{1, 100, 1000}
+
+func BenchmarkAssignMemory(b *testing.B) {
+	store := memstore.New()
+	for id := 1; id <= benchUsers; id++ {
+		store.AddUsers(id)
+	}
+
+	cfg := &config.Config{}
+	cfg.Storage.Driver = config.StorageMemory
+	benchAssign(b, quiet(NewMemorySegmentsRepo(store, cfg)))
+}
+
+// BenchmarkAssignSQL compares the batch sizes on the test database of openTestDB.
+func BenchmarkAssignSQL(b *testing.B) {
+	db, driver := openTestDB(b)
+
+	for _, size := range benchBatchSizes {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			cfg := &config.Config{}
+			cfg.Storage.Driver = driver
+			cfg.Segment.BatchSize = size
+			benchAssign(b, quiet(NewSegmentsRepo(db, cfg)))
+		})
+	}
+}
+
+// quiet drops the informational log of the repository, a line per call would bury the benchmark results.
+func quiet(repo Repository) Repository {
+	discard := log.New(io.Discard, "", 0)
+	switch r := repo.(type) {
+	case *segmentsRepository:
+		r.InfoLog = discard
+	case *memorySegmentsRepository:
+		r.InfoLog = discard
+	}
+	return repo
+}
+
+// benchAssign assigns and unassigns a throwaway segment for the same users on every iteration
+// and reports the users handled per second.
+func benchAssign(b *testing.B, repo Repository) {
+	ctx := context.Background()
+	slug := fmt.Sprintf("BENCH_%d", time.Now().UnixNano())
+
+	_, err := repo.InsertSegment(ctx, &Segment{Slug: slug, Description: "throwaway segment of the assignment benchmark"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_ = repo.DeleteSegment(ctx, slug)
+	})
+
+	users, err := repo.GetNRandomUsersWithoutSegment(benchUsers, slug)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if len(users) == 0 {
+		b.Fatal("no active users to assign")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = repo.AssignSegments(ctx, users, []string{slug}, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = repo.UnassignSegments(ctx, users, []string{slug})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(users)*b.N)/b.Elapsed().Seconds(), "users/s")
+}
@@ -0,0 +1,103 @@
+package segment
+
+import (
+	"context"
+	"sort"
+	"time"
+	"usersegmentator/pkg/bucket"
+	"usersegmentator/pkg/job"
+)
+
+// includes reports whether a hash segment contains the user by its bucket alone, ignoring stored relations.
+func (s *Segment) includes(userID int) bool {
+	return s.Bucketing == BucketingHash && s.Fraction > 0 && bucket.Includes(s.Salt, userID, s.Fraction)
+}
+
+// bucketMembers returns the users whose bucket of the salt falls under the fraction.
+func bucketMembers(salt string, userIDs []int, fraction int) []int {
+	members := []int{}
+	for _, id := range userIDs {
+		if bucket.Includes(salt, id, fraction) {
+			members = append(members, id)
+		}
+	}
+	return members
+}
+
+// mergeLazy adds the hash segments the user falls into without a stored relation, keeping the id order.
+func mergeLazy(userID int, stored, lazy []*Segment) []*Segment {
+	for _, seg := range lazy {
+		if seg.includes(userID) {
+			stored = append(stored, seg)
+		}
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].ID < stored[j].ID
+	})
+	return stored
+}
+
+// assignBuckets materializes the members of a hash segment. Active users are read in id order one batch
+// at a time, so the whole users table is never loaded at once.
+func (sr *segmentsRepository) assignBuckets(
+	ctx context.Context,
+	seg *Segment,
+	fraction int,
+	expiresAt *time.Time,
+) error {
+	activeUsers, err := sr.GetActiveUsersAmount(ctx)
+	if err != nil {
+		return err
+	}
+
+	afterID, checked := 0, 0
+	for {
+		userIDs, err := sr.activeUsersAfter(ctx, afterID, sr.batchSize())
+		if err != nil {
+			return err
+		}
+		if len(userIDs) == 0 {
+			return nil
+		}
+		afterID = userIDs[len(userIDs)-1]
+
+		err = sr.AssignSegments(ctx, bucketMembers(seg.Salt, userIDs, fraction), []string{seg.Slug}, expiresAt)
+		if err != nil {
+			return err
+		}
+
+		checked += len(userIDs)
+		job.Progress(ctx, checked, activeUsers)
+	}
+}
+
+// activeUsersAfter returns up to limit active users with ids greater than afterID, ordered by id.
+func (sr *segmentsRepository) activeUsersAfter(ctx context.Context, afterID, limit int) ([]int, error) {
+	rows, err := sr.db.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT id FROM users WHERE is_active = TRUE AND id > ? ORDER BY id LIMIT ?"),
+		afterID,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanIDs(rows)
+}
+
+// lazySegments returns the active hash segments within their window at now that the user has never had
+// a relation with, provided the user is active. Whether the user falls into them is left to the caller.
+func (sr *segmentsRepository) lazySegments(ctx context.Context, userID int, now time.Time) ([]*Segment, error) {
+	return sr.readSegments(
+		ctx,
+		sr.db,
+		"WHERE is_active = TRUE AND bucketing = ? AND fraction > 0 AND "+windowCondition+" "+
+			"AND id NOT IN (SELECT segment_id FROM user_segment_relation WHERE user_id = ?) "+
+			"AND EXISTS (SELECT 1 FROM users WHERE id = ? AND is_active = TRUE)",
+		BucketingHash,
+		now,
+		now,
+		userID,
+		userID,
+	)
+}
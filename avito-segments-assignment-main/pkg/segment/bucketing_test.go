@@ -0,0 +1,52 @@
+package segment
+
+import (
+	"testing"
+	"usersegmentator/pkg/bucket"
+)
+
+func TestMergeLazy(t *testing.T) {
+	const salt = "checkout-2023-09"
+
+	// find a user inside the 50% bucket and one outside of it
+	in, out := 0, 0
+	for id := 1000; in == 0 || out == 0; id++ {
+		if bucket.Includes(salt, id, 50) {
+			in = id
+		} else {
+			out = id
+		}
+	}
+
+	stored := func() []*Segment {
+		return []*Segment{{ID: 1, Slug: "AVITO_VOICE_MESSAGES"}, {ID: 4, Slug: "AVITO_DISCOUNT_30"}}
+	}
+	lazy := []*Segment{
+		{ID: 3, Slug: "AVITO_NEW_CHECKOUT", Bucketing: BucketingHash, Salt: salt, Fraction: 50},
+		{ID: 2, Slug: "AVITO_PAUSED", Bucketing: BucketingHash, Salt: salt},
+		{ID: 5, Slug: "AVITO_RANDOM", Bucketing: BucketingRandom, Salt: salt, Fraction: 100},
+	}
+
+	tests := []struct {
+		name   string
+		userID int
+		want   []string
+	}{
+		{"user in the bucket", in, []string{"AVITO_VOICE_MESSAGES", "AVITO_NEW_CHECKOUT", "AVITO_DISCOUNT_30"}},
+		{"user out of the bucket", out, []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeLazy(tt.userID, stored(), lazy)
+			if len(got) != len(tt.want) {
+				t.Fatalf("%d segments, want %v", len(got), tt.want)
+			}
+			for i, seg := range got {
+				if seg.Slug != tt.want[i] {
+					t.Errorf("segment %d = %s, want %s", i, seg.Slug, tt.want[i])
+				}
+			}
+		})
+	}
+}
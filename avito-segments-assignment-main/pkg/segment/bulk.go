@@ -0,0 +1,158 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+	errs "usersegmentator/pkg/errors"
+)
+
+// defaultBulkMaxUsers bounds a bulk update when segment.bulk_max_users is not set.
+const defaultBulkMaxUsers = 10000
+
+func bulkMaxUsers(limit int) int {
+	if limit < 1 {
+		return defaultBulkMaxUsers
+	}
+	return limit
+}
+
+// userUpdate is a user of a bulk update with its expiry resolved. Index is its position in the request.
+type userUpdate struct {
+	Index     int
+	UserID    int
+	Assign    []string
+	Unassign  []string
+	ExpiresAt *time.Time
+}
+
+func (r *RequestBulkUpdate) validate(maxUsers int) error {
+	if r.Mode == "" {
+		r.Mode = BulkAllOrNothing
+	}
+	if r.Mode != BulkAllOrNothing && r.Mode != BulkBestEffort {
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalidInput, r.Mode)
+	}
+	if len(r.Users) == 0 {
+		return fmt.Errorf("%w: no users", ErrInvalidInput)
+	}
+	if len(r.Users) > maxUsers {
+		return fmt.Errorf("%w: %d users, at most %d are allowed", ErrTooManyUsers, len(r.Users), maxUsers)
+	}
+	for i, u := range r.Users {
+		if u == nil {
+			return fmt.Errorf("%w: user #%d is empty", ErrInvalidInput, i)
+		}
+	}
+	return nil
+}
+
+// resolve turns the users into updates and prepares the result. Users with an invalid expiry
+// are reported as failed in the result and left out of the updates.
+func (r *RequestBulkUpdate) resolve(now time.Time) ([]*userUpdate, *BulkUpdateResult) {
+	result := &BulkUpdateResult{Mode: r.Mode, Users: make([]BulkUserResult, len(r.Users))}
+	updates := make([]*userUpdate, 0, len(r.Users))
+
+	for i, u := range r.Users {
+		result.Users[i].UserID = u.UserID
+
+		expiresAt, err := MembershipExpiry(now, u.TTL, u.ExpiresAt, u.ExpiresIn)
+		if err != nil {
+			result.fail(i, err)
+			continue
+		}
+
+		updates = append(updates, &userUpdate{
+			Index:     i,
+			UserID:    u.UserID,
+			Assign:    u.AssignSegments,
+			Unassign:  u.UnassignSegments,
+			ExpiresAt: expiresAt,
+		})
+	}
+	return updates, result
+}
+
+func (r *BulkUpdateResult) fail(index int, err error) {
+	r.Users[index].Error = err.Error()
+	r.Failed++
+}
+
+func (r *BulkUpdateResult) apply(index int, results []SegmentResult) {
+	r.Users[index].Results = results
+	r.Applied++
+}
+
+// byUser orders the updates by user, so concurrent all_or_nothing updates lock the user rows in the same order.
+func byUser(updates []*userUpdate) []*userUpdate {
+	sorted := append([]*userUpdate{}, updates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].UserID < sorted[j].UserID
+	})
+	return sorted
+}
+
+// BulkUpdateUserSegments applies the assign and unassign lists of many users. A failed all_or_nothing update
+// returns the result along with the error, the users that caused the rollback carry the reason.
+func (sr *segmentsRepository) BulkUpdateUserSegments(
+	ctx context.Context,
+	req *RequestBulkUpdate,
+) (*BulkUpdateResult, error) {
+	err := req.validate(bulkMaxUsers(sr.cfg.Segment.BulkMaxUsers))
+	if err != nil {
+		return nil, err
+	}
+
+	updates, result := req.resolve(time.Now())
+
+	if req.Mode == BulkBestEffort {
+		for _, u := range updates {
+			res, err := sr.UpdateUserSegments(ctx, u.UserID, u.Assign, u.Unassign, u.ExpiresAt)
+			if err != nil {
+				result.fail(u.Index, err)
+				continue
+			}
+			result.apply(u.Index, res.Results)
+		}
+
+		sr.InfoLog.Printf("BulkUpdateUserSegments — %d applied, %d failed\n", result.Applied, result.Failed)
+		return result, nil
+	}
+
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%w: %d users have an invalid expiry", ErrInvalidInput, result.Failed)
+	}
+
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorBeginTransaction, err)
+		return nil, err
+	}
+
+	plans := make([]*updatePlan, len(req.Users))
+	for _, u := range byUser(updates) {
+		plan, err := sr.updateUserSegments(ctx, tx, u.UserID, u.Assign, u.Unassign, u.ExpiresAt)
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+			}
+			result.fail(u.Index, err)
+			return result, err
+		}
+		plans[u.Index] = plan
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorCommittingTransaction, err)
+		return nil, err
+	}
+
+	for _, u := range updates {
+		result.apply(u.Index, plans[u.Index].Results)
+	}
+
+	sr.InfoLog.Printf("BulkUpdateUserSegments — %d users\n", result.Applied)
+	return result, nil
+}
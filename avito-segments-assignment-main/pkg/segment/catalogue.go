@@ -0,0 +1,144 @@
+package segment
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// Validate fills in the defaults of the filter and decodes its cursor into the id to continue after.
+func (f *SegmentFilter) Validate() (int, error) {
+	switch f.Status {
+	case "":
+		f.Status = StatusActive
+	case StatusActive, StatusDeleted, StatusAll:
+	default:
+		return 0, fmt.Errorf("%w: unknown status %q", ErrInvalidInput, f.Status)
+	}
+
+	switch {
+	case f.Limit == 0:
+		f.Limit = defaultPageLimit
+	case f.Limit < 0 || f.Limit > maxPageLimit:
+		return 0, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidInput, maxPageLimit)
+	}
+
+	return decodeCursor(f.Cursor)
+}
+
+// matches reports whether seg passes the status, tag, owner and prefix filters.
+func (f *SegmentFilter) matches(seg *Segment) bool {
+	switch {
+	case f.Status == StatusActive && !seg.IsActive,
+		f.Status == StatusDeleted && seg.IsActive,
+		f.Owner != "" && seg.Owner != f.Owner,
+		f.Prefix != "" && !strings.HasPrefix(seg.Slug, f.Prefix):
+		return false
+	}
+
+	if f.Tag == "" {
+		return true
+	}
+	for _, tag := range seg.Tags {
+		if tag == f.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Cursors are opaque to clients: the base64 encoded id of the last segment of the previous page.
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("%w: malformed cursor", ErrInvalidInput)
+	}
+
+	id, err := strconv.Atoi(string(raw))
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("%w: malformed cursor", ErrInvalidInput)
+	}
+	return id, nil
+}
+
+// escapeLike escapes the LIKE wildcards of a literal prefix. Both dialects use \ as the default escape character.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (sr *segmentsRepository) ListSegments(ctx context.Context, filter *SegmentFilter) (*SegmentPage, error) {
+	afterID, err := filter.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := []string{"id > ?"}
+	args := []interface{}{afterID}
+
+	switch filter.Status {
+	case StatusActive:
+		conditions = append(conditions, "is_active = TRUE")
+	case StatusDeleted:
+		conditions = append(conditions, "is_active = FALSE")
+	}
+	if filter.Tag != "" {
+		conditions = append(conditions, "id IN (SELECT segment_id FROM segment_tags WHERE tag = ?)")
+		args = append(args, filter.Tag)
+	}
+	if filter.Owner != "" {
+		conditions = append(conditions, "owner = ?")
+		args = append(args, filter.Owner)
+	}
+	if filter.Prefix != "" {
+		conditions = append(conditions, "slug LIKE ?")
+		args = append(args, escapeLike(filter.Prefix)+"%")
+	}
+
+	// one extra row tells whether there is a next page
+	args = append(args, filter.Limit+1)
+	segments, err := sr.readSegments(
+		ctx,
+		sr.db,
+		"WHERE "+strings.Join(conditions, " AND ")+" ORDER BY id LIMIT ?",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSegmentPage(segments, filter.Limit), nil
+}
+
+func newSegmentPage(segments []*Segment, limit int) *SegmentPage {
+	page := &SegmentPage{Segments: segments}
+	if len(segments) > limit {
+		page.Segments = segments[:limit]
+		page.NextCursor = encodeCursor(page.Segments[limit-1].ID)
+	}
+	return page
+}
+
+func (sr *segmentsRepository) countMembers(ctx context.Context, segmentID int) (int, error) {
+	var count int
+	err := sr.db.QueryRowContext(
+		ctx,
+		sr.dialect.Rebind("SELECT COUNT(*) FROM user_segment_relation WHERE segment_id = ? AND is_active = TRUE"),
+		segmentID,
+	).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,286 @@
+package segment
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/dialect"
+	errs "usersegmentator/pkg/errors"
+	"usersegmentator/pkg/isoduration"
+)
+
+// expiryFunc maps the current expiry of a membership to the new one, nil meaning it never expires.
+type expiryFunc func(current *time.Time) *time.Time
+
+// plan validates the change and returns the expiry every affected membership gets. Extending or shortening
+// leaves memberships without an expiry alone. An expiry that ends up in the past is moved to now,
+// so the membership expires on the next TTL sweep.
+func (c *ExpiryChange) plan(now time.Time) (expiryFunc, error) {
+	if c.SegmentSlug == "" {
+		return nil, fmt.Errorf("%w: segment_slug is required", ErrInvalidInput)
+	}
+	if c.UserID != nil && *c.UserID <= 0 {
+		return nil, fmt.Errorf("%w: user_id must be positive", ErrInvalidInput)
+	}
+
+	actions := 0
+	for _, set := range []bool{c.ExpiresAt != nil, c.ExpiresIn != "", c.ExtendBy != "", c.ShortenBy != "", c.Clear} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return nil, fmt.Errorf(
+			"%w: exactly one of expires_at, expires_in, extend_by, shorten_by and clear is required", ErrInvalidInput)
+	}
+
+	notPast := func(t time.Time) *time.Time {
+		if t.Before(now) {
+			t = now
+		}
+		return truncateTime(&t)
+	}
+
+	switch {
+	case c.Clear:
+		return func(*time.Time) *time.Time { return nil }, nil
+	case c.ExpiresAt != nil:
+		expiresAt := notPast(*c.ExpiresAt)
+		return func(*time.Time) *time.Time { return expiresAt }, nil
+	case c.ExpiresIn != "":
+		d, err := isoduration.Parse(c.ExpiresIn)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidInput, err)
+		}
+		expiresAt := notPast(d.AddTo(now))
+		return func(*time.Time) *time.Time { return expiresAt }, nil
+	}
+
+	by := c.ExtendBy
+	if c.ShortenBy != "" {
+		by = c.ShortenBy
+	}
+	d, err := isoduration.Parse(by)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidInput, err)
+	}
+	if c.ShortenBy != "" {
+		d = d.Neg()
+	}
+
+	return func(current *time.Time) *time.Time {
+		if current == nil {
+			return nil
+		}
+		return notPast(d.AddTo(*current))
+	}, nil
+}
+
+func sameExpiry(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// expiryRow is an active membership locked by UpdateExpiry.
+type expiryRow struct {
+	ID        int
+	UserID    int
+	ExpiresAt sql.NullTime
+}
+
+// UpdateExpiry moves the expiry of the matching active memberships in one transaction and writes every
+// actual change to membership_audit. Memberships are locked and updated in keyset batches.
+func (sr *segmentsRepository) UpdateExpiry(ctx context.Context, change *ExpiryChange) (*ExpiryResult, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	newExpiry, err := change.plan(now)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorBeginTransaction, err)
+		return nil, err
+	}
+
+	updated, err := sr.updateExpiry(ctx, tx, change, newExpiry)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorCommittingTransaction, err)
+		return nil, err
+	}
+
+	sr.InfoLog.Printf("UpdateExpiry — %s, %d memberships\n", change.SegmentSlug, updated)
+	return &ExpiryResult{SegmentSlug: change.SegmentSlug, UserID: change.UserID, Updated: updated}, nil
+}
+
+func (sr *segmentsRepository) updateExpiry(
+	ctx context.Context,
+	tx *sql.Tx,
+	change *ExpiryChange,
+	newExpiry expiryFunc,
+) (int, error) {
+	var segmentID int
+	err := tx.QueryRowContext(
+		ctx,
+		sr.dialect.Rebind("SELECT id FROM segments WHERE slug = ? AND is_active = TRUE"),
+		change.SegmentSlug,
+	).Scan(&segmentID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w: %s", ErrSegmentNotFound, change.SegmentSlug)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	query := "SELECT id, user_id, date_unassigned FROM user_segment_relation " +
+		"WHERE segment_id = ? AND is_active = TRUE AND id > ?"
+	if change.UserID != nil {
+		query += " AND user_id = ?"
+	}
+	query = sr.dialect.Rebind(query + " ORDER BY id LIMIT ? FOR UPDATE")
+
+	var (
+		updated, matched, afterID int
+		size                      = sr.batchSize()
+	)
+	for {
+		args := []interface{}{segmentID, afterID}
+		if change.UserID != nil {
+			args = append(args, *change.UserID)
+		}
+
+		batch, err := sr.readExpiryRows(ctx, tx, query, append(args, size)...)
+		if err != nil {
+			return 0, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		matched += len(batch)
+		afterID = batch[len(batch)-1].ID
+
+		n, err := sr.applyExpiry(ctx, tx, segmentID, batch, newExpiry)
+		if err != nil {
+			return 0, err
+		}
+		updated += n
+
+		if len(batch) < size {
+			break
+		}
+	}
+
+	if change.UserID != nil && matched == 0 {
+		return 0, fmt.Errorf("%w: user %d is not in segment %s", ErrMembershipNotFound, *change.UserID, change.SegmentSlug)
+	}
+	return updated, nil
+}
+
+func (sr *segmentsRepository) readExpiryRows(
+	ctx context.Context,
+	tx *sql.Tx,
+	query string,
+	args ...interface{},
+) ([]expiryRow, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := []expiryRow{}
+	for rows.Next() {
+		row := expiryRow{}
+		err = rows.Scan(&row.ID, &row.UserID, &row.ExpiresAt)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		batch = append(batch, row)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// applyExpiry updates the memberships of a batch that get the same expiry with one statement
+// and audits the changes with a single multi-row insert.
+func (sr *segmentsRepository) applyExpiry(
+	ctx context.Context,
+	tx *sql.Tx,
+	segmentID int,
+	batch []expiryRow,
+	newExpiry expiryFunc,
+) (int, error) {
+	var (
+		groups  = map[time.Time][]int{}
+		cleared = []int{}
+		entries = []auditEntry{}
+	)
+	for _, row := range batch {
+		var current *time.Time
+		if row.ExpiresAt.Valid {
+			current = &row.ExpiresAt.Time
+		}
+
+		next := newExpiry(current)
+		if sameExpiry(current, next) {
+			continue
+		}
+
+		if next == nil {
+			cleared = append(cleared, row.ID)
+		} else {
+			groups[*next] = append(groups[*next], row.ID)
+		}
+		entries = append(entries, auditEntry{UserID: row.UserID, SegmentID: segmentID, ExpiresAt: next})
+	}
+
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	if len(cleared) > 0 {
+		_, err := tx.ExecContext(
+			ctx,
+			sr.dialect.Rebind("UPDATE user_segment_relation SET date_unassigned = NULL WHERE id IN ("+
+				dialect.Placeholders(len(cleared))+")"),
+			appendInts(nil, cleared)...,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for expiresAt, ids := range groups {
+		_, err := tx.ExecContext(
+			ctx,
+			sr.dialect.Rebind("UPDATE user_segment_relation SET date_unassigned = ? WHERE id IN ("+
+				dialect.Placeholders(len(ids))+")"),
+			appendInts([]interface{}{expiresAt}, ids)...,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err := sr.writeAudit(ctx, tx, audit.ActionExpiryChange, entries)
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
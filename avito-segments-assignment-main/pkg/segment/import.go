@@ -0,0 +1,426 @@
+package segment
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	stdErrors "errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"usersegmentator/pkg/audit"
+	errs "usersegmentator/pkg/errors"
+	"usersegmentator/pkg/job"
+)
+
+// Formats of an import file.
+const (
+	ImportCSV    = "csv"
+	ImportNDJSON = "ndjson"
+)
+
+const (
+	// defaultImportMaxRows bounds an import when segment.import_max_rows is not set.
+	defaultImportMaxRows = 100000
+	// maxImportErrors bounds the line errors kept in a validation error or an import result.
+	maxImportErrors = 100
+	// maxNDJSONLine bounds the length of a single NDJSON line.
+	maxNDJSONLine = 1 << 20
+)
+
+var importColumns = []string{"user_id", "segment", "action", "expires_at"}
+
+// ImportRequest is the payload of an import job. The rows are validated before the job is created.
+type ImportRequest struct {
+	DryRun bool         `json:"dry_run"`
+	Rows   []*ImportRow `json:"rows"`
+}
+
+// ImportRow is a single membership change of an import, Line is its line in the uploaded file.
+type ImportRow struct {
+	Line      int        `json:"line"`
+	UserID    int        `json:"user_id"`
+	Segment   string     `json:"segment"`
+	Action    string     `json:"action"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportValidationError lists the invalid lines of an import file, at most maxImportErrors of Total.
+type ImportValidationError struct {
+	Total  int           `json:"total"`
+	Errors []ImportError `json:"errors"`
+}
+
+func (e *ImportValidationError) Error() string {
+	return fmt.Sprintf("%s: %d invalid lines", ErrInvalidInput, e.Total)
+}
+
+func (e *ImportValidationError) Unwrap() error {
+	return ErrInvalidInput
+}
+
+func (e *ImportValidationError) add(line int, err error) {
+	e.Total++
+	if len(e.Errors) < maxImportErrors {
+		e.Errors = append(e.Errors, ImportError{Line: line, Error: err.Error()})
+	}
+}
+
+// ImportResult counts the outcomes of the imported rows. Failed rows are those of users that don't exist,
+// their lines are listed in Errors, at most maxImportErrors of them.
+type ImportResult struct {
+	DryRun   bool            `json:"dry_run"`
+	Rows     int             `json:"rows"`
+	Outcomes map[Outcome]int `json:"outcomes"`
+	Failed   int             `json:"failed"`
+	Errors   []ImportError   `json:"errors,omitempty"`
+}
+
+func newImportResult(req *ImportRequest) *ImportResult {
+	return &ImportResult{DryRun: req.DryRun, Rows: len(req.Rows), Outcomes: map[Outcome]int{}}
+}
+
+func (r *ImportResult) record(results []SegmentResult) {
+	for _, res := range results {
+		r.Outcomes[res.Result]++
+	}
+}
+
+func (r *ImportResult) fail(g *importGroup, err error) {
+	for _, row := range g.Rows {
+		r.Failed++
+		if len(r.Errors) < maxImportErrors {
+			r.Errors = append(r.Errors, ImportError{Line: row.Line, Error: err.Error()})
+		}
+	}
+}
+
+// ImportMaxRows returns the configured row limit of an import.
+func ImportMaxRows(limit int) int {
+	if limit < 1 {
+		return defaultImportMaxRows
+	}
+	return limit
+}
+
+// ParseImport reads and validates an import file. The CSV header names the columns, expires_at may be left out;
+// every NDJSON line is an object with the same fields. All lines are checked, an invalid file returns
+// an *ImportValidationError listing them. More than maxRows rows return ErrTooManyRows.
+func ParseImport(r io.Reader, format string, maxRows int) ([]*ImportRow, error) {
+	switch format {
+	case ImportCSV:
+		return parseImportCSV(r, maxRows)
+	case ImportNDJSON:
+		return parseImportNDJSON(r, maxRows)
+	default:
+		return nil, fmt.Errorf("%w: unknown import format %q, expected %s or %s", ErrInvalidInput, format, ImportCSV, ImportNDJSON)
+	}
+}
+
+func parseImportCSV(r io.Reader, maxRows int) ([]*ImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: empty file", ErrInvalidInput)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidInput, err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range importColumns[:3] {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%w: header has no %s column, expected %s", ErrInvalidInput, name,
+				strings.Join(importColumns, ","))
+		}
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var (
+		rows    = []*ImportRow{}
+		invalid = &ImportValidationError{}
+		now     = time.Now()
+	)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// the reader can't be trusted to find the next record after a broken quote
+			var parseErr *csv.ParseError
+			if stdErrors.As(err, &parseErr) {
+				invalid.add(parseErr.StartLine, parseErr.Err)
+				return nil, invalid
+			}
+			return nil, err
+		}
+		if len(rows)+invalid.Total >= maxRows {
+			return nil, fmt.Errorf("%w: more than %d rows", ErrTooManyRows, maxRows)
+		}
+
+		line, _ := reader.FieldPos(0)
+
+		userID, err := strconv.Atoi(field(record, "user_id"))
+		if err != nil {
+			invalid.add(line, fmt.Errorf("user_id %q is not a number", field(record, "user_id")))
+			continue
+		}
+
+		row, err := importRow(line, userID, field(record, "segment"), field(record, "action"),
+			field(record, "expires_at"), now)
+		if err != nil {
+			invalid.add(line, err)
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	return importRows(rows, invalid)
+}
+
+func parseImportNDJSON(r io.Reader, maxRows int) ([]*ImportRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxNDJSONLine)
+
+	var (
+		rows    = []*ImportRow{}
+		invalid = &ImportValidationError{}
+		now     = time.Now()
+		line    int
+	)
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if len(rows)+invalid.Total >= maxRows {
+			return nil, fmt.Errorf("%w: more than %d rows", ErrTooManyRows, maxRows)
+		}
+
+		var raw struct {
+			UserID    int    `json:"user_id"`
+			Segment   string `json:"segment"`
+			Action    string `json:"action"`
+			ExpiresAt string `json:"expires_at"`
+		}
+		err := json.Unmarshal([]byte(text), &raw)
+		if err != nil {
+			invalid.add(line, err)
+			continue
+		}
+
+		row, err := importRow(line, raw.UserID, strings.TrimSpace(raw.Segment), strings.TrimSpace(raw.Action),
+			strings.TrimSpace(raw.ExpiresAt), now)
+		if err != nil {
+			invalid.add(line, err)
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		if stdErrors.Is(err, bufio.ErrTooLong) {
+			invalid.add(line+1, fmt.Errorf("line is longer than %d bytes", maxNDJSONLine))
+			return nil, invalid
+		}
+		return nil, err
+	}
+
+	return importRows(rows, invalid)
+}
+
+func importRows(rows []*ImportRow, invalid *ImportValidationError) ([]*ImportRow, error) {
+	if invalid.Total > 0 {
+		return nil, invalid
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%w: no rows", ErrInvalidInput)
+	}
+	return rows, nil
+}
+
+func importRow(line, userID int, segment, action, expiresAt string, now time.Time) (*ImportRow, error) {
+	row := &ImportRow{Line: line, UserID: userID, Segment: segment, Action: strings.ToLower(action)}
+
+	if row.UserID < 1 {
+		return nil, fmt.Errorf("user_id must be positive")
+	}
+	if row.Segment == "" {
+		return nil, fmt.Errorf("segment is empty")
+	}
+	if row.Action != ActionAssign && row.Action != ActionUnassign {
+		return nil, fmt.Errorf("action %q must be %s or %s", action, ActionAssign, ActionUnassign)
+	}
+
+	if expiresAt != "" {
+		if row.Action != ActionAssign {
+			return nil, fmt.Errorf("expires_at is only allowed with %s", ActionAssign)
+		}
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("expires_at %q is not an RFC3339 time", expiresAt)
+		}
+		if !t.After(now) {
+			return nil, fmt.Errorf("expires_at %s is in the past", expiresAt)
+		}
+		row.ExpiresAt = &t
+	}
+
+	return row, nil
+}
+
+// importGroup is an update made of consecutive rows of one user with the same expiry.
+// Its rows are assignments followed by unassignments, the order an update reports its results in.
+type importGroup struct {
+	UserID    int
+	ExpiresAt *time.Time
+	Assign    []string
+	Unassign  []string
+	Rows      []*ImportRow
+}
+
+// importBatches orders the rows by user and cuts them into batches of about size rows. The rows of a user
+// never span two batches, so a batch sees all earlier changes of its users, the rolled back ones of a dry run as well.
+func importBatches(rows []*ImportRow, size int) [][]*importGroup {
+	sorted := append([]*ImportRow{}, rows...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].UserID < sorted[j].UserID
+	})
+
+	var (
+		batches = [][]*importGroup{}
+		batch   []*importGroup
+		rowsIn  int
+		g       *importGroup
+	)
+	for _, row := range sorted {
+		sameUser := g != nil && g.UserID == row.UserID
+		if !sameUser && rowsIn >= size {
+			batches = append(batches, batch)
+			batch, rowsIn = nil, 0
+		}
+
+		// an update assigns before it unassigns, so an assignment after an unassignment starts a new one
+		if !sameUser || !sameExpiry(g.ExpiresAt, row.ExpiresAt) || row.Action == ActionAssign && len(g.Unassign) > 0 {
+			g = &importGroup{UserID: row.UserID, ExpiresAt: row.ExpiresAt}
+			batch = append(batch, g)
+		}
+
+		if row.Action == ActionAssign {
+			g.Assign = append(g.Assign, row.Segment)
+		} else {
+			g.Unassign = append(g.Unassign, row.Segment)
+		}
+		g.Rows = append(g.Rows, row)
+		rowsIn++
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+func groupRows(batch []*importGroup) int {
+	n := 0
+	for _, g := range batch {
+		n += len(g.Rows)
+	}
+	return n
+}
+
+// ImportMemberships applies the rows of an import through the same planning as UpdateUserSegments, a transaction
+// per batch of segment.batch_size rows. A dry run rolls every batch back and reports what would have changed.
+func (sr *segmentsRepository) ImportMemberships(ctx context.Context, req *ImportRequest) (*ImportResult, error) {
+	result := newImportResult(req)
+	ctx = audit.WithSource(ctx, audit.SourceImport)
+
+	done := 0
+	for _, batch := range importBatches(req.Rows, sr.batchSize()) {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		err = sr.importBatch(ctx, batch, req.DryRun, result)
+		if err != nil {
+			return nil, err
+		}
+
+		done += groupRows(batch)
+		job.Progress(ctx, done, len(req.Rows))
+	}
+
+	sr.InfoLog.Printf("ImportMemberships — %d rows, %d failed, dry run %t\n", result.Rows, result.Failed, result.DryRun)
+	return result, nil
+}
+
+func (sr *segmentsRepository) importBatch(
+	ctx context.Context,
+	batch []*importGroup,
+	dryRun bool,
+	result *ImportResult,
+) error {
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorBeginTransaction, err)
+		return err
+	}
+
+	for _, g := range batch {
+		var plan *updatePlan
+		plan, err = sr.updateUserSegments(ctx, tx, g.UserID, g.Assign, g.Unassign, g.ExpiresAt)
+		if stdErrors.Is(err, ErrUserNotFound) {
+			result.fail(g, err)
+			continue
+		}
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+			}
+			return err
+		}
+		result.record(plan.Results)
+	}
+
+	if dryRun {
+		err = tx.Rollback()
+		if err != nil && err != sql.ErrTxDone {
+			return err
+		}
+		return nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorCommittingTransaction, err)
+		return err
+	}
+	return nil
+}
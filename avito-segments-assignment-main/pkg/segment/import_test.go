@@ -0,0 +1,293 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseImport(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name    string
+		format  string
+		file    string
+		lines   []int
+		expires bool
+	}{
+		{"csv", ImportCSV, "user_id,segment,action,expires_at\n" +
+			"1000,AVITO_VOICE_MESSAGES,assign," + expiresAt.Format(time.RFC3339) + "\n" +
+			"1001, AVITO_DISCOUNT_30 ,UNASSIGN,\n",
+			[]int{2, 3}, true},
+		{"csv with other column order and no expires_at", ImportCSV, "Action,User_ID,Segment\n" +
+			"assign,1000,AVITO_VOICE_MESSAGES\n" +
+			"unassign,1001,AVITO_DISCOUNT_30\n",
+			[]int{2, 3}, false},
+		{"ndjson", ImportNDJSON,
+			`{"user_id":1000,"segment":"AVITO_VOICE_MESSAGES","action":"assign","expires_at":"` +
+				expiresAt.Format(time.RFC3339) + `"}` + "\n" +
+				"\n" +
+				`{"user_id":1001,"segment":" AVITO_DISCOUNT_30 ","action":"UNASSIGN"}` + "\n",
+			[]int{1, 3}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := ParseImport(strings.NewReader(tt.file), tt.format, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 2 {
+				t.Fatalf("%d rows, want 2", len(rows))
+			}
+
+			first, second := rows[0], rows[1]
+			if first.Line != tt.lines[0] || first.UserID != 1000 || first.Segment != "AVITO_VOICE_MESSAGES" ||
+				first.Action != ActionAssign {
+				t.Errorf("row 1 = %+v", first)
+			}
+			if second.Line != tt.lines[1] || second.UserID != 1001 || second.Segment != "AVITO_DISCOUNT_30" ||
+				second.Action != ActionUnassign || second.ExpiresAt != nil {
+				t.Errorf("row 2 = %+v", second)
+			}
+			if tt.expires && (first.ExpiresAt == nil || !first.ExpiresAt.Equal(expiresAt)) {
+				t.Errorf("expires_at = %v, want %s", first.ExpiresAt, expiresAt)
+			}
+		})
+	}
+}
+
+func TestParseImportInvalidLines(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name   string
+		format string
+		file   string
+		lines  []int
+	}{
+		{"csv", ImportCSV, "user_id,segment,action,expires_at\n" +
+			"1000,AVITO_VOICE_MESSAGES,assign,\n" +
+			"abc,AVITO_VOICE_MESSAGES,assign,\n" +
+			"0,AVITO_VOICE_MESSAGES,assign,\n" +
+			"1001,,assign,\n" +
+			"1002,AVITO_VOICE_MESSAGES,add,\n" +
+			"1003,AVITO_VOICE_MESSAGES,unassign,2030-01-01T00:00:00Z\n" +
+			"1004,AVITO_VOICE_MESSAGES,assign,tomorrow\n" +
+			"1005,AVITO_VOICE_MESSAGES,assign," + past + "\n",
+			[]int{3, 4, 5, 6, 7, 8, 9}},
+		{"csv broken quote", ImportCSV, "user_id,segment,action\n" +
+			"1000,AVITO_VOICE_MESSAGES,assign\n" +
+			"1001,\"AVITO_VOICE_MESSAGES,assign\n",
+			[]int{3}},
+		{"csv quoted line break", ImportCSV, "user_id,segment,action\n" +
+			"1000,\"AVITO_VOICE\nMESSAGES\",add\n" +
+			"abc,AVITO_VOICE_MESSAGES,assign\n",
+			[]int{2, 4}},
+		{"ndjson", ImportNDJSON,
+			`{"user_id":1000,"segment":"AVITO_VOICE_MESSAGES","action":"assign"}` + "\n" +
+				`{"user_id":"1001","segment":"AVITO_VOICE_MESSAGES","action":"assign"}` + "\n" +
+				"not json\n" +
+				"\n" +
+				`{"segment":"AVITO_VOICE_MESSAGES","action":"assign"}` + "\n" +
+				`{"user_id":1002,"segment":"AVITO_VOICE_MESSAGES","action":"unassign",` +
+				`"expires_at":"2030-01-01T00:00:00Z"}` + "\n",
+			[]int{2, 3, 5, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseImport(strings.NewReader(tt.file), tt.format, 100)
+			invalid := &ImportValidationError{}
+			if !errors.As(err, &invalid) {
+				t.Fatalf("err = %v, want an *ImportValidationError", err)
+			}
+			if !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("err = %v doesn't wrap %v", err, ErrInvalidInput)
+			}
+
+			lines := []int{}
+			for _, e := range invalid.Errors {
+				lines = append(lines, e.Line)
+			}
+			if invalid.Total != len(tt.lines) || fmt.Sprint(lines) != fmt.Sprint(tt.lines) {
+				t.Errorf("%d invalid lines %v, want %v: %+v", invalid.Total, lines, tt.lines, invalid.Errors)
+			}
+		})
+	}
+}
+
+func TestParseImportInvalidFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		file   string
+	}{
+		{"unknown format", "xml", "<rows/>"},
+		{"empty csv", ImportCSV, ""},
+		{"csv without an action column", ImportCSV, "user_id,segment\n1000,AVITO_VOICE_MESSAGES\n"},
+		{"csv header only", ImportCSV, "user_id,segment,action\n"},
+		{"empty ndjson", ImportNDJSON, "\n\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseImport(strings.NewReader(tt.file), tt.format, 100)
+			if !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("err = %v, want %v", err, ErrInvalidInput)
+			}
+		})
+	}
+}
+
+func TestParseImportMaxRows(t *testing.T) {
+	csvFile := func(rows int) string {
+		b := &strings.Builder{}
+		b.WriteString("user_id,segment,action\n")
+		for i := 0; i < rows; i++ {
+			fmt.Fprintf(b, "%d,AVITO_VOICE_MESSAGES,assign\n", 1000+i)
+		}
+		return b.String()
+	}
+	ndjsonFile := func(rows int) string {
+		b := &strings.Builder{}
+		for i := 0; i < rows; i++ {
+			fmt.Fprintf(b, `{"user_id":%d,"segment":"AVITO_VOICE_MESSAGES","action":"assign"}`+"\n", 1000+i)
+		}
+		return b.String()
+	}
+
+	for format, file := range map[string]func(int) string{ImportCSV: csvFile, ImportNDJSON: ndjsonFile} {
+		t.Run(format, func(t *testing.T) {
+			rows, err := ParseImport(strings.NewReader(file(3)), format, 3)
+			if err != nil || len(rows) != 3 {
+				t.Errorf("%d rows, err = %v at the limit, want 3 rows", len(rows), err)
+			}
+
+			_, err = ParseImport(strings.NewReader(file(4)), format, 3)
+			if !errors.Is(err, ErrTooManyRows) {
+				t.Errorf("err = %v over the limit, want %v", err, ErrTooManyRows)
+			}
+		})
+	}
+}
+
+// describeBatches lists the groups of every batch as user:assigned/unassigned.
+func describeBatches(batches [][]*importGroup) string {
+	parts := []string{}
+	for _, batch := range batches {
+		groups := []string{}
+		for _, g := range batch {
+			groups = append(groups,
+				fmt.Sprintf("%d:%s/%s", g.UserID, strings.Join(g.Assign, "+"), strings.Join(g.Unassign, "+")))
+		}
+		parts = append(parts, "["+strings.Join(groups, " ")+"]")
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestImportBatches(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	row := func(userID int, segment, action string) *ImportRow {
+		return &ImportRow{UserID: userID, Segment: segment, Action: action}
+	}
+	expiring := row(1001, "C", ActionAssign)
+	expiring.ExpiresAt = &later
+
+	tests := []struct {
+		name string
+		rows []*ImportRow
+		size int
+		want string
+	}{
+		{"rows are grouped by user in file order", []*ImportRow{
+			row(1001, "A", ActionAssign), row(1000, "A", ActionAssign), row(1001, "B", ActionUnassign),
+			row(1000, "B", ActionAssign),
+		}, 10, "[1000:A+B/ 1001:A/B]"},
+		{"a user never spans two batches", []*ImportRow{
+			row(1000, "A", ActionAssign), row(1000, "B", ActionAssign), row(1000, "C", ActionAssign),
+			row(1001, "A", ActionAssign), row(1002, "A", ActionAssign),
+		}, 2, "[1000:A+B+C/] [1001:A/ 1002:A/]"},
+		{"an assignment after an unassignment starts an update", []*ImportRow{
+			row(1000, "A", ActionAssign), row(1000, "A", ActionUnassign), row(1000, "A", ActionAssign),
+		}, 10, "[1000:A/A 1000:A/]"},
+		{"another expiry starts an update", []*ImportRow{
+			row(1001, "A", ActionAssign), row(1001, "B", ActionAssign), expiring,
+		}, 10, "[1001:A+B/ 1001:C/]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := importBatches(tt.rows, tt.size)
+			if describeBatches(got) != tt.want {
+				t.Errorf("batches = %s, want %s", describeBatches(got), tt.want)
+			}
+
+			lines := 0
+			for _, batch := range got {
+				lines += groupRows(batch)
+			}
+			if lines != len(tt.rows) {
+				t.Errorf("%d rows in the batches, want %d", lines, len(tt.rows))
+			}
+		})
+	}
+}
+
+func testImportDryRun(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	slug := insertTestSegment(t, repo, BucketingRandom)
+
+	// user 1000 is assigned and unassigned in the same file, 999 doesn't exist
+	req := &ImportRequest{DryRun: true, Rows: []*ImportRow{
+		{Line: 2, UserID: 1000, Segment: slug, Action: ActionAssign},
+		{Line: 3, UserID: 1001, Segment: slug, Action: ActionAssign},
+		{Line: 4, UserID: 1000, Segment: slug, Action: ActionUnassign},
+		{Line: 5, UserID: 1002, Segment: slug, Action: ActionUnassign},
+		{Line: 6, UserID: 999, Segment: slug, Action: ActionAssign},
+	}}
+
+	check := func(result *ImportResult) {
+		t.Helper()
+		if result.Rows != 5 || result.Outcomes[OutcomeAssigned] != 2 || result.Outcomes[OutcomeUnassigned] != 1 ||
+			result.Outcomes[OutcomeNotMember] != 1 || result.Failed != 1 ||
+			len(result.Errors) != 1 || result.Errors[0].Line != 6 {
+			t.Errorf("result = %+v", result)
+		}
+	}
+
+	result, err := repo.ImportMemberships(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.DryRun {
+		t.Error("the result is not a dry run")
+	}
+	check(result)
+	if members := memberSet(t, repo, slug); len(members) != 0 {
+		t.Errorf("members %v after a dry run, want none", members)
+	}
+
+	// the import itself reports the same and applies it
+	req.DryRun = false
+	result, err = repo.ImportMemberships(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(result)
+	if members := memberSet(t, repo, slug); len(members) != 1 || !members[1001] {
+		t.Errorf("members %v after the import, want [1001]", members)
+	}
+}
+
+func TestImportDryRunMemory(t *testing.T) {
+	testImportDryRun(t, newTestMemoryRepo(t))
+}
+
+func TestImportDryRunSQL(t *testing.T) {
+	testImportDryRun(t, newTestSQLRepo(t))
+}
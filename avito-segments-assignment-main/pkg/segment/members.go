@@ -0,0 +1,134 @@
+package segment
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultMembersLimit = 100
+	maxMembersLimit     = 10000
+)
+
+// Validate fills in the defaults of the query and decodes its cursor into the user id to continue after.
+func (q *MembersQuery) Validate() (int, error) {
+	if q.SegmentSlug == "" {
+		return 0, fmt.Errorf("%w: empty segment slug", ErrInvalidInput)
+	}
+
+	switch {
+	case q.Limit == 0:
+		q.Limit = defaultMembersLimit
+	case q.Limit < 0 || q.Limit > maxMembersLimit:
+		return 0, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidInput, maxMembersLimit)
+	}
+
+	return decodeCursor(q.Cursor)
+}
+
+// memberAt reports whether a relation made the user a member at asOf. Without asOf only active
+// relations count, otherwise the relation must have started by asOf and not ended yet.
+func memberAt(asOf *time.Time, isActive bool, assigned time.Time, unassigned *time.Time) bool {
+	if asOf == nil {
+		return isActive
+	}
+	return !assigned.After(*asOf) && (unassigned == nil || unassigned.After(*asOf))
+}
+
+// newMember builds the streamed member, leaving out the dates unless they were requested.
+func newMember(q *MembersQuery, userID int, assigned time.Time, unassigned *time.Time) *Member {
+	member := &Member{UserID: userID}
+	if q.IncludeDates {
+		member.DateAssigned = &assigned
+		if unassigned != nil {
+			expiresAt := *unassigned
+			member.ExpiresAt = &expiresAt
+		}
+	}
+	return member
+}
+
+// StreamSegmentMembers calls fn for every member of the page in user id order, reading rows straight
+// from the cursor, and returns the cursor of the next page or an empty string after the last one.
+func (sr *segmentsRepository) StreamSegmentMembers(
+	ctx context.Context,
+	q *MembersQuery,
+	fn func(*Member) error,
+) (string, error) {
+	afterID, err := q.Validate()
+	if err != nil {
+		return "", err
+	}
+
+	ids, err := sr.GetSegmentsIDs(ctx, []string{q.SegmentSlug})
+	if err != nil {
+		return "", err
+	}
+
+	query := "SELECT user_id, date_assigned, date_unassigned FROM user_segment_relation " +
+		"WHERE segment_id = ? AND user_id > ? AND "
+	args := []interface{}{ids[0], afterID}
+	if q.AsOf == nil {
+		query += "is_active = TRUE "
+	} else {
+		query += "date_assigned <= ? AND (date_unassigned IS NULL OR date_unassigned > ?) "
+		args = append(args, q.AsOf.UTC(), q.AsOf.UTC())
+	}
+	// one extra row tells whether there is a next page
+	query += "ORDER BY user_id LIMIT ?"
+	args = append(args, q.Limit+1)
+
+	rows, err := sr.db.QueryContext(ctx, sr.dialect.Rebind(query), args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	read, streamed, lastID := 0, 0, 0
+	for rows.Next() {
+		read++
+
+		var (
+			userID         int
+			dateAssigned   time.Time
+			dateUnassigned sql.NullTime
+		)
+		err = rows.Scan(&userID, &dateAssigned, &dateUnassigned)
+		if err != nil {
+			return "", err
+		}
+
+		// overlapping relations of the same user are reported once
+		if userID == lastID {
+			continue
+		}
+		if streamed == q.Limit {
+			return encodeCursor(lastID), rows.Close()
+		}
+
+		var unassigned *time.Time
+		if dateUnassigned.Valid {
+			unassigned = &dateUnassigned.Time
+		}
+
+		err = fn(newMember(q, userID, dateAssigned, unassigned))
+		if err != nil {
+			return "", err
+		}
+		streamed++
+		lastID = userID
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return "", err
+	}
+
+	// duplicates may have used up the extra row, so a full page always offers a next one
+	if read > q.Limit && streamed == q.Limit {
+		return encodeCursor(lastID), nil
+	}
+	return "", nil
+}
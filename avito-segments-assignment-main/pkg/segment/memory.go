@@ -0,0 +1,1106 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/bucket"
+	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/memstore"
+)
+
+type memorySegmentsRepository struct {
+	store   *memstore.Store
+	cfg     *config.Config
+	InfoLog *log.Logger
+	ErrLog  *log.Logger
+}
+
+func NewMemorySegmentsRepo(store *memstore.Store, cfg *config.Config) Repository {
+	return &memorySegmentsRepository{
+		store:   store,
+		cfg:     cfg,
+		InfoLog: log.New(os.Stdout, "INFO\tMEMORY SEGMENTS REPO\t", log.Ldate|log.Ltime),
+		ErrLog:  log.New(os.Stdout, "ERROR\tMEMORY SEGMENTS REPO\t", log.Ldate|log.Ltime),
+	}
+}
+
+func (sr *memorySegmentsRepository) AutoAssignSegment(
+	ctx context.Context,
+	fraction int,
+	slug string,
+	expiresAt *time.Time,
+) error {
+	if fraction < 1 || fraction > 100 {
+		sr.ErrLog.Printf("invalid fraction value: %d", fraction)
+		return fmt.Errorf("invalid fraction value: %d", fraction)
+	}
+	ctx = audit.WithSource(ctx, audit.SourceAutoFraction)
+
+	sr.store.RLock()
+	stored := sr.store.SegmentBySlug(slug)
+	if stored == nil {
+		sr.store.RUnlock()
+		return fmt.Errorf("%w: %s", ErrSegmentNotFound, slug)
+	}
+
+	if stored.Bucketing == BucketingHash {
+		userIDs := sr.activeUserIDs()
+		salt := stored.Salt
+		sr.store.RUnlock()
+
+		err := sr.AssignSegments(ctx, bucketMembers(salt, userIDs, fraction), []string{slug}, expiresAt)
+		if err != nil {
+			sr.ErrLog.Printf("%s", err)
+		}
+		return err
+	}
+	sr.store.RUnlock()
+
+	activeUsers, err := sr.GetActiveUsersAmount(ctx)
+	if err != nil {
+		sr.ErrLog.Printf("%s", err)
+		return err
+	}
+
+	sampleSize := rolloutTarget(activeUsers, fraction)
+
+	users, err := sr.GetNRandomUsersWithoutSegment(sampleSize, slug)
+	if err != nil {
+		sr.ErrLog.Printf("%s", err)
+		return err
+	}
+
+	err = sr.AssignSegments(ctx, users, []string{slug}, expiresAt)
+	if err != nil {
+		sr.ErrLog.Printf("%s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (sr *memorySegmentsRepository) RunWindowChecker(ctx context.Context) {
+	sr.runEvery(ctx, "Window checker", windowCheckInterval(sr.cfg.Segment.WindowCheckInterval), func() {
+		now := time.Now().UTC()
+		origin := audit.Origin{Source: audit.SourceTTL, Actor: audit.SystemActor, Reason: windowEndReason}
+
+		sr.store.Lock()
+		defer sr.store.Unlock()
+
+		for _, stored := range sr.store.Segments {
+			if !stored.IsActive || stored.EndsAt == nil || stored.EndsAt.After(now) {
+				continue
+			}
+
+			endsAt := *stored.EndsAt
+			stored.IsActive = false
+			stored.DeletedAt = &endsAt
+			stored.UpdatedAt = memstore.Now()
+			for _, rel := range sr.store.Relations {
+				if !rel.IsActive || rel.SegmentID != stored.ID {
+					continue
+				}
+				// memberships whose TTL ran out before ends_at are left to the TTL checker
+				if rel.DateUnassigned != nil && rel.DateUnassigned.Before(endsAt) {
+					continue
+				}
+				sr.store.DeactivateAt(rel, endsAt, origin)
+				rel.UnassignReason = UnassignReasonExpired
+			}
+			sr.InfoLog.Printf("Segment %s has reached its ends_at\n", stored.Slug)
+		}
+	})
+}
+
+func (sr *memorySegmentsRepository) RunReconciler(ctx context.Context) {
+	sr.runEvery(ctx, "Reconciler", reconcileInterval(sr.cfg.Segment.ReconcileInterval), func() {
+		rollouts, err := sr.ReconcileSegments(ctx)
+		if err != nil {
+			sr.ErrLog.Printf("error reconciling segments: %s", err)
+			return
+		}
+
+		for _, r := range rollouts {
+			sr.InfoLog.Printf("Reconciled %s — %.2f%% of %d%% target\n", r.SegmentSlug, r.ActualFraction, r.TargetFraction)
+		}
+	})
+}
+
+func (sr *memorySegmentsRepository) ReconcileSegments(ctx context.Context) ([]*Rollout, error) {
+	origin := audit.FromContext(audit.WithSource(ctx, audit.SourceAutoFraction))
+
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	activeUsers := sr.activeUserIDs()
+	now := memstore.Now()
+	rollouts := []*Rollout{}
+
+	for _, stored := range sr.store.Segments {
+		if !stored.IsActive || stored.Fraction == 0 {
+			continue
+		}
+
+		excluded := sr.excludedUsers(stored.ID)
+		eligible := []int{}
+		for _, id := range activeUsers {
+			if !excluded[id] {
+				eligible = append(eligible, id)
+			}
+		}
+
+		var toAssign []int
+		if stored.Bucketing == BucketingHash {
+			toAssign = bucketMembers(stored.Salt, eligible, stored.Fraction)
+		} else {
+			missing := rolloutTarget(len(activeUsers), stored.Fraction) - sr.countActiveMembers(stored.ID)
+			if missing > len(eligible) {
+				missing = len(eligible)
+			}
+			if missing > 0 {
+				rand.Shuffle(len(eligible), func(i, j int) {
+					eligible[i], eligible[j] = eligible[j], eligible[i]
+				})
+				toAssign = eligible[:missing]
+			}
+		}
+
+		for _, id := range toAssign {
+			sr.store.NewRelation(id, stored.ID, now, nil, origin)
+		}
+
+		rollouts = append(rollouts, newRollout(toSegment(stored), sr.countActiveMembers(stored.ID), len(activeUsers)))
+	}
+
+	return rollouts, nil
+}
+
+func (sr *memorySegmentsRepository) GetRollout(_ context.Context, segmentSlug string) (*Rollout, error) {
+	sr.store.RLock()
+	defer sr.store.RUnlock()
+
+	stored := sr.store.SegmentBySlug(segmentSlug)
+	if stored == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, segmentSlug)
+	}
+	return newRollout(toSegment(stored), sr.countActiveMembers(stored.ID), len(sr.activeUserIDs())), nil
+}
+
+func (sr *memorySegmentsRepository) RunRampScheduler(ctx context.Context, jobs job.Repository) {
+	sr.runEvery(ctx, "Ramp scheduler", rampCheckInterval(sr.cfg.Segment.RampCheckInterval), func() {
+		now := memstore.Now()
+
+		sr.store.RLock()
+		due := []*memstore.Ramp{}
+		for _, ramp := range sr.store.Ramps {
+			if ramp.AppliedAt == nil && !ramp.RunAt.After(now) && sr.store.SegmentByID(ramp.SegmentID).IsActive {
+				due = append(due, ramp)
+			}
+		}
+		// ramps are stored in id order, so a stable sort orders them like ORDER BY run_at, id
+		sort.SliceStable(due, func(i, j int) bool {
+			return due[i].RunAt.Before(due[j].RunAt)
+		})
+
+		ramps := make([]*dueRamp, 0, len(due))
+		for _, ramp := range due {
+			ramps = append(ramps, &dueRamp{
+				ID:          ramp.ID,
+				SegmentSlug: sr.store.SegmentByID(ramp.SegmentID).Slug,
+				Fraction:    ramp.Fraction,
+			})
+		}
+		sr.store.RUnlock()
+
+		for _, ramp := range latestRamps(ramps) {
+			j, err := enqueueRamp(ctx, jobs, ramp)
+			if err != nil {
+				sr.ErrLog.Printf("error enqueueing ramp of %s: %s", ramp.SegmentSlug, err)
+				continue
+			}
+			sr.InfoLog.Printf("Ramping %s to %d%% in job %s, %d earlier steps skipped\n",
+				ramp.SegmentSlug, ramp.Fraction, j.ID, len(ramp.Superseded))
+
+			applied := map[int]bool{ramp.ID: true}
+			for _, id := range ramp.Superseded {
+				applied[id] = true
+			}
+
+			sr.store.Lock()
+			appliedAt := memstore.Now()
+			for _, stored := range sr.store.Ramps {
+				if applied[stored.ID] {
+					stored.AppliedAt = &appliedAt
+				}
+				if stored.ID == ramp.ID {
+					stored.JobID = j.ID
+				}
+			}
+			sr.store.Unlock()
+		}
+	})
+}
+
+func (sr *memorySegmentsRepository) SetFraction(ctx context.Context, segmentSlug string, fraction int) (*Rollout, error) {
+	err := validateFraction(fraction)
+	if err != nil {
+		return nil, err
+	}
+	origin := audit.FromContext(audit.WithSource(ctx, audit.SourceAutoFraction))
+
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	stored := sr.store.SegmentBySlug(segmentSlug)
+	if stored == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, segmentSlug)
+	}
+	if !stored.IsActive {
+		return nil, fmt.Errorf("%w: segment %s is deleted", ErrInvalidInput, segmentSlug)
+	}
+
+	now := memstore.Now()
+	previous := stored.Fraction
+	stored.Fraction = fraction
+	stored.UpdatedAt = now
+
+	activeUsers := sr.activeUserIDs()
+	if stored.Bucketing == BucketingHash {
+		excluded := sr.excludedUsers(stored.ID)
+		for _, id := range activeUsers {
+			in := bucket.Includes(stored.Salt, id, fraction)
+			rel := sr.store.ActiveRelation(id, stored.ID)
+			switch {
+			case fraction >= previous && in && !excluded[id]:
+				sr.store.NewRelation(id, stored.ID, now, nil, origin)
+			case fraction < previous && !in && rel != nil:
+				sr.store.Deactivate(rel, &now, origin)
+				rel.UnassignReason = UnassignReasonFraction
+			}
+		}
+	} else {
+		sr.rampRandom(stored.ID, rolloutTarget(len(activeUsers), fraction), activeUsers, now, origin)
+	}
+
+	sr.InfoLog.Printf("SetFraction — %s %d%% → %d%%\n", segmentSlug, previous, fraction)
+	return newRollout(toSegment(stored), sr.countActiveMembers(stored.ID), len(activeUsers)), nil
+}
+
+// rampRandom expects the store lock to be held by the caller. It tops the segment up with random eligible users
+// or unassigns its most recently assigned members until target active users are members.
+func (sr *memorySegmentsRepository) rampRandom(
+	segmentID, target int,
+	activeUsers []int,
+	now time.Time,
+	origin audit.Origin,
+) {
+	members := sr.countActiveMembers(segmentID)
+
+	if members < target {
+		excluded := sr.excludedUsers(segmentID)
+		candidates := []int{}
+		for _, id := range activeUsers {
+			if !excluded[id] {
+				candidates = append(candidates, id)
+			}
+		}
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+		if target-members < len(candidates) {
+			candidates = candidates[:target-members]
+		}
+		for _, id := range candidates {
+			sr.store.NewRelation(id, segmentID, now, nil, origin)
+		}
+		return
+	}
+
+	// relations are appended in assignment order, so walking backwards finds the latest members first
+	for i := len(sr.store.Relations) - 1; i >= 0 && members > target; i-- {
+		rel := sr.store.Relations[i]
+		if !rel.IsActive || rel.SegmentID != segmentID {
+			continue
+		}
+		if usr, ok := sr.store.Users[rel.UserID]; !ok || !usr.IsActive {
+			continue
+		}
+		sr.store.Deactivate(rel, &now, origin)
+		rel.UnassignReason = UnassignReasonFraction
+		members--
+	}
+}
+
+func (sr *memorySegmentsRepository) ScheduleRamp(ctx context.Context, schedule *RampSchedule) (*RampSchedule, error) {
+	err := schedule.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	sr.store.Lock()
+	stored := sr.store.SegmentBySlug(schedule.SegmentSlug)
+	if stored == nil {
+		sr.store.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, schedule.SegmentSlug)
+	}
+	if !stored.IsActive {
+		sr.store.Unlock()
+		return nil, fmt.Errorf("%w: segment %s is deleted", ErrInvalidInput, schedule.SegmentSlug)
+	}
+
+	ramps := sr.store.Ramps[:0]
+	for _, ramp := range sr.store.Ramps {
+		if ramp.SegmentID != stored.ID || ramp.AppliedAt != nil {
+			ramps = append(ramps, ramp)
+		}
+	}
+	sr.store.Ramps = ramps
+
+	for _, step := range schedule.Steps {
+		sr.store.NewRamp(stored.ID, step.Fraction, step.At)
+	}
+	sr.store.Unlock()
+
+	sr.InfoLog.Printf("ScheduleRamp — %s, %d steps\n", schedule.SegmentSlug, len(schedule.Steps))
+	return sr.GetRamp(ctx, schedule.SegmentSlug)
+}
+
+func (sr *memorySegmentsRepository) GetRamp(_ context.Context, segmentSlug string) (*RampSchedule, error) {
+	sr.store.RLock()
+	defer sr.store.RUnlock()
+
+	ids, err := sr.segmentsIDs([]string{segmentSlug})
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := &RampSchedule{SegmentSlug: segmentSlug, Steps: []*RampStep{}}
+	for _, ramp := range sr.store.Ramps {
+		if ramp.SegmentID != ids[0] {
+			continue
+		}
+
+		step := &RampStep{Fraction: ramp.Fraction, At: ramp.RunAt, JobID: ramp.JobID}
+		if ramp.AppliedAt != nil {
+			appliedAt := *ramp.AppliedAt
+			step.AppliedAt = &appliedAt
+		}
+		schedule.Steps = append(schedule.Steps, step)
+	}
+
+	sort.SliceStable(schedule.Steps, func(i, j int) bool {
+		return schedule.Steps[i].At.Before(schedule.Steps[j].At)
+	})
+	return schedule, nil
+}
+
+// activeUserIDs expects the store lock to be held by the caller. The ids are sorted.
+func (sr *memorySegmentsRepository) activeUserIDs() []int {
+	userIDs := []int{}
+	for id, usr := range sr.store.Users {
+		if usr.IsActive {
+			userIDs = append(userIDs, id)
+		}
+	}
+	sort.Ints(userIDs)
+	return userIDs
+}
+
+// countActiveMembers expects the store lock to be held by the caller.
+func (sr *memorySegmentsRepository) countActiveMembers(segmentID int) int {
+	count := 0
+	for _, rel := range sr.store.Relations {
+		if !rel.IsActive || rel.SegmentID != segmentID {
+			continue
+		}
+		if usr, ok := sr.store.Users[rel.UserID]; ok && usr.IsActive {
+			count++
+		}
+	}
+	return count
+}
+
+func (sr *memorySegmentsRepository) GetSegmentsIDs(_ context.Context, segmentSlugs []string) ([]int, error) {
+	sr.store.RLock()
+	defer sr.store.RUnlock()
+
+	return sr.segmentsIDs(segmentSlugs)
+}
+
+// segmentsIDs expects the store lock to be held by the caller.
+func (sr *memorySegmentsRepository) segmentsIDs(segmentSlugs []string) ([]int, error) {
+	ids := []int{}
+	for _, f := range segmentSlugs {
+		seg := sr.store.SegmentBySlug(f)
+		if seg == nil {
+			return []int{}, fmt.Errorf("%w: %s", ErrSegmentNotFound, f)
+		}
+		ids = append(ids, seg.ID)
+	}
+	return ids, nil
+}
+
+// excludedUsers expects the store lock to be held by the caller. It returns the users a fraction may not assign
+// the segment to, the counterpart of eligibleCondition: its members and the users whose last membership
+// was unassigned explicitly.
+func (sr *memorySegmentsRepository) excludedUsers(segmentID int) map[int]bool {
+	excluded := map[int]bool{}
+	// relations are appended in assignment order, so the last one of a user wins
+	for _, rel := range sr.store.Relations {
+		if rel.SegmentID == segmentID {
+			excluded[rel.UserID] = rel.IsActive || rel.UnassignReason == ""
+		}
+	}
+	return excluded
+}
+
+// hasActiveRelation expects the store lock to be held by the caller.
+func (sr *memorySegmentsRepository) hasActiveRelation(userID, segmentID int) bool {
+	return sr.store.ActiveRelation(userID, segmentID) != nil
+}
+
+func (sr *memorySegmentsRepository) GetNRandomUsersWithoutSegment(n int, slug string) ([]int, error) {
+	sr.store.RLock()
+	defer sr.store.RUnlock()
+
+	userIDs := []int{}
+	seg := sr.store.SegmentBySlug(slug)
+
+	for id, usr := range sr.store.Users {
+		if !usr.IsActive {
+			continue
+		}
+		if seg != nil && sr.hasActiveRelation(id, seg.ID) {
+			continue
+		}
+		userIDs = append(userIDs, id)
+	}
+
+	// map iteration order is not uniformly random, so shuffle explicitly like ORDER BY RAND()
+	rand.Shuffle(len(userIDs), func(i, j int) {
+		userIDs[i], userIDs[j] = userIDs[j], userIDs[i]
+	})
+
+	if n < len(userIDs) {
+		userIDs = userIDs[:n]
+	}
+	return userIDs, nil
+}
+
+func (sr *memorySegmentsRepository) GetActiveUsersAmount(_ context.Context) (int, error) {
+	sr.store.RLock()
+	defer sr.store.RUnlock()
+
+	amount := 0
+	for _, usr := range sr.store.Users {
+		if usr.IsActive {
+			amount++
+		}
+	}
+	return amount, nil
+}
+
+func (sr *memorySegmentsRepository) InsertSegment(_ context.Context, seg *Segment) (InsertOutcome, error) {
+	err := seg.Validate()
+	if err != nil {
+		return "", err
+	}
+
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	stored := sr.store.SegmentBySlug(seg.Slug)
+	outcome := InsertRevived
+	switch {
+	case stored == nil:
+		outcome = InsertCreated
+		stored = sr.store.NewSegment(seg.Slug)
+	case stored.DeletedAt == nil:
+		// creating an active segment again keeps the bucketing, fraction and window it runs with
+		if seg.Fraction != 0 {
+			return "", fmt.Errorf("%w: %s is active, its fraction is changed by update_segment_fraction",
+				ErrSegmentExists, seg.Slug)
+		}
+		outcome = InsertUnchanged
+		stored.UpdatedAt = memstore.Now()
+	default:
+		stored.IsActive = true
+		stored.DeletedAt = nil
+		stored.UpdatedAt = memstore.Now()
+	}
+
+	if seg.Description != "" {
+		stored.Description = seg.Description
+	}
+	if seg.Owner != "" {
+		stored.Owner = seg.Owner
+	}
+	if seg.Tags != nil {
+		stored.Tags = append([]string{}, seg.Tags...)
+	}
+
+	if outcome == InsertUnchanged {
+		sr.InfoLog.Printf("InsertSegment — %s %s\n", seg.Slug, outcome)
+		return outcome, nil
+	}
+
+	// a generated salt is only used when the segment has none, so reviving a segment keeps its buckets
+	switch {
+	case seg.Salt != "":
+		stored.Salt = seg.Salt
+	case stored.Salt == "":
+		stored.Salt, err = bucket.NewSalt()
+		if err != nil {
+			return "", err
+		}
+	}
+	stored.Bucketing = seg.Bucketing
+	stored.Fraction = seg.Fraction
+	stored.StartsAt = seg.StartsAt
+	stored.EndsAt = seg.EndsAt
+
+	sr.InfoLog.Printf("InsertSegment — %s %s\n", seg.Slug, outcome)
+	return outcome, nil
+}
+
+func (sr *memorySegmentsRepository) UpdateSegment(_ context.Context, patch *SegmentPatch) (*Segment, error) {
+	err := patch.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	stored := sr.store.SegmentBySlug(patch.SegmentSlug)
+	if stored == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, patch.SegmentSlug)
+	}
+
+	startsAt, endsAt := patch.window(stored.StartsAt, stored.EndsAt)
+	err = validateWindow(startsAt, endsAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if patch.Description != nil {
+		stored.Description = *patch.Description
+	}
+	if patch.Owner != nil {
+		stored.Owner = *patch.Owner
+	}
+	if patch.Tags != nil {
+		stored.Tags = append([]string{}, *patch.Tags...)
+	}
+	stored.StartsAt, stored.EndsAt = startsAt, endsAt
+	stored.UpdatedAt = memstore.Now()
+
+	sr.InfoLog.Printf("UpdateSegment — %s\n", patch.SegmentSlug)
+	return toSegment(stored), nil
+}
+
+func (sr *memorySegmentsRepository) GetSegment(_ context.Context, segmentSlug string) (*Segment, error) {
+	sr.store.RLock()
+	defer sr.store.RUnlock()
+
+	stored := sr.store.SegmentBySlug(segmentSlug)
+	if stored == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, segmentSlug)
+	}
+
+	count := 0
+	for _, rel := range sr.store.Relations {
+		if rel.IsActive && rel.SegmentID == stored.ID {
+			count++
+		}
+	}
+
+	seg := toSegment(stored)
+	seg.MemberCount = &count
+	return seg, nil
+}
+
+func (sr *memorySegmentsRepository) ListSegments(_ context.Context, filter *SegmentFilter) (*SegmentPage, error) {
+	afterID, err := filter.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	sr.store.RLock()
+	defer sr.store.RUnlock()
+
+	// store segments are ordered by id, like ORDER BY id of the SQL repository
+	segments := []*Segment{}
+	for _, stored := range sr.store.Segments {
+		if stored.ID <= afterID {
+			continue
+		}
+
+		seg := toSegment(stored)
+		if !filter.matches(seg) {
+			continue
+		}
+
+		segments = append(segments, seg)
+		if len(segments) > filter.Limit {
+			break
+		}
+	}
+
+	return newSegmentPage(segments, filter.Limit), nil
+}
+
+// toSegment copies a stored segment, so callers never share memory with the store.
+func toSegment(stored *memstore.Segment) *Segment {
+	seg := &Segment{
+		ID:          stored.ID,
+		Slug:        stored.Slug,
+		Description: stored.Description,
+		Owner:       stored.Owner,
+		Tags:        append([]string{}, stored.Tags...),
+		Bucketing:   stored.Bucketing,
+		Salt:        stored.Salt,
+		Fraction:    stored.Fraction,
+		StartsAt:    copyTime(stored.StartsAt),
+		EndsAt:      copyTime(stored.EndsAt),
+		IsActive:    stored.IsActive,
+		CreatedAt:   stored.CreatedAt,
+		UpdatedAt:   stored.UpdatedAt,
+		DeletedAt:   copyTime(stored.DeletedAt),
+	}
+	return seg
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func (sr *memorySegmentsRepository) DeleteSegment(ctx context.Context, segmentSlug string) error {
+	origin := audit.FromContext(audit.WithSource(ctx, audit.SourceSegmentDelete))
+
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	segmentID, err := sr.segmentsIDs([]string{segmentSlug})
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errors.ErrorGettingSegmentID, err)
+		return err
+	}
+
+	now := memstore.Now()
+	stored := sr.store.SegmentByID(segmentID[0])
+	stored.IsActive = false
+	stored.DeletedAt = &now
+	stored.UpdatedAt = now
+	for _, rel := range sr.store.Relations {
+		if rel.IsActive && rel.SegmentID == segmentID[0] {
+			sr.store.Deactivate(rel, &now, origin)
+			rel.UnassignReason = UnassignReasonDeleted
+		}
+	}
+	ramps := sr.store.Ramps[:0]
+	for _, ramp := range sr.store.Ramps {
+		if ramp.SegmentID != segmentID[0] || ramp.AppliedAt != nil {
+			ramps = append(ramps, ramp)
+		}
+	}
+	sr.store.Ramps = ramps
+
+	sr.InfoLog.Printf("DeleteSegment — %s\n", segmentSlug)
+	return nil
+}
+
+func (sr *memorySegmentsRepository) UnassignSegments(
+	ctx context.Context,
+	userID []int,
+	segmentsToUnassign []string,
+) error {
+	if len(segmentsToUnassign) == 0 {
+		return nil
+	}
+
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	ids, err := sr.segmentsIDs(segmentsToUnassign)
+	if err != nil {
+		return err
+	}
+
+	now := memstore.Now()
+	for _, usr := range userID {
+		for _, id := range ids {
+			if rel := sr.store.ActiveRelation(usr, id); rel != nil {
+				sr.store.Deactivate(rel, &now, audit.FromContext(ctx))
+				rel.UnassignReason = unassignReason(ctx)
+			}
+		}
+	}
+
+	sr.InfoLog.Printf("UnassignSegments — %d users\n", len(userID))
+	return nil
+}
+
+func (sr *memorySegmentsRepository) AssignSegments(
+	ctx context.Context,
+	userID []int,
+	segmentsToAssign []string,
+	expiresAt *time.Time,
+) error {
+	if len(segmentsToAssign) == 0 {
+		return nil
+	}
+
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	ids, err := sr.segmentsIDs(segmentsToAssign)
+	if err != nil {
+		return err
+	}
+
+	// validate everything up front so a failure leaves the store untouched, as a rolled back transaction would
+	for _, usr := range userID {
+		if _, ok := sr.store.Users[usr]; !ok {
+			return fmt.Errorf("user %d does not exist", usr)
+		}
+	}
+
+	now := memstore.Now()
+	for _, usr := range userID {
+		for _, segmentID := range ids {
+			if sr.hasActiveRelation(usr, segmentID) {
+				continue
+			}
+
+			sr.store.NewRelation(usr, segmentID, now, truncateTime(expiresAt), audit.FromContext(ctx))
+		}
+	}
+
+	sr.InfoLog.Printf("AssignSegments — %d users\n", len(userID))
+	return nil
+}
+
+func (sr *memorySegmentsRepository) UpdateUserSegments(
+	ctx context.Context,
+	userID int,
+	assign, unassign []string,
+	expiresAt *time.Time,
+) (*UpdateSegmentsResult, error) {
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	if _, ok := sr.store.Users[userID]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+	}
+
+	plan := sr.updateUserSegments(userID, assign, unassign, expiresAt, audit.FromContext(ctx))
+
+	sr.InfoLog.Printf("UpdateUserSegments — %d\n", userID)
+	return &UpdateSegmentsResult{UserID: userID, Results: plan.Results}, nil
+}
+
+// updateUserSegments applies the update of an existing user. The caller must hold the store lock.
+func (sr *memorySegmentsRepository) updateUserSegments(
+	userID int,
+	assign, unassign []string,
+	expiresAt *time.Time,
+	origin audit.Origin,
+) *updatePlan {
+	segments := map[string]segmentState{}
+	member := map[int]bool{}
+	sr.loadSegmentStates(userID, append(append([]string{}, assign...), unassign...), segments, member)
+
+	plan := planUpdate(assign, unassign, segments, member)
+	sr.applyPlan(userID, plan, expiresAt, origin)
+	return plan
+}
+
+// loadSegmentStates adds the given segments that are not in segments yet, and whether userID is active in them.
+// Known segments are skipped, so member keeps the changes planned since.
+func (sr *memorySegmentsRepository) loadSegmentStates(
+	userID int,
+	slugs []string,
+	segments map[string]segmentState,
+	member map[int]bool,
+) {
+	for _, slug := range slugs {
+		if _, ok := segments[slug]; ok {
+			continue
+		}
+		seg := sr.store.SegmentBySlug(slug)
+		if seg == nil {
+			continue
+		}
+		segments[slug] = segmentState{ID: seg.ID, IsActive: seg.IsActive}
+		member[seg.ID] = sr.hasActiveRelation(userID, seg.ID)
+	}
+}
+
+func (sr *memorySegmentsRepository) applyPlan(userID int, plan *updatePlan, expiresAt *time.Time, origin audit.Origin) {
+	now := memstore.Now()
+	for _, segmentID := range plan.ToAssign {
+		sr.store.NewRelation(userID, segmentID, now, truncateTime(expiresAt), origin)
+	}
+	for _, segmentID := range plan.ToUnassign {
+		if rel := sr.store.ActiveRelation(userID, segmentID); rel != nil {
+			sr.store.Deactivate(rel, &now, origin)
+		}
+	}
+}
+
+func (sr *memorySegmentsRepository) ImportMemberships(ctx context.Context, req *ImportRequest) (*ImportResult, error) {
+	result := newImportResult(req)
+	origin := audit.FromContext(audit.WithSource(ctx, audit.SourceImport))
+
+	size := sr.cfg.Segment.BatchSize
+	if size < 1 {
+		size = defaultBatchSize
+	}
+
+	done := 0
+	for _, batch := range importBatches(req.Rows, size) {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		sr.importBatch(batch, req.DryRun, origin, result)
+
+		done += groupRows(batch)
+		job.Progress(ctx, done, len(req.Rows))
+	}
+
+	sr.InfoLog.Printf("ImportMemberships — %d rows, %d failed, dry run %t\n", result.Rows, result.Failed, result.DryRun)
+	return result, nil
+}
+
+// importBatch plans the updates of a user against one membership state, so a dry run that changes nothing
+// still reports every row as if the earlier ones had been applied.
+func (sr *memorySegmentsRepository) importBatch(
+	batch []*importGroup,
+	dryRun bool,
+	origin audit.Origin,
+	result *ImportResult,
+) {
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	var (
+		userID   int
+		segments map[string]segmentState
+		member   map[int]bool
+	)
+	for _, g := range batch {
+		if _, ok := sr.store.Users[g.UserID]; !ok {
+			result.fail(g, fmt.Errorf("%w: %d", ErrUserNotFound, g.UserID))
+			continue
+		}
+
+		if segments == nil || userID != g.UserID {
+			userID, segments, member = g.UserID, map[string]segmentState{}, map[int]bool{}
+		}
+		sr.loadSegmentStates(g.UserID, append(append([]string{}, g.Assign...), g.Unassign...), segments, member)
+
+		plan := planUpdate(g.Assign, g.Unassign, segments, member)
+		if !dryRun {
+			sr.applyPlan(g.UserID, plan, g.ExpiresAt, origin)
+		}
+		result.record(plan.Results)
+	}
+}
+
+func (sr *memorySegmentsRepository) BulkUpdateUserSegments(
+	ctx context.Context,
+	req *RequestBulkUpdate,
+) (*BulkUpdateResult, error) {
+	err := req.validate(bulkMaxUsers(sr.cfg.Segment.BulkMaxUsers))
+	if err != nil {
+		return nil, err
+	}
+
+	updates, result := req.resolve(time.Now())
+
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	if req.Mode == BulkAllOrNothing {
+		if result.Failed > 0 {
+			return result, fmt.Errorf("%w: %d users have an invalid expiry", ErrInvalidInput, result.Failed)
+		}
+		// a missing user is the only way a single update fails, so checking them first stands in for the rollback
+		for _, u := range byUser(updates) {
+			if _, ok := sr.store.Users[u.UserID]; !ok {
+				err = fmt.Errorf("%w: %d", ErrUserNotFound, u.UserID)
+				result.fail(u.Index, err)
+				return result, err
+			}
+		}
+	}
+
+	for _, u := range updates {
+		if _, ok := sr.store.Users[u.UserID]; !ok {
+			result.fail(u.Index, fmt.Errorf("%w: %d", ErrUserNotFound, u.UserID))
+			continue
+		}
+		plan := sr.updateUserSegments(u.UserID, u.Assign, u.Unassign, u.ExpiresAt, audit.FromContext(ctx))
+		result.apply(u.Index, plan.Results)
+	}
+
+	sr.InfoLog.Printf("BulkUpdateUserSegments — %d applied, %d failed\n", result.Applied, result.Failed)
+	return result, nil
+}
+
+func (sr *memorySegmentsRepository) UpdateExpiry(ctx context.Context, change *ExpiryChange) (*ExpiryResult, error) {
+	now := memstore.Now()
+	newExpiry, err := change.plan(now)
+	if err != nil {
+		return nil, err
+	}
+
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	seg := sr.store.SegmentBySlug(change.SegmentSlug)
+	if seg == nil || !seg.IsActive {
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, change.SegmentSlug)
+	}
+
+	matched, updated := 0, 0
+	for _, rel := range sr.store.Relations {
+		if !rel.IsActive || rel.SegmentID != seg.ID || change.UserID != nil && rel.UserID != *change.UserID {
+			continue
+		}
+		matched++
+
+		next := newExpiry(rel.DateUnassigned)
+		if sameExpiry(rel.DateUnassigned, next) {
+			continue
+		}
+		sr.store.ChangeExpiry(rel, next, now, audit.FromContext(ctx))
+		updated++
+	}
+
+	if change.UserID != nil && matched == 0 {
+		return nil, fmt.Errorf("%w: user %d is not in segment %s", ErrMembershipNotFound, *change.UserID, change.SegmentSlug)
+	}
+
+	sr.InfoLog.Printf("UpdateExpiry — %s, %d memberships\n", change.SegmentSlug, updated)
+	return &ExpiryResult{SegmentSlug: change.SegmentSlug, UserID: change.UserID, Updated: updated}, nil
+}
+
+func (sr *memorySegmentsRepository) GetUserSegments(
+	_ context.Context,
+	userID int,
+	asOf *time.Time,
+) (*UserSegments, error) {
+	sr.store.RLock()
+	defer sr.store.RUnlock()
+
+	if asOf != nil {
+		err := validateAsOf(*asOf, time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		sr.InfoLog.Printf("GetSegments — %d as of %s\n", userID, asOf.Format(time.RFC3339))
+		return newUserSegments(userID, sr.userSegmentsAsOf(userID, asOf.UTC())), nil
+	}
+
+	userSegments := &UserSegments{
+		UserID:   userID,
+		Segments: []string{},
+		Details:  []*Segment{},
+	}
+
+	usr, userActive := sr.store.Users[userID]
+	userActive = userActive && usr.IsActive
+	now := time.Now().UTC()
+
+	for _, stored := range sr.store.Segments {
+		if !stored.IsActive {
+			continue
+		}
+
+		seg := toSegment(stored)
+		if !seg.inWindow(now) {
+			continue
+		}
+		// users without any relation to a hash segment are evaluated by their bucket
+		member := sr.hasActiveRelation(userID, seg.ID) ||
+			userActive && seg.includes(userID) && !sr.store.HasRelation(userID, seg.ID)
+		if member {
+			userSegments.Segments = append(userSegments.Segments, seg.Slug)
+			userSegments.Details = append(userSegments.Details, seg)
+		}
+	}
+
+	sr.InfoLog.Printf("GetSegments — %d\n", userID)
+	return userSegments, nil
+}
+
+func (sr *memorySegmentsRepository) StreamSegmentMembers(
+	_ context.Context,
+	q *MembersQuery,
+	fn func(*Member) error,
+) (string, error) {
+	afterID, err := q.Validate()
+	if err != nil {
+		return "", err
+	}
+
+	sr.store.RLock()
+	ids, err := sr.segmentsIDs([]string{q.SegmentSlug})
+	if err != nil {
+		sr.store.RUnlock()
+		return "", err
+	}
+
+	var asOf *time.Time
+	if q.AsOf != nil {
+		utc := q.AsOf.UTC()
+		asOf = &utc
+	}
+
+	byUser := map[int]*Member{}
+	for _, rel := range sr.store.Relations {
+		if rel.SegmentID != ids[0] || rel.UserID <= afterID || byUser[rel.UserID] != nil {
+			continue
+		}
+		if memberAt(asOf, rel.IsActive, rel.DateAssigned, rel.DateUnassigned) {
+			byUser[rel.UserID] = newMember(q, rel.UserID, rel.DateAssigned, rel.DateUnassigned)
+		}
+	}
+	// the callback may be slow, so the lock is not held while streaming
+	sr.store.RUnlock()
+
+	userIDs := make([]int, 0, len(byUser))
+	for id := range byUser {
+		userIDs = append(userIDs, id)
+	}
+	sort.Ints(userIDs)
+
+	for i, id := range userIDs {
+		if i == q.Limit {
+			return encodeCursor(userIDs[i-1]), nil
+		}
+
+		err = fn(byUser[id])
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,350 @@
+package segment
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"usersegmentator/pkg/bucket"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/errors"
+)
+
+const segmentColumns = "id, slug, description, owner, bucketing, salt, fraction, starts_at, ends_at, " +
+	"is_active, created_at, updated_at, deleted_at"
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (sr *segmentsRepository) insertSegment(ctx context.Context, tx *sql.Tx, seg *Segment) (InsertOutcome, error) {
+	// a generated salt is only used when the segment has none, so reviving a segment keeps its buckets
+	salt := seg.Salt
+	if salt == "" {
+		var err error
+		salt, err = bucket.NewSalt()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var (
+		id        int
+		deletedAt sql.NullTime
+	)
+	err := tx.QueryRowContext(
+		ctx,
+		sr.dialect.Rebind("SELECT id, deleted_at FROM segments WHERE slug = ? FOR UPDATE"),
+		seg.Slug,
+	).Scan(&id, &deletedAt)
+
+	outcome := InsertRevived
+	switch {
+	case err == sql.ErrNoRows:
+		outcome = InsertCreated
+		_, err = tx.ExecContext(
+			ctx,
+			sr.dialect.Rebind("INSERT INTO segments "+
+				"(slug, description, owner, bucketing, salt, fraction, starts_at, ends_at) "+
+				"VALUES (?, ?, ?, ?, ?, ?, ?, ?)"),
+			seg.Slug,
+			seg.Description,
+			seg.Owner,
+			seg.Bucketing,
+			salt,
+			seg.Fraction,
+			seg.StartsAt,
+			seg.EndsAt,
+		)
+		if err != nil {
+			return "", err
+		}
+
+		err = tx.QueryRowContext(ctx, sr.dialect.Rebind("SELECT id FROM segments WHERE slug = ?"), seg.Slug).Scan(&id)
+		if err != nil {
+			return "", err
+		}
+
+	case err != nil:
+		return "", err
+
+	case !deletedAt.Valid:
+		// creating an active segment again only fills in the description and the owner, the bucketing,
+		// fraction and window it runs with are changed through their own methods
+		if seg.Fraction != 0 {
+			return "", fmt.Errorf("%w: %s is active, its fraction is changed by update_segment_fraction",
+				ErrSegmentExists, seg.Slug)
+		}
+		outcome = InsertUnchanged
+		_, err = tx.ExecContext(
+			ctx,
+			sr.dialect.Rebind("UPDATE segments SET updated_at = CURRENT_TIMESTAMP, "+
+				"description = CASE WHEN ? = '' THEN description ELSE ? END, "+
+				"owner = CASE WHEN ? = '' THEN owner ELSE ? END "+
+				"WHERE id = ?"),
+			seg.Description,
+			seg.Description,
+			seg.Owner,
+			seg.Owner,
+			id,
+		)
+		if err != nil {
+			return "", err
+		}
+
+	default:
+		// a deleted segment is revived with the bucketing, fraction and window of the request
+		_, err = tx.ExecContext(
+			ctx,
+			sr.dialect.Rebind("UPDATE segments SET "+
+				"is_active = TRUE, deleted_at = NULL, updated_at = CURRENT_TIMESTAMP, "+
+				"description = CASE WHEN ? = '' THEN description ELSE ? END, "+
+				"owner = CASE WHEN ? = '' THEN owner ELSE ? END, "+
+				"salt = CASE WHEN ? <> '' THEN ? WHEN salt = '' THEN ? ELSE salt END, "+
+				"bucketing = ?, fraction = ?, starts_at = ?, ends_at = ? "+
+				"WHERE id = ?"),
+			seg.Description,
+			seg.Description,
+			seg.Owner,
+			seg.Owner,
+			seg.Salt,
+			seg.Salt,
+			salt,
+			seg.Bucketing,
+			seg.Fraction,
+			seg.StartsAt,
+			seg.EndsAt,
+			id,
+		)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if seg.Tags != nil {
+		err = sr.replaceTags(ctx, tx, id, seg.Tags)
+		if err != nil {
+			return "", err
+		}
+	}
+	return outcome, nil
+}
+
+func (sr *segmentsRepository) UpdateSegment(ctx context.Context, patch *SegmentPatch) (*Segment, error) {
+	err := patch.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errors.ErrorBeginTransaction, err)
+		return nil, err
+	}
+
+	seg, err := sr.updateSegment(ctx, tx, patch)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errors.ErrorCommittingTransaction, err)
+		return nil, err
+	}
+
+	sr.InfoLog.Printf("UpdateSegment — %s\n", patch.SegmentSlug)
+	return seg, nil
+}
+
+func (sr *segmentsRepository) updateSegment(ctx context.Context, tx *sql.Tx, patch *SegmentPatch) (*Segment, error) {
+	segments, err := sr.readSegments(ctx, tx, "WHERE slug = ? FOR UPDATE", patch.SegmentSlug)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, patch.SegmentSlug)
+	}
+	seg := segments[0]
+
+	if patch.Description != nil {
+		seg.Description = *patch.Description
+	}
+	if patch.Owner != nil {
+		seg.Owner = *patch.Owner
+	}
+	seg.StartsAt, seg.EndsAt = patch.window(seg.StartsAt, seg.EndsAt)
+
+	err = validateWindow(seg.StartsAt, seg.EndsAt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		sr.dialect.Rebind("UPDATE segments SET description = ?, owner = ?, starts_at = ?, ends_at = ?, "+
+			"updated_at = CURRENT_TIMESTAMP WHERE id = ?"),
+		seg.Description,
+		seg.Owner,
+		seg.StartsAt,
+		seg.EndsAt,
+		seg.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if patch.Tags != nil {
+		err = sr.replaceTags(ctx, tx, seg.ID, *patch.Tags)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	segments, err = sr.readSegments(ctx, tx, "WHERE id = ?", seg.ID)
+	if err != nil {
+		return nil, err
+	}
+	return segments[0], nil
+}
+
+func (sr *segmentsRepository) GetSegment(ctx context.Context, segmentSlug string) (*Segment, error) {
+	segments, err := sr.readSegments(ctx, sr.db, "WHERE slug = ?", segmentSlug)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, segmentSlug)
+	}
+
+	count, err := sr.countMembers(ctx, segments[0].ID)
+	if err != nil {
+		return nil, err
+	}
+	segments[0].MemberCount = &count
+
+	return segments[0], nil
+}
+
+func (sr *segmentsRepository) replaceTags(ctx context.Context, tx *sql.Tx, segmentID int, tags []string) error {
+	_, err := tx.ExecContext(ctx, sr.dialect.Rebind("DELETE FROM segment_tags WHERE segment_id = ?"), segmentID)
+	if err != nil {
+		return err
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(tags)*2) //nolint:gomnd // two inserted columns
+	for _, tag := range tags {
+		args = append(args, segmentID, tag)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		sr.dialect.Rebind("INSERT INTO segment_tags (segment_id, tag) VALUES "+
+			dialect.Values(len(tags), 2)), //nolint:gomnd // two inserted columns
+		args...,
+	)
+	return err
+}
+
+// readSegments selects segments by the given WHERE clause (with optional ORDER BY, LIMIT or locking)
+// and fills in their tags.
+func (sr *segmentsRepository) readSegments(
+	ctx context.Context,
+	q querier,
+	where string,
+	args ...interface{},
+) ([]*Segment, error) {
+	rows, err := q.QueryContext(ctx, sr.dialect.Rebind("SELECT "+segmentColumns+" FROM segments "+where), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []*Segment{}
+	byID := map[int]*Segment{}
+	for rows.Next() {
+		seg := &Segment{Tags: []string{}}
+		var startsAt, endsAt, deletedAt sql.NullTime
+
+		err = rows.Scan(
+			&seg.ID,
+			&seg.Slug,
+			&seg.Description,
+			&seg.Owner,
+			&seg.Bucketing,
+			&seg.Salt,
+			&seg.Fraction,
+			&startsAt,
+			&endsAt,
+			&seg.IsActive,
+			&seg.CreatedAt,
+			&seg.UpdatedAt,
+			&deletedAt,
+		)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+
+		if startsAt.Valid {
+			seg.StartsAt = &startsAt.Time
+		}
+		if endsAt.Valid {
+			seg.EndsAt = &endsAt.Time
+		}
+		if deletedAt.Valid {
+			seg.DeletedAt = &deletedAt.Time
+		}
+		segments = append(segments, seg)
+		byID[seg.ID] = seg
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segments) == 0 {
+		return segments, nil
+	}
+
+	tagArgs := make([]interface{}, 0, len(segments))
+	for _, seg := range segments {
+		tagArgs = append(tagArgs, seg.ID)
+	}
+
+	rows, err = q.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT segment_id, tag FROM segment_tags "+
+			"WHERE segment_id IN ("+dialect.Placeholders(len(tagArgs))+") ORDER BY tag"),
+		tagArgs...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var (
+			segmentID int
+			tag       string
+		)
+		err = rows.Scan(&segmentID, &tag)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		byID[segmentID].Tags = append(byID[segmentID].Tags, tag)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
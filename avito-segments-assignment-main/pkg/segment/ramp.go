@@ -0,0 +1,449 @@
+package segment
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/bucket"
+	"usersegmentator/pkg/dialect"
+	errs "usersegmentator/pkg/errors"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/lease"
+)
+
+const (
+	maxRampSteps = 100
+
+	// defaultRampCheckInterval is used when segment.ramp_check_interval is not set.
+	defaultRampCheckInterval = time.Minute
+)
+
+func validateFraction(fraction int) error {
+	if fraction < 0 || fraction > 100 {
+		return fmt.Errorf("%w: fraction %d is out of [0, 100]", ErrInvalidInput, fraction)
+	}
+	return nil
+}
+
+func (c *FractionChange) Validate() error {
+	if c.SegmentSlug == "" {
+		return fmt.Errorf("%w: empty segment slug", ErrInvalidInput)
+	}
+	return validateFraction(c.Fraction)
+}
+
+// Validate checks the steps and orders them by time.
+func (s *RampSchedule) Validate() error {
+	if s.SegmentSlug == "" {
+		return fmt.Errorf("%w: empty segment slug", ErrInvalidInput)
+	}
+	if len(s.Steps) > maxRampSteps {
+		return fmt.Errorf("%w: more than %d ramp steps", ErrInvalidInput, maxRampSteps)
+	}
+
+	for _, step := range s.Steps {
+		if step == nil || step.At.IsZero() {
+			return fmt.Errorf("%w: every ramp step needs a time", ErrInvalidInput)
+		}
+		err := validateFraction(step.Fraction)
+		if err != nil {
+			return err
+		}
+		step.At = step.At.UTC().Truncate(time.Second)
+		step.AppliedAt = nil
+	}
+
+	sort.SliceStable(s.Steps, func(i, j int) bool {
+		return s.Steps[i].At.Before(s.Steps[j].At)
+	})
+	return nil
+}
+
+func rampCheckInterval(minutes int) time.Duration {
+	if minutes < 1 {
+		return defaultRampCheckInterval
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// rampLeaseName is the worker_leases row that elects the replica applying the ramp steps, so a step
+// is applied once however many replicas are running.
+const rampLeaseName = "ramp_scheduler"
+
+// dueRamp is a pending ramp step whose time has come.
+type dueRamp struct {
+	ID          int
+	SegmentSlug string
+	Fraction    int
+	// Superseded are the earlier due steps of the same segment, applying this one makes them moot.
+	Superseded []int
+}
+
+// latestRamps keeps the latest due step of every segment, ramps are expected in time order.
+// A scheduler that was down for a while goes straight to the fraction it should be at now.
+func latestRamps(ramps []*dueRamp) []*dueRamp {
+	latest := map[string]*dueRamp{}
+	slugs := []string{}
+	for _, ramp := range ramps {
+		prev, ok := latest[ramp.SegmentSlug]
+		if ok {
+			ramp.Superseded = append(prev.Superseded, prev.ID)
+		} else {
+			slugs = append(slugs, ramp.SegmentSlug)
+		}
+		latest[ramp.SegmentSlug] = ramp
+	}
+
+	result := make([]*dueRamp, 0, len(slugs))
+	for _, slug := range slugs {
+		result = append(result, latest[slug])
+	}
+	return result
+}
+
+// enqueueRamp hands the step to the job runner as a set_fraction job.
+func enqueueRamp(ctx context.Context, jobs job.Repository, ramp *dueRamp) (*job.Job, error) {
+	return jobs.Create(ctx, job.KindSetFraction, &FractionChange{SegmentSlug: ramp.SegmentSlug, Fraction: ramp.Fraction})
+}
+
+// RunRampScheduler enqueues a set_fraction job for the ramp steps whose time has come every
+// segment.ramp_check_interval minutes until ctx is done, and marks the steps applied with the id of the job.
+// The job reports its progress, can be cancelled and is resumed by another runner when this one stops.
+// Only the latest due step of a segment is enqueued and deleted segments are skipped. Only the replica holding
+// the ramp_scheduler lease schedules.
+func (sr *segmentsRepository) RunRampScheduler(ctx context.Context, jobs job.Repository) {
+	interval := rampCheckInterval(sr.cfg.Segment.RampCheckInterval)
+	sr.runLeased(ctx, "Ramp scheduler", rampLeaseName, interval, func(ctx context.Context, _ *lease.Lease) {
+		ramps, err := sr.dueRamps(ctx)
+		if err != nil {
+			sr.ErrLog.Printf("error reading due ramps: %s", err)
+			return
+		}
+
+		for _, ramp := range latestRamps(ramps) {
+			j, err := enqueueRamp(ctx, jobs, ramp)
+			if err != nil {
+				sr.ErrLog.Printf("error enqueueing ramp of %s: %s", ramp.SegmentSlug, err)
+				continue
+			}
+			sr.InfoLog.Printf("Ramping %s to %d%% in job %s, %d earlier steps skipped\n",
+				ramp.SegmentSlug, ramp.Fraction, j.ID, len(ramp.Superseded))
+
+			ids := append(ramp.Superseded, ramp.ID)
+			args := make([]interface{}, 0, len(ids)+2) //nolint:gomnd // the step and its job come first
+			args = append(args, ramp.ID, j.ID)
+			for _, id := range ids {
+				args = append(args, id)
+			}
+			_, err = sr.db.ExecContext(
+				ctx,
+				sr.dialect.Rebind("UPDATE segment_ramps "+
+					"SET applied_at = CURRENT_TIMESTAMP, job_id = CASE WHEN id = ? THEN ? END "+
+					"WHERE id IN ("+dialect.Placeholders(len(ids))+")"),
+				args...,
+			)
+			if err != nil {
+				sr.ErrLog.Printf("error marking ramp of %s applied: %s", ramp.SegmentSlug, err)
+			}
+		}
+	})
+}
+
+func (sr *segmentsRepository) dueRamps(ctx context.Context) ([]*dueRamp, error) {
+	rows, err := sr.db.QueryContext(
+		ctx,
+		"SELECT r.id, s.slug, r.fraction FROM segment_ramps r "+
+			"JOIN segments s ON s.id = r.segment_id AND s.is_active = TRUE "+
+			"WHERE r.applied_at IS NULL AND r.run_at <= CURRENT_TIMESTAMP "+
+			"ORDER BY r.run_at, r.id",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ramps := []*dueRamp{}
+	for rows.Next() {
+		ramp := &dueRamp{}
+		err = rows.Scan(&ramp.ID, &ramp.SegmentSlug, &ramp.Fraction)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		ramps = append(ramps, ramp)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return ramps, nil
+}
+
+// SetFraction changes the target fraction of an active segment and brings its members in line right away.
+// Hash segments gain or lose exactly the users whose buckets cross the fraction. Random segments are topped
+// up with random users or lose their most recently assigned members. Like the reconciler, a ramp up brings
+// back the users a lower fraction took out but never the ones unassigned by hand. Users leave through
+// a regular unassignment, so the history shows when they left the rollout. The fraction is stored first,
+// so an interrupted change is completed by the reconciler or by repeating the request.
+func (sr *segmentsRepository) SetFraction(ctx context.Context, segmentSlug string, fraction int) (*Rollout, error) {
+	err := validateFraction(fraction)
+	if err != nil {
+		return nil, err
+	}
+	ctx = audit.WithSource(ctx, audit.SourceAutoFraction)
+
+	segments, err := sr.readSegments(ctx, sr.db, "WHERE slug = ?", segmentSlug)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, segmentSlug)
+	}
+
+	seg := segments[0]
+	if !seg.IsActive {
+		return nil, fmt.Errorf("%w: segment %s is deleted", ErrInvalidInput, segmentSlug)
+	}
+
+	_, err = sr.db.ExecContext(
+		ctx,
+		sr.dialect.Rebind("UPDATE segments SET fraction = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?"),
+		fraction,
+		seg.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := seg.Fraction
+	seg.Fraction = fraction
+
+	if seg.Bucketing == BucketingHash {
+		err = sr.rampBuckets(ctx, seg, previous)
+	} else {
+		err = sr.rampRandom(ctx, seg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sr.InfoLog.Printf("SetFraction — %s %d%% → %d%%\n", segmentSlug, previous, fraction)
+	return sr.rollout(ctx, seg)
+}
+
+func (sr *segmentsRepository) rampBuckets(ctx context.Context, seg *Segment, previous int) error {
+	if seg.Fraction >= previous {
+		if seg.Fraction == 0 {
+			return nil
+		}
+		return sr.assignEligibleBuckets(ctx, seg)
+	}
+
+	members, err := sr.countActiveMembers(ctx, seg.ID)
+	if err != nil {
+		return err
+	}
+
+	afterID, checked := 0, 0
+	for {
+		rows, err := sr.db.QueryContext(
+			ctx,
+			sr.dialect.Rebind("SELECT user_id FROM user_segment_relation "+
+				"WHERE segment_id = ? AND is_active = TRUE AND user_id > ? "+
+				"ORDER BY user_id LIMIT ?"),
+			seg.ID,
+			afterID,
+			sr.batchSize(),
+		)
+		if err != nil {
+			return err
+		}
+
+		userIDs, err := scanIDs(rows)
+		if err != nil {
+			return err
+		}
+		if len(userIDs) == 0 {
+			return nil
+		}
+		afterID = userIDs[len(userIDs)-1]
+
+		outside := []int{}
+		for _, id := range userIDs {
+			if !bucket.Includes(seg.Salt, id, seg.Fraction) {
+				outside = append(outside, id)
+			}
+		}
+
+		err = sr.UnassignSegments(ctx, outside, []string{seg.Slug})
+		if err != nil {
+			return err
+		}
+
+		checked += len(userIDs)
+		job.Progress(ctx, checked, members)
+	}
+}
+
+func (sr *segmentsRepository) rampRandom(ctx context.Context, seg *Segment) error {
+	activeUsers, err := sr.GetActiveUsersAmount(ctx)
+	if err != nil {
+		return err
+	}
+
+	members, err := sr.countActiveMembers(ctx, seg.ID)
+	if err != nil {
+		return err
+	}
+
+	target := rolloutTarget(activeUsers, seg.Fraction)
+	switch {
+	case members < target:
+		userIDs, err := sr.randomEligibleUsers(ctx, seg.ID, target-members)
+		if err != nil {
+			return err
+		}
+		return sr.AssignSegments(ctx, userIDs, []string{seg.Slug}, nil)
+
+	case members > target:
+		rows, err := sr.db.QueryContext(
+			ctx,
+			sr.dialect.Rebind("SELECT r.user_id FROM user_segment_relation r "+
+				"JOIN users u ON u.id = r.user_id "+
+				"WHERE r.segment_id = ? AND r.is_active = TRUE AND u.is_active = TRUE "+
+				"ORDER BY r.date_assigned DESC, r.id DESC LIMIT ?"),
+			seg.ID,
+			members-target,
+		)
+		if err != nil {
+			return err
+		}
+
+		userIDs, err := scanIDs(rows)
+		if err != nil {
+			return err
+		}
+		return sr.UnassignSegments(ctx, userIDs, []string{seg.Slug})
+	}
+
+	return nil
+}
+
+// ScheduleRamp replaces the pending steps of the segment ramp. Applied steps are kept as its history.
+func (sr *segmentsRepository) ScheduleRamp(ctx context.Context, schedule *RampSchedule) (*RampSchedule, error) {
+	err := schedule.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorBeginTransaction, err)
+		return nil, err
+	}
+
+	err = sr.scheduleRamp(ctx, tx, schedule)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorCommittingTransaction, err)
+		return nil, err
+	}
+
+	sr.InfoLog.Printf("ScheduleRamp — %s, %d steps\n", schedule.SegmentSlug, len(schedule.Steps))
+	return sr.GetRamp(ctx, schedule.SegmentSlug)
+}
+
+func (sr *segmentsRepository) scheduleRamp(ctx context.Context, tx *sql.Tx, schedule *RampSchedule) error {
+	var (
+		segmentID int
+		isActive  bool
+	)
+	err := tx.QueryRowContext(
+		ctx,
+		sr.dialect.Rebind("SELECT id, is_active FROM segments WHERE slug = ? FOR UPDATE"),
+		schedule.SegmentSlug,
+	).Scan(&segmentID, &isActive)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s", ErrSegmentNotFound, schedule.SegmentSlug)
+	}
+	if err != nil {
+		return err
+	}
+	if !isActive {
+		return fmt.Errorf("%w: segment %s is deleted", ErrInvalidInput, schedule.SegmentSlug)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		sr.dialect.Rebind("DELETE FROM segment_ramps WHERE segment_id = ? AND applied_at IS NULL"),
+		segmentID,
+	)
+	if err != nil || len(schedule.Steps) == 0 {
+		return err
+	}
+
+	args := make([]interface{}, 0, len(schedule.Steps)*3) //nolint:gomnd // three inserted columns
+	for _, step := range schedule.Steps {
+		args = append(args, segmentID, step.Fraction, step.At)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		sr.dialect.Rebind("INSERT INTO segment_ramps (segment_id, fraction, run_at) VALUES "+
+			dialect.Values(len(schedule.Steps), 3)), //nolint:gomnd // three inserted columns
+		args...,
+	)
+	return err
+}
+
+func (sr *segmentsRepository) GetRamp(ctx context.Context, segmentSlug string) (*RampSchedule, error) {
+	ids, err := sr.GetSegmentsIDs(ctx, []string{segmentSlug})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sr.db.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT fraction, run_at, applied_at, job_id FROM segment_ramps "+
+			"WHERE segment_id = ? ORDER BY run_at, id"),
+		ids[0],
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := &RampSchedule{SegmentSlug: segmentSlug, Steps: []*RampStep{}}
+	for rows.Next() {
+		var (
+			step      = &RampStep{}
+			appliedAt sql.NullTime
+			jobID     sql.NullString
+		)
+		err = rows.Scan(&step.Fraction, &step.At, &appliedAt, &jobID)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if appliedAt.Valid {
+			step.AppliedAt = &appliedAt.Time
+		}
+		step.JobID = jobID.String
+		schedule.Steps = append(schedule.Steps, step)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
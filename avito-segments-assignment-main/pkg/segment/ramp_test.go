@@ -0,0 +1,124 @@
+package segment
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func setFraction(t *testing.T, repo Repository, slug string, fraction int) *Rollout {
+	t.Helper()
+	rollout, err := repo.SetFraction(context.Background(), slug, fraction)
+	if err != nil {
+		t.Fatalf("fraction %d: %s", fraction, err)
+	}
+	return rollout
+}
+
+func testHashRampUpDownUp(t *testing.T, repo Repository) {
+	slug := insertTestSegment(t, repo, BucketingHash)
+
+	setFraction(t, repo, slug, 25)
+	first := memberSet(t, repo, slug)
+	if len(first) == 0 {
+		t.Fatal("no members at 25%")
+	}
+
+	// a user unassigned by hand stays out of the rollout
+	var manual int
+	for id := range first {
+		manual = id
+		break
+	}
+	_, err := repo.UpdateUserSegments(context.Background(), manual, nil, []string{slug}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setFraction(t, repo, slug, 5)
+	for id := range memberSet(t, repo, slug) {
+		if !first[id] {
+			t.Errorf("user %d joined the segment when its fraction went down", id)
+		}
+	}
+
+	setFraction(t, repo, slug, 25)
+	last := memberSet(t, repo, slug)
+	if last[manual] {
+		t.Errorf("user %d unassigned by hand is back in the segment", manual)
+	}
+	delete(first, manual)
+	if len(last) != len(first) {
+		t.Errorf("%d members after 25%% → 5%% → 25%%, want the %d of the first 25%%", len(last), len(first))
+	}
+	for id := range first {
+		if !last[id] {
+			t.Errorf("user %d of the first 25%% is not back", id)
+		}
+	}
+}
+
+func testRandomRampUpDownUp(t *testing.T, repo Repository) {
+	slug := insertTestSegment(t, repo, BucketingRandom)
+
+	for _, fraction := range []int{100, 50, 100} {
+		rollout := setFraction(t, repo, slug, fraction)
+		if target := rolloutTarget(rollout.ActiveUsers, fraction); rollout.Members != target {
+			t.Errorf("%d members at %d%%, want %d", rollout.Members, fraction, target)
+		}
+	}
+}
+
+func testDeleteCancelsRamp(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	slug := insertTestSegment(t, repo, BucketingRandom)
+
+	_, err := repo.ScheduleRamp(ctx, &RampSchedule{
+		SegmentSlug: slug,
+		Steps:       []*RampStep{{Fraction: 50, At: time.Now().Add(time.Hour)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.DeleteSegment(ctx, slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a revived segment starts without the steps of the deleted one
+	_, err = repo.InsertSegment(ctx, &Segment{Slug: slug, Bucketing: BucketingRandom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule, err := repo.GetRamp(ctx, slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedule.Steps) != 0 {
+		t.Errorf("steps = %+v after the deletion, want none", schedule.Steps)
+	}
+}
+
+func TestHashRampUpDownUpMemory(t *testing.T) {
+	testHashRampUpDownUp(t, newTestMemoryRepo(t))
+}
+
+func TestHashRampUpDownUpSQL(t *testing.T) {
+	testHashRampUpDownUp(t, newTestSQLRepo(t))
+}
+
+func TestRandomRampUpDownUpMemory(t *testing.T) {
+	testRandomRampUpDownUp(t, newTestMemoryRepo(t))
+}
+
+func TestRandomRampUpDownUpSQL(t *testing.T) {
+	testRandomRampUpDownUp(t, newTestSQLRepo(t))
+}
+
+func TestDeleteCancelsRampMemory(t *testing.T) {
+	testDeleteCancelsRamp(t, newTestMemoryRepo(t))
+}
+
+func TestDeleteCancelsRampSQL(t *testing.T) {
+	testDeleteCancelsRamp(t, newTestSQLRepo(t))
+}
@@ -0,0 +1,234 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/job"
+	"usersegmentator/pkg/lease"
+)
+
+// defaultReconcileInterval is used when segment.reconcile_interval is not set.
+const defaultReconcileInterval = 5 * time.Minute
+
+// rolloutTarget is the number of members a segment needs to cover fraction percent of the active users.
+func rolloutTarget(activeUsers, fraction int) int {
+	return int(math.Ceil(float64(activeUsers) * (float64(fraction) / 100))) //nolint:gomnd // creating percents
+}
+
+func newRollout(seg *Segment, members, activeUsers int) *Rollout {
+	rollout := &Rollout{
+		SegmentSlug:    seg.Slug,
+		Bucketing:      seg.Bucketing,
+		TargetFraction: seg.Fraction,
+		Members:        members,
+		ActiveUsers:    activeUsers,
+	}
+	if activeUsers > 0 {
+		//nolint:gomnd // percents rounded to two decimals
+		rollout.ActualFraction = math.Round(float64(members)*100*100/float64(activeUsers)) / 100
+	}
+	return rollout
+}
+
+func reconcileInterval(minutes int) time.Duration {
+	if minutes < 1 {
+		return defaultReconcileInterval
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// reconcilerLeaseName is the worker_leases row that elects the replica reconciling the fraction segments.
+// Replicas reconciling together would each top a random segment up to its target and overshoot it.
+const reconcilerLeaseName = "reconciler"
+
+// RunReconciler brings every fraction segment back to its target every segment.reconcile_interval minutes
+// until ctx is done and logs the resulting shares. Only the replica holding the reconciler lease reconciles.
+func (sr *segmentsRepository) RunReconciler(ctx context.Context) {
+	interval := reconcileInterval(sr.cfg.Segment.ReconcileInterval)
+	sr.runLeased(ctx, "Reconciler", reconcilerLeaseName, interval, func(ctx context.Context, _ *lease.Lease) {
+		rollouts, err := sr.ReconcileSegments(ctx)
+		if err != nil {
+			sr.ErrLog.Printf("error reconciling segments: %s", err)
+			return
+		}
+
+		for _, r := range rollouts {
+			sr.InfoLog.Printf("Reconciled %s — %.2f%% of %d%% target\n", r.SegmentSlug, r.ActualFraction, r.TargetFraction)
+		}
+	})
+}
+
+// ReconcileSegments includes the active users that joined after a fraction segment was rolled out.
+// Hash segments get every eligible user of their buckets, random segments are topped up with random
+// eligible users until the target share is reached. Users who were unassigned explicitly are left alone,
+// and members are never removed, so a share above the target is only reported.
+func (sr *segmentsRepository) ReconcileSegments(ctx context.Context) ([]*Rollout, error) {
+	ctx = audit.WithSource(ctx, audit.SourceAutoFraction)
+	segments, err := sr.readSegments(ctx, sr.db, "WHERE is_active = TRUE AND fraction > 0 ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	rollouts := make([]*Rollout, 0, len(segments))
+	for _, seg := range segments {
+		err = sr.reconcileSegment(ctx, seg)
+		if err != nil {
+			return nil, fmt.Errorf("reconciling %s: %w", seg.Slug, err)
+		}
+
+		rollout, err := sr.rollout(ctx, seg)
+		if err != nil {
+			return nil, err
+		}
+		rollouts = append(rollouts, rollout)
+	}
+
+	return rollouts, nil
+}
+
+func (sr *segmentsRepository) reconcileSegment(ctx context.Context, seg *Segment) error {
+	if seg.Bucketing == BucketingHash {
+		return sr.assignEligibleBuckets(ctx, seg)
+	}
+
+	activeUsers, err := sr.GetActiveUsersAmount(ctx)
+	if err != nil {
+		return err
+	}
+
+	members, err := sr.countActiveMembers(ctx, seg.ID)
+	if err != nil {
+		return err
+	}
+
+	missing := rolloutTarget(activeUsers, seg.Fraction) - members
+	if missing <= 0 {
+		return nil
+	}
+
+	userIDs, err := sr.randomEligibleUsers(ctx, seg.ID, missing)
+	if err != nil {
+		return err
+	}
+	return sr.AssignSegments(ctx, userIDs, []string{seg.Slug}, nil)
+}
+
+// eligibleCondition keeps the users u a fraction may assign the segment of the placeholder to: users who are
+// not its members and whose last membership, if any, was not unassigned explicitly. Users taken out by a lower
+// fraction, by their TTL or by the deletion of the segment come back, the ones unassigned by hand don't.
+const eligibleCondition = "NOT EXISTS (SELECT 1 FROM user_segment_relation r " +
+	"WHERE r.user_id = u.id AND r.segment_id = ? " +
+	"AND (r.is_active = TRUE OR r.unassign_reason = '') " +
+	"AND NOT EXISTS (SELECT 1 FROM user_segment_relation l " +
+	"WHERE l.user_id = r.user_id AND l.segment_id = r.segment_id AND l.id > r.id))"
+
+// assignEligibleBuckets assigns the hash segment to the eligible active users of its buckets, a batch at a time.
+func (sr *segmentsRepository) assignEligibleBuckets(ctx context.Context, seg *Segment) error {
+	eligible, err := sr.countEligibleUsers(ctx, seg.ID)
+	if err != nil {
+		return err
+	}
+
+	afterID, checked := 0, 0
+	for {
+		userIDs, err := sr.eligibleUsers(ctx, seg.ID, afterID, sr.batchSize())
+		if err != nil {
+			return err
+		}
+		if len(userIDs) == 0 {
+			return nil
+		}
+		afterID = userIDs[len(userIDs)-1]
+
+		err = sr.AssignSegments(ctx, bucketMembers(seg.Salt, userIDs, seg.Fraction), []string{seg.Slug}, nil)
+		if err != nil {
+			return err
+		}
+
+		checked += len(userIDs)
+		job.Progress(ctx, checked, eligible)
+	}
+}
+
+// countEligibleUsers counts the active users a fraction may assign the segment to.
+func (sr *segmentsRepository) countEligibleUsers(ctx context.Context, segmentID int) (int, error) {
+	var count int
+	err := sr.db.QueryRowContext(
+		ctx,
+		sr.dialect.Rebind("SELECT COUNT(*) FROM users u WHERE u.is_active = TRUE AND "+eligibleCondition),
+		segmentID,
+	).Scan(&count)
+	return count, err
+}
+
+// randomEligibleUsers returns up to n random active users a fraction may assign the segment to.
+func (sr *segmentsRepository) randomEligibleUsers(ctx context.Context, segmentID, n int) ([]int, error) {
+	rows, err := sr.db.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT u.id FROM users u WHERE u.is_active = TRUE AND "+eligibleCondition+
+			" ORDER BY "+sr.dialect.Random()+" LIMIT ?"),
+		segmentID,
+		n,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanIDs(rows)
+}
+
+// eligibleUsers returns up to limit active users with ids greater than afterID that a fraction may assign
+// the segment to, ordered by id.
+func (sr *segmentsRepository) eligibleUsers(ctx context.Context, segmentID, afterID, limit int) ([]int, error) {
+	rows, err := sr.db.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT u.id FROM users u WHERE u.is_active = TRUE AND u.id > ? AND "+eligibleCondition+
+			" ORDER BY u.id LIMIT ?"),
+		afterID,
+		segmentID,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanIDs(rows)
+}
+
+// countActiveMembers counts the active members of a segment that are active users themselves.
+func (sr *segmentsRepository) countActiveMembers(ctx context.Context, segmentID int) (int, error) {
+	var count int
+	err := sr.db.QueryRowContext(
+		ctx,
+		sr.dialect.Rebind("SELECT COUNT(*) FROM user_segment_relation r "+
+			"JOIN users u ON u.id = r.user_id "+
+			"WHERE r.segment_id = ? AND r.is_active = TRUE AND u.is_active = TRUE"),
+		segmentID,
+	).Scan(&count)
+	return count, err
+}
+
+func (sr *segmentsRepository) rollout(ctx context.Context, seg *Segment) (*Rollout, error) {
+	activeUsers, err := sr.GetActiveUsersAmount(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := sr.countActiveMembers(ctx, seg.ID)
+	if err != nil {
+		return nil, err
+	}
+	return newRollout(seg, members, activeUsers), nil
+}
+
+func (sr *segmentsRepository) GetRollout(ctx context.Context, segmentSlug string) (*Rollout, error) {
+	segments, err := sr.readSegments(ctx, sr.db, "WHERE slug = ?", segmentSlug)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, segmentSlug)
+	}
+	return sr.rollout(ctx, segments[0])
+}
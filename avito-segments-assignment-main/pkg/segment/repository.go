@@ -5,114 +5,97 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"math"
 	"os"
 	"time"
 	"usersegmentator/config"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/dialect"
 	"usersegmentator/pkg/errors"
+	"usersegmentator/pkg/job"
 )
 
 type Repository interface {
-	InsertSegment(ctx context.Context, segmentSlug string) error
+	InsertSegment(ctx context.Context, seg *Segment) (InsertOutcome, error)
+	UpdateSegment(ctx context.Context, patch *SegmentPatch) (*Segment, error)
+	GetSegment(ctx context.Context, segmentSlug string) (*Segment, error)
+	ListSegments(ctx context.Context, filter *SegmentFilter) (*SegmentPage, error)
+	StreamSegmentMembers(ctx context.Context, q *MembersQuery, fn func(*Member) error) (string, error)
 	DeleteSegment(ctx context.Context, segmentSlug string) error
 	UnassignSegments(ctx context.Context, userID []int, segmentsToUnassign []string) error
-	AssignSegments(ctx context.Context, userID []int, segmentsToAssign []string, ttl int) error
-	GetUserSegments(ctx context.Context, userID int) (*UserSegments, error)
+	AssignSegments(ctx context.Context, userID []int, segmentsToAssign []string, expiresAt *time.Time) error
+	UpdateUserSegments(
+		ctx context.Context,
+		userID int,
+		assign, unassign []string,
+		expiresAt *time.Time,
+	) (*UpdateSegmentsResult, error)
+	// BulkUpdateUserSegments applies UpdateUserSegments to many users. A failed all_or_nothing update returns
+	// the per-user result along with the error.
+	BulkUpdateUserSegments(ctx context.Context, req *RequestBulkUpdate) (*BulkUpdateResult, error)
+	ImportMemberships(ctx context.Context, req *ImportRequest) (*ImportResult, error)
+	// GetUserSegments returns the segments the user is in now, or at asOf when it is given.
+	GetUserSegments(ctx context.Context, userID int, asOf *time.Time) (*UserSegments, error)
+	UpdateExpiry(ctx context.Context, change *ExpiryChange) (*ExpiryResult, error)
 	GetNRandomUsersWithoutSegment(n int, slug string) ([]int, error)
 	GetActiveUsersAmount(ctx context.Context) (int, error)
 	GetSegmentsIDs(ctx context.Context, segmentSlugs []string) ([]int, error)
-	AutoAssignSegment(ctx context.Context, fraction int, slug string, ttl int) error
-	RunTTLChecker()
+	AutoAssignSegment(ctx context.Context, fraction int, slug string, expiresAt *time.Time) error
+	GetRollout(ctx context.Context, segmentSlug string) (*Rollout, error)
+	ReconcileSegments(ctx context.Context) ([]*Rollout, error)
+	SetFraction(ctx context.Context, segmentSlug string, fraction int) (*Rollout, error)
+	ScheduleRamp(ctx context.Context, schedule *RampSchedule) (*RampSchedule, error)
+	GetRamp(ctx context.Context, segmentSlug string) (*RampSchedule, error)
+	// The background workers block until ctx is done, they are started and stopped by the caller.
+	RunTTLChecker(ctx context.Context)
+	RunReconciler(ctx context.Context)
+	// RunRampScheduler hands the due ramp steps to the job runner through jobs
+	RunRampScheduler(ctx context.Context, jobs job.Repository)
+	RunWindowChecker(ctx context.Context)
 }
 
+// defaultBatchSize bounds the number of rows touched by a single statement when segment.batch_size is not set.
+const defaultBatchSize = 1000
+
 type segmentsRepository struct {
 	db      *sql.DB
+	dialect dialect.Dialect
 	cfg     *config.Config
 	InfoLog *log.Logger
 	ErrLog  *log.Logger
 }
 
 func NewSegmentsRepo(db *sql.DB, cfg *config.Config) Repository {
-	sr := &segmentsRepository{
+	return &segmentsRepository{
 		db:      db,
+		dialect: dialect.Dialect(cfg.Storage.Driver),
 		cfg:     cfg,
 		InfoLog: log.New(os.Stdout, "INFO\tSEGMENTS REPO\t", log.Ldate|log.Ltime),
 		ErrLog:  log.New(os.Stdout, "ERROR\tSEGMENTS REPO\t", log.Ldate|log.Ltime),
 	}
-
-	go func() {
-		sr.RunTTLChecker()
-	}()
-	return sr
-}
-
-func (sr *segmentsRepository) RunTTLChecker() {
-	sr.InfoLog.Printf("TTL checker is running")
-	ticker := time.NewTicker(time.Minute)
-	defer ticker.Stop()
-
-	ctx := context.Background()
-
-	for {
-		select {
-		case <-ticker.C:
-			tx, err := sr.db.BeginTx(ctx, nil)
-			if err != nil {
-				sr.ErrLog.Printf("%s: %s", errors.ErrorBeginTransaction, err)
-				continue
-			}
-
-			rows, err := tx.QueryContext(ctx, "SELECT id FROM user_segment_relation "+
-				"WHERE date_unassigned <= CURRENT_TIMESTAMP AND is_active = TRUE")
-
-			if err != nil {
-				sr.ErrLog.Printf("error checking table for ttl: %s", err)
-				if rbErr := tx.Rollback(); rbErr != nil {
-					sr.ErrLog.Printf("rollback error: %s", rbErr)
-					continue
-				}
-			}
-
-			var curID int
-			ids := []int{}
-
-			for rows.Next() {
-				err = rows.Scan(&curID)
-				if err != nil {
-					sr.ErrLog.Printf("error reading row: %s", err)
-					continue
-				}
-				ids = append(ids, curID)
-			}
-
-			err = rows.Close()
-			if err != nil {
-				sr.ErrLog.Printf("error closing rows: %s", err)
-			}
-
-			for _, id := range ids {
-				_, err := tx.ExecContext(ctx, "UPDATE user_segment_relation SET is_active = FALSE WHERE id = ?", id)
-				if err != nil {
-					sr.ErrLog.Printf("error unassigning segments: %s", err)
-					if rbErr := tx.Rollback(); rbErr != nil {
-						sr.ErrLog.Printf("rollback error: %s", rbErr)
-					}
-				}
-			}
-
-			err = tx.Commit()
-			if err != nil {
-				sr.ErrLog.Printf("%s: %s", errors.ErrorCommittingTransaction, err)
-			}
-		}
-	}
 }
 
-func (sr *segmentsRepository) AutoAssignSegment(ctx context.Context, fraction int, slug string, ttl int) error {
+func (sr *segmentsRepository) AutoAssignSegment(ctx context.Context, fraction int, slug string, expiresAt *time.Time) error {
 	if fraction < 1 || fraction > 100 {
 		sr.ErrLog.Printf("invalid fraction value: %d", fraction)
 		return fmt.Errorf("invalid fraction value: %d", fraction)
 	}
+	ctx = audit.WithSource(ctx, audit.SourceAutoFraction)
+
+	segments, err := sr.readSegments(ctx, sr.db, "WHERE slug = ?", slug)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return fmt.Errorf("%w: %s", ErrSegmentNotFound, slug)
+	}
+
+	if segments[0].Bucketing == BucketingHash {
+		err = sr.assignBuckets(ctx, segments[0], fraction, expiresAt)
+		if err != nil {
+			sr.ErrLog.Printf("%s", err)
+		}
+		return err
+	}
 
 	activeUsers, err := sr.GetActiveUsersAmount(ctx)
 	if err != nil {
@@ -120,7 +103,7 @@ func (sr *segmentsRepository) AutoAssignSegment(ctx context.Context, fraction in
 		return err
 	}
 
-	sampleSize := int(math.Ceil(float64(activeUsers) * (float64(fraction) / 100))) //nolint:gomnd // creating percents
+	sampleSize := rolloutTarget(activeUsers, fraction)
 
 	users, err := sr.GetNRandomUsersWithoutSegment(sampleSize, slug)
 	if err != nil {
@@ -128,7 +111,7 @@ func (sr *segmentsRepository) AutoAssignSegment(ctx context.Context, fraction in
 		return err
 	}
 
-	err = sr.AssignSegments(ctx, users, []string{slug}, ttl)
+	err = sr.AssignSegments(ctx, users, []string{slug}, expiresAt)
 	if err != nil {
 		sr.ErrLog.Printf("%s", err)
 		return err
@@ -138,25 +121,50 @@ func (sr *segmentsRepository) AutoAssignSegment(ctx context.Context, fraction in
 }
 
 func (sr *segmentsRepository) GetSegmentsIDs(ctx context.Context, segmentSlugs []string) ([]int, error) {
-	ids := []int{}
-	for _, f := range segmentSlugs {
-		var curID int
-		row, err := sr.db.QueryContext(ctx, "SELECT id FROM segments WHERE slug = ? LIMIT 1", f)
-		if err != nil {
-			return []int{}, err
-		}
-		row.Next()
-		err = row.Scan(&curID)
-		if err != nil {
-			return []int{}, err
-		}
+	if len(segmentSlugs) == 0 {
+		return []int{}, nil
+	}
+
+	args := make([]interface{}, len(segmentSlugs))
+	for i, slug := range segmentSlugs {
+		args[i] = slug
+	}
 
-		err = row.Close()
+	rows, err := sr.db.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT id, slug FROM segments WHERE slug IN ("+dialect.Placeholders(len(args))+")"),
+		args...,
+	)
+	if err != nil {
+		return []int{}, err
+	}
+
+	idBySlug := make(map[string]int, len(segmentSlugs))
+	for rows.Next() {
+		var (
+			id   int
+			slug string
+		)
+		err = rows.Scan(&id, &slug)
 		if err != nil {
+			_ = rows.Close()
 			return []int{}, err
 		}
+		idBySlug[slug] = id
+	}
 
-		ids = append(ids, curID)
+	err = rows.Close()
+	if err != nil {
+		return []int{}, err
+	}
+
+	ids := make([]int, 0, len(segmentSlugs))
+	for _, slug := range segmentSlugs {
+		id, ok := idBySlug[slug]
+		if !ok {
+			return []int{}, fmt.Errorf("%w: %s", ErrSegmentNotFound, slug)
+		}
+		ids = append(ids, id)
 	}
 	return ids, nil
 }
@@ -165,7 +173,7 @@ func (sr *segmentsRepository) GetNRandomUsersWithoutSegment(n int, slug string)
 	userIDs := []int{}
 
 	rows, err := sr.db.Query(
-		`SELECT DISTINCT u.id FROM users u
+		sr.dialect.Rebind(`SELECT u.id FROM users u
 				WHERE (SELECT user_id 
 					   FROM user_segment_relation 
 					   WHERE user_id = u.id 
@@ -178,7 +186,7 @@ func (sr *segmentsRepository) GetNRandomUsersWithoutSegment(n int, slug string)
 					   ORDER BY date_assigned 
 					   LIMIT 1) IS NULL 
 					   AND is_active = TRUE
-				ORDER BY RAND() LIMIT ?`,
+				ORDER BY `+sr.dialect.Random()+` LIMIT ?`),
 		slug,
 		n,
 	)
@@ -224,22 +232,37 @@ func (sr *segmentsRepository) GetActiveUsersAmount(ctx context.Context) (int, er
 	return amount, nil
 }
 
-func (sr *segmentsRepository) InsertSegment(ctx context.Context, segmentSlug string) error {
-	if segmentSlug == "" {
-		return fmt.Errorf("empty segment slug")
+// InsertSegment creates a segment or revives a deleted one with the same slug. Metadata left empty
+// keeps the values stored before, tags are replaced only when given. An active segment can't be created
+// again with a fraction, that is a change of its rollout made by SetFraction.
+func (sr *segmentsRepository) InsertSegment(ctx context.Context, seg *Segment) (InsertOutcome, error) {
+	err := seg.Validate()
+	if err != nil {
+		return "", err
 	}
 
-	_, err := sr.db.ExecContext(
-		ctx,
-		"INSERT INTO segments (`slug`) VALUES (?) ON DUPLICATE KEY UPDATE is_active = TRUE",
-		segmentSlug,
-	)
+	tx, err := sr.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		sr.ErrLog.Printf("%s: %s", errors.ErrorBeginTransaction, err)
+		return "", err
 	}
 
-	sr.InfoLog.Printf("InsertSegment — %s\n", segmentSlug)
-	return nil
+	outcome, err := sr.insertSegment(ctx, tx, seg)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return "", fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errors.ErrorCommittingTransaction, err)
+		return "", err
+	}
+
+	sr.InfoLog.Printf("InsertSegment — %s %s\n", seg.Slug, outcome)
+	return outcome, nil
 }
 
 func (sr *segmentsRepository) DeleteSegment(ctx context.Context, segmentSlug string) error {
@@ -255,7 +278,28 @@ func (sr *segmentsRepository) DeleteSegment(ctx context.Context, segmentSlug str
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, "UPDATE segments SET is_active = FALSE WHERE id = ?", segmentID[0])
+	_, err = tx.ExecContext(
+		ctx,
+		sr.dialect.Rebind("UPDATE segments "+
+			"SET is_active = FALSE, deleted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP "+
+			"WHERE id = ?"),
+		segmentID[0],
+	)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return err
+	}
+
+	_, err = sr.closeRelations(
+		audit.WithSource(ctx, audit.SourceSegmentDelete),
+		tx,
+		"segment_id = ?",
+		[]interface{}{segmentID[0]},
+		", date_unassigned = CURRENT_TIMESTAMP, unassign_reason = ?",
+		[]interface{}{UnassignReasonDeleted},
+	)
 	if err != nil {
 		if rbErr := tx.Rollback(); rbErr != nil {
 			return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
@@ -263,11 +307,10 @@ func (sr *segmentsRepository) DeleteSegment(ctx context.Context, segmentSlug str
 		return err
 	}
 
+	// the pending ramp steps would fail on a deleted segment, a revived one starts without a schedule
 	_, err = tx.ExecContext(
 		ctx,
-		"UPDATE user_segment_relation "+
-			"SET is_active = FALSE, date_unassigned = CURRENT_TIMESTAMP "+
-			"WHERE segment_id = ?",
+		sr.dialect.Rebind("DELETE FROM segment_ramps WHERE segment_id = ? AND applied_at IS NULL"),
 		segmentID[0],
 	)
 	if err != nil {
@@ -288,7 +331,7 @@ func (sr *segmentsRepository) DeleteSegment(ctx context.Context, segmentSlug str
 }
 
 func (sr *segmentsRepository) UnassignSegments(ctx context.Context, userID []int, segmentsToUnassign []string) error {
-	if len(segmentsToUnassign) == 0 {
+	if len(segmentsToUnassign) == 0 || len(userID) == 0 {
 		return nil
 	}
 
@@ -303,23 +346,25 @@ func (sr *segmentsRepository) UnassignSegments(ctx context.Context, userID []int
 		return err
 	}
 
-	for _, usr := range userID {
-		for _, id := range ids {
-			_, err = tx.ExecContext(
-				ctx,
-				"UPDATE user_segment_relation "+
-					"SET is_active = FALSE, date_unassigned = CURRENT_TIMESTAMP "+
-					"WHERE user_id = ? AND segment_id = ? AND is_active = TRUE",
-				usr,
-				id,
-			)
-
-			if err != nil {
-				if rbErr := tx.Rollback(); rbErr != nil {
-					return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
-				}
-				return err
+	for _, batch := range batches(userID, sr.batchSize()) {
+		args := make([]interface{}, 0, len(ids)+len(batch))
+		args = appendInts(args, ids)
+		args = appendInts(args, batch)
+
+		_, err = sr.closeRelations(
+			ctx,
+			tx,
+			"segment_id IN ("+dialect.Placeholders(len(ids))+") "+
+				"AND user_id IN ("+dialect.Placeholders(len(batch))+")",
+			args,
+			", date_unassigned = CURRENT_TIMESTAMP, unassign_reason = ?",
+			[]interface{}{unassignReason(ctx)},
+		)
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
 			}
+			return err
 		}
 	}
 
@@ -329,7 +374,7 @@ func (sr *segmentsRepository) UnassignSegments(ctx context.Context, userID []int
 		return err
 	}
 
-	sr.InfoLog.Printf("UnassignSegments — %d\n", userID)
+	sr.InfoLog.Printf("UnassignSegments — %d users\n", len(userID))
 	return nil
 }
 
@@ -337,12 +382,9 @@ func (sr *segmentsRepository) AssignSegments(
 	ctx context.Context,
 	userID []int,
 	segmentsToAssign []string,
-	ttl int,
+	expiresAt *time.Time,
 ) error {
-	if len(segmentsToAssign) == 0 {
-		return nil
-	}
-	if len(segmentsToAssign) == 0 {
+	if len(segmentsToAssign) == 0 || len(userID) == 0 {
 		return nil
 	}
 
@@ -351,107 +393,396 @@ func (sr *segmentsRepository) AssignSegments(
 		return err
 	}
 
+	unassignTime := nullTime(expiresAt)
+
 	tx, err := sr.db.BeginTx(ctx, nil)
 	if err != nil {
 		sr.ErrLog.Printf("%s: %s", errors.ErrorBeginTransaction, err)
 		return err
 	}
 
-	for _, usr := range userID {
-		for _, segmentID := range ids {
-			var rows *sql.Rows
-			rows, err = tx.QueryContext(
-				ctx,
-				"SELECT id FROM user_segment_relation WHERE is_active = TRUE AND user_id = ? AND segment_id = ?",
-				usr,
-				segmentID,
-			)
-
-			if err != nil {
-				if rbErr := tx.Rollback(); rbErr != nil {
-					return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
-				}
-				return err
+	// every segment of a batch is inserted with one statement, so users are batched by batchSize / len(ids)
+	usersPerBatch := sr.batchSize() / len(ids)
+	if usersPerBatch < 1 {
+		usersPerBatch = 1
+	}
+
+	for _, batch := range batches(userID, usersPerBatch) {
+		err = sr.assignBatch(ctx, tx, batch, ids, unassignTime)
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
 			}
+			return err
+		}
+	}
 
-			ok := rows.Next()
+	err = tx.Commit()
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errors.ErrorCommittingTransaction, err)
+		return err
+	}
 
-			err = rows.Close()
-			if err != nil {
-				return err
-			}
+	sr.InfoLog.Printf("AssignSegments — %d users\n", len(userID))
+	return nil
+}
 
-			if ok {
-				return nil
-			}
+// assignBatch inserts the missing user×segment pairs of one batch: a single SELECT finds pairs that are
+// already active and a single multi-row INSERT adds the rest.
+func (sr *segmentsRepository) assignBatch(
+	ctx context.Context,
+	tx *sql.Tx,
+	userID []int,
+	segmentIDs []int,
+	unassignTime sql.NullTime,
+) error {
+	args := make([]interface{}, 0, len(segmentIDs)+len(userID))
+	args = appendInts(args, segmentIDs)
+	args = appendInts(args, userID)
 
-			result, err := tx.ExecContext(
-				ctx,
-				"INSERT INTO user_segment_relation (`user_id`, `segment_id`) VALUES (?, ?)",
-				usr,
-				segmentID,
-			)
-			if err != nil {
-				if rbErr := tx.Rollback(); rbErr != nil {
-					return fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
-				}
-				return err
-			}
+	rows, err := tx.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT user_id, segment_id FROM user_segment_relation "+
+			"WHERE is_active = TRUE "+
+			"AND segment_id IN ("+dialect.Placeholders(len(segmentIDs))+") "+
+			"AND user_id IN ("+dialect.Placeholders(len(userID))+")"),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+
+	active := map[[2]int]bool{}
+	for rows.Next() {
+		var usr, segmentID int
+		err = rows.Scan(&usr, &segmentID)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		active[[2]int{usr, segmentID}] = true
+	}
 
-			if lastID, err := result.LastInsertId(); err == nil && ttl != 0 {
-				unassignTime := time.Now().AddDate(0, 0, ttl)
-				_, err = tx.ExecContext(
-					ctx,
-					"UPDATE user_segment_relation SET date_unassigned = ? WHERE id = ?",
-					unassignTime,
-					lastID,
-				)
+	err = rows.Close()
+	if err != nil {
+		return err
+	}
+
+	var expiresAt *time.Time
+	if unassignTime.Valid {
+		expiresAt = &unassignTime.Time
+	}
+
+	insertArgs := make([]interface{}, 0, len(userID)*len(segmentIDs)*3) //nolint:gomnd // three inserted columns
+	entries := []auditEntry{}
+	for _, usr := range userID {
+		for _, segmentID := range segmentIDs {
+			if active[[2]int{usr, segmentID}] {
+				continue
 			}
+			active[[2]int{usr, segmentID}] = true // the same user may be listed twice
+			insertArgs = append(insertArgs, usr, segmentID, unassignTime)
+			entries = append(entries, auditEntry{UserID: usr, SegmentID: segmentID, ExpiresAt: expiresAt})
+		}
+	}
+
+	if len(insertArgs) == 0 {
+		return nil
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		sr.dialect.Rebind("INSERT INTO user_segment_relation (user_id, segment_id, date_unassigned) VALUES "+
+			dialect.Values(len(insertArgs)/3, 3)), //nolint:gomnd // three inserted columns
+		insertArgs...,
+	)
+	if err != nil {
+		return err
+	}
+	return sr.writeAudit(ctx, tx, audit.ActionAssign, entries)
+}
+
+// UpdateUserSegments applies the assignments and unassignments of a single user in one transaction
+// and reports the outcome for every requested segment.
+func (sr *segmentsRepository) UpdateUserSegments(
+	ctx context.Context,
+	userID int,
+	assign, unassign []string,
+	expiresAt *time.Time,
+) (*UpdateSegmentsResult, error) {
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errors.ErrorBeginTransaction, err)
+		return nil, err
+	}
+
+	plan, err := sr.updateUserSegments(ctx, tx, userID, assign, unassign, expiresAt)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
 		}
+		return nil, err
 	}
 
 	err = tx.Commit()
 	if err != nil {
 		sr.ErrLog.Printf("%s: %s", errors.ErrorCommittingTransaction, err)
-		return err
+		return nil, err
 	}
 
-	sr.InfoLog.Printf("AssignSegments — %d\n", userID)
-	return nil
+	sr.InfoLog.Printf("UpdateUserSegments — %d\n", userID)
+	return &UpdateSegmentsResult{UserID: userID, Results: plan.Results}, nil
 }
 
-func (sr *segmentsRepository) GetUserSegments(ctx context.Context, userID int) (*UserSegments, error) {
-	rows, err := sr.db.QueryContext(
+func (sr *segmentsRepository) updateUserSegments(
+	ctx context.Context,
+	tx *sql.Tx,
+	userID int,
+	assign, unassign []string,
+	expiresAt *time.Time,
+) (*updatePlan, error) {
+	// locking the user row serializes concurrent updates of the same user
+	var id int
+	err := tx.QueryRowContext(ctx, sr.dialect.Rebind("SELECT id FROM users WHERE id = ? FOR UPDATE"), userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := sr.segmentStates(ctx, tx, append(append([]string{}, assign...), unassign...))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		sr.dialect.Rebind("SELECT segment_id FROM user_segment_relation WHERE user_id = ? AND is_active = TRUE"),
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	member := map[int]bool{}
+	for rows.Next() {
+		var segmentID int
+		err = rows.Scan(&segmentID)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		member[segmentID] = true
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := planUpdate(assign, unassign, segments, member)
+
+	if len(plan.ToAssign) > 0 {
+		unassignTime := nullTime(expiresAt)
+
+		args := make([]interface{}, 0, len(plan.ToAssign)*3) //nolint:gomnd // three inserted columns
+		for _, segmentID := range plan.ToAssign {
+			args = append(args, userID, segmentID, unassignTime)
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			sr.dialect.Rebind("INSERT INTO user_segment_relation (user_id, segment_id, date_unassigned) VALUES "+
+				dialect.Values(len(plan.ToAssign), 3)), //nolint:gomnd // three inserted columns
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = sr.writeAudit(ctx, tx, audit.ActionAssign, planEntries(userID, plan.ToAssign, expiresAt))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(plan.ToUnassign) > 0 {
+		args := make([]interface{}, 0, len(plan.ToUnassign)+1)
+		args = append(args, userID)
+		args = appendInts(args, plan.ToUnassign)
+
+		_, err = tx.ExecContext(
+			ctx,
+			sr.dialect.Rebind("UPDATE user_segment_relation "+
+				"SET is_active = FALSE, date_unassigned = CURRENT_TIMESTAMP "+
+				"WHERE is_active = TRUE AND user_id = ? "+
+				"AND segment_id IN ("+dialect.Placeholders(len(plan.ToUnassign))+")"),
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = sr.writeAudit(ctx, tx, audit.ActionUnassign, planEntries(userID, plan.ToUnassign, nil))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// segmentStates reads id and activity of the given segments. Unknown slugs are missing from the result.
+func (sr *segmentsRepository) segmentStates(
+	ctx context.Context,
+	tx *sql.Tx,
+	slugs []string,
+) (map[string]segmentState, error) {
+	segments := map[string]segmentState{}
+	if len(slugs) == 0 {
+		return segments, nil
+	}
+
+	args := make([]interface{}, len(slugs))
+	for i, slug := range slugs {
+		args[i] = slug
+	}
+
+	rows, err := tx.QueryContext(
 		ctx,
-		"SELECT slug FROM segments "+
-			"WHERE id IN ("+
+		sr.dialect.Rebind("SELECT id, slug, is_active FROM segments WHERE slug IN ("+dialect.Placeholders(len(args))+")"),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var (
+			slug  string
+			state segmentState
+		)
+		err = rows.Scan(&state.ID, &slug, &state.IsActive)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		segments[slug] = state
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+func (sr *segmentsRepository) GetUserSegments(ctx context.Context, userID int, asOf *time.Time) (*UserSegments, error) {
+	now := time.Now().UTC()
+	if asOf != nil {
+		err := validateAsOf(*asOf, now)
+		if err != nil {
+			return nil, err
+		}
+
+		segments, err := sr.userSegmentsAsOf(ctx, userID, asOf.UTC())
+		if err != nil {
+			return nil, err
+		}
+
+		sr.InfoLog.Printf("GetSegments — %d as of %s\n", userID, asOf.Format(time.RFC3339))
+		return newUserSegments(userID, segments), nil
+	}
+
+	segments, err := sr.readSegments(
+		ctx,
+		sr.db,
+		"WHERE id IN ("+
 			"SELECT segment_id FROM user_segment_relation "+
 			"WHERE user_id = ? AND is_active = TRUE"+
-			") AND is_active = TRUE",
+			") AND is_active = TRUE AND "+windowCondition+" ORDER BY id",
 		userID,
+		now,
+		now,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	lazy, err := sr.lazySegments(ctx, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	segments = mergeLazy(userID, segments, lazy)
+
+	sr.InfoLog.Printf("GetSegments — %d\n", userID)
+	return newUserSegments(userID, segments), nil
+}
+
+func newUserSegments(userID int, segments []*Segment) *UserSegments {
 	userSegments := &UserSegments{
 		UserID:   userID,
-		Segments: []string{},
+		Segments: make([]string, 0, len(segments)),
+		Details:  segments,
 	}
+	for _, seg := range segments {
+		userSegments.Segments = append(userSegments.Segments, seg.Slug)
+	}
+	return userSegments
+}
 
+func (sr *segmentsRepository) batchSize() int {
+	if sr.cfg.Segment.BatchSize < 1 {
+		return defaultBatchSize
+	}
+	return sr.cfg.Segment.BatchSize
+}
+
+// batches splits ids into consecutive chunks of at most size elements.
+func batches(ids []int, size int) [][]int {
+	chunks := make([][]int, 0, (len(ids)+size-1)/size)
+	for size < len(ids) {
+		chunks = append(chunks, ids[:size:size])
+		ids = ids[size:]
+	}
+	if len(ids) > 0 {
+		chunks = append(chunks, ids)
+	}
+	return chunks
+}
+
+// nullTime converts an optional expiry into a date_unassigned value.
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+// scanIDs reads and closes rows of a single integer column.
+func scanIDs(rows *sql.Rows) ([]int, error) {
+	ids := []int{}
 	for rows.Next() {
-		var segment string
-		err = rows.Scan(&segment)
+		var id int
+		err := rows.Scan(&id)
 		if err != nil {
+			_ = rows.Close()
 			return nil, err
 		}
-		userSegments.Segments = append(userSegments.Segments, segment)
+		ids = append(ids, id)
 	}
-	err = rows.Close()
+
+	err := rows.Close()
 	if err != nil {
 		return nil, err
 	}
+	return ids, nil
+}
 
-	sr.InfoLog.Printf("GetSegments — %d\n", userID)
-	return userSegments, nil
+func appendInts(args []interface{}, ids []int) []interface{} {
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	return args
 }
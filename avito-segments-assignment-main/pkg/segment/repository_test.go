@@ -0,0 +1,109 @@
+package segment
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+	"usersegmentator/config"
+	"usersegmentator/pkg/dialect"
+	"usersegmentator/pkg/memstore"
+	"usersegmentator/pkg/migrate"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// openTestDB connects to the disposable database SEGMENT_TEST_DSN of the SEGMENT_TEST_DRIVER driver, mysql
+// or postgres, and skips without them. The database is migrated and gets the seed users, a MySQL DSN needs
+// multiStatements=true and parseTime=true for that.
+func openTestDB(tb testing.TB) (*sql.DB, string) {
+	tb.Helper()
+	driver, dsn := os.Getenv("SEGMENT_TEST_DRIVER"), os.Getenv("SEGMENT_TEST_DSN")
+	if driver == "" || dsn == "" {
+		tb.Skip("SEGMENT_TEST_DRIVER and SEGMENT_TEST_DSN are not set")
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	migrator, err := migrate.NewMigrator(db, dialect.Dialect(driver))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = migrator.Up(context.Background())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = migrator.Seed(context.Background())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db, driver
+}
+
+// newTestMemoryRepo returns a repository over an in-memory storage with the users of the seed, 1000 to 2000.
+func newTestMemoryRepo(tb testing.TB) Repository {
+	tb.Helper()
+	store := memstore.New()
+	for id := 1000; id <= 2000; id++ {
+		store.AddUsers(id)
+	}
+
+	cfg := &config.Config{}
+	cfg.Storage.Driver = config.StorageMemory
+	return quiet(NewMemorySegmentsRepo(store, cfg))
+}
+
+// newTestSQLRepo returns a repository over the test database of openTestDB.
+func newTestSQLRepo(tb testing.TB) Repository {
+	tb.Helper()
+	db, driver := openTestDB(tb)
+
+	cfg := &config.Config{}
+	cfg.Storage.Driver = driver
+	return quiet(NewSegmentsRepo(db, cfg))
+}
+
+// insertTestSegment creates a throwaway segment with no fraction, which is deleted after the test.
+func insertTestSegment(t *testing.T, repo Repository, bucketing string) string {
+	t.Helper()
+	ctx := context.Background()
+	slug := fmt.Sprintf("TEST_%d", time.Now().UnixNano())
+
+	_, err := repo.InsertSegment(ctx, &Segment{Slug: slug, Bucketing: bucketing, Salt: "segment-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = repo.DeleteSegment(ctx, slug)
+	})
+	return slug
+}
+
+// memberSet reads all the current members of the segment.
+func memberSet(t *testing.T, repo Repository, slug string) map[int]bool {
+	t.Helper()
+	members := map[int]bool{}
+	q := &MembersQuery{SegmentSlug: slug, Limit: maxMembersLimit}
+	for {
+		next, err := repo.StreamSegmentMembers(context.Background(), q, func(m *Member) error {
+			members[m.UserID] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next == "" {
+			return members
+		}
+		q.Cursor = next
+	}
+}
@@ -1,17 +1,93 @@
 package segment
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"usersegmentator/pkg/isoduration"
+)
+
+var (
+	ErrSegmentNotFound    = errors.New("segment not found")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrMembershipNotFound = errors.New("membership not found")
+	ErrInvalidInput       = errors.New("invalid input")
+	ErrTooManyUsers       = errors.New("too many users")
+	ErrTooManyRows        = errors.New("too many rows")
+	ErrSegmentExists      = errors.New("segment already exists")
+)
+
+const (
+	maxDescriptionLength = 1000
+	maxOwnerLength       = 100
+	maxTagLength         = 50
+	maxSaltLength        = 64
+)
+
+// Bucketing modes of a segment. Random segments sample users with ORDER BY RAND() once, hash segments
+// include every user whose bucket of the segment salt falls under the fraction.
+const (
+	BucketingRandom = "random"
+	BucketingHash   = "hash"
+)
+
+type Outcome string
+
+const (
+	OutcomeAssigned        Outcome = "assigned"
+	OutcomeAlreadyMember   Outcome = "already_member"
+	OutcomeUnassigned      Outcome = "unassigned"
+	OutcomeNotMember       Outcome = "not_member"
+	OutcomeUnknownSegment  Outcome = "unknown_segment"
+	OutcomeInactiveSegment Outcome = "inactive_segment"
+)
+
+// InsertOutcome is what InsertSegment did with the slug. An active segment created again keeps
+// its bucketing, fraction and window, only its metadata is updated.
+type InsertOutcome string
+
+const (
+	InsertCreated   InsertOutcome = "created"
+	InsertRevived   InsertOutcome = "revived"
+	InsertUnchanged InsertOutcome = "unchanged"
+)
+
+const (
+	ActionAssign   = "assign"
+	ActionUnassign = "unassign"
+)
+
+// Modes of a bulk update. An all_or_nothing update applies every user in one transaction or none of them,
+// a best_effort one applies every user on its own and reports the users that failed.
+const (
+	BulkAllOrNothing = "all_or_nothing"
+	BulkBestEffort   = "best_effort"
+)
+
 type Template struct {
-	SegmentSlug      string   `json:"segment_slug,omitempty"`
-	Segments         []string `json:"segments,omitempty"`
-	UserID           int      `json:"user_id,omitempty"`
-	AssignSegments   []string `json:"assign_segments,omitempty"`
-	UnassignSegments []string `json:"unassign_segments,omitempty"`
-	Fraction         int      `json:"fraction,omitempty"`
-	TTL              int      `json:"ttl"`
+	SegmentSlug      string     `json:"segment_slug,omitempty"`
+	Description      string     `json:"description,omitempty"`
+	Owner            string     `json:"owner,omitempty"`
+	Tags             []string   `json:"tags,omitempty"`
+	Bucketing        string     `json:"bucketing,omitempty"`
+	Salt             string     `json:"salt,omitempty"`
+	Segments         []string   `json:"segments,omitempty"`
+	UserID           int        `json:"user_id,omitempty"`
+	AssignSegments   []string   `json:"assign_segments,omitempty"`
+	UnassignSegments []string   `json:"unassign_segments,omitempty"`
+	Fraction         int        `json:"fraction,omitempty"`
+	StartsAt         *time.Time `json:"starts_at,omitempty"`
+	EndsAt           *time.Time `json:"ends_at,omitempty"`
+	TTL              int        `json:"ttl"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	ExpiresIn        string     `json:"expires_in,omitempty"`
 }
 
 type RequestUserID struct {
-	UserID int `json:"user_id"`
+	UserID int        `json:"user_id"`
+	AsOf   *time.Time `json:"as_of,omitempty"`
 }
 
 type RequestSegmentSlug struct {
@@ -19,14 +95,347 @@ type RequestSegmentSlug struct {
 	Fraction    int    `json:"fraction"`
 }
 
+type RequestCreateSegment struct {
+	SegmentSlug string     `json:"segment_slug"`
+	Description string     `json:"description"`
+	Owner       string     `json:"owner"`
+	Tags        []string   `json:"tags"`
+	Fraction    int        `json:"fraction"`
+	Bucketing   string     `json:"bucketing" enums:"random,hash"`
+	Salt        string     `json:"salt"`
+	StartsAt    *time.Time `json:"starts_at"`
+	EndsAt      *time.Time `json:"ends_at"`
+}
+
+// SegmentPatch changes the metadata of a segment. Nil fields are left as they are. ClearWindow removes
+// the stored activation window first, so StartsAt and EndsAt of the same patch make up the whole new window.
+type SegmentPatch struct {
+	SegmentSlug string     `json:"segment_slug"`
+	Description *string    `json:"description"`
+	Owner       *string    `json:"owner"`
+	Tags        *[]string  `json:"tags"`
+	StartsAt    *time.Time `json:"starts_at"`
+	EndsAt      *time.Time `json:"ends_at"`
+	ClearWindow bool       `json:"clear_window,omitempty"`
+}
+
+// window returns the activation window of a segment with the patch applied.
+func (p *SegmentPatch) window(startsAt, endsAt *time.Time) (*time.Time, *time.Time) {
+	if p.ClearWindow {
+		startsAt, endsAt = nil, nil
+	}
+	if p.StartsAt != nil {
+		startsAt = p.StartsAt
+	}
+	if p.EndsAt != nil {
+		endsAt = p.EndsAt
+	}
+	return startsAt, endsAt
+}
+
 type RequestUpdateSegments struct {
-	UserID           int      `json:"user_id"`
-	AssignSegments   []string `json:"assign_segments"`
-	UnassignSegments []string `json:"unassign_segments"`
-	TTL              int      `json:"ttl"`
+	UserID           int        `json:"user_id"`
+	AssignSegments   []string   `json:"assign_segments"`
+	UnassignSegments []string   `json:"unassign_segments"`
+	TTL              int        `json:"ttl"`
+	ExpiresAt        *time.Time `json:"expires_at"`
+	ExpiresIn        string     `json:"expires_in"`
 }
 
 type UserSegments struct {
-	UserID   int      `json:"user_id"`
-	Segments []string `json:"segments"`
+	UserID   int        `json:"user_id"`
+	Segments []string   `json:"segments"`
+	Details  []*Segment `json:"details"`
+}
+
+type Segment struct {
+	ID          int        `json:"-"`
+	Slug        string     `json:"slug"`
+	Description string     `json:"description"`
+	Owner       string     `json:"owner"`
+	Tags        []string   `json:"tags"`
+	Bucketing   string     `json:"bucketing"`
+	Salt        string     `json:"salt"`
+	Fraction    int        `json:"fraction"`
+	StartsAt    *time.Time `json:"starts_at,omitempty"`
+	EndsAt      *time.Time `json:"ends_at,omitempty"`
+	IsActive    bool       `json:"is_active"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	MemberCount *int       `json:"member_count,omitempty"`
+}
+
+const (
+	StatusActive  = "active"
+	StatusDeleted = "deleted"
+	StatusAll     = "all"
+)
+
+// SegmentFilter selects a page of the segment catalogue. Empty fields do not filter.
+type SegmentFilter struct {
+	Status string `json:"status"`
+	Tag    string `json:"tag"`
+	Owner  string `json:"owner"`
+	Prefix string `json:"prefix"`
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+// MembersQuery selects a page of the members of a segment, either current ones or those at AsOf.
+type MembersQuery struct {
+	SegmentSlug  string     `json:"segment_slug"`
+	AsOf         *time.Time `json:"as_of"`
+	IncludeDates bool       `json:"include_dates"`
+	Limit        int        `json:"limit"`
+	Cursor       string     `json:"cursor"`
+}
+
+type Member struct {
+	UserID       int        `json:"user_id"`
+	DateAssigned *time.Time `json:"date_assigned,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+}
+
+// MembersPage documents the response of the members endpoint, which is streamed rather than marshaled at once.
+type MembersPage struct {
+	SegmentSlug string    `json:"segment_slug"`
+	Members     []*Member `json:"members"`
+	NextCursor  string    `json:"next_cursor,omitempty"`
+}
+
+type SegmentPage struct {
+	Segments   []*Segment `json:"segments"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// Validate checks the segment fields against the column sizes and normalizes its tags.
+func (s *Segment) Validate() error {
+	if s.Slug == "" {
+		return fmt.Errorf("%w: empty segment slug", ErrInvalidInput)
+	}
+
+	err := validateMetadata(s.Description, s.Owner)
+	if err != nil {
+		return err
+	}
+
+	if s.Bucketing == "" {
+		s.Bucketing = BucketingRandom
+	}
+	if s.Bucketing != BucketingRandom && s.Bucketing != BucketingHash {
+		return fmt.Errorf("%w: unknown bucketing %q", ErrInvalidInput, s.Bucketing)
+	}
+	err = validateFraction(s.Fraction)
+	if err != nil {
+		return err
+	}
+	if len(s.Salt) > maxSaltLength {
+		return fmt.Errorf("%w: salt is longer than %d bytes", ErrInvalidInput, maxSaltLength)
+	}
+
+	s.StartsAt, s.EndsAt = truncateTime(s.StartsAt), truncateTime(s.EndsAt)
+	err = validateWindow(s.StartsAt, s.EndsAt)
+	if err != nil {
+		return err
+	}
+
+	if s.Tags != nil {
+		s.Tags, err = NormalizeTags(s.Tags)
+	}
+	return err
+}
+
+// Validate checks the patched fields against the column sizes and normalizes the tags.
+func (p *SegmentPatch) Validate() error {
+	if p.SegmentSlug == "" {
+		return fmt.Errorf("%w: empty segment slug", ErrInvalidInput)
+	}
+
+	var description, owner string
+	if p.Description != nil {
+		description = *p.Description
+	}
+	if p.Owner != nil {
+		owner = *p.Owner
+	}
+
+	err := validateMetadata(description, owner)
+	if err != nil {
+		return err
+	}
+
+	p.StartsAt, p.EndsAt = truncateTime(p.StartsAt), truncateTime(p.EndsAt)
+
+	if p.Tags != nil {
+		var tags []string
+		tags, err = NormalizeTags(*p.Tags)
+		p.Tags = &tags
+	}
+	return err
+}
+
+// MembershipExpiry resolves the expiry of new memberships from at most one of ttl in days, an absolute
+// expiresAt or an ISO-8601 expiresIn counted from now. Nil means the memberships never expire.
+func MembershipExpiry(now time.Time, ttl int, expiresAt *time.Time, expiresIn string) (*time.Time, error) {
+	given := 0
+	for _, set := range []bool{ttl != 0, expiresAt != nil, expiresIn != ""} {
+		if set {
+			given++
+		}
+	}
+	if given > 1 {
+		return nil, fmt.Errorf("%w: only one of ttl, expires_at and expires_in may be given", ErrInvalidInput)
+	}
+
+	switch {
+	case ttl != 0:
+		expiry := now.AddDate(0, 0, ttl)
+		return truncateTime(&expiry), nil
+	case expiresAt != nil:
+		return truncateTime(expiresAt), nil
+	case expiresIn != "":
+		d, err := isoduration.Parse(expiresIn)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidInput, err)
+		}
+		expiry := d.AddTo(now)
+		return truncateTime(&expiry), nil
+	}
+	return nil, nil
+}
+
+func validateWindow(startsAt, endsAt *time.Time) error {
+	if startsAt != nil && endsAt != nil && !endsAt.After(*startsAt) {
+		return fmt.Errorf("%w: ends_at must be after starts_at", ErrInvalidInput)
+	}
+	return nil
+}
+
+// truncateTime converts t to UTC with the second precision of a DATETIME column.
+func truncateTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC().Truncate(time.Second)
+	return &utc
+}
+
+// inWindow reports whether now falls into the activation window of the segment. Open ends are unbounded.
+func (s *Segment) inWindow(now time.Time) bool {
+	return (s.StartsAt == nil || !s.StartsAt.After(now)) && (s.EndsAt == nil || s.EndsAt.After(now))
+}
+
+func validateMetadata(description, owner string) error {
+	if len(description) > maxDescriptionLength {
+		return fmt.Errorf("%w: description is longer than %d bytes", ErrInvalidInput, maxDescriptionLength)
+	}
+	if len(owner) > maxOwnerLength {
+		return fmt.Errorf("%w: owner is longer than %d bytes", ErrInvalidInput, maxOwnerLength)
+	}
+	return nil
+}
+
+// NormalizeTags trims and deduplicates tags, dropping empty ones. The result is sorted.
+func NormalizeTags(tags []string) ([]string, error) {
+	seen := map[string]bool{}
+	normalized := []string{}
+
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("%w: tag %q is longer than %d bytes", ErrInvalidInput, tag, maxTagLength)
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// Rollout compares the share of active users in a fraction segment with its target. Members counts stored
+// assignments of active users, so hash bucketed users evaluated lazily are counted once reconciled.
+type Rollout struct {
+	SegmentSlug    string  `json:"segment_slug"`
+	Bucketing      string  `json:"bucketing"`
+	TargetFraction int     `json:"target_fraction"`
+	ActualFraction float64 `json:"actual_fraction"`
+	Members        int     `json:"members"`
+	ActiveUsers    int     `json:"active_users"`
+}
+
+// FractionChange is the parameters of the jobs that bring a segment to a fraction: the auto-assignment
+// of a new segment, a fraction change and a ramp step.
+type FractionChange struct {
+	SegmentSlug string `json:"segment_slug"`
+	Fraction    int    `json:"fraction"`
+}
+
+// RampStep sets the fraction of a segment at the given moment. An applied step names the set_fraction job
+// that runs it, a step skipped in favour of a later one has none.
+type RampStep struct {
+	Fraction  int        `json:"fraction"`
+	At        time.Time  `json:"at"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	JobID     string     `json:"job_id,omitempty"`
+}
+
+// RampSchedule lists the steps of a segment rollout. Scheduling replaces the pending steps, so an empty
+// list cancels the ramp.
+type RampSchedule struct {
+	SegmentSlug string      `json:"segment_slug"`
+	Steps       []*RampStep `json:"steps"`
+}
+
+// ExpiryChange moves the expiry of the active memberships of a segment, of a single user when UserID is set.
+// Exactly one of the actions is allowed: set ExpiresAt or ExpiresIn, move the current expiry by an ISO-8601
+// ExtendBy or ShortenBy, or Clear it so the memberships never expire.
+type ExpiryChange struct {
+	SegmentSlug string     `json:"segment_slug"`
+	UserID      *int       `json:"user_id,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	ExpiresIn   string     `json:"expires_in,omitempty"`
+	ExtendBy    string     `json:"extend_by,omitempty"`
+	ShortenBy   string     `json:"shorten_by,omitempty"`
+	Clear       bool       `json:"clear,omitempty"`
+}
+
+type ExpiryResult struct {
+	SegmentSlug string `json:"segment_slug"`
+	UserID      *int   `json:"user_id,omitempty"`
+	Updated     int    `json:"updated"`
+}
+
+type SegmentResult struct {
+	Segment string  `json:"segment"`
+	Action  string  `json:"action"`
+	Result  Outcome `json:"result"`
+}
+
+type UpdateSegmentsResult struct {
+	UserID  int             `json:"user_id"`
+	Results []SegmentResult `json:"results"`
+}
+
+type RequestBulkUpdate struct {
+	Mode  string                   `json:"mode" enums:"all_or_nothing,best_effort"`
+	Users []*RequestUpdateSegments `json:"users"`
+}
+
+type BulkUserResult struct {
+	UserID  int             `json:"user_id"`
+	Results []SegmentResult `json:"results,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// BulkUpdateResult lists the users in request order. Applied counts the users whose changes were committed.
+type BulkUpdateResult struct {
+	Mode    string           `json:"mode"`
+	Applied int              `json:"applied"`
+	Failed  int              `json:"failed"`
+	Users   []BulkUserResult `json:"users"`
 }
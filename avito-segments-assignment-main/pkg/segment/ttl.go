@@ -0,0 +1,140 @@
+package segment
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"usersegmentator/pkg/audit"
+	errs "usersegmentator/pkg/errors"
+	"usersegmentator/pkg/lease"
+	"usersegmentator/pkg/memstore"
+)
+
+// defaultTTLCheckInterval is used when segment.ttl_check_interval is not set.
+const defaultTTLCheckInterval = time.Minute
+
+// ttlLeaseName is the worker_leases row that elects the replica sweeping expired memberships.
+const ttlLeaseName = "ttl_checker"
+
+func ttlCheckInterval(minutes int) time.Duration {
+	if minutes < 1 {
+		return defaultTTLCheckInterval
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// SweepStats describes a single pass of the TTL checker.
+type SweepStats struct {
+	Expired  int
+	Duration time.Duration
+}
+
+// RunTTLChecker deactivates expired memberships every segment.ttl_check_interval minutes until ctx is done.
+// Only the replica holding the ttl_checker lease sweeps. A sweep in progress stops after its current batch
+// and the lease is released on the way out.
+func (sr *segmentsRepository) RunTTLChecker(ctx context.Context) {
+	interval := ttlCheckInterval(sr.cfg.Segment.TTLCheckInterval)
+	sr.runLeased(ctx, "TTL checker", ttlLeaseName, interval, func(ctx context.Context, l *lease.Lease) {
+		stats, err := sr.expireMemberships(ctx, l, time.Now().UTC().Truncate(time.Second))
+		if err != nil {
+			sr.ErrLog.Printf("error expiring memberships after %d rows: %s", stats.Expired, err)
+			return
+		}
+		sr.InfoLog.Printf("TTL sweep expired %d memberships in %s", stats.Expired, stats.Duration)
+	})
+}
+
+// expireMemberships deactivates the active memberships whose expiry is not after now, at most
+// segment.batch_size rows at a time. Each batch commits on its own together with its audit entries and
+// the sweep stops between batches once ctx is done, so shutting down never interrupts a statement half way.
+// The lease is renewed between batches, a sweep that lost it stops and leaves the rest to the new holder.
+func (sr *segmentsRepository) expireMemberships(ctx context.Context, l *lease.Lease, now time.Time) (*SweepStats, error) {
+	started := time.Now()
+	stats := &SweepStats{}
+
+	// batches are not bound to ctx, the one in progress runs to its commit
+	batchCtx := audit.WithActor(audit.WithSource(context.Background(), audit.SourceTTL), audit.SystemActor, "")
+
+	for ctx.Err() == nil {
+		n, err := sr.expireBatch(batchCtx, now)
+		stats.Expired += n
+		if err != nil {
+			stats.Duration = time.Since(started)
+			return stats, err
+		}
+
+		if n < sr.batchSize() {
+			break
+		}
+
+		held, err := l.Acquire(ctx)
+		if err == nil && !held {
+			err = fmt.Errorf("%s lease was taken over", ttlLeaseName)
+		}
+		if err != nil && ctx.Err() == nil {
+			stats.Duration = time.Since(started)
+			return stats, err
+		}
+	}
+
+	stats.Duration = time.Since(started)
+	return stats, nil
+}
+
+func (sr *segmentsRepository) expireBatch(ctx context.Context, now time.Time) (int, error) {
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorBeginTransaction, err)
+		return 0, err
+	}
+
+	n, err := sr.closeRelationsBatch(
+		ctx,
+		tx,
+		"date_unassigned <= ?",
+		[]interface{}{now},
+		", unassign_reason = ?",
+		[]interface{}{UnassignReasonExpired},
+	)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return 0, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorCommittingTransaction, err)
+		return 0, err
+	}
+	return n, nil
+}
+
+// RunTTLChecker deactivates expired memberships every segment.ttl_check_interval minutes until ctx is done.
+// The in-memory storage lives in a single process, so it needs no lease.
+func (sr *memorySegmentsRepository) RunTTLChecker(ctx context.Context) {
+	sr.runEvery(ctx, "TTL checker", ttlCheckInterval(sr.cfg.Segment.TTLCheckInterval), func() {
+		stats := sr.expireMemberships(memstore.Now())
+		sr.InfoLog.Printf("TTL sweep expired %d memberships in %s", stats.Expired, stats.Duration)
+	})
+}
+
+func (sr *memorySegmentsRepository) expireMemberships(now time.Time) *SweepStats {
+	started := time.Now()
+	stats := &SweepStats{}
+
+	sr.store.Lock()
+	defer sr.store.Unlock()
+
+	for _, rel := range sr.store.Relations {
+		if rel.IsActive && rel.DateUnassigned != nil && !rel.DateUnassigned.After(now) {
+			sr.store.Deactivate(rel, nil, audit.Origin{Source: audit.SourceTTL, Actor: audit.SystemActor})
+			rel.UnassignReason = UnassignReasonExpired
+			stats.Expired++
+		}
+	}
+
+	stats.Duration = time.Since(started)
+	return stats
+}
@@ -0,0 +1,59 @@
+package segment
+
+import (
+	"context"
+	"testing"
+	"time"
+	"usersegmentator/pkg/audit"
+	"usersegmentator/pkg/memstore"
+)
+
+func TestExpireMembershipsMemory(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestMemoryRepo(t).(*memorySegmentsRepository)
+	expiring := insertTestSegment(t, repo, BucketingRandom)
+	kept := insertTestSegment(t, repo, BucketingRandom)
+
+	// the sweep is driven with its own clock, the expiry is never reached on the wall clock
+	expiresAt := memstore.Now().Add(time.Hour)
+	_, err := repo.UpdateUserSegments(ctx, 1000, []string{expiring}, nil, &expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.UpdateUserSegments(ctx, 1000, []string{kept}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := repo.expireMemberships(expiresAt.Add(-time.Second)); stats.Expired != 0 {
+		t.Errorf("%d memberships expired a second before the expiry, want none", stats.Expired)
+	}
+	if stats := repo.expireMemberships(expiresAt); stats.Expired != 1 {
+		t.Errorf("%d memberships expired at the expiry, want 1", stats.Expired)
+	}
+	if stats := repo.expireMemberships(expiresAt.Add(time.Hour)); stats.Expired != 0 {
+		t.Errorf("%d memberships expired again, want none", stats.Expired)
+	}
+
+	userSegments, err := repo.GetUserSegments(ctx, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userSegments.Segments) != 1 || userSegments.Segments[0] != kept {
+		t.Errorf("segments after the sweep = %v, want [%s]", userSegments.Segments, kept)
+	}
+
+	expired, err := repo.GetSegment(ctx, expiring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range repo.store.Relations {
+		if rel.SegmentID == expired.ID && rel.UnassignReason != UnassignReasonExpired {
+			t.Errorf("relation %+v is not closed as expired", rel)
+		}
+	}
+	last := repo.store.Audit[len(repo.store.Audit)-1]
+	if last.SegmentID != expired.ID || last.Action != audit.ActionUnassign || last.Source != audit.SourceTTL {
+		t.Errorf("last audit entry = %+v, want the TTL unassignment", last)
+	}
+}
@@ -0,0 +1,67 @@
+package segment
+
+// segmentState is what an update needs to know about a requested segment.
+type segmentState struct {
+	ID       int
+	IsActive bool
+}
+
+// updatePlan lists the changes an update has to apply and the outcome reported for every requested segment.
+type updatePlan struct {
+	Results    []SegmentResult
+	ToAssign   []int
+	ToUnassign []int
+}
+
+// planUpdate decides the outcome of every requested segment. Both lists are handled in request order,
+// assignments first, so a segment both assigned and unassigned in one request ends up unassigned.
+// segments holds the requested segments that exist, member the ids of segments the user is active in.
+func planUpdate(assign, unassign []string, segments map[string]segmentState, member map[int]bool) *updatePlan {
+	plan := &updatePlan{
+		Results:    make([]SegmentResult, 0, len(assign)+len(unassign)),
+		ToAssign:   []int{},
+		ToUnassign: []int{},
+	}
+
+	for _, slug := range assign {
+		result := SegmentResult{Segment: slug, Action: ActionAssign}
+
+		seg, ok := segments[slug]
+		switch {
+		case !ok:
+			result.Result = OutcomeUnknownSegment
+		case !seg.IsActive:
+			result.Result = OutcomeInactiveSegment
+		case member[seg.ID]:
+			result.Result = OutcomeAlreadyMember
+		default:
+			result.Result = OutcomeAssigned
+			member[seg.ID] = true
+			plan.ToAssign = append(plan.ToAssign, seg.ID)
+		}
+
+		plan.Results = append(plan.Results, result)
+	}
+
+	for _, slug := range unassign {
+		result := SegmentResult{Segment: slug, Action: ActionUnassign}
+
+		seg, ok := segments[slug]
+		switch {
+		case !ok:
+			result.Result = OutcomeUnknownSegment
+		case !seg.IsActive:
+			result.Result = OutcomeInactiveSegment
+		case !member[seg.ID]:
+			result.Result = OutcomeNotMember
+		default:
+			result.Result = OutcomeUnassigned
+			delete(member, seg.ID)
+			plan.ToUnassign = append(plan.ToUnassign, seg.ID)
+		}
+
+		plan.Results = append(plan.Results, result)
+	}
+
+	return plan
+}
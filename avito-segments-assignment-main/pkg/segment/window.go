@@ -0,0 +1,140 @@
+package segment
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+	"usersegmentator/pkg/audit"
+	errs "usersegmentator/pkg/errors"
+	"usersegmentator/pkg/lease"
+)
+
+// windowCondition keeps segments whose activation window contains the moment bound to both placeholders.
+const windowCondition = "(starts_at IS NULL OR starts_at <= ?) AND (ends_at IS NULL OR ends_at > ?)"
+
+// Unassign reasons of the closed relations. An empty reason is an explicit unassignment, by hand or by an import.
+const (
+	// UnassignReasonExpired marks relations closed because their TTL ran out or their segment window ended.
+	// The history shows them as expired rather than unassigned.
+	UnassignReasonExpired = "expired"
+	// UnassignReasonFraction marks relations closed by a lower fraction of the segment, a later ramp up
+	// may assign the user again.
+	UnassignReasonFraction = "fraction"
+	// UnassignReasonDeleted marks relations closed by the deletion of the segment, a segment created again
+	// may assign the user again.
+	UnassignReasonDeleted = "deleted"
+)
+
+// unassignReason is the reason of the relations UnassignSegments closes with ctx.
+func unassignReason(ctx context.Context) string {
+	if audit.FromContext(ctx).Source == audit.SourceAutoFraction {
+		return UnassignReasonFraction
+	}
+	return ""
+}
+
+// windowEndReason is the audit reason of memberships closed because their segment window ended.
+const windowEndReason = "segment window ended"
+
+// defaultWindowCheckInterval is used when segment.window_check_interval is not set.
+const defaultWindowCheckInterval = time.Minute
+
+func windowCheckInterval(minutes int) time.Duration {
+	if minutes < 1 {
+		return defaultWindowCheckInterval
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// windowLeaseName is the worker_leases row that elects the replica closing the ended segment windows.
+const windowLeaseName = "window_checker"
+
+// RunWindowChecker deactivates the segments whose ends_at has passed every segment.window_check_interval
+// minutes until ctx is done. Only the replica holding the window_checker lease checks.
+func (sr *segmentsRepository) RunWindowChecker(ctx context.Context) {
+	interval := windowCheckInterval(sr.cfg.Segment.WindowCheckInterval)
+	sr.runLeased(ctx, "Window checker", windowLeaseName, interval, func(ctx context.Context, _ *lease.Lease) {
+		slugs, err := sr.expireWindows(ctx, time.Now().UTC())
+		if err != nil {
+			sr.ErrLog.Printf("error expiring segments: %s", err)
+			return
+		}
+
+		for _, slug := range slugs {
+			sr.InfoLog.Printf("Segment %s has reached its ends_at\n", slug)
+		}
+	})
+}
+
+// expireWindows deactivates every active segment that ended by now, the way DeleteSegment does, except that
+// the segment is deleted and its memberships expire at ends_at rather than at the moment of the sweep,
+// and the audit entries are dated at ends_at as well. Memberships whose TTL ran out before ends_at
+// are left to the TTL checker, which closes them as of their own expiry.
+func (sr *segmentsRepository) expireWindows(ctx context.Context, now time.Time) ([]string, error) {
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorBeginTransaction, err)
+		return nil, err
+	}
+
+	slugs, err := sr.expireWindowsTx(ctx, tx, now)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return nil, fmt.Errorf("transaction error: %w, rollback error: %s", err, rbErr)
+		}
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sr.ErrLog.Printf("%s: %s", errs.ErrorCommittingTransaction, err)
+		return nil, err
+	}
+	return slugs, nil
+}
+
+func (sr *segmentsRepository) expireWindowsTx(ctx context.Context, tx *sql.Tx, now time.Time) ([]string, error) {
+	segments, err := sr.readSegments(
+		ctx,
+		tx,
+		"WHERE is_active = TRUE AND ends_at IS NOT NULL AND ends_at <= ? ORDER BY id FOR UPDATE",
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = audit.WithActor(audit.WithSource(ctx, audit.SourceTTL), audit.SystemActor, windowEndReason)
+
+	slugs := make([]string, 0, len(segments))
+	for _, seg := range segments {
+		endsAt := *seg.EndsAt
+		_, err = tx.ExecContext(
+			ctx,
+			sr.dialect.Rebind("UPDATE segments "+
+				"SET is_active = FALSE, deleted_at = ?, updated_at = CURRENT_TIMESTAMP "+
+				"WHERE id = ?"),
+			endsAt,
+			seg.ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = sr.closeRelations(
+			audit.WithTime(ctx, endsAt),
+			tx,
+			"segment_id = ? AND (date_unassigned IS NULL OR date_unassigned >= ?)",
+			[]interface{}{seg.ID, endsAt},
+			", unassign_reason = ?, date_unassigned = ?",
+			[]interface{}{UnassignReasonExpired, endsAt},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		slugs = append(slugs, seg.Slug)
+	}
+	return slugs, nil
+}
@@ -0,0 +1,82 @@
+package segment
+
+import (
+	"context"
+	"time"
+	"usersegmentator/pkg/lease"
+)
+
+// leaseIntervals is how many check intervals a worker lease outlives a pass, so the holder renews it
+// on every tick while a crashed holder is replaced after a couple of missed ones.
+const leaseIntervals = 2
+
+// runLeased calls pass every interval until ctx is done. Only the replica holding the worker_leases row
+// leaseName runs a pass, the others keep trying to take the lease over. pass gets the lease to renew it
+// during a long run, the lease is released on the way out.
+func (sr *segmentsRepository) runLeased(
+	ctx context.Context,
+	worker, leaseName string,
+	interval time.Duration,
+	pass func(ctx context.Context, l *lease.Lease),
+) {
+	l, err := lease.New(sr.db, sr.dialect, leaseName, leaseIntervals*interval)
+	if err != nil {
+		sr.ErrLog.Printf("%s is not running: %s", worker, err)
+		return
+	}
+
+	sr.InfoLog.Printf("%s is running as %s every %s", worker, l.Holder(), interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	leader := false
+	for {
+		select {
+		case <-ctx.Done():
+			if leader {
+				// ctx is already done, the lease is released with a fresh one
+				err = l.Release(context.Background())
+				if err != nil {
+					sr.ErrLog.Printf("error releasing %s lease: %s", leaseName, err)
+				}
+			}
+			sr.InfoLog.Printf("%s has been stopped", worker)
+			return
+		case <-ticker.C:
+		}
+
+		acquired, err := l.Acquire(ctx)
+		if err != nil {
+			sr.ErrLog.Printf("error acquiring %s lease: %s", leaseName, err)
+			continue
+		}
+		if acquired != leader {
+			leader = acquired
+			sr.InfoLog.Printf("%s leadership changed, leader: %t", worker, leader)
+		}
+		if !leader {
+			continue
+		}
+
+		pass(ctx, l)
+	}
+}
+
+// runEvery calls pass every interval until ctx is done. The in-memory storage lives in a single process,
+// so its workers need no lease.
+func (sr *memorySegmentsRepository) runEvery(ctx context.Context, worker string, interval time.Duration, pass func()) {
+	sr.InfoLog.Printf("%s is running every %s", worker, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			sr.InfoLog.Printf("%s has been stopped", worker)
+			return
+		case <-ticker.C:
+		}
+
+		pass()
+	}
+}